@@ -4,139 +4,410 @@ import (
 	"archive/tar"
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"fmt"
+	"hash"
 	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
 )
 
 var (
 	archiveCount        = EnvInt("ARCHIVE_OFFSET", 0, "Archive numbering offset")
 	archiveTar          *tar.Writer
-	archiveGzip         *gzip.Writer
-	archiveFile         *os.File
+	archiveCompressor   io.WriteCloser
+	archiveFile         *TempFile
 	archiveBytesWritten int64
+	archiveHash         hash.Hash // Digest of the compressed archive as it is written
+	archiveSums         []string  // sha256sum formatted lines for each entry, in CHECKSUM_ALGORITHM
+	archiveDirs         map[string]struct{}
+	archiveNames        map[string]struct{} // Names of the file entries of the open archive
+	archiveClass        string              // Highest classification level of the contents
+	archiveRetention    *Retention          // Longest retention of the contents
+
+	// PAX headers carry keys longer than 100 characters and entries over
+	// 8 GiB without truncation, so every header is written in PAX format
+	// unless TAR_FORMAT asks otherwise.
+	archiveTarFormat = tar.FormatPAX
+
+	archiveCodec    = Env("ARCHIVE_CODEC", "gzip", "Archive compression codec: gzip, zstd or none")
+	emitDirs        = Env("EMIT_DIRS", "", "Add tar directory entries for the folders implied by keys") != ""
+	checksumSidecar = Env("DISABLE_SHA256SUMS", "", "Disable the .sha256 (or CHECKSUM_ALGORITHM) checksum file uploaded with each archive") == ""
+	rollInterval    = EnvInt("ARCHIVE_ROLL_INTERVAL", 0, "Minutes after which an open archive is closed and uploaded even if under SIZECAP (0 to disable)")
+	paxTimes        = Env("TAR_PAX_TIMES", "", "Also set the atime and ctime of tar entries to the object LastModified") != ""
+	paxScan         = Env("TAR_PAX_SCAN", "", "Record the scan verdict and ClamAV database version of each tar entry in x-scan-result and x-scan-db PAX records") != ""
+	archiveStdout   = Env("ARCHIVE_STDOUT", "", "Write one continuous archive to stdout instead of uploading size capped archives") != ""
 
 	doneArchiving = make(chan struct{})
 )
 
-// DownloadTask represents a file to download.
+// ArchiveFile represents a finished archive ready for upload.
 type ArchiveFile struct {
 	Filename string
 	Contents []string
+	Sidecars []string // Additional local files to upload next to the archive
+	Manifest []*ManifestEntry
+
+	Classification string     // Highest classification level of the contents
+	Retention      *Retention // Longest retention of the contents
+	Exceptions     bool       // Holds the objects which failed, with EXCEPTIONS_PREFIX
 }
 
-// Archiver listens for WorkFile on tasksCh, archives them, and sends to a bucket.
-func Archiver(ctx context.Context, tasksCh <-chan *WorkFile, doneCh chan<- *ArchiveFile) {
+// Archiver listens for WorkFile on tasksCh, and batches of them on smallCh,
+// archives them, and sends to a bucket.
+func Archiver(ctx context.Context, tasksCh <-chan *WorkFile, smallCh <-chan []*WorkFile, doneCh chan<- *ArchiveFile) {
 	log.Println("Starting archiver...")
 	defer close(doneCh)
 
-	var tgzFile string
-	var contents []string
-	for {
+	var rollC <-chan time.Time // Checks for open archives due to be rolled
+	if (rollInterval > 0 || workMode == modeEvents) && !archiveStdout {
+		ticker := time.NewTicker(10 * time.Second)
+		defer ticker.Stop()
+		rollC = ticker.C
+	}
+	pressureC := tempDisk.pressure // Rolls the open archives when downloads wait for disk
+	if archiveStdout || streamUpload {
+		pressureC = nil // The stream is not counted against the disk
+	}
+	for tasksCh != nil || smallCh != nil {
 		select {
 		case <-ctx.Done():
 			return
+		case <-rollC:
+			// Data trickling in slowly should not sit on local disk for hours
+			for _, s := range allStreams() {
+				if s.tgzFile == "" {
+					continue
+				}
+				if rollInterval > 0 && time.Since(s.opened) >= time.Duration(rollInterval)*time.Minute ||
+					workMode == modeEvents && !windowOf(s.opened).Equal(windowOf(time.Now())) {
+					if debug {
+						log.Println("Rolling", s.tgzFile, "opened at", s.opened.Format(time.RFC3339))
+					}
+					s.roll(doneCh)
+				}
+			}
+		case <-canaryRoll:
+			// The canary objects are all in, their archives are uploaded
+			for _, s := range allStreams() {
+				if len(s.contents) > 0 {
+					s.roll(doneCh)
+				}
+			}
+		case <-pressureC:
+			// Downloads are waiting for the disk held by the open archives
+			for _, s := range allStreams() {
+				if len(s.contents) > 0 {
+					if debug {
+						log.Println("Rolling", s.tgzFile, "to free temp disk")
+					}
+					s.roll(doneCh)
+				}
+			}
+		case batch, ok := <-smallCh:
+			if !ok {
+				smallCh = nil // Only the other objects are left
+				continue
+			}
+			for _, task := range batch {
+				archiveTask(task, doneCh)
+			}
 		case task, ok := <-tasksCh:
 			if debug {
 				log.Printf("Archiver task: %#v %v\n", task, ok)
 			}
 
 			if !ok {
-				if tgzFile == "" {
-					return
-				}
-				CloseArchive()
-				FileContents := make([]string, len(contents))
-				for i := range contents {
-					FileContents[i] = contents[i]
-				}
-				doneCh <- &ArchiveFile{Filename: tgzFile, Contents: FileContents}
-				contents = nil
-				Println("Closing archiver...")
-				return
+				tasksCh = nil
+				continue
 			}
+			archiveTask(task, doneCh)
+		}
+	}
+	for _, s := range allStreams() {
+		if s.tgzFile != "" {
+			s.roll(doneCh)
+		}
+	}
+	Println("Closing archiver...")
+}
 
-			if archiveFile == nil {
-				// Open the initial file
-				tgzFile = OpenArchive()
-			}
+// archiveTask writes an object into the archive of its stream, rolling the
+// archive first if the object would take it over its SIZECAP.
+func archiveTask(task *WorkFile, doneCh chan<- *ArchiveFile) {
+	archiveStage.begin()
+	defer archiveStage.end()
+	if canaryObjects > 0 {
+		atomic.AddInt64(&canaryArrived, 1)
+	}
+	if retryPasses > 0 {
+		retryArrived(task)
+	}
 
-			if debug {
-				log.Println("Written", archiveBytesWritten, "Size Cap", sizeCapLimit)
-			}
-			if archiveBytesWritten > 0 && archiveBytesWritten+task.Size > sizeCapLimit {
-				// If the internal size is above the capacity limit, roll files
-				CloseArchive()
-				FileContents := make([]string, len(contents))
-				for i := range contents {
-					FileContents[i] = contents[i]
-				}
-				doneCh <- &ArchiveFile{Filename: tgzFile, Contents: FileContents}
-				contents = nil
-				archiveBytesWritten = 0
-				tgzFile = OpenArchive()
-			}
+	// Switch in the archive state of the stream the object belongs to
+	stream := streamFor(task.Filename)
+	if classificationSeparate {
+		stream = stream.forLevel(task.Classification)
+	}
+	if task.Exception != "" {
+		stream = exceptionStream
+	}
+	switchStream(stream)
 
-			if debug {
-				log.Println("Writing", task.Filename, "to tar with size", task.Size)
-			}
+	if archiveFile == nil {
+		// Open the initial file
+		stream.open()
+	}
 
-			contents = append(contents, task.Filename)
+	if debug {
+		log.Println("Written", archiveBytesWritten, "Size Cap", stream.sizeCap)
+	}
+	if !archiveStdout && archiveBytesWritten > 0 && archiveBytesWritten+task.Size > stream.sizeCap {
+		// If the internal size is above the capacity limit, roll files
+		stream.roll(doneCh)
+		stream.open()
+	}
 
-			// Create a tar header for the file
-			header := &tar.Header{
-				Name: task.Filename,
-				Size: task.Size,
-				Mode: 0600, // Set file permissions
-			}
+	if debug {
+		log.Println("Writing", task.Filename, "to tar with size", task.Size)
+	}
 
-			if err := archiveTar.WriteHeader(header); err != nil {
-				log.Fatalf("failed to write tar header for %s: %v", task.Filename, err)
-			}
+	if chunks(task) {
+		// Huge objects are split by content into entries, and archives
+		archiveChunks(stream, task, entryName(task.Filename), doneCh)
+		return
+	}
 
-			if task.Size == 0 {
-				// Empty files don't need anything written, just the header
-				continue
-			}
-			archiveBytesWritten += task.Size
+	stream.contents = append(stream.contents, task.Filename)
+	archiveClass = higherLevel(archiveClass, task.Classification)
+	archiveRetention = longerRetention(archiveRetention, task.Retention)
+
+	// The entry name may differ from the key, the manifest keeps both
+	name := entryName(task.Filename)
 
+	var digest string
+	if dedupIndex != nil && task.Size > 0 && task.Exception == "" {
+		// Contents already archived, by this or an earlier run, are
+		// recorded as a reference instead of being stored again
+		var err error
+		if digest, err = contentDigest(task, sha256.New()); err != nil {
+			log.Fatalf("failed to digest %s: %v", task.Filename, err)
+		}
+		if ref := findDedup(digest); ref != nil {
 			if task.TempFile == "" {
-				if n, err := io.Copy(archiveTar, bytes.NewReader(task.Bytes)); err != nil {
-					log.Fatalf("failed to write file %s to tar: %v", task.Filename, err)
-				} else if debug {
-					log.Println("Wrote", n, "bytes to tar")
+				if task.Bytes != nil {
+					putMemory(task.Bytes)
 				}
 			} else {
-				fh, err := os.Open(task.TempFile)
-				if err != nil {
-					log.Fatalf("failed to open temp file %s: %v", task.TempFile, err)
-				}
+				removeTempFile(task)
+			}
+			archiveManifest = append(archiveManifest, &ManifestEntry{
+				Key:          task.Filename,
+				Name:         name,
+				Size:         task.Size,
+				LastModified: task.LastModified,
+				ETag:         task.ETag,
+				SHA256:       digest,
+				Ref:          ref,
+				Custody:      custodyRecord(task, digest, false),
+				Scan:         task.ScanResult,
+				ScanReport:   task.ScanReport,
+				Findings:     task.Findings,
+				Retention:    task.Retention,
+				Attributes:   task.Attrs,
+				Run:          runUUID,
+			})
+			recordStage(task.Filename, "archived", stream.tgzFile)
+			atomic.AddInt64(&DedupedFiles, 1)
+			return
+		}
+	}
 
-				if n, err := io.Copy(archiveTar, fh); err != nil {
-					log.Fatalf("failed to write file %s to tar: %v", task.Filename, err)
-				} else if debug {
-					log.Println("Wrote", n, "bytes to tar")
-				}
-				fh.Close()
-				os.Remove(task.TempFile)
+	var compressed bool
+	var originalSum string
+	if zstdDictSamples > 0 && task.TempFile == "" && task.Size > 0 {
+		// Small objects are compressed individually with a trained
+		// dictionary, the manifest keeps the digest of their contents
+		originalSum, _ = contentDigest(task, newChecksum())
+		task, compressed = dictCompress(task)
+	}
+	if !strings.HasSuffix(name, "/") || task.DeleteMarker {
+		ext := ""
+		switch {
+		case task.DeleteMarker:
+			ext = ".deleted" // An empty tombstone, never a folder
+		case compressed:
+			ext = ".zst"
+		}
+		name = uniqueEntryName(task.Filename, name, ext)
+	}
+
+	// Create a tar header for the file
+	header := &tar.Header{
+		Name:       name,
+		Size:       task.Size,
+		Mode:       0600, // Set file permissions
+		ModTime:    tarTime(task.LastModified),
+		Format:     headerFormat(),
+		PAXRecords: scanRecords(task),
+	}
+	if paxTimes && !task.LastModified.IsZero() {
+		// Recorded as PAX atime and ctime records
+		header.AccessTime = task.LastModified
+		header.ChangeTime = task.LastModified
+	}
+	writeHeader := true
+	if emitDirs {
+		writeDirEntries(name, task.LastModified)
+		if task.Size == 0 && strings.HasSuffix(name, "/") {
+			// Folder marker objects become the directory itself, unless
+			// it was already written as the parent of an earlier key
+			_, written := archiveDirs[name]
+			writeHeader = !written
+			header.Typeflag = tar.TypeDir
+			header.Mode = 0700 // Keeping the time of the marker object
+			archiveDirs[name] = struct{}{}
+		}
+	}
+
+	if writeHeader {
+		if err := archiveTar.WriteHeader(header); err != nil {
+			log.Fatalf("failed to write tar header for %s: %v", task.Filename, err)
+		}
+	} // A marker whose directory is already written is only recorded in the manifest
+
+	// Digest the entry as it is written into the tar
+	entryHash := newChecksum()
+	entryWriter := io.MultiWriter(archiveTar, entryHash)
+
+	if task.Size > 0 {
+		archiveBytesWritten += task.Size
+
+		if task.TempFile == "" {
+			if n, err := io.Copy(entryWriter, bytes.NewReader(task.Bytes)); err != nil {
+				log.Fatalf("failed to write file %s to tar: %v", task.Filename, err)
+			} else if debug {
+				log.Println("Wrote", n, "bytes to tar")
 			}
-			if debug {
-				log.Println("Wrote", task.Filename, "to tar")
+			putMemory(task.Bytes) // The tar writer has copied the contents
+		} else {
+			fh, err := openTempFile(task.TempFile)
+			if err != nil {
+				log.Fatalf("failed to open temp file %s: %v", task.TempFile, err)
 			}
+
+			if n, err := io.Copy(entryWriter, fh); err != nil {
+				log.Fatalf("failed to write file %s to tar: %v", task.Filename, err)
+			} else if debug {
+				log.Println("Wrote", n, "bytes to tar")
+			}
+			fh.Close()
+			removeTempFile(task)
 		}
+	} // Empty files don't need anything written, just the header
+
+	entrySum := fmt.Sprintf("%x", entryHash.Sum(nil))
+	if !strings.HasSuffix(name, "/") {
+		// Folder markers extract as directories, which sha256sum -c cannot read
+		archiveSums = append(archiveSums, entrySum+"  "+name)
+	}
+	var checksum string
+	contentSum := entrySum
+	if compressed {
+		contentSum = originalSum
+	}
+	if digest != "" {
+		addDedup(digest, stream.tgzFile, name)
+	} else if checksumAlgorithm == "sha256" {
+		digest = contentSum
+	}
+	if checksumAlgorithm != "sha256" {
+		checksum = checksumAlgorithm + ":" + contentSum
+	}
+	archiveManifest = append(archiveManifest, &ManifestEntry{
+		Key:          task.Filename,
+		Name:         name,
+		Size:         task.Size,
+		LastModified: task.LastModified,
+		ETag:         task.ETag,
+		SHA256:       digest,
+		Checksum:     checksum,
+		Custody:      custodyRecord(task, entrySum, compressed),
+		Scan:         task.ScanResult,
+		ScanReport:   task.ScanReport,
+		Findings:     task.Findings,
+		Retention:    task.Retention,
+		Attributes:   task.Attrs,
+		Run:          runUUID,
+		Exception:    task.Exception,
+		DeleteMarker: task.DeleteMarker,
+	})
+	recordStage(task.Filename, "archived", stream.tgzFile)
+	if task.DeleteMarker {
+		atomic.AddInt64(&DeleteMarkerFiles, 1)
+	}
+	if debug {
+		log.Println("Wrote", task.Filename, "to tar")
+	}
+}
+
+// finishArchive closes the open archive and describes it, along with its
+// sidecar files, for the uploader.
+func finishArchive(tgzFile string, contents []string) *ArchiveFile {
+	writeManifestEntry()
+	CloseArchive()
+	if name := archiveNaming.finish(tgzFile, fmt.Sprintf("%x", archiveHash.Sum(nil))); name != tgzFile {
+		// Named once its contents are known, with ARCHIVE_NAMING=content-hash
+		if !archiveStdout {
+			if err := renameArchiveFile(tgzFile, name); err != nil {
+				log.Fatalf("failed to rename archive %s: %v", tgzFile, err)
+			}
+		}
+		tgzFile = name
+	}
+	recordState(stateArchive, tgzFile, "closed", 0, "", nil)
+	FileContents := make([]string, len(contents))
+	for i := range contents {
+		FileContents[i] = contents[i]
+	}
+	manifest := WriteManifest(tgzFile)
+	return &ArchiveFile{
+		Filename: tgzFile,
+		Contents: FileContents,
+		Sidecars: slices.Concat(WriteChecksums(tgzFile), manifest, signFiles(manifest), WriteScanReport(tgzFile), WriteInfo(tgzFile)),
+		Manifest: archiveManifest,
+
+		Classification: archiveClass,
+		Retention:      archiveRetention,
+		Exceptions:     exceptionStream != nil && curStream == exceptionStream,
 	}
 }
 
-func OpenArchive() string {
+func OpenArchive(nameTemplate string) string {
 	// Create a .tgz file on disk and prepare to write to it
 	archiveCount++
-	tgzFilePath := fmt.Sprintf(ArchiveName, archiveCount)
+	tgzFilePath := archiveNaming.open(nameTemplate, archiveCount)
+	checkpointArchive(archiveCount)
 	var err error
-	archiveFile, err = os.Create(tgzFilePath)
-	if err != nil {
+	if archiveStdout {
+		// The stream is never rolled, the name is only used for the sidecars
+		archiveFile = &TempFile{File: os.Stdout}
+	} else if err = os.MkdirAll(filepath.Dir(tgzFilePath), 0755); err != nil {
+		log.Fatalf("failed to create archive directory: %v", err)
+	} else if streamUpload {
+		// The sidecars are still written next to where the archive would be
+		if archiveFile, err = createStreamFile(tgzFilePath); err != nil {
+			log.Fatalf("failed to start the upload of %s: %v", tgzFilePath, err)
+		}
+	} else if archiveFile, err = createArchiveFile(tgzFilePath); err != nil {
 		// No sense proceeding if the archives cannot be created
 		log.Fatalf("failed to create tgz file: %v", err)
 	}
@@ -144,12 +415,29 @@ func OpenArchive() string {
 		log.Println("created archive", tgzFilePath)
 	}
 
-	// Create a gzip writer and tar writer
-	archiveGzip, err = gzip.NewWriterLevel(archiveFile, gzip.BestSpeed)
+	// Create a compressor and tar writer, digesting the compressed output
+	archiveHash = newChecksum()
+	archiveSums = nil
+	archiveManifest = nil
+	archiveDirs = make(map[string]struct{})
+	archiveNames = make(map[string]struct{})
+	if embedManifest {
+		archiveNames[manifestEntryName] = struct{}{}
+	}
+	archiveClass, archiveRetention = "", nil
+	var out io.Writer = archiveFile
+	if !archiveStdout && !streamUpload {
+		out = io.MultiWriter(archiveFile, diskWriter{})
+	}
+	archiveCompressor, err = newCompressor(io.MultiWriter(out, archiveHash))
 	if err != nil {
 		log.Fatalf("failed to create compressor for tgz file: %v", err)
 	}
-	archiveTar = tar.NewWriter(archiveGzip)
+	archiveTar = tar.NewWriter(archiveCompressor)
+	if zstdDict != nil {
+		// Every archive carries the dictionary needed to decompress its entries
+		writeDictEntry()
+	}
 	return tgzFilePath
 }
 
@@ -160,9 +448,20 @@ func CloseArchive() {
 	if err := archiveTar.Close(); err != nil {
 		log.Printf("failed to close tar writer: %v", err)
 	}
-	archiveGzip.Flush()
-	if err := archiveGzip.Close(); err != nil {
-		log.Printf("failed to close gzip writer: %v", err)
+	if err := archiveCompressor.Close(); err != nil {
+		log.Printf("failed to close %s writer: %v", archiveCodec, err)
+	}
+	if archiveStdout {
+		if err := archiveFile.Close(); err != nil {
+			log.Fatalf("failed to close stdout: %v", err)
+		}
+		archiveFile = nil
+		return
+	}
+	if streamUpload {
+		closeStreamFile(archiveFile)
+		archiveFile = nil
+		return
 	}
 	archiveFile.Sync()
 	if err := archiveFile.Close(); err != nil {
@@ -170,3 +469,71 @@ func CloseArchive() {
 	}
 	archiveFile = nil
 }
+
+// writeDirEntries writes a directory entry for each parent folder of name
+// which has not yet been written to the open archive.  They are given the
+// time of the entry implying them, so the archives are reproducible.
+func writeDirEntries(name string, modTime time.Time) {
+	for i := 0; i < len(name)-1; i++ {
+		if name[i] != '/' {
+			continue
+		}
+		dir := name[:i+1]
+		if _, ok := archiveDirs[dir]; ok {
+			continue
+		}
+		archiveDirs[dir] = struct{}{}
+		header := &tar.Header{
+			Typeflag: tar.TypeDir,
+			Name:     dir,
+			Mode:     0700,
+			ModTime:  tarTime(modTime),
+			Format:   headerFormat(),
+		}
+		if err := archiveTar.WriteHeader(header); err != nil {
+			log.Fatalf("failed to write tar header for %s: %v", dir, err)
+		}
+	}
+}
+
+// newCompressor wraps w with the stream compression selected by ARCHIVE_CODEC.
+func newCompressor(w io.Writer) (io.WriteCloser, error) {
+	switch archiveCodec {
+	case "gzip":
+		return gzip.NewWriterLevel(w, gzip.BestSpeed)
+	case "zstd":
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedFastest))
+	case "none":
+		return nopWriteCloser{w}, nil
+	}
+	return nil, fmt.Errorf("unknown ARCHIVE_CODEC %q", archiveCodec)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// WriteChecksums writes a <archive>.sha256 file in sha256sum format holding the
+// digest of the archive itself followed by the digest of every entry, so the
+// archive and its extracted contents can be checked with "sha256sum -c".  With
+// CHECKSUM_ALGORITHM the file is named, and holds digests, after the algorithm.
+func WriteChecksums(tgzFile string) []string {
+	if !checksumSidecar {
+		return nil
+	}
+	sumFile := tgzFile + checksumExt()
+	f, err := os.Create(sumFile)
+	if err != nil {
+		log.Fatalf("failed to create checksum file: %v", err)
+	}
+	fmt.Fprintf(f, "%x  %s\n", archiveHash.Sum(nil), filepath.Base(tgzFile))
+	for _, line := range archiveSums {
+		fmt.Fprintln(f, line)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatalf("failed to close checksum file: %v", err)
+	}
+	return []string{sumFile}
+}
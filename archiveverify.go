@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"sync/atomic"
+)
+
+var (
+	verifyArchives = Env("VERIFY_ARCHIVES", "", "Read each finished archive back before upload, checking its compression, tar structure and checksums against the manifest") != ""
+	verifyWorkers  = EnvInt("VERIFY_WORKERS", 2, "How many archives are verified at once with VERIFY_ARCHIVES")
+
+	VerifiedArchives int64
+)
+
+// initArchiveVerify checks the archives can be read back before upload.
+func initArchiveVerify() {
+	if !verifyArchives {
+		return
+	}
+	switch {
+	case archiveStdout:
+		log.Fatal("VERIFY_ARCHIVES cannot be used with ARCHIVE_STDOUT, the archive is never on disk")
+	case verifyWorkers < 1:
+		log.Fatalf("invalid VERIFY_WORKERS %d", verifyWorkers)
+	}
+	log.Printf("Archives are verified before upload by %d workers", verifyWorkers)
+}
+
+// Verifier reads back each archive on tasksCh in a pool of VERIFY_WORKERS,
+// passing them on to doneCh in the order they came once verified.  An archive
+// which does not match its manifest and checksums stops the run before it is
+// uploaded, as the disk or memory it was written with cannot be trusted.
+func Verifier(ctx context.Context, tasksCh <-chan *ArchiveFile, doneCh chan<- *ArchiveFile) {
+	log.Println("Starting verifier...")
+	defer close(doneCh)
+
+	// Each archive is given a result channel, queued in order, so a slow
+	// verification holds back those after it but not their verification
+	pending := make(chan chan *ArchiveFile, verifyWorkers)
+	workers := make(chan struct{}, verifyWorkers)
+	go func() {
+		defer close(pending)
+		for task := range tasksCh {
+			result := make(chan *ArchiveFile, 1)
+			pending <- result
+			workers <- struct{}{}
+			go func(task *ArchiveFile) {
+				defer func() { <-workers }()
+				verifyStage.begin()
+				defer verifyStage.end()
+				if err := verifyArchive(task); err != nil {
+					log.Fatalf("archive %s failed verification, it was not uploaded: %v", task.Filename, err)
+				}
+				atomic.AddInt64(&VerifiedArchives, 1)
+				result <- task
+			}(task)
+		}
+	}()
+
+	for result := range pending {
+		select {
+		case task := <-result:
+			doneCh <- task
+		case <-ctx.Done():
+			return
+		}
+	}
+	Println("Closing verifier...")
+}
+
+// verifyArchive reads a finished archive through as repack reads the archives
+// it downloads, checking it against the entries of its manifest and, with
+// CHECKSUM_SIDECAR, the digests in its checksum file.
+func verifyArchive(task *ArchiveFile) error {
+	entries := make(map[string]*ManifestEntry, len(task.Manifest))
+	for _, entry := range task.Manifest {
+		entries[entry.Name] = entry
+	}
+	var (
+		archiveSum string
+		entrySums  map[string]string
+	)
+	if checksumSidecar {
+		dat, err := os.ReadFile(task.Filename + checksumExt())
+		if err != nil {
+			return err
+		}
+		if archiveSum, entrySums, err = parseChecksums(dat); err != nil {
+			return err
+		}
+	}
+	return verifyArchiveContents(task.Filename, task.Filename, checksumAlgorithms[checksumAlgorithm].new, entries, entrySums, archiveSum)
+}
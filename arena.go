@@ -0,0 +1,80 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+const (
+	arenaSlabSize  = 4 << 20 // Bytes allocated at a time for each arena
+	arenaMaxBuffer = 1 << 20 // Largest buffer from an arena, as every object takes a whole one
+)
+
+var (
+	// Arenas for the in-memory object path
+	smallArena = &slabArena{size: 32 * 1024}
+	largeArena = &slabArena{size: int(min(maxMemBytes, arenaMaxBuffer))}
+
+	ArenaBytes int64 // Bytes held by the arenas
+)
+
+// slabArena hands out fixed size buffers carved from large slabs.  The slabs
+// hold no pointers and are never freed, so the garbage collector neither
+// scans nor reclaims them.  Unlike a sync.Pool, which is emptied by every
+// collection, buffers stay cached however much garbage the rest of the
+// pipeline produces, and returning one allocates nothing.
+type slabArena struct {
+	mu    sync.Mutex
+	size  int      // Size of each buffer
+	slabs [][]byte // Slabs of size * perSlab bytes
+	free  []uint32 // Free buffers, as slab index * perSlab + slot
+}
+
+func (a *slabArena) perSlab() int {
+	return max(1, arenaSlabSize/a.size)
+}
+
+// get returns a buffer of the arena size.
+func (a *slabArena) get() []byte {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	per := a.perSlab()
+	if len(a.free) == 0 {
+		// Grow by a slab, handing its slots out last first
+		slab := make([]byte, a.size*per)
+		atomic.AddInt64(&ArenaBytes, int64(len(slab)))
+		a.slabs = append(a.slabs, slab)
+		for slot := per - 1; slot >= 0; slot-- {
+			a.free = append(a.free, uint32((len(a.slabs)-1)*per+slot))
+		}
+	}
+	i := int(a.free[len(a.free)-1])
+	a.free = a.free[:len(a.free)-1]
+	off := (i % per) * a.size
+	return a.slabs[i/per][off : off+a.size : off+a.size]
+}
+
+// put returns a buffer handed out by get.  Buffers which did not come from
+// the arena are left to the garbage collector.
+func (a *slabArena) put(b []byte) bool {
+	if cap(b) != a.size {
+		return false
+	}
+	p := uintptr(unsafe.Pointer(unsafe.SliceData(b)))
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	per := a.perSlab()
+	for s, slab := range a.slabs {
+		base := uintptr(unsafe.Pointer(unsafe.SliceData(slab)))
+		if p < base || p >= base+uintptr(len(slab)) {
+			continue
+		}
+		if (p-base)%uintptr(a.size) != 0 {
+			return false
+		}
+		a.free = append(a.free, uint32(s*per+int((p-base)/uintptr(a.size))))
+		return true
+	}
+	return false
+}
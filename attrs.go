@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/url"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+var recordAttributes = Env("RECORD_ATTRIBUTES", "", "Record the headers, user metadata, tags and storage class of each object in the manifest so restores can reapply them") != ""
+
+// ObjectAttrs are the attributes of a source object, besides its contents,
+// which a restore needs to recreate it faithfully.
+type ObjectAttrs struct {
+	ContentType        string            `json:"content_type,omitempty"`
+	ContentEncoding    string            `json:"content_encoding,omitempty"`
+	ContentDisposition string            `json:"content_disposition,omitempty"`
+	ContentLanguage    string            `json:"content_language,omitempty"`
+	CacheControl       string            `json:"cache_control,omitempty"`
+	Metadata           map[string]string `json:"metadata,omitempty"` // User metadata, without the x-amz-meta- prefix
+	Tags               map[string]string `json:"tags,omitempty"`
+	StorageClass       string            `json:"storage_class,omitempty"` // Empty for STANDARD
+	Checksums          map[string]string `json:"checksums,omitempty"`     // S3 checksums of the object by algorithm, base64 encoded
+}
+
+// sourceAttrs returns the attributes of a source object, those headed ahead
+// of the download with ENRICH or else headed now with RECORD_ATTRIBUTES set,
+// and nil otherwise.  The tags have already been fetched by sourceTags.
+func sourceAttrs(ctx context.Context, task *DownloadTask, tags map[string]string) (*ObjectAttrs, error) {
+	attrs := task.Attrs
+	if attrs == nil {
+		if !recordAttributes {
+			return nil, nil
+		}
+		var err error
+		if attrs, err = headAttrs(ctx, task.Filename); err != nil {
+			return nil, err
+		}
+	}
+	if len(tags) > 0 {
+		attrs.Tags = tags
+	}
+	return attrs, nil
+}
+
+// headAttrs heads a source object for its attributes, besides its tags.
+func headAttrs(ctx context.Context, key string) (*ObjectAttrs, error) {
+	s3Ready.Wait() // Wait for the S3 client to be ready
+	out, err := s3client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:       aws.String(srcBucket),
+		Key:          aws.String(key),
+		ChecksumMode: types.ChecksumModeEnabled,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to head %s: %w", key, err)
+	}
+	attrs := &ObjectAttrs{
+		ContentType:        aws.ToString(out.ContentType),
+		ContentEncoding:    aws.ToString(out.ContentEncoding),
+		ContentDisposition: aws.ToString(out.ContentDisposition),
+		ContentLanguage:    aws.ToString(out.ContentLanguage),
+		CacheControl:       aws.ToString(out.CacheControl),
+		StorageClass:       string(out.StorageClass),
+	}
+	if len(out.Metadata) > 0 {
+		attrs.Metadata = out.Metadata
+	}
+	for algorithm, sum := range map[string]*string{
+		"CRC32": out.ChecksumCRC32, "CRC32C": out.ChecksumCRC32C, "CRC64NVME": out.ChecksumCRC64NVME,
+		"SHA1": out.ChecksumSHA1, "SHA256": out.ChecksumSHA256,
+	} {
+		if sum == nil {
+			continue
+		}
+		if attrs.Checksums == nil {
+			attrs.Checksums = make(map[string]string)
+		}
+		attrs.Checksums[algorithm] = *sum
+	}
+	return attrs, nil
+}
+
+// restoredMetadata returns the user metadata of a restored object: that which
+// was recorded, with the scan results added under any keys it does not use.
+func restoredMetadata(attrs *ObjectAttrs) map[string]string {
+	if attrs == nil || len(attrs.Metadata) == 0 {
+		return virusScanMap
+	}
+	metadata := maps.Clone(attrs.Metadata)
+	for k, v := range virusScanMap {
+		if _, ok := metadata[k]; !ok {
+			metadata[k] = v
+		}
+	}
+	return metadata
+}
+
+// restoredTagging returns the recorded tags as a Tagging header, nil without
+// any.
+func restoredTagging(attrs *ObjectAttrs) *string {
+	if attrs == nil || len(attrs.Tags) == 0 {
+		return nil
+	}
+	tags := url.Values{}
+	for k, v := range attrs.Tags {
+		tags.Set(k, v)
+	}
+	return aws.String(tags.Encode())
+}
+
+// header returns a header value, nil when it was not recorded.
+func header(v string) *string {
+	if v == "" {
+		return nil
+	}
+	return aws.String(v)
+}
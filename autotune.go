@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+)
+
+var (
+	autotune          = Env("AUTOTUNE", "", "Adjust download, scan and upload concurrency while running, within the AUTOTUNE_* bounds") != ""
+	autotuneInterval  = EnvInt("AUTOTUNE_INTERVAL", 10, "Seconds between concurrency adjustments")
+	autotuneDownloads = Env("AUTOTUNE_DOWNLOADS", "4-64", "Bounds, as MIN-MAX, of the concurrent large object download parts")
+	autotuneSmall     = Env("AUTOTUNE_SMALL_DOWNLOADS", "8-256", "Bounds, as MIN-MAX, of the concurrent small object downloads")
+	autotuneScanners  = Env("AUTOTUNE_SCANNERS", "1-"+strconv.Itoa(runtime.NumCPU()), "Bounds, as MIN-MAX, of the concurrent scanners")
+	autotuneUploads   = Env("AUTOTUNE_UPLOAD_PARTS", "2-16", "Bounds, as MIN-MAX, of the parts of an archive uploaded at once")
+	autotuneMaxCPU    = EnvInt("AUTOTUNE_MAX_CPU", 90, "Percent of all CPUs in use above which concurrency is not raised")
+	autotuneMaxMemory = Env("AUTOTUNE_MAX_MEMORY", "", "Memory use, e.g. 8G, above which concurrency is lowered (empty for no limit)")
+
+	// Limits of the stages, adjusted by the tuner
+	downloadParts     = newTunedGroup(16)
+	smallDownloads    = newTunedGroup(concurrentSmall)
+	scanners          = newTunedGroup(concurrentScans)
+	uploadConcurrency = int64(manager.DefaultUploadConcurrency)
+)
+
+// tunedGroup is a sized wait group whose limit can change while in use.
+type tunedGroup struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	limit   int
+	ceiling int // Lower cap while ramping up with slow start, 0 for none
+	active  int
+	wg      sync.WaitGroup
+}
+
+func newTunedGroup(limit int) *tunedGroup {
+	g := &tunedGroup{limit: max(limit, 1)}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+// Add takes n slots, blocking until they fit under the limit.  A request
+// larger than the limit is let through once the group is idle, so lowering
+// the limit cannot wedge a multi-part download.
+func (g *tunedGroup) Add(n int) {
+	g.mu.Lock()
+	for g.active > 0 && g.active+n > g.effective() {
+		g.cond.Wait()
+	}
+	g.active += n
+	g.wg.Add(n)
+	g.mu.Unlock()
+}
+
+// Done returns one slot.
+func (g *tunedGroup) Done() {
+	g.mu.Lock()
+	g.active--
+	g.cond.Broadcast()
+	g.mu.Unlock()
+	g.wg.Done()
+}
+
+// Wait blocks until every slot has been returned.
+func (g *tunedGroup) Wait() {
+	g.wg.Wait()
+}
+
+func (g *tunedGroup) Limit() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.limit
+}
+
+// effective is the limit brought under the slow start ceiling.
+func (g *tunedGroup) effective() int {
+	if g.ceiling > 0 && g.ceiling < g.limit {
+		return g.ceiling
+	}
+	return g.limit
+}
+
+// SetCeiling caps the limit while ramping up, 0 lifts the cap.
+func (g *tunedGroup) SetCeiling(n int) {
+	g.mu.Lock()
+	g.ceiling = n
+	g.cond.Broadcast()
+	g.mu.Unlock()
+}
+
+func (g *tunedGroup) SetLimit(n int) {
+	g.mu.Lock()
+	g.limit = n
+	g.cond.Broadcast()
+	g.mu.Unlock()
+}
+
+// tunable is one concurrency setting steered by the tuner.  Its input and
+// output report how full the queues before and after the stage are, and
+// progress counts the work the stage has done.
+type tunable struct {
+	name          string
+	get           func() int
+	set           func(int)
+	lo, hi        int
+	input, output func() float64
+	progress      func() int64
+
+	last   int64
+	raised bool    // The last adjustment raised the setting
+	before float64 // Throughput before that raise
+}
+
+// queueFill reports how full a channel is, from 0 to 1.
+func queueFill[T any](ch chan T) func() float64 {
+	return func() float64 { return float64(len(ch)) / float64(max(cap(ch), 1)) }
+}
+
+func parseBounds(name, spec string) (int, int) {
+	lo, hi, ok := strings.Cut(spec, "-")
+	a, err1 := strconv.Atoi(lo)
+	b, err2 := strconv.Atoi(hi)
+	if !ok || err1 != nil || err2 != nil || a < 1 || a > b {
+		log.Fatalf("invalid %s %q, expected MIN-MAX", name, spec)
+	}
+	return a, b
+}
+
+// StartAutotune adjusts the concurrency of the downloader, scanner and
+// uploader every AUTOTUNE_INTERVAL seconds.  Each interval one setting is
+// considered in turn: it is lowered when the queue after it is backed up, its
+// input is starved or memory runs short, and raised while its input backs up
+// and its throughput keeps improving, with CPU to spare.  A raise which made
+// things slower is undone.
+func StartAutotune(toDownload chan *DownloadTask, downloaded, scanned chan *WorkFile, archives chan *ArchiveFile) {
+	if !autotune {
+		return
+	}
+	var maxMemory int64
+	if autotuneMaxMemory != "" {
+		var err error
+		if maxMemory, err = parseByteSize(autotuneMaxMemory); err != nil {
+			log.Fatalf("failed to parse AUTOTUNE_MAX_MEMORY: %v", err)
+		}
+	}
+	none := func() float64 { return 0 }
+	counter := func(v *int64) func() int64 { return func() int64 { return atomic.LoadInt64(v) } }
+
+	dlLo, dlHi := parseBounds("AUTOTUNE_DOWNLOADS", autotuneDownloads)
+	smLo, smHi := parseBounds("AUTOTUNE_SMALL_DOWNLOADS", autotuneSmall)
+	upLo, upHi := parseBounds("AUTOTUNE_UPLOAD_PARTS", autotuneUploads)
+	knobs := []*tunable{
+		{name: "download parts", get: downloadParts.Limit, set: downloadParts.SetLimit, lo: dlLo, hi: dlHi,
+			input: queueFill(toDownload), output: queueFill(downloaded), progress: counter(&DownloadedBytes)},
+		{name: "small downloads", get: smallDownloads.Limit, set: smallDownloads.SetLimit, lo: smLo, hi: smHi,
+			input: queueFill(toDownload), output: queueFill(downloaded), progress: counter(&DownloadedFiles)},
+		{name: "upload parts",
+			get: func() int { return int(atomic.LoadInt64(&uploadConcurrency)) },
+			set: func(n int) { atomic.StoreInt64(&uploadConcurrency, int64(n)) },
+			lo:  upLo, hi: upHi,
+			input: queueFill(archives), output: none, progress: counter(&UploadedBytes)},
+	}
+	if scanningEnabled {
+		lo, hi := parseBounds("AUTOTUNE_SCANNERS", autotuneScanners)
+		knobs = append(knobs, &tunable{name: "scanners", get: scanners.Limit, set: scanners.SetLimit, lo: lo, hi: hi,
+			input: queueFill(downloaded), output: queueFill(scanned), progress: counter(&ScannedFiles)})
+	}
+	for _, k := range knobs {
+		// Start from the configured values, brought within bounds
+		k.set(min(max(k.get(), k.lo), k.hi))
+		k.last = k.progress()
+	}
+
+	go func() {
+		log.Println("Starting autotuner...")
+		interval := time.Duration(autotuneInterval) * time.Second
+		lastCPU, lastTime := cpuTime(), time.Now()
+		for i := 0; ; i++ {
+			time.Sleep(interval)
+			now, cpu := time.Now(), cpuTime()
+			busy := float64(cpu-lastCPU) / float64(now.Sub(lastTime)) / float64(runtime.NumCPU())
+			lastCPU, lastTime = cpu, now
+			var mem runtime.MemStats
+			runtime.ReadMemStats(&mem)
+			memHigh := maxMemory > 0 && int64(mem.Sys-mem.HeapReleased) > maxMemory
+
+			// Rates are measured for every setting, but only one is changed
+			// per interval so its effect can be told apart
+			turn := knobs[i%len(knobs)]
+			for _, k := range knobs {
+				done := k.progress()
+				rate := float64(done-k.last) / interval.Seconds()
+				k.last = done
+				if k == turn {
+					k.adjust(rate, busy*100 > float64(autotuneMaxCPU), memHigh)
+				}
+			}
+		}
+	}()
+}
+
+// adjust moves the setting one step given its throughput over the last
+// interval.
+func (k *tunable) adjust(rate float64, cpuHigh, memHigh bool) {
+	cur := k.get()
+	step := max(1, cur/4)
+	next, reason := cur, ""
+	switch {
+	case memHigh:
+		next, reason = cur-step, "memory above AUTOTUNE_MAX_MEMORY"
+	case k.output() >= 0.75:
+		next, reason = cur-step, "the next stage is backed up"
+	case k.raised && rate < k.before*0.95:
+		next, reason = cur-step, fmt.Sprintf("throughput fell to %.0f%% after raising", 100*rate/max(k.before, 1))
+	case k.input() < 0.1 && rate == 0:
+		next, reason = cur-1, "no work waiting"
+	case k.input() >= 0.5 && !cpuHigh && (!k.raised || rate > k.before*1.05):
+		next, reason = cur+step, "work is queueing"
+	}
+	next = min(max(next, k.lo), k.hi)
+	k.raised = next > cur
+	k.before = rate
+	if next != cur {
+		k.set(next)
+		log.Printf("Autotune: %s %d -> %d, %s", k.name, cur, next, reason)
+	}
+}
+
+// cpuTime returns the user and system CPU time used by the process.
+func cpuTime() time.Duration {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// awsSigner signs requests to AWS services which have no vendored SDK client.
+var awsSigner = v4.NewSigner()
+
+// awsAPIError is the error document returned by AWS JSON protocol services.
+type awsAPIError struct {
+	Type    string `json:"__type"`
+	Message string `json:"message"`
+	Status  int    `json:"-"`
+}
+
+func (e *awsAPIError) Error() string {
+	code := e.Type
+	if i := strings.LastIndex(code, "#"); i >= 0 {
+		code = code[i+1:]
+	}
+	return fmt.Sprintf("%s (HTTP %d): %s", code, e.Status, e.Message)
+}
+
+// awsEndpoint returns the regional endpoint of an AWS service.
+func awsEndpoint(service string) string {
+	if awsEndpointURL != "" {
+		return awsEndpointURL // LocalStack serves every service on one port
+	}
+	host := service
+	if fipsMode {
+		host += "-fips"
+	}
+	return fmt.Sprintf("https://%s.%s.amazonaws.com/", host, region)
+}
+
+// awsJSONCall invokes target on an AWS JSON protocol service, such as SQS or
+// DynamoDB, with a SigV4 signed request using the shared credentials.
+// jsonVersion is the protocol version of the service, "1.0" or "1.1".
+func awsJSONCall(ctx context.Context, service, jsonVersion, target string, in, out any) error {
+	s3Ready.Wait() // Credentials and region are resolved with the S3 client
+
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, awsEndpoint(service), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-"+jsonVersion)
+	req.Header.Set("X-Amz-Target", target)
+
+	creds, err := awsCredentials.Retrieve(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve credentials: %w", err)
+	}
+	sum := sha256.Sum256(body)
+	if err := awsSigner.SignHTTP(ctx, creds, req, hex.EncodeToString(sum[:]), service, region, time.Now()); err != nil {
+		return fmt.Errorf("failed to sign %s request: %w", target, err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	dat, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		apiErr := &awsAPIError{Status: resp.StatusCode}
+		if json.Unmarshal(dat, apiErr) != nil || apiErr.Type == "" {
+			apiErr.Type, apiErr.Message = http.StatusText(resp.StatusCode), string(dat)
+		}
+		return apiErr
+	}
+	if out == nil || len(dat) == 0 {
+		return nil
+	}
+	return json.Unmarshal(dat, out)
+}
+
+// awsQueryCall invokes action on an AWS Query protocol service, such as STS,
+// signing the request with creds, unless nil for an unsigned action, and
+// decodes the XML response into out.
+// Unlike awsJSONCall it does not wait for the S3 client, as it is used while
+// resolving the credentials of that client.
+func awsQueryCall(ctx context.Context, creds aws.CredentialsProvider, service, version, action string, params url.Values, out any) error {
+	params.Set("Action", action)
+	params.Set("Version", version)
+	body := []byte(params.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, awsEndpoint(service), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+
+	if creds != nil {
+		c, err := creds.Retrieve(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to retrieve credentials: %w", err)
+		}
+		sum := sha256.Sum256(body)
+		if err := awsSigner.SignHTTP(ctx, c, req, hex.EncodeToString(sum[:]), service, region, time.Now()); err != nil {
+			return fmt.Errorf("failed to sign %s request: %w", action, err)
+		}
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	dat, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var doc struct {
+			Error struct {
+				Code    string
+				Message string
+			}
+		}
+		apiErr := &awsAPIError{Status: resp.StatusCode}
+		if xml.Unmarshal(dat, &doc) == nil && doc.Error.Code != "" {
+			apiErr.Type, apiErr.Message = doc.Error.Code, doc.Error.Message
+		} else {
+			apiErr.Type, apiErr.Message = http.StatusText(resp.StatusCode), string(dat)
+		}
+		return apiErr
+	}
+	return xml.Unmarshal(dat, out)
+}
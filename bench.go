@@ -0,0 +1,444 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"math"
+	"math/bits"
+	"math/rand/v2"
+	"os"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const modeBench = "bench"
+
+var (
+	benchConcurrency = Env("BENCH_CONCURRENCY", "1,4,16,64", "Concurrency levels tried for downloads and uploads in bench mode, joined by ,")
+	benchSeconds     = EnvInt("BENCH_SECONDS", 15, "Seconds each measurement runs for in bench mode")
+	benchObjects     = EnvInt("BENCH_OBJECTS", 1000, "Synthetic objects generated in bench mode")
+	benchMaxSize     = Env("BENCH_MAX_SIZE", "64M", "Largest synthetic object generated in bench mode")
+	benchBucket      = Env("BENCH_BUCKET", "", "Scratch bucket the synthetic objects of bench mode are written to")
+	benchPrefix      = Env("BENCH_PREFIX", "", "Prefix of the synthetic objects of bench mode, removed afterwards; required to write them to DST_BUCKET")
+)
+
+// benchObject is a synthetic object, a window onto the shared source data.
+type benchObject struct {
+	key          string
+	offset, size int64
+	uploaded     atomic.Bool
+}
+
+// benchResult is one measurement of a stage.
+type benchResult struct {
+	stage       string
+	setting     string
+	concurrency int
+	objects     int64
+	bytes       int64
+	elapsed     time.Duration
+	ratio       float64 // Compressed to uncompressed size
+	note        string
+}
+
+func (r *benchResult) rate() float64 {
+	return float64(r.bytes) / r.elapsed.Seconds()
+}
+
+// RunBench measures the download, scan, compress and upload throughput of
+// this host with synthetic objects whose sizes follow those in the metadata
+// file, and recommends settings for a real run.  The objects are written to,
+// and read back from, BENCH_BUCKET under BENCH_PREFIX and removed at the end;
+// the source bucket is never touched.
+func RunBench(ctx context.Context) {
+	if benchBucket == "" {
+		// Only share the production bucket under a prefix chosen for it
+		if benchPrefix == "" {
+			log.Fatal("bench mode writes synthetic objects: set BENCH_BUCKET to a scratch bucket, or BENCH_PREFIX to write them to DST_BUCKET")
+		}
+		benchBucket = dstBucket
+	}
+	log.Printf("Bench: writing synthetic objects to s3://%s/%s", benchBucket, benchPrefix)
+	maxSize, err := parseByteSize(benchMaxSize)
+	if err != nil {
+		log.Fatalf("failed to parse BENCH_MAX_SIZE: %v", err)
+	}
+	var levels []int
+	for _, s := range strings.Split(benchConcurrency, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || n < 1 {
+			log.Fatalf("invalid BENCH_CONCURRENCY level %q", s)
+		}
+		levels = append(levels, n)
+	}
+	sort.Ints(levels)
+
+	// Objects are windows onto one buffer of synthetic data
+	rng := rand.New(rand.NewPCG(1, 2))
+	data := syntheticData(rng, maxSize)
+
+	sizes := benchSizes()
+	objects := make([]*benchObject, benchObjects)
+	var total int64
+	for i := range objects {
+		size := min(sizes(rng), maxSize)
+		objects[i] = &benchObject{
+			key:    fmt.Sprintf("%s%06d", benchPrefix, i),
+			offset: rng.Int64N(maxSize - size + 1),
+			size:   size,
+		}
+		total += size
+	}
+	log.Printf("Bench: %d synthetic objects, %s in total, averaging %s", len(objects), humanizeBytes(total), humanizeBytes(total/int64(len(objects))))
+	body := func(o *benchObject) []byte { return data[o.offset : o.offset+o.size] }
+
+	var results []*benchResult
+	defer benchCleanup(ctx, objects)
+
+	// Uploads of the objects double as the setup of the download measurements
+	for _, c := range levels {
+		results = append(results, benchRun("upload objects", c, objects, func(o *benchObject) error {
+			s3Ready.Wait()
+			_, err := s3client.PutObject(ctx, &s3.PutObjectInput{
+				Bucket: aws.String(benchBucket),
+				Key:    aws.String(o.key),
+				Body:   bytes.NewReader(body(o)),
+			})
+			o.uploaded.Store(err == nil)
+			return err
+		}))
+	}
+	var stored []*benchObject
+	for _, o := range objects {
+		if o.uploaded.Load() {
+			stored = append(stored, o)
+		}
+	}
+	if len(stored) == 0 {
+		log.Println("Bench: no objects were uploaded, skipping downloads")
+		levels = nil
+	}
+	for _, c := range levels {
+		results = append(results, benchRun("download objects", c, stored, func(o *benchObject) error {
+			if o.size <= maxMemBytes {
+				mem := getMemory(o.size)
+				defer putMemory(mem)
+				_, err := downloadObjectToBuffer(ctx, benchBucket, o.key, "", mem)
+				return err
+			}
+			parts := downloadPartsFor(o.size)
+			file, err := downloadObjectInParts(ctx, benchBucket, o.key, "", o.size, parts)
+			if err == nil {
+				deleteTempFile(file)
+			}
+			return err
+		}))
+	}
+
+	if scanningEnabled {
+		var scanLevels []int
+		for c := 1; c < runtime.NumCPU(); c *= 2 {
+			scanLevels = append(scanLevels, c)
+		}
+		scanLevels = append(scanLevels, runtime.NumCPU())
+		for _, c := range scanLevels {
+			results = append(results, benchRun("scan", c, objects, func(o *benchObject) error {
+				virus, err := scanWorkFile(&WorkFile{Filename: o.key, Size: o.size, Bytes: body(o)})
+				if virus != "" {
+					return fmt.Errorf("virus %s found in synthetic data", virus)
+				}
+				return err
+			}))
+		}
+	}
+
+	// The archiver is a single goroutine, so codecs are measured on one core
+	codec := archiveCodec
+	for _, name := range slices.Sorted(maps.Keys(archiveCodecs)) {
+		archiveCodec = name
+		var out countingWriter
+		compressor, err := newCompressor(&out)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tw := tar.NewWriter(compressor)
+		r := benchRun("compress", 1, objects, func(o *benchObject) error {
+			if err := tw.WriteHeader(&tar.Header{Name: o.key, Size: o.size, Mode: 0600, Format: archiveTarFormat}); err != nil {
+				return err
+			}
+			_, err := tw.Write(body(o))
+			return err
+		})
+		tw.Close()
+		compressor.Close()
+		r.setting = "ARCHIVE_CODEC=" + name
+		r.ratio = float64(out.n) / float64(max(r.bytes, 1))
+		r.note = fmt.Sprintf("ratio %.2f", r.ratio)
+		results = append(results, r)
+	}
+	archiveCodec = codec
+
+	results = append(results, benchArchiveUpload(ctx, data))
+
+	benchReport(results)
+}
+
+// syntheticData returns size bytes, half random and half text, so that
+// compression ratios are neither best nor worst case.
+func syntheticData(rng *rand.Rand, size int64) []byte {
+	data := make([]byte, size)
+	for i := 0; i < len(data)/2; i += 8 {
+		v := rng.Uint64()
+		for j := 0; j < 8 && i+j < len(data)/2; j++ {
+			data[i+j] = byte(v >> (8 * j))
+		}
+	}
+	text := []byte("The quick brown fox jumps over the lazy dog. 0123456789 {\"key\": \"value\", \"size\": 4096}\n")
+	for i := len(data) / 2; i < len(data); i += len(text) {
+		copy(data[i:], text)
+	}
+	return data
+}
+
+// benchSizes returns a generator of object sizes following a log2 histogram
+// of the sizes in the metadata file, or spread from 1 KiB to 16 MiB if there
+// is none.
+func benchSizes() func(*rand.Rand) int64 {
+	sizes, count := histogramSizes(metadataFileName)
+	if count == 0 {
+		log.Printf("Bench: no objects in %s, using sizes from 1 KiB to 16 MiB", metadataFileName)
+		return logUniformSizes(1024, 16<<20)
+	}
+	log.Printf("Bench: object sizes drawn from the %d objects in %s", count, metadataFileName)
+	return sizes
+}
+
+// logUniformSizes returns a generator of sizes spread evenly across the powers
+// of two from lo to hi.
+func logUniformSizes(lo, hi int64) func(*rand.Rand) int64 {
+	return func(rng *rand.Rand) int64 {
+		return int64(math.Exp(math.Log(float64(lo)) + rng.Float64()*(math.Log(float64(hi))-math.Log(float64(lo)))))
+	}
+}
+
+// histogramSizes returns a generator of object sizes following a log2
+// histogram of the sizes in a metadata file, and the number of objects the
+// histogram was built from.
+func histogramSizes(file string) (func(*rand.Rand) int64, int64) {
+	var hist [64]int64
+	var count int64
+	if fh, err := os.Open(file); err == nil {
+		scanner := bufio.NewScanner(fh)
+		for scanner.Scan() {
+			var entry MetaEntry
+			if json.Unmarshal(scanner.Bytes(), &entry) != nil || entry.Key == "" {
+				continue // The last line holds the totals
+			}
+			hist[bits.Len64(uint64(entry.Size))]++
+			count++
+		}
+		fh.Close()
+	}
+	if count == 0 {
+		return nil, 0
+	}
+	return func(rng *rand.Rand) int64 {
+		n := rng.Int64N(count)
+		for b, c := range hist {
+			if n -= c; n < 0 {
+				if b == 0 {
+					return 0
+				}
+				// Uniform within the bucket [2^(b-1), 2^b)
+				lo := int64(1) << (b - 1)
+				return lo + rng.Int64N(lo)
+			}
+		}
+		return 0
+	}, count
+}
+
+// benchRun runs fn over the objects with the given concurrency until
+// BENCH_SECONDS have passed, cycling through them as needed.
+func benchRun(stage string, concurrency int, objects []*benchObject, fn func(*benchObject) error) *benchResult {
+	log.Printf("Bench: %s with concurrency %d", stage, concurrency)
+	var (
+		next     int64 = -1
+		wg       sync.WaitGroup
+		deadline = time.Now().Add(time.Duration(benchSeconds) * time.Second)
+		r        = &benchResult{stage: stage, concurrency: concurrency}
+		errs     int64
+		start    = time.Now()
+	)
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				o := objects[atomic.AddInt64(&next, 1)%int64(len(objects))]
+				if err := fn(o); err != nil {
+					if atomic.AddInt64(&errs, 1) == 1 {
+						log.Printf("Bench: %s %s: %v", stage, o.key, err)
+					}
+					continue
+				}
+				atomic.AddInt64(&r.objects, 1)
+				atomic.AddInt64(&r.bytes, o.size)
+			}
+		}()
+	}
+	wg.Wait()
+	r.elapsed = time.Since(start)
+	if errs > 0 {
+		r.note = fmt.Sprintf("%d errors", errs)
+	}
+	return r
+}
+
+// benchArchiveUpload times the multipart upload of one archive sized file.
+func benchArchiveUpload(ctx context.Context, data []byte) *benchResult {
+	size := min(sizeCapLimit, 256<<20)
+	log.Printf("Bench: upload of a %s archive", humanizeBytes(size))
+	tmp, err := os.CreateTemp("", "s3bench-*.tar")
+	if err != nil {
+		log.Fatalf("failed to create temp file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	for written := int64(0); written < size; {
+		n, err := tmp.Write(data[:min(int64(len(data)), size-written)])
+		if err != nil {
+			log.Fatalf("failed to write temp file: %v", err)
+		}
+		written += int64(n)
+	}
+	tmp.Close()
+
+	r := &benchResult{stage: "upload archive", concurrency: 1, objects: 1, bytes: size}
+	start := time.Now()
+	if err := uploadFileInParts(ctx, benchBucket, benchPrefix+"archive.tar", tmp.Name(), uploadAttrs{}); err != nil {
+		r.note = err.Error()
+	}
+	r.elapsed = time.Since(start)
+	return r
+}
+
+// benchCleanup removes the synthetic objects from DST_BUCKET.
+func benchCleanup(ctx context.Context, objects []*benchObject) {
+	s3Ready.Wait() // Wait for the S3 client to be ready
+	keys := []string{benchPrefix + "archive.tar"}
+	for _, o := range objects {
+		keys = append(keys, o.key)
+	}
+	for len(keys) > 0 {
+		batch := keys[:min(len(keys), 1000)]
+		keys = keys[len(batch):]
+		var ids []types.ObjectIdentifier
+		for _, key := range batch {
+			ids = append(ids, types.ObjectIdentifier{Key: aws.String(key)})
+		}
+		if _, err := s3client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(benchBucket),
+			Delete: &types.Delete{Objects: ids, Quiet: aws.Bool(true)},
+		}); err != nil {
+			log.Printf("Bench: failed to remove synthetic objects under %s: %v", benchPrefix, err)
+			return
+		}
+	}
+}
+
+// benchKnee returns the lowest concurrency of a stage within 10% of its best
+// throughput, as more only adds load.
+func benchKnee(results []*benchResult, stage string) *benchResult {
+	var best, knee *benchResult
+	for _, r := range results {
+		if r.stage == stage && (best == nil || r.rate() > best.rate()) {
+			best = r
+		}
+	}
+	for _, r := range results {
+		if r.stage == stage && best != nil && r.rate() >= 0.9*best.rate() && (knee == nil || r.concurrency < knee.concurrency) {
+			knee = r
+		}
+	}
+	return knee
+}
+
+func benchReport(results []*benchResult) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "STAGE\tSETTING\tCONCURRENCY\tOBJECTS/S\tTHROUGHPUT\tNOTE")
+	for _, r := range results {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%.1f\t%s\t%s\n", r.stage, r.setting, r.concurrency,
+			float64(r.objects)/r.elapsed.Seconds(), humanizeRate(r.bytes, r.elapsed), r.note)
+	}
+	w.Flush()
+
+	fmt.Println("\nRecommended settings for this host:")
+	download := benchKnee(results, "download objects")
+	if download != nil {
+		fmt.Printf("  CONCURRENT_SMALL_DOWNLOADS=%d  # %s\n", download.concurrency, humanizeRate(download.bytes, download.elapsed))
+	}
+	if scan := benchKnee(results, "scan"); scan != nil {
+		fmt.Printf("  CONCURRENT_SCANNERS=%d  # %s\n", scan.concurrency, humanizeRate(scan.bytes, scan.elapsed))
+	}
+
+	// The best compression which keeps up with downloads, else the fastest
+	var codec *benchResult
+	for _, r := range results {
+		if r.stage != "compress" {
+			continue
+		}
+		if codec == nil {
+			codec = r
+			continue
+		}
+		fast := download == nil || r.rate() >= download.rate()
+		codecFast := download == nil || codec.rate() >= download.rate()
+		switch {
+		case fast && !codecFast,
+			fast && codecFast && r.ratio < codec.ratio,
+			!fast && !codecFast && r.rate() > codec.rate():
+			codec = r
+		}
+	}
+	if codec != nil {
+		fmt.Printf("  %s  # %s on one core, %s\n", codec.setting, humanizeRate(codec.bytes, codec.elapsed), codec.note)
+	}
+
+	// The slowest stage bounds the whole pipeline
+	var bottleneck *benchResult
+	for _, r := range []*benchResult{download, benchKnee(results, "scan"), codec, benchKnee(results, "upload archive")} {
+		if r != nil && (bottleneck == nil || r.rate() < bottleneck.rate()) {
+			bottleneck = r
+		}
+	}
+	if bottleneck != nil {
+		fmt.Printf("Expected throughput about %s, limited by %s\n", humanizeRate(bottleneck.bytes, bottleneck.elapsed), bottleneck.stage)
+	}
+}
+
+// countingWriter discards what is written, counting the bytes.
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+var (
+	budgetMaxCost     = Env("BUDGET_MAX_COST", "", "Estimated S3 request and transfer cost, in dollars, at which the run pauses (empty for no cap)")
+	budgetMaxRequests = int64(EnvInt("BUDGET_MAX_REQUESTS", 0, "S3 requests at which the run pauses (0 for no cap)"))
+	s3PutPrice        = Env("S3_PUT_PRICE", "0.005", "Dollars per 1000 PUT, COPY, POST and LIST requests, for the cost estimate")
+	s3GetPrice        = Env("S3_GET_PRICE", "0.0004", "Dollars per 1000 GET, HEAD and other read requests, for the cost estimate")
+	s3TransferPrice   = Env("S3_TRANSFER_PRICE", "0", "Dollars per GB read from S3, for the cost estimate (0 within a region)")
+
+	// Requests made to the object store, by how S3 bills them
+	S3GetRequests   int64
+	S3PutRequests   int64
+	S3ListRequests  int64
+	S3TransferBytes int64 // Bytes of object contents read
+
+	putPrice, getPrice, transferPrice float64
+	budgetCost                        float64 // BUDGET_MAX_COST, zero for no cap
+	budget                            struct {
+		sync.Mutex
+		maxCost     float64 // Zero for no cap
+		maxRequests int64
+		paused      bool
+	}
+)
+
+// S3Usage is the request counts and estimated cost of a run.
+type S3Usage struct {
+	GetRequests   int64   `json:"get_requests"`
+	PutRequests   int64   `json:"put_requests"`
+	ListRequests  int64   `json:"list_requests"`
+	TransferBytes int64   `json:"transfer_bytes"`
+	EstimatedCost float64 `json:"estimated_cost"`
+}
+
+func initBudget() {
+	for _, p := range []struct {
+		name, value string
+		price       *float64
+	}{{"S3_PUT_PRICE", s3PutPrice, &putPrice}, {"S3_GET_PRICE", s3GetPrice, &getPrice}, {"S3_TRANSFER_PRICE", s3TransferPrice, &transferPrice}} {
+		var err error
+		if *p.price, err = strconv.ParseFloat(p.value, 64); err != nil || *p.price < 0 {
+			log.Fatalf("invalid %s %q", p.name, p.value)
+		}
+	}
+	if budgetMaxCost != "" {
+		var err error
+		if budgetCost, err = strconv.ParseFloat(budgetMaxCost, 64); err != nil || budgetCost <= 0 {
+			log.Fatalf("invalid BUDGET_MAX_COST %q", budgetMaxCost)
+		}
+	}
+	budget.maxCost = budgetCost
+	if budgetMaxRequests < 0 {
+		log.Fatalf("invalid BUDGET_MAX_REQUESTS %d", budgetMaxRequests)
+	}
+	budget.maxRequests = budgetMaxRequests
+	if budget.maxCost == 0 && budget.maxRequests == 0 {
+		return
+	}
+	log.Printf("Pausing the run at %d S3 requests or $%.2f of estimated S3 cost (0 for no cap)", budget.maxRequests, budget.maxCost)
+
+	// SIGUSR1 grants the same budget again and resumes a paused run
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR1)
+	go func() {
+		for range sig {
+			extendBudget()
+		}
+	}()
+}
+
+// s3Usage returns the requests made so far and their estimated cost.
+func s3Usage() *S3Usage {
+	u := &S3Usage{
+		GetRequests:   atomic.LoadInt64(&S3GetRequests),
+		PutRequests:   atomic.LoadInt64(&S3PutRequests),
+		ListRequests:  atomic.LoadInt64(&S3ListRequests),
+		TransferBytes: atomic.LoadInt64(&S3TransferBytes),
+	}
+	u.EstimatedCost = float64(u.PutRequests+u.ListRequests)/1000*putPrice +
+		float64(u.GetRequests)/1000*getPrice + float64(u.TransferBytes)/1e9*transferPrice
+	return u
+}
+
+// overBudget reports whether the usage has reached a cap, pausing the run
+// the first time it does.
+func overBudget() bool {
+	budget.Lock()
+	defer budget.Unlock()
+	if budget.maxCost == 0 && budget.maxRequests == 0 {
+		return false
+	}
+	u := s3Usage()
+	over := budget.maxRequests > 0 && u.GetRequests+u.PutRequests+u.ListRequests >= budget.maxRequests ||
+		budget.maxCost > 0 && u.EstimatedCost >= budget.maxCost
+	if over && !budget.paused {
+		budget.paused = true
+		log.Printf("Budget reached with %d GET, %d PUT and %d LIST requests, %s read, ~$%.2f: pausing, send SIGUSR1 to grant the budget again or stop and resume later",
+			u.GetRequests, u.PutRequests, u.ListRequests, humanizeBytes(u.TransferBytes), u.EstimatedCost)
+	}
+	return over
+}
+
+// extendBudget raises each cap by its configured amount.
+func extendBudget() {
+	budget.Lock()
+	defer budget.Unlock()
+	budget.maxCost += budgetCost
+	budget.maxRequests += budgetMaxRequests
+	budget.paused = false
+	log.Printf("Budget raised to %d S3 requests and $%.2f, resuming", budget.maxRequests, budget.maxCost)
+}
+
+// budgetPaused reports whether requests are held back by the budget.
+func budgetPaused() bool {
+	budget.Lock()
+	defer budget.Unlock()
+	return budget.paused
+}
+
+// waitBudget holds a request back while the run is over budget.
+func waitBudget(ctx context.Context) {
+	for overBudget() && ctx.Err() == nil {
+		time.Sleep(time.Second)
+	}
+}
+
+// meteredStore counts the requests made to an object store, and pauses them
+// while the run is over BUDGET_MAX_COST or BUDGET_MAX_REQUESTS.
+type meteredStore struct {
+	ObjectStore
+}
+
+// meter wraps a store so its requests are counted.
+func meter(store ObjectStore) ObjectStore {
+	return meteredStore{store}
+}
+
+func (m meteredStore) count(ctx context.Context, counter *int64) {
+	waitBudget(ctx)
+	atomic.AddInt64(counter, 1)
+}
+
+func (m meteredStore) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	m.count(ctx, &S3GetRequests)
+	out, err := m.ObjectStore.GetObject(ctx, params, optFns...)
+	if err == nil {
+		atomic.AddInt64(&S3TransferBytes, aws.ToInt64(out.ContentLength))
+	}
+	return out, err
+}
+
+func (m meteredStore) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	m.count(ctx, &S3GetRequests)
+	return m.ObjectStore.HeadObject(ctx, params, optFns...)
+}
+
+func (m meteredStore) GetObjectAttributes(ctx context.Context, params *s3.GetObjectAttributesInput, optFns ...func(*s3.Options)) (*s3.GetObjectAttributesOutput, error) {
+	m.count(ctx, &S3GetRequests)
+	return m.ObjectStore.GetObjectAttributes(ctx, params, optFns...)
+}
+
+func (m meteredStore) GetObjectTagging(ctx context.Context, params *s3.GetObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error) {
+	m.count(ctx, &S3GetRequests)
+	return m.ObjectStore.GetObjectTagging(ctx, params, optFns...)
+}
+
+func (m meteredStore) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	m.count(ctx, &S3ListRequests)
+	return m.ObjectStore.ListObjectsV2(ctx, params, optFns...)
+}
+
+func (m meteredStore) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	m.count(ctx, &S3PutRequests)
+	return m.ObjectStore.PutObject(ctx, params, optFns...)
+}
+
+func (m meteredStore) CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	m.count(ctx, &S3PutRequests)
+	return m.ObjectStore.CopyObject(ctx, params, optFns...)
+}
+
+func (m meteredStore) DeleteObjects(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+	m.count(ctx, &S3PutRequests) // A POST, billed as a PUT
+	return m.ObjectStore.DeleteObjects(ctx, params, optFns...)
+}
+
+func (m meteredStore) CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	m.count(ctx, &S3PutRequests)
+	return m.ObjectStore.CreateMultipartUpload(ctx, params, optFns...)
+}
+
+func (m meteredStore) UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	m.count(ctx, &S3PutRequests)
+	return m.ObjectStore.UploadPart(ctx, params, optFns...)
+}
+
+func (m meteredStore) CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	m.count(ctx, &S3PutRequests)
+	return m.ObjectStore.CompleteMultipartUpload(ctx, params, optFns...)
+}
+
+func (m meteredStore) ListMultipartUploads(ctx context.Context, params *s3.ListMultipartUploadsInput, optFns ...func(*s3.Options)) (*s3.ListMultipartUploadsOutput, error) {
+	m.count(ctx, &S3ListRequests)
+	return m.ObjectStore.ListMultipartUploads(ctx, params, optFns...)
+}
+
+func (m meteredStore) ListObjectVersions(ctx context.Context, params *s3.ListObjectVersionsInput, optFns ...func(*s3.Options)) (*s3.ListObjectVersionsOutput, error) {
+	m.count(ctx, &S3ListRequests)
+	return m.ObjectStore.ListObjectVersions(ctx, params, optFns...)
+}
+
+func (m meteredStore) RestoreObject(ctx context.Context, params *s3.RestoreObjectInput, optFns ...func(*s3.Options)) (*s3.RestoreObjectOutput, error) {
+	m.count(ctx, &S3PutRequests) // A POST, billed as a PUT, besides the retrieval
+	return m.ObjectStore.RestoreObject(ctx, params, optFns...)
+}
+
+// AbortMultipartUpload is a free DELETE, and is let through when paused so
+// failed uploads are still cleaned up.
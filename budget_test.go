@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// TestBudgetPausesRequests checks that requests past BUDGET_MAX_REQUESTS wait
+// until the budget is granted again.
+func TestBudgetPausesRequests(t *testing.T) {
+	store := meter(newMemStore())
+	base := s3Usage()
+	budgetMaxRequests = base.GetRequests + base.PutRequests + base.ListRequests + 2
+	budget.maxRequests = budgetMaxRequests
+	defer func() { budgetMaxRequests, budget.maxRequests, budget.paused = 0, 0, false }()
+
+	ctx := context.Background()
+	list := func() {
+		store.ListObjectsV2(ctx, &s3.ListObjectsV2Input{Bucket: aws.String("src")})
+	}
+	list()
+	list()
+	if !overBudget() || !budgetPaused() {
+		t.Fatal("the run is not paused at BUDGET_MAX_REQUESTS")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		list()
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("a request was made over budget")
+	case <-time.After(1500 * time.Millisecond):
+	}
+	extendBudget()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the request did not resume once the budget was raised")
+	}
+	if got := s3Usage().ListRequests - base.ListRequests; got != 3 {
+		t.Errorf("counted %d LIST requests, want 3", got)
+	}
+}
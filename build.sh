@@ -6,5 +6,9 @@ set -e -x
 
 version=$(date +%Y%m%d.%H%M)
 rpm -q clamav-devel clamav golang || yum install clamav-devel clamav golang
+# FIPS=1 builds with the Go FIPS 140-3 module enabled by default
+if [ -n "$FIPS" ]; then
+  export GOFIPS140=v1.0.0
+fi
 LD_LIBRARY_PATH=$LD_LIBRARY_PATH:/usr/local/lib CGO_LDFLAGS="-L/usr/local/lib -lclamav" go build -ldflags "-X main.version=$version" -o s3archiver .
 
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+var (
+	canaryObjects = EnvInt("CANARY", 0, "Archive, upload and verify only the first N objects, then pause for confirmation before the rest (0 to not pause)")
+
+	canaryRoll     = make(chan struct{}, 1) // Has the archiver roll the canary archives
+	canaryConfirm  = make(chan struct{})    // The operator confirmed the canary
+	canaryArrived  int64                    // Objects the archiver has taken
+	canaryUploaded int64                    // Objects in the uploaded canary archives
+	canaryDone     atomic.Bool              // The canary was confirmed
+
+	canaryMu       sync.Mutex
+	canaryArchives []*ArchiveFile // Archives uploaded before the confirmation
+)
+
+func initCanary() {
+	if canaryObjects == 0 {
+		return
+	}
+	switch {
+	case canaryObjects < 0:
+		log.Fatalf("invalid CANARY %d", canaryObjects)
+	case workMode != "":
+		log.Fatal("CANARY cannot be used with MODE, it pauses a standalone run")
+	case archiveStdout || exportDir != "" || simulating:
+		log.Fatal("CANARY reads its archives back from DST_BUCKET and cannot be used with ARCHIVE_STDOUT, EXPORT_DIR or SIMULATE")
+	}
+	log.Printf("Canary: the first %d objects are archived, uploaded and verified before the rest", canaryObjects)
+
+	// SIGUSR2 confirms the canary once it is waiting
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR2)
+	go func() {
+		for range sig {
+			select {
+			case canaryConfirm <- struct{}{}:
+			default:
+				log.Println("Canary: not waiting for confirmation yet")
+			}
+		}
+	}()
+}
+
+// canaryGate passes the first CANARY objects from in to out, then holds the
+// rest back until those are in archives which have been uploaded, read back
+// and confirmed by the operator.
+func canaryGate(ctx context.Context, in <-chan *DownloadTask, out chan<- *DownloadTask) {
+	defer close(out)
+	n := 0
+	for task := range in {
+		if n == canaryObjects {
+			if !waitCanary(ctx) {
+				return
+			}
+		}
+		select {
+		case out <- task:
+		case <-ctx.Done():
+			return
+		}
+		n++
+	}
+}
+
+// waitCanary waits for the canary objects to be archived and uploaded,
+// verifies their archives, and waits for SIGUSR2 to carry on.
+func waitCanary(ctx context.Context) bool {
+	// Failed objects only reach the archiver as exceptions
+	if !pollUntil(ctx, func() bool {
+		arrived := atomic.LoadInt64(&canaryArrived) - atomic.LoadInt64(&ExceptionFiles)
+		return arrived+atomic.LoadInt64(&ErroredFiles) >= int64(canaryObjects)
+	}) {
+		return false
+	}
+	canaryRoll <- struct{}{}
+	archived := atomic.LoadInt64(&canaryArrived)
+	if !pollUntil(ctx, func() bool { return atomic.LoadInt64(&canaryUploaded) >= archived }) {
+		return false
+	}
+
+	canaryMu.Lock()
+	archives := canaryArchives
+	canaryMu.Unlock()
+	for _, task := range archives {
+		if err := verifyCanary(ctx, task); err != nil {
+			log.Fatalf("Canary: archive %s failed verification: %v", task.Filename, err)
+		}
+		log.Printf("Canary: verified %s in DST_BUCKET with %d entries", task.Filename, len(task.Manifest))
+	}
+
+	Println(fmt.Sprintf("Canary: %d objects archived in %d archives, %d failed: send SIGUSR2 to continue with the rest, or stop the run",
+		canaryObjects, len(archives), atomic.LoadInt64(&ErroredFiles)))
+	select {
+	case <-canaryConfirm:
+	case <-ctx.Done():
+		return false
+	}
+	canaryDone.Store(true)
+	log.Println("Canary: confirmed, continuing")
+	return true
+}
+
+// addCanary notes an archive uploaded before the canary was confirmed.
+func addCanary(task *ArchiveFile) {
+	if canaryObjects == 0 || canaryDone.Load() {
+		return
+	}
+	canaryMu.Lock()
+	canaryArchives = append(canaryArchives, task)
+	canaryMu.Unlock()
+	atomic.AddInt64(&canaryUploaded, int64(len(task.Contents)))
+}
+
+// verifyCanary downloads an uploaded archive and its checksum file and checks
+// them against the manifest, as repack does before reusing an archive.
+func verifyCanary(ctx context.Context, task *ArchiveFile) error {
+	entries := make(map[string]*ManifestEntry, len(task.Manifest))
+	for _, entry := range task.Manifest {
+		entries[entry.Name] = entry
+	}
+	var (
+		archiveSum string
+		entrySums  map[string]string
+	)
+	if checksumSidecar {
+		dat, err := getDestObject(ctx, task.Filename+checksumExt())
+		if err != nil {
+			return err
+		}
+		if archiveSum, entrySums, err = parseChecksums(dat); err != nil {
+			return err
+		}
+	}
+
+	head, err := s3client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(dstBucket), Key: aws.String(task.Filename)})
+	if err != nil {
+		return err
+	}
+	size := aws.ToInt64(head.ContentLength)
+	tempDisk.Reserve(size)
+	defer tempDisk.Release(size)
+	path, err := downloadObjectInParts(ctx, dstBucket, task.Filename, "", size, downloadPartsFor(size))
+	if err != nil {
+		return err
+	}
+	defer deleteTempFile(path)
+	return verifyArchiveContents(task.Filename, path, checksumAlgorithms[checksumAlgorithm].new, entries, entrySums, archiveSum)
+}
+
+// pollUntil checks done every second, returning false if ctx ends first.
+func pollUntil(ctx context.Context, done func() bool) bool {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for !done() {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+var (
+	catalogPrefix = Env("CATALOG_PARQUET", "", "Prefix in DST_BUCKET to write the catalog of archived objects as Parquet files for Athena, e.g. catalog/")
+	catalogRows   = EnvInt("CATALOG_ROWS", 500000, "Rows per Parquet file of the CATALOG_PARQUET catalog")
+
+	catalogWriter *parquetWriter // Rows not yet written out
+	catalogParts  int
+	catalogFiles  []string // Catalog files written in this run
+)
+
+// catalogColumns is the schema of the Parquet catalog, the manifest data a
+// query needs to find an object in the archives.
+var catalogColumns = []parquetColumn{
+	{Name: "key", Type: parquetByteArray, Converted: parquetUTF8},
+	{Name: "size", Type: parquetInt64, Converted: -1},
+	{Name: "last_modified", Type: parquetInt64, Converted: parquetTimestampMillis, Optional: true},
+	{Name: "etag", Type: parquetByteArray, Converted: parquetUTF8, Optional: true},
+	{Name: "sha256", Type: parquetByteArray, Converted: parquetUTF8, Optional: true},
+	{Name: "checksum", Type: parquetByteArray, Converted: parquetUTF8, Optional: true},
+	{Name: "archive", Type: parquetByteArray, Converted: parquetUTF8},
+	{Name: "entry", Type: parquetByteArray, Converted: parquetUTF8},
+	{Name: "chunk", Type: parquetInt64, Converted: -1, Optional: true},
+	{Name: "scan_result", Type: parquetByteArray, Converted: parquetUTF8, Optional: true},
+	{Name: "scan_db", Type: parquetByteArray, Converted: parquetUTF8, Optional: true},
+	{Name: "exception", Type: parquetByteArray, Converted: parquetUTF8, Optional: true},
+	{Name: "deleted", Type: parquetInt64, Converted: -1},
+}
+
+func initCatalog() {
+	if catalogPrefix == "" {
+		return
+	}
+	if catalogRows <= 0 {
+		log.Fatal("CATALOG_ROWS must be positive")
+	}
+	catalogWriter = newParquetWriter(catalogColumns)
+}
+
+// addCatalog adds the entries of an uploaded archive to the catalog, writing
+// out a Parquet file every CATALOG_ROWS rows.
+func addCatalog(ctx context.Context, task *ArchiveFile) {
+	if catalogWriter == nil {
+		return
+	}
+	for _, entry := range task.Manifest {
+		// Point at the archive holding the contents
+		archive, name := task.Filename, entry.Name
+		if entry.Ref != nil {
+			archive, name = entry.Ref.Archive, entry.Ref.Name
+		}
+		var lastModified, etag, sha, checksum, chunk, scan, scanDB, exception any
+		if !entry.LastModified.IsZero() {
+			lastModified = entry.LastModified.UnixMilli()
+		}
+		if entry.ETag != "" {
+			etag = entry.ETag
+		}
+		if entry.SHA256 != "" {
+			sha = entry.SHA256
+		}
+		if entry.Checksum != "" {
+			checksum = entry.Checksum
+		}
+		if entry.Chunk != nil {
+			chunk = int64(entry.Chunk.Index)
+		}
+		if entry.Exception != "" {
+			exception = entry.Exception
+		} else if scanningEnabled && !entry.DeleteMarker {
+			// Only objects which scanned clean are in the regular archives
+			scan = "clean"
+			if db := virusScanMap["version"]; db != "" {
+				scanDB = db
+			}
+		}
+		var deleted int64
+		if entry.DeleteMarker {
+			deleted = 1
+		}
+		catalogWriter.add(entry.Key, entry.Size, lastModified, etag, sha, checksum,
+			archive, name, chunk, scan, scanDB, exception, deleted)
+	}
+	if catalogWriter.rows >= int64(catalogRows) {
+		flushCatalog(ctx)
+	}
+}
+
+// flushCatalog writes out the buffered rows as the next Parquet file under
+// CATALOG_PARQUET, partitioned by run so Athena can prune on it.  The run is
+// only in the path, as Athena refuses a partition column also in the data.
+func flushCatalog(ctx context.Context) {
+	if catalogWriter == nil || catalogWriter.rows == 0 {
+		return
+	}
+	catalogParts++
+	name := fmt.Sprintf("part-%05d.parquet", catalogParts)
+	if workMode == modeWorker {
+		name = workerID + "_" + name
+	}
+	key := path.Join(catalogPrefix, "run="+runUUID, name)
+
+	if err := os.MkdirAll(filepath.Dir(key), 0755); err != nil {
+		log.Fatalf("failed to create catalog directory: %v", err)
+	}
+	f, err := os.Create(key)
+	if err != nil {
+		log.Fatalf("failed to create catalog file: %v", err)
+	}
+	if err := catalogWriter.writeTo(f); err != nil {
+		log.Fatalf("failed to write catalog file %s: %v", key, err)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatalf("failed to write catalog file %s: %v", key, err)
+	}
+	log.Printf("Wrote catalog %s with %d rows", key, catalogWriter.rows)
+	catalogWriter = newParquetWriter(catalogColumns)
+	catalogFiles = append(catalogFiles, key)
+
+	if archiveStdout || simulating {
+		return
+	} else if exportDir != "" {
+		exportFiles([]string{key})
+	} else if err := uploadFileInParts(ctx, dstBucket, key, key, withDstAttrs(uploadAttrs{
+		ContentType: "application/vnd.apache.parquet",
+	})); err != nil {
+		log.Fatal(err)
+	}
+	os.Remove(key)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+var (
+	downloadURL       = Env("DOWNLOAD_URL", "", "Download source objects from this CloudFront or HTTPS base URL instead of from S3")
+	downloadHeader    = EnvSecret("DOWNLOAD_HEADER", "Header, as \"Name: value\", added to every DOWNLOAD_URL request")
+	downloadSignKeyID = Env("DOWNLOAD_SIGN_KEY_ID", "", "CloudFront key pair ID used to sign DOWNLOAD_URL requests")
+	downloadSignKey   = Env("DOWNLOAD_SIGN_KEY", "", "File holding the PEM RSA private key of DOWNLOAD_SIGN_KEY_ID")
+	downloadSignMode  = Env("DOWNLOAD_SIGN_MODE", "url", "Sign DOWNLOAD_URL requests with signed \"url\"s or signed \"cookie\"s")
+	downloadSignTTL   = EnvInt("DOWNLOAD_SIGN_TTL", 3600, "Seconds the DOWNLOAD_URL signatures are valid for")
+
+	cdnBase    *url.URL
+	cdnKey     *rsa.PrivateKey
+	cdnClient  = &http.Client{}
+	cdnCookies struct {
+		sync.Mutex
+		values  []*http.Cookie
+		refresh time.Time
+	}
+)
+
+func initCDN() {
+	if downloadURL == "" {
+		return
+	}
+	var err error
+	if cdnBase, err = url.Parse(strings.TrimSuffix(downloadURL, "/") + "/"); err != nil || cdnBase.Host == "" {
+		log.Fatalf("invalid DOWNLOAD_URL %q: %v", downloadURL, err)
+	}
+	if cdnBase.Scheme != "https" {
+		if fipsMode {
+			log.Fatal("DOWNLOAD_URL must be HTTPS in FIPS mode")
+		}
+		log.Printf("DOWNLOAD_URL %s is not HTTPS, objects will be fetched in the clear", cdnBase.Redacted())
+	}
+	if downloadHeader != "" && !strings.Contains(downloadHeader, ":") {
+		log.Fatal("invalid DOWNLOAD_HEADER, expected \"Name: value\"")
+	}
+	if downloadSignKeyID != "" {
+		if fipsMode {
+			// CloudFront signatures are RSA with SHA-1
+			log.Fatal("signed DOWNLOAD_URL requests cannot be made in FIPS mode")
+		}
+		if downloadSignMode != "url" && downloadSignMode != "cookie" {
+			log.Fatalf("unknown DOWNLOAD_SIGN_MODE %q, expected url or cookie", downloadSignMode)
+		}
+		pemBytes, err := os.ReadFile(downloadSignKey)
+		if err != nil {
+			log.Fatalf("failed to read DOWNLOAD_SIGN_KEY: %v", err)
+		}
+		block, _ := pem.Decode(pemBytes)
+		if block == nil {
+			log.Fatalf("no PEM key in %s", downloadSignKey)
+		}
+		if cdnKey, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			key, err8 := x509.ParsePKCS8PrivateKey(block.Bytes)
+			var ok bool
+			if cdnKey, ok = key.(*rsa.PrivateKey); err8 != nil || !ok {
+				log.Fatalf("DOWNLOAD_SIGN_KEY is not an RSA private key: %v", err)
+			}
+		}
+	}
+	log.Println("Downloading source objects from", cdnBase.Redacted())
+}
+
+// getSourceObject fetches a source object from its URL_LIST URL or
+// DOWNLOAD_URL when set, and from S3 otherwise.
+func getSourceObject(ctx context.Context, in *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	if urlList != "" && aws.ToString(in.Bucket) == srcBucket {
+		return getURLObject(ctx, in)
+	}
+	if cdnBase == nil || aws.ToString(in.Bucket) != srcBucket {
+		return s3client.GetObject(ctx, in)
+	}
+	u := *cdnBase
+	u.Path += aws.ToString(in.Key)
+	u.RawPath = ""
+	target := u.String()
+	if cdnKey != nil && downloadSignMode == "url" {
+		target = cdnSignURL(target, time.Now().Add(time.Duration(downloadSignTTL)*time.Second))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	if in.Range != nil {
+		req.Header.Set("Range", *in.Range)
+	}
+	if in.IfMatch != nil {
+		req.Header.Set("If-Match", *in.IfMatch)
+	}
+	if name, value, ok := strings.Cut(downloadHeader, ":"); ok {
+		req.Header.Set(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	if cdnKey != nil && downloadSignMode == "cookie" {
+		for _, c := range cdnSignedCookies() {
+			req.AddCookie(c)
+		}
+	}
+
+	resp, err := cdnClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	return httpObjectOutput(resp, in, cdnBase.Redacted())
+}
+
+// httpObjectOutput turns the response to an HTTP GET of a source object into
+// what S3 would have returned, with a missing object as NoSuchKey.
+func httpObjectOutput(resp *http.Response, in *s3.GetObjectInput, source string) (*s3.GetObjectOutput, error) {
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, &types.NoSuchKey{Message: aws.String(aws.ToString(in.Key) + " not found at " + source)}
+	default:
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s: %s", aws.ToString(in.Key), resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if in.Range != nil && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: range requests are not supported by %s", aws.ToString(in.Key), resp.Request.URL.Host)
+	}
+
+	out := &s3.GetObjectOutput{
+		Body:          resp.Body,
+		ContentLength: aws.Int64(resp.ContentLength),
+		ContentType:   aws.String(resp.Header.Get("Content-Type")),
+	}
+	if v := resp.Header.Get("Content-Range"); v != "" {
+		out.ContentRange = aws.String(v)
+	}
+	if v := resp.Header.Get("ETag"); v != "" {
+		out.ETag = aws.String(v)
+	}
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		out.LastModified = aws.Time(t)
+	}
+	return out, nil
+}
+
+// cdnSign returns the CloudFront signature of policy, an RSA SHA-1 signature
+// in CloudFront's URL safe base64.
+func cdnSign(policy []byte) string {
+	sum := sha1.Sum(policy)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, cdnKey, crypto.SHA1, sum[:])
+	if err != nil {
+		log.Fatalf("failed to sign DOWNLOAD_URL request: %v", err)
+	}
+	return cdnBase64(sig)
+}
+
+func cdnBase64(b []byte) string {
+	return strings.NewReplacer("+", "-", "=", "_", "/", "~").Replace(base64.StdEncoding.EncodeToString(b))
+}
+
+func cdnPolicy(resource string, expires time.Time) []byte {
+	return []byte(`{"Statement":[{"Resource":"` + resource +
+		`","Condition":{"DateLessThan":{"AWS:EpochTime":` + strconv.FormatInt(expires.Unix(), 10) + `}}}]}`)
+}
+
+// cdnSignURL signs target with a canned policy.
+func cdnSignURL(target string, expires time.Time) string {
+	sep := "?"
+	if strings.Contains(target, "?") {
+		sep = "&"
+	}
+	return target + sep + "Expires=" + strconv.FormatInt(expires.Unix(), 10) +
+		"&Signature=" + cdnSign(cdnPolicy(target, expires)) +
+		"&Key-Pair-Id=" + downloadSignKeyID
+}
+
+// cdnSignedCookies returns cookies granting access to everything under
+// DOWNLOAD_URL, renewed once half their lifetime has passed.
+func cdnSignedCookies() []*http.Cookie {
+	cdnCookies.Lock()
+	defer cdnCookies.Unlock()
+	if now := time.Now(); cdnCookies.values == nil || now.After(cdnCookies.refresh) {
+		ttl := time.Duration(downloadSignTTL) * time.Second
+		policy := cdnPolicy(cdnBase.String()+"*", now.Add(ttl))
+		cdnCookies.values = []*http.Cookie{
+			{Name: "CloudFront-Policy", Value: cdnBase64(policy)},
+			{Name: "CloudFront-Signature", Value: cdnSign(policy)},
+			{Name: "CloudFront-Key-Pair-Id", Value: downloadSignKeyID},
+		}
+		cdnCookies.refresh = now.Add(ttl / 2)
+	}
+	return cdnCookies.values
+}
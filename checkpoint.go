@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	checkpointInterval = EnvInt("CHECKPOINT_INTERVAL", 0, "Seconds between saves of the metadata read position for restarts (0 to disable)")
+
+	checkpointFileName = metadataFileName + ".checkpoint"
+	checkpointMutex    sync.Mutex
+	checkpointSaving   sync.Mutex // Held from the snapshot until its file is in place
+	checkpointActive   bool
+	checkpointState    Checkpoint
+	checkpointPending  []*checkpointLine                  // Lines sent for processing, in file order
+	checkpointKeys     = make(map[string]*checkpointLine) // Key to its pending line
+)
+
+// Checkpoint is the position in metadata.jsonl up to which every object has
+// been uploaded or logged as an error.
+type Checkpoint struct {
+	Line         int   `json:"line"`
+	Offset       int64 `json:"offset"`
+	Files        int64 `json:"files"`         // Objects selected before Offset
+	Bytes        int64 `json:"bytes"`         // Size of the objects selected before Offset
+	ArchiveCount int   `json:"archive_count"` // Last archive number opened
+	MetadataSize int64 `json:"metadata_size"` // Guards against a regenerated metadata file
+}
+
+type checkpointLine struct {
+	line   int
+	offset int64 // Offset just past the line
+	size   int64
+	done   bool
+}
+
+// loadCheckpoint returns the saved checkpoint for the metadata file, if any,
+// and starts saving new ones.
+func loadCheckpoint(metadataFile *os.File) *Checkpoint {
+	if checkpointInterval <= 0 || workMode == modeCoordinator {
+		return nil // The coordinator never learns when objects are done
+	}
+	fi, err := metadataFile.Stat()
+	if err != nil {
+		log.Fatalf("failed to stat metadata file: %v", err)
+	}
+	checkpointMutex.Lock()
+	checkpointActive = true
+	checkpointState.MetadataSize = fi.Size()
+	checkpointMutex.Unlock()
+	go func() {
+		for range time.Tick(time.Duration(checkpointInterval) * time.Second) {
+			saveCheckpoint()
+		}
+	}()
+
+	dat, err := os.ReadFile(checkpointFileName)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		log.Fatalf("failed to read checkpoint: %v", err)
+	}
+	var cp Checkpoint
+	if err := json.Unmarshal(dat, &cp); err != nil {
+		log.Fatalf("failed to unmarshal checkpoint: %v", err)
+	}
+	if cp.MetadataSize != fi.Size() {
+		log.Printf("ignoring checkpoint %s made for a different %s", checkpointFileName, metadataFileName)
+		return nil
+	}
+	log.Printf("Resuming %s from line %d", metadataFileName, cp.Line)
+
+	checkpointMutex.Lock()
+	checkpointState = cp
+	checkpointMutex.Unlock()
+	return &cp
+}
+
+// checkpointAdd tracks a line sent for processing.
+func checkpointAdd(key string, line int, offset, size int64) {
+	if !checkpointActive {
+		return
+	}
+	checkpointMutex.Lock()
+	defer checkpointMutex.Unlock()
+	l := &checkpointLine{line: line, offset: offset, size: size}
+	checkpointPending = append(checkpointPending, l)
+	checkpointKeys[key] = l
+}
+
+// checkpointFinished marks the line of key as done and moves the checkpoint
+// past every leading line which is done.
+func checkpointFinished(key string) {
+	if !checkpointActive {
+		return
+	}
+	checkpointMutex.Lock()
+	defer checkpointMutex.Unlock()
+	if l, ok := checkpointKeys[key]; ok {
+		l.done = true
+		delete(checkpointKeys, key)
+	}
+	n := 0
+	for n < len(checkpointPending) && checkpointPending[n].done {
+		l := checkpointPending[n]
+		checkpointState.Line, checkpointState.Offset = l.line, l.offset
+		checkpointState.Files++
+		checkpointState.Bytes += l.size
+		n++
+	}
+	checkpointPending = checkpointPending[n:]
+}
+
+// checkpointArchive records the number of a newly opened archive.  It is saved
+// right away so a restart never reuses the name of an uploaded archive.
+func checkpointArchive(count int) {
+	if !checkpointActive {
+		return
+	}
+	checkpointMutex.Lock()
+	// Each archive stream counts separately, the highest covers them all
+	checkpointState.ArchiveCount = max(checkpointState.ArchiveCount, count)
+	checkpointMutex.Unlock()
+	saveCheckpoint()
+}
+
+// saveCheckpoint atomically replaces the checkpoint file.  It is called from
+// the ticker, the archiver and main at once, so the saves are made one at a
+// time, each of a snapshot taken once the save before it is in place, and
+// an older snapshot can never replace a newer one.
+func saveCheckpoint() {
+	checkpointSaving.Lock()
+	defer checkpointSaving.Unlock()
+	checkpointMutex.Lock()
+	if !checkpointActive {
+		checkpointMutex.Unlock()
+		return
+	}
+	dat, _ := json.Marshal(checkpointState)
+	checkpointMutex.Unlock()
+
+	tmp := checkpointFileName + ".tmp"
+	if err := os.WriteFile(tmp, append(dat, '\n'), 0644); err != nil {
+		log.Printf("failed to write checkpoint: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, checkpointFileName); err != nil {
+		log.Printf("failed to replace checkpoint: %v", err)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"hash"
+	"hash/crc32"
+	"log"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/zeebo/blake3"
+)
+
+var checksumAlgorithm = Env("CHECKSUM_ALGORITHM", "sha256", "Digest used for checksum files, manifests and upload checksums: sha256, sha1, crc32c or blake3")
+
+// checksumInfo describes a selectable checksum algorithm.
+type checksumInfo struct {
+	new      func() hash.Hash
+	s3       types.ChecksumAlgorithm // Upload checksum, empty if S3 has no equivalent
+	approved bool                    // Usable in FIPS mode
+}
+
+var checksumAlgorithms = map[string]checksumInfo{
+	"sha256": {new: sha256.New, s3: types.ChecksumAlgorithmSha256, approved: true},
+	"sha1":   {new: sha1.New, s3: types.ChecksumAlgorithmSha1, approved: true},
+	"crc32c": {new: func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) }, s3: types.ChecksumAlgorithmCrc32c},
+	"blake3": {new: func() hash.Hash { return blake3.New() }},
+}
+
+func initChecksum() {
+	info, ok := checksumAlgorithms[checksumAlgorithm]
+	if !ok {
+		log.Fatalf("CHECKSUM_ALGORITHM must be sha256, sha1, crc32c or blake3: %q", checksumAlgorithm)
+	}
+	if fipsMode && !info.approved {
+		log.Fatalf("CHECKSUM_ALGORITHM %s is not FIPS approved", checksumAlgorithm)
+	}
+}
+
+// newChecksum returns a hash of the configured algorithm.
+func newChecksum() hash.Hash {
+	return checksumAlgorithms[checksumAlgorithm].new()
+}
+
+// checksumExt is the extension of the checksum sidecar, named after the
+// algorithm like the sha256sum family of tools.
+func checksumExt() string {
+	return "." + checksumAlgorithm
+}
+
+// uploadChecksum is the S3 checksum uploads are made with.  S3 has no
+// BLAKE3 checksum, so those uploads use CRC32C.
+func uploadChecksum() types.ChecksumAlgorithm {
+	if c := checksumAlgorithms[checksumAlgorithm].s3; c != "" {
+		return c
+	}
+	return types.ChecksumAlgorithmCrc32c
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"math/bits"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+var (
+	chunkThreshold = Env("CHUNK_THRESHOLD", "", "Split objects larger than this into content-defined chunks, each its own tar entry (empty to disable)")
+	chunkAvgSize   = Env("CHUNK_SIZE", "256M", "Average size of the chunks of objects above CHUNK_THRESHOLD, each between a quarter and four times this")
+
+	chunkAbove         int64 // Zero unless CHUNK_THRESHOLD is set
+	chunkMin, chunkMax int64
+	chunkMask          uint64
+	gearTable          [256]uint64
+	ChunkedFiles       int64
+)
+
+// ChunkInfo places an entry holding one chunk of an object split by
+// CHUNK_THRESHOLD.  The chunks of an object are restored by writing each at
+// its offset, in any order, and checking the whole against the digest.
+type ChunkInfo struct {
+	Index        int    `json:"index"`
+	Count        int    `json:"count"`
+	Offset       int64  `json:"offset"`
+	ObjectSize   int64  `json:"object_size"`
+	ObjectSHA256 string `json:"object_sha256"`
+}
+
+func initChunking() {
+	if chunkThreshold == "" {
+		return
+	}
+	var err error
+	if chunkAbove, err = parseByteSize(chunkThreshold); err != nil || chunkAbove <= 0 {
+		log.Fatalf("invalid CHUNK_THRESHOLD %q", chunkThreshold)
+	}
+	avg, err := parseByteSize(chunkAvgSize)
+	if err != nil || avg < 1<<20 {
+		log.Fatalf("invalid CHUNK_SIZE %q, must be at least 1M", chunkAvgSize)
+	}
+	// A cut point is where the top bits of the rolling hash are all zero
+	n := bits.Len64(uint64(avg)) - 1
+	chunkMask = (1<<n - 1) << (64 - n)
+	chunkMin, chunkMax = avg/4, avg*4
+
+	// The gear table is fixed, so the same contents are always cut alike
+	seed := uint64(0x9e3779b97f4a7c15)
+	for i := range gearTable {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		gearTable[i] = z ^ z>>31
+	}
+	log.Printf("Objects over %s are split into chunks of about %s", humanizeBytes(chunkAbove), humanizeBytes(avg))
+}
+
+// chunks reports whether task is split into chunks as it is archived.  Only
+// objects downloaded to temp files are large enough, and those going to the
+// exceptions archive are kept whole.
+func chunks(task *WorkFile) bool {
+	return chunkAbove > 0 && task.Size > chunkAbove && task.TempFile != "" && task.Exception == ""
+}
+
+// chunkSizes finds the content-defined cut points of the temp file of task
+// with a gear rolling hash.  It also returns the SHA-256 of the whole object
+// and, with CUSTODY_HASHES, its CHECKSUM_ALGORITHM digest.
+func chunkSizes(task *WorkFile) ([]int64, string, string, error) {
+	fh, err := openTempFile(task.TempFile)
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer fh.Close()
+	objectHash := sha256.New()
+	var w io.Writer = objectHash
+	custodyHash := newChecksum()
+	if custodyHashes {
+		w = io.MultiWriter(objectHash, custodyHash)
+	}
+	r := bufio.NewReaderSize(io.TeeReader(fh, w), 1<<20)
+
+	var (
+		sizes       []int64
+		size, total int64
+		h           uint64
+	)
+	for {
+		b, err := r.ReadByte()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, "", "", err
+		}
+		size++
+		h = h<<1 + gearTable[b]
+		if size >= chunkMax || size >= chunkMin && h&chunkMask == 0 {
+			sizes = append(sizes, size)
+			total += size
+			size, h = 0, 0
+		}
+	}
+	if size > 0 {
+		sizes = append(sizes, size)
+		total += size
+	}
+	if total != task.Size {
+		return nil, "", "", fmt.Errorf("read %d bytes, expected %d", total, task.Size)
+	}
+	var custody string
+	if custodyHashes {
+		custody = fmt.Sprintf("%x", custodyHash.Sum(nil))
+	}
+	return sizes, fmt.Sprintf("%x", objectHash.Sum(nil)), custody, nil
+}
+
+// archiveChunks writes an object above CHUNK_THRESHOLD as one tar entry per
+// chunk, named <name>.chunkNNNNN, rolling the archive between chunks at its
+// size cap so a huge object does not make a huge archive.  The object is
+// only in the contents of the archive holding its last chunk, so it is
+// logged as uploaded, or deleted, once all of its chunks are stored.
+func archiveChunks(stream *archiveStream, task *WorkFile, name string, doneCh chan<- *ArchiveFile) {
+	sizes, digest, custodySum, err := chunkSizes(task)
+	if err != nil {
+		log.Fatalf("failed to chunk %s: %v", task.Filename, err)
+	}
+	custody := custodyRecord(task, custodySum, false)
+	fh, err := openTempFile(task.TempFile)
+	if err != nil {
+		log.Fatalf("failed to open temp file %s: %v", task.TempFile, err)
+	}
+	defer fh.Close()
+
+	var offset int64
+	for i, size := range sizes {
+		if !archiveStdout && archiveBytesWritten > 0 && archiveBytesWritten+size > stream.sizeCap {
+			stream.roll(doneCh)
+			stream.open()
+		}
+		archiveClass = higherLevel(archiveClass, task.Classification)
+		archiveRetention = longerRetention(archiveRetention, task.Retention)
+
+		chunkName := uniqueEntryName(task.Filename, fmt.Sprintf("%s.chunk%05d", name, i), "")
+		header := &tar.Header{
+			Name:       chunkName,
+			Size:       size,
+			Mode:       0600,
+			ModTime:    tarTime(task.LastModified),
+			Format:     headerFormat(),
+			PAXRecords: scanRecords(task),
+		}
+		if paxTimes && !task.LastModified.IsZero() {
+			header.AccessTime = task.LastModified
+			header.ChangeTime = task.LastModified
+		}
+		if emitDirs {
+			writeDirEntries(chunkName, task.LastModified)
+		}
+		if err := archiveTar.WriteHeader(header); err != nil {
+			log.Fatalf("failed to write tar header for %s: %v", chunkName, err)
+		}
+		entryHash := newChecksum()
+		if _, err := io.CopyN(io.MultiWriter(archiveTar, entryHash), fh, size); err != nil {
+			log.Fatalf("failed to write chunk %s to tar: %v", chunkName, err)
+		}
+		archiveBytesWritten += size
+
+		entrySum := fmt.Sprintf("%x", entryHash.Sum(nil))
+		archiveSums = append(archiveSums, entrySum+"  "+chunkName)
+		entry := &ManifestEntry{
+			Key:          task.Filename,
+			Name:         chunkName,
+			Size:         size,
+			LastModified: task.LastModified,
+			ETag:         task.ETag,
+			Scan:         task.ScanResult,
+			ScanReport:   task.ScanReport,
+			Retention:    task.Retention,
+			Attributes:   task.Attrs,
+			Run:          runUUID,
+			Chunk:        &ChunkInfo{Index: i, Count: len(sizes), Offset: offset, ObjectSize: task.Size, ObjectSHA256: digest},
+		}
+		if checksumAlgorithm == "sha256" {
+			entry.SHA256 = entrySum
+		} else {
+			entry.Checksum = checksumAlgorithm + ":" + entrySum
+		}
+		if custody != nil {
+			c := *custody
+			c.Archived = entrySum
+			entry.Custody = &c
+		}
+		if i == len(sizes)-1 {
+			entry.Findings = task.Findings
+		}
+		archiveManifest = append(archiveManifest, entry)
+		offset += size
+	}
+	stream.contents = append(stream.contents, task.Filename)
+	recordStage(task.Filename, "archived", stream.tgzFile)
+	removeTempFile(task)
+	atomic.AddInt64(&ChunkedFiles, 1)
+}
+
+// lastChunk reports whether entry holds an object whole or its last chunk,
+// the one which stands for the object once all its chunks are stored.
+func lastChunk(entry *ManifestEntry) bool {
+	return entry.Chunk == nil || entry.Chunk.Index == entry.Chunk.Count-1
+}
+
+// chunkAssembly is an object split by CHUNK_THRESHOLD being put back
+// together on import from its chunks.
+type chunkAssembly struct {
+	file     *TempFile // Open for writing until the last chunk is in
+	received map[int]bool
+}
+
+// importChunks are the objects being reassembled, by key and digest.
+var importChunks = make(map[string]*chunkAssembly)
+
+// importChunk writes a chunk read from an archive into place in the temp
+// file of its object.  Once every chunk is in, the object is checked against
+// its digest, scanned, and uploaded whole.
+func importChunk(ctx context.Context, task *WorkFile, entry *ManifestEntry) error {
+	c := entry.Chunk
+	id := entry.Key + "\x00" + c.ObjectSHA256
+	a, ok := importChunks[id]
+	if !ok {
+		f, err := createTempFile("s3chunks-*")
+		if err != nil {
+			return err
+		}
+		a = &chunkAssembly{file: f, received: make(map[int]bool)}
+		importChunks[id] = a
+	}
+
+	var src io.Reader = bytes.NewReader(task.Bytes)
+	if task.TempFile != "" {
+		fh, err := openTempFile(task.TempFile)
+		if err != nil {
+			return err
+		}
+		defer fh.Close()
+		src = fh
+	}
+	if _, err := io.Copy(io.NewOffsetWriter(a.file, c.Offset), src); err != nil {
+		return err
+	}
+	a.received[c.Index] = true
+	if len(a.received) < c.Count {
+		return nil
+	}
+
+	delete(importChunks, id)
+	defer deleteTempFile(a.file.Name())
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+	whole := &WorkFile{Filename: entry.Key, Size: c.ObjectSize, TempFile: a.file.Name(), LastModified: entry.LastModified, Attrs: entry.Attributes}
+	if digest, err := contentDigest(whole, sha256.New()); err != nil {
+		return err
+	} else if digest != c.ObjectSHA256 {
+		return fmt.Errorf("reassembled %s digest %s does not match the manifest %s", entry.Key, digest, c.ObjectSHA256)
+	}
+	if scanningEnabled && scanSkipReason(whole) == "" {
+		if virus, err := scanWorkFile(whole); virus != "" || err != nil {
+			return fmt.Errorf("virus found in %s: %s %v", entry.Key, virus, err)
+		}
+	}
+	if err := uploadWorkFile(ctx, dstBucket, whole); err != nil {
+		return err
+	}
+	atomic.AddInt64(&UploadedArchivedFiles, 1)
+	return nil
+}
+
+// reportIncompleteChunks logs the objects of which some chunks were not in
+// the imported archives.
+func reportIncompleteChunks() {
+	for _, id := range slices.Sorted(maps.Keys(importChunks)) {
+		key, _, _ := strings.Cut(id, "\x00")
+		fileErrCh <- &ErrorEvent{Filename: key, Err: fmt.Errorf("only %d chunks of %s were imported, the archives holding the rest were not",
+			len(importChunks[id].received), key)}
+		importChunks[id].file.Close()
+		deleteTempFile(importChunks[id].file.Name())
+	}
+	clear(importChunks)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+var (
+	classificationTag      = Env("CLASSIFICATION_TAG", "", "Source object tag holding the data classification of the object")
+	classificationMap      = Env("CLASSIFICATION_MAP", "", "File of PREFIX LEVEL lines classifying objects by key prefix")
+	classificationLevels   = Env("CLASSIFICATION_LEVELS", "public,internal,confidential,restricted", "Classification levels, lowest first, joined by ,")
+	classificationDefault  = Env("CLASSIFICATION_DEFAULT", "", "Level of objects with no tag or mapping (defaults to the lowest level)")
+	classificationSeparate = Env("CLASSIFICATION_SEPARATE", "", "Never mix classification levels in one archive") != ""
+
+	classificationEnabled bool
+	levelRank             = map[string]int{} // Lower cased level to its rank
+	levelNames            []string           // Levels as spelled in CLASSIFICATION_LEVELS
+	classPrefixes         []classPrefix      // Longest prefix first
+)
+
+type classPrefix struct {
+	prefix, level string
+}
+
+func initClassification() {
+	if classificationTag == "" && classificationMap == "" {
+		return
+	}
+	classificationEnabled = true
+	if classificationSeparate && archiveStdout {
+		log.Fatal("CLASSIFICATION_SEPARATE cannot be used with ARCHIVE_STDOUT")
+	}
+	for _, level := range strings.Split(classificationLevels, ",") {
+		if level = strings.TrimSpace(level); level != "" {
+			levelRank[strings.ToLower(level)] = len(levelNames)
+			levelNames = append(levelNames, level)
+		}
+	}
+	if len(levelNames) == 0 {
+		log.Fatal("CLASSIFICATION_LEVELS must list at least one level")
+	}
+	if classificationDefault == "" {
+		classificationDefault = levelNames[0]
+	} else if level, ok := canonicalLevel(classificationDefault); ok {
+		classificationDefault = level
+	} else {
+		log.Fatalf("CLASSIFICATION_DEFAULT %q is not one of CLASSIFICATION_LEVELS", classificationDefault)
+	}
+
+	if classificationMap != "" {
+		fh, err := os.Open(classificationMap)
+		if err != nil {
+			log.Fatalf("failed to open CLASSIFICATION_MAP: %v", err)
+		}
+		defer fh.Close()
+		scanner := bufio.NewScanner(fh)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			i := strings.LastIndexAny(line, " \t")
+			if i < 0 {
+				log.Fatalf("CLASSIFICATION_MAP lines must be of the form PREFIX LEVEL: %q", line)
+			}
+			level, ok := canonicalLevel(line[i+1:])
+			if !ok {
+				log.Fatalf("CLASSIFICATION_MAP level %q is not one of CLASSIFICATION_LEVELS", line[i+1:])
+			}
+			classPrefixes = append(classPrefixes, classPrefix{prefix: strings.TrimSpace(line[:i]), level: level})
+		}
+		if err := scanner.Err(); err != nil {
+			log.Fatalf("failed to read CLASSIFICATION_MAP: %v", err)
+		}
+		sort.SliceStable(classPrefixes, func(i, j int) bool {
+			return len(classPrefixes[i].prefix) > len(classPrefixes[j].prefix)
+		})
+	}
+	log.Printf("Classifying objects as one of %s, default %s", strings.Join(levelNames, ", "), classificationDefault)
+}
+
+// canonicalLevel returns the level as spelled in CLASSIFICATION_LEVELS.
+func canonicalLevel(level string) (string, bool) {
+	rank, ok := levelRank[strings.ToLower(strings.TrimSpace(level))]
+	if !ok {
+		return "", false
+	}
+	return levelNames[rank], true
+}
+
+// sourceTags returns the tags of a source object when a feature needs them,
+// and nil otherwise.
+func sourceTags(ctx context.Context, key string) (map[string]string, error) {
+	if classificationTag == "" && retentionTag == "" && !recordAttributes {
+		return nil, nil
+	}
+	s3Ready.Wait() // Wait for the S3 client to be ready
+	out, err := s3client.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{
+		Bucket: aws.String(srcBucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tags of %s: %w", key, err)
+	}
+	tags := make(map[string]string, len(out.TagSet))
+	for _, tag := range out.TagSet {
+		tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+	return tags, nil
+}
+
+// classify returns the classification level of an object.  The object tag
+// takes precedence over the prefix mapping, which takes precedence over the
+// default.  An object tagged with an unknown level is an error rather than
+// being archived with less care than it asks for.
+func classify(key string, tags map[string]string) (string, error) {
+	if !classificationEnabled {
+		return "", nil
+	}
+	if value, ok := tags[classificationTag]; ok && classificationTag != "" {
+		level, ok := canonicalLevel(value)
+		if !ok {
+			return "", fmt.Errorf("object %s has unknown classification %q", key, value)
+		}
+		return level, nil
+	}
+	for _, p := range classPrefixes {
+		if strings.HasPrefix(key, p.prefix) {
+			return p.level, nil
+		}
+	}
+	return classificationDefault, nil
+}
+
+// higherLevel returns the more restrictive of two levels.
+func higherLevel(a, b string) string {
+	if a == "" || levelRank[strings.ToLower(b)] > levelRank[strings.ToLower(a)] {
+		return b
+	}
+	return a
+}
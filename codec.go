@@ -0,0 +1,109 @@
+package main
+
+import (
+	"log"
+	"maps"
+	"os"
+	"strings"
+	"time"
+)
+
+// codecInfo describes how archives written with a codec are named and served.
+type codecInfo struct {
+	exts        []string // Accepted archive name extensions, the first is the default
+	contentType string
+}
+
+var archiveCodecs = map[string]codecInfo{
+	"gzip": {exts: []string{".tgz", ".tar.gz"}, contentType: "application/gzip"},
+	"zstd": {exts: []string{".tar.zst", ".tzst"}, contentType: "application/zstd"},
+	"none": {exts: []string{".tar"}, contentType: "application/x-tar"},
+}
+
+// initArchiveName checks ARCHIVE_CODEC and makes the ARCHIVE_NAME extension
+// match it.  When ARCHIVE_NAME is not set the default extension of the codec
+// is used, and a template without an archive extension gets one appended.
+func initArchiveName() {
+	info, ok := archiveCodecs[archiveCodec]
+	if !ok {
+		log.Fatalf("unknown ARCHIVE_CODEC %q, must be gzip, zstd or none", archiveCodec)
+	}
+	if os.Getenv("ARCHIVE_NAME") == "" {
+		ArchiveName = strings.TrimSuffix(ArchiveName, ".tgz") + info.exts[0]
+		return
+	}
+	ext := archiveExt(ArchiveName)
+	if ext == "" {
+		ArchiveName += info.exts[0]
+		log.Printf("ARCHIVE_NAME has no archive extension, using %s", ArchiveName)
+		return
+	}
+	for _, e := range info.exts {
+		if ext == e {
+			return
+		}
+	}
+	log.Fatalf("ARCHIVE_NAME %q ends in %s which does not match ARCHIVE_CODEC %s, use %s",
+		ArchiveName, ext, archiveCodec, strings.Join(info.exts, " or "))
+}
+
+// archiveExt returns the archive extension of name, if any.
+func archiveExt(name string) string {
+	var found string
+	for _, info := range archiveCodecs {
+		for _, e := range info.exts {
+			if strings.HasSuffix(name, e) && len(e) > len(found) {
+				found = e
+			}
+		}
+	}
+	for _, e := range []string{".zip", ".gz", ".zst"} {
+		if found == "" && strings.HasSuffix(name, e) {
+			found = e
+		}
+	}
+	return found
+}
+
+// scanMetadata is the virus scan metadata set on an archive and its
+// sidecars.  An exceptions archive holds the objects which failed, so its
+// result is fail rather than the pass of the scanner.
+func scanMetadata(exceptions bool) map[string]string {
+	if !exceptions || virusScanMap["result"] == "" {
+		return virusScanMap
+	}
+	m := maps.Clone(virusScanMap)
+	m["result"] = "fail"
+	return m
+}
+
+// archiveAttrs returns the attributes of an uploaded archive.
+func archiveAttrs(task *ArchiveFile) uploadAttrs {
+	attrs := uploadAttrs{
+		ContentType: archiveCodecs[archiveCodec].contentType,
+		Metadata:    map[string]string{"compression": archiveCodec},
+	}
+	for k, v := range scanMetadata(task.Exceptions) {
+		attrs.Metadata[k] = v
+	}
+	attrs.Tags = map[string]string{}
+	if task.Exceptions {
+		attrs.Metadata["archive-type"] = "exceptions"
+		attrs.Tags["archive-type"] = "exceptions"
+	}
+	if task.Classification != "" {
+		attrs.Metadata["classification"] = task.Classification
+		attrs.Tags["classification"] = task.Classification
+	}
+	if r := task.Retention; r != nil {
+		if r.Class != "" {
+			attrs.Metadata["retention-class"] = r.Class
+			attrs.Tags["retention-class"] = r.Class
+		}
+		if !r.Expires.IsZero() {
+			attrs.Metadata["retention-expires"] = r.Expires.Format(time.DateOnly)
+			attrs.Tags["retention-expires"] = r.Expires.Format(time.DateOnly)
+		}
+	}
+	return withDstAttrs(attrs)
+}
@@ -12,23 +12,30 @@ var (
 		New: func() interface{} {
 			return make([]byte, 32*1024)
 		},
-	} // bufPool is a sync.Pool to reuse byte slices for copying data
-	bufPoolLarge = sync.Pool{
-		New: func() interface{} {
-			return make([]byte, maxMemObject*1024)
-		},
 	}
 )
 
 func Env(env, def, usage string) string {
 	if e := os.Getenv(env); len(e) > 0 {
-		fmt.Printf("  %-30s # %s\n", fmt.Sprintf("%s=%q", env, e), usage)
+		printSetting(env, e, false, usage)
 		return e
 	}
-	fmt.Printf("  %-30s # %s\n", fmt.Sprintf("%s=%q (default)", env, def), usage)
+	printSetting(env, def, true, usage)
 	return def
 }
 
+// EnvSecret reads a setting like Env, but prints only whether it is set, so
+// keys and credentials never reach the log.
+func EnvSecret(env, usage string) string {
+	e := os.Getenv(env)
+	if len(e) > 0 {
+		printSetting(env, "(set)", false, usage)
+	} else {
+		printSetting(env, "(not set)", true, usage)
+	}
+	return e
+}
+
 func EnvInt(env string, def int, usage string) int {
 	valStr := os.Getenv(env)
 	if valStr != "" {
@@ -38,10 +45,10 @@ func EnvInt(env string, def int, usage string) int {
 			fmt.Fprintf(os.Stderr, "Invalid integer for %s: %q\n", env, valStr)
 			os.Exit(1)
 		}
-		fmt.Printf("  %-30s # %s\n", fmt.Sprintf("%s=%d", env, val), usage)
+		printSetting(env, val, false, usage)
 		return val
 	}
-	fmt.Printf("  %-30s # %s\n", fmt.Sprintf("%s=%d (default)", env, def), usage)
+	printSetting(env, def, true, usage)
 	return def
 }
 
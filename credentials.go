@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+)
+
+var (
+	credentialProviders = Env("CREDENTIAL_PROVIDERS", "env,web,imds", "Credential sources tried in order: env (AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY), web (AWS_WEB_IDENTITY_TOKEN_FILE and AWS_ROLE_ARN, as set for IRSA on EKS), imds (the EC2 instance role)")
+
+	credentialExpiryWindow time.Duration // How long before they expire credentials are refreshed
+)
+
+// credentialChain uses the first of its sources which has credentials.
+type credentialChain struct {
+	names     []string
+	providers []aws.CredentialsProvider
+}
+
+// newCredentialChain builds the sources of CREDENTIAL_PROVIDERS, in order.
+func newCredentialChain(imdsClient *imds.Client) credentialChain {
+	var chain credentialChain
+	for _, name := range strings.Split(credentialProviders, ",") {
+		var p aws.CredentialsProvider
+		switch name = strings.TrimSpace(name); name {
+		case "env":
+			p = aws.CredentialsProviderFunc(envCredentials)
+		case "web":
+			p = aws.CredentialsProviderFunc(webIdentityCredentials)
+		case "imds":
+			p = ec2rolecreds.New(func(o *ec2rolecreds.Options) {
+				o.Client = imdsClient
+			})
+		default:
+			log.Fatalf("unknown credential provider %q in CREDENTIAL_PROVIDERS, expected env, web or imds", name)
+		}
+		chain.names = append(chain.names, name)
+		chain.providers = append(chain.providers, p)
+	}
+	return chain
+}
+
+// uses reports whether the chain includes the named source.
+func (c credentialChain) uses(name string) bool {
+	for _, n := range c.names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (c credentialChain) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	var errs []error
+	for i, p := range c.providers {
+		creds, err := p.Retrieve(ctx)
+		if err == nil {
+			if debug {
+				log.Printf("Using %s credentials, expiring %v", c.names[i], creds.Expires)
+			}
+			return creds, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", c.names[i], err))
+	}
+	return aws.Credentials{}, fmt.Errorf("no credentials from CREDENTIAL_PROVIDERS: %w", errors.Join(errs...))
+}
+
+// envCredentials reads the static credentials of the environment.  They are
+// read directly, rather than with Env, so the secret is never printed.
+func envCredentials(context.Context) (aws.Credentials, error) {
+	creds := aws.Credentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		Source:          "environment",
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return aws.Credentials{}, errors.New("AWS_ACCESS_KEY_ID or AWS_SECRET_ACCESS_KEY not set")
+	}
+	return creds, nil
+}
+
+// webIdentityCredentials exchanges the token of AWS_WEB_IDENTITY_TOKEN_FILE
+// for the credentials of AWS_ROLE_ARN, as the EKS pod identity webhook sets
+// up for IAM Roles for Service Accounts.  The file is read again on every
+// refresh as the token is rotated.
+func webIdentityCredentials(ctx context.Context) (aws.Credentials, error) {
+	tokenFile, roleARN := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"), os.Getenv("AWS_ROLE_ARN")
+	if tokenFile == "" || roleARN == "" {
+		return aws.Credentials{}, errors.New("AWS_WEB_IDENTITY_TOKEN_FILE or AWS_ROLE_ARN not set")
+	}
+	token, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return aws.Credentials{}, err
+	}
+	session := os.Getenv("AWS_ROLE_SESSION_NAME")
+	if session == "" {
+		session = "archiver-" + workerID
+	}
+	session = sessionNameInvalid.ReplaceAllString(session, "-")
+
+	var out struct {
+		Result struct {
+			Credentials struct {
+				AccessKeyId     string
+				SecretAccessKey string
+				SessionToken    string
+				Expiration      time.Time
+			}
+		} `xml:"AssumeRoleWithWebIdentityResult"`
+	}
+	params := url.Values{}
+	params.Set("RoleArn", roleARN)
+	params.Set("RoleSessionName", session[:min(len(session), 64)])
+	params.Set("WebIdentityToken", strings.TrimSpace(string(token)))
+	// The token is the proof of identity, the request is not signed
+	if err := awsQueryCall(ctx, nil, "sts", "2011-06-15", "AssumeRoleWithWebIdentity", params, &out); err != nil {
+		return aws.Credentials{}, fmt.Errorf("failed to assume role %s with web identity: %w", roleARN, err)
+	}
+	c := out.Result.Credentials
+	return aws.Credentials{
+		AccessKeyID:     c.AccessKeyId,
+		SecretAccessKey: c.SecretAccessKey,
+		SessionToken:    c.SessionToken,
+		Source:          "WebIdentity",
+		CanExpire:       true,
+		Expires:         c.Expiration,
+	}, nil
+}
+
+// newCredentialsCache caches the credentials of p until shortly before they
+// expire.  Concurrent requests share a single retrieval and keep signing with
+// the cached credentials meanwhile, so transfers in flight are undisturbed.
+func newCredentialsCache(p aws.CredentialsProvider) *aws.CredentialsCache {
+	return aws.NewCredentialsCache(earlyExpiry{p})
+}
+
+// earlyExpiry brings the expiry of credentials forward by
+// CREDENTIAL_EXPIRY_WINDOW, but by no more than half their lifetime, so
+// short-lived credentials are still cached rather than fetched again for
+// every request.  A quarter of the window is jitter, so workers started
+// together refresh apart.
+type earlyExpiry struct {
+	aws.CredentialsProvider
+}
+
+func (e earlyExpiry) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	creds, err := e.CredentialsProvider.Retrieve(ctx)
+	if err != nil || !creds.CanExpire {
+		return creds, err
+	}
+	window := max(min(credentialExpiryWindow, time.Until(creds.Expires)/2), 0)
+	window -= time.Duration(rand.Int64N(int64(window/4) + 1))
+	creds.Expires = creds.Expires.Add(-window)
+	return creds, nil
+}
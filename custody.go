@@ -0,0 +1,51 @@
+package main
+
+import (
+	"log"
+)
+
+var custodyHashes = Env("CUSTODY_HASHES", "", "Hash each object after download, after scanning and as written into the tar, recording all three in the manifest") != ""
+
+// CustodyDigests are the CHECKSUM_ALGORITHM digests of an object taken as it
+// moves through the pipeline, so the stage at which any corruption happened
+// can be pinpointed.
+type CustodyDigests struct {
+	Downloaded string `json:"downloaded"`
+	Scanned    string `json:"scanned,omitempty"`
+	Archived   string `json:"archived"`
+}
+
+// custodyDigest returns the digest of the current contents of task, or an
+// empty string when CUSTODY_HASHES is off.
+func custodyDigest(task *WorkFile) string {
+	if !custodyHashes {
+		return ""
+	}
+	digest, err := contentDigest(task, newChecksum())
+	if err != nil {
+		log.Printf("failed to digest %s: %v", task.Filename, err)
+	}
+	return digest
+}
+
+// custodyRecord completes the digests of task with the digest of the bytes
+// written into the tar and reports any stage at which they changed.  Entries
+// rewritten by TRANSFORM_CMD or dictionary compression are expected to differ.
+func custodyRecord(task *WorkFile, archived string, compressed bool) *CustodyDigests {
+	if !custodyHashes {
+		return nil
+	}
+	c := task.Custody
+	c.Archived = archived
+	before := c.Downloaded
+	if c.Scanned != "" {
+		if c.Scanned != c.Downloaded {
+			log.Printf("custody: %s changed between download and scan: %s != %s", task.Filename, c.Downloaded, c.Scanned)
+		}
+		before = c.Scanned
+	}
+	if !task.Transformed && !compressed && before != c.Archived {
+		log.Printf("custody: %s changed before it was written into the tar: %s != %s", task.Filename, before, c.Archived)
+	}
+	return &c
+}
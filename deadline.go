@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	perObjectTimeout = time.Duration(EnvInt("PER_OBJECT_TIMEOUT", 0, "Seconds an object may spend being downloaded, scanned and transformed before it is abandoned and logged as an error (0 for no limit)")) * time.Second
+
+	TimedOutFiles int64
+)
+
+func initObjectTimeout() {
+	if perObjectTimeout < 0 {
+		log.Fatalf("invalid PER_OBJECT_TIMEOUT %s", perObjectTimeout)
+	}
+	if perObjectTimeout > 0 {
+		log.Printf("Objects are abandoned after %s of work on them", perObjectTimeout)
+	}
+}
+
+// objectContext bounds the work of a stage on an object by the time the
+// object has left, given the time spent on it by the stages before.
+func objectContext(ctx context.Context, spent time.Duration) (context.Context, context.CancelFunc) {
+	if perObjectTimeout == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, perObjectTimeout-spent)
+}
+
+// objectErr marks err as the object being abandoned when ctx ran out of the
+// time given by objectContext.
+func objectErr(ctx context.Context, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		atomic.AddInt64(&TimedOutFiles, 1)
+		return fmt.Errorf("abandoned after PER_OBJECT_TIMEOUT of %s: %w", perObjectTimeout, err)
+	}
+	return err
+}
+
+// runWithin runs work, which cannot be cancelled, on the object of task for
+// the time it has left.  When the time runs out it returns false at once,
+// and work is left to finish in the background before cleanup is called.
+func runWithin(task *WorkFile, work, cleanup func()) bool {
+	if perObjectTimeout == 0 {
+		work()
+		return true
+	}
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		work()
+	}()
+	timer := time.NewTimer(perObjectTimeout - task.Spent)
+	defer timer.Stop()
+	select {
+	case <-done:
+		task.Spent += time.Since(start)
+		return true
+	case <-timer.C:
+		atomic.AddInt64(&TimedOutFiles, 1)
+		go func() {
+			<-done
+			cleanup()
+		}()
+		return false
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestRunWithinAbandonsSlowWork checks that work running past
+// PER_OBJECT_TIMEOUT is abandoned at once and cleaned up when it returns.
+func TestRunWithinAbandonsSlowWork(t *testing.T) {
+	perObjectTimeout = time.Second
+	defer func() { perObjectTimeout = 0 }()
+
+	task := &WorkFile{Filename: "slow", Spent: 900 * time.Millisecond}
+	release, cleaned := make(chan struct{}), make(chan struct{})
+	start := time.Now()
+	if runWithin(task, func() { <-release }, func() { close(cleaned) }) {
+		t.Fatal("work past the deadline was not abandoned")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("abandoned after %s, want the 100ms left", elapsed)
+	}
+	select {
+	case <-cleaned:
+		t.Fatal("cleaned up while the work was still running")
+	default:
+	}
+	close(release)
+	select {
+	case <-cleaned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not cleaned up once the work returned")
+	}
+
+	task.Spent = 0
+	if !runWithin(task, func() {}, func() { t.Error("finished work was cleaned up") }) {
+		t.Error("work within the deadline was abandoned")
+	}
+}
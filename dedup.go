@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	dedupIndexFile = Env("DEDUP_INDEX", "", "Persistent content-hash index file used to skip objects archived by earlier runs")
+	dedupTable     = Env("DEDUP_TABLE", "", "DynamoDB table keyed by sha256 holding the content-hash index shared by all workers")
+
+	dedupIndex   map[string]*DedupRef // Content digest to the entry already holding it
+	dedupMutex   sync.Mutex
+	DedupedFiles int64
+)
+
+// DedupRef points to the archive entry which already holds some content.
+type DedupRef struct {
+	Archive string `json:"archive"`
+	Name    string `json:"name"`
+}
+
+// dedupRecord is one line of the DEDUP_INDEX file.
+type dedupRecord struct {
+	SHA256 string `json:"sha256"`
+	DedupRef
+}
+
+// loadDedupIndex reads the index left by previous runs into memory.
+func loadDedupIndex() {
+	if dedupIndexFile == "" && dedupTable == "" {
+		return
+	}
+	dedupIndex = make(map[string]*DedupRef)
+	if dedupIndexFile != "" {
+		loadDedupFile()
+	}
+	if dedupTable != "" {
+		loadDedupTable()
+	}
+}
+
+// loadDedupFile reads the DEDUP_INDEX file.
+func loadDedupFile() {
+	f, err := os.Open(dedupIndexFile)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		log.Fatalf("failed to open dedup index: %v", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec dedupRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			log.Printf("failed to unmarshal dedup index line %q: %v", scanner.Text(), err)
+			continue
+		}
+		ref := rec.DedupRef
+		dedupIndex[rec.SHA256] = &ref
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatalf("error reading dedup index: %v", err)
+	}
+	log.Printf("Loaded %d entries from dedup index %s", len(dedupIndex), dedupIndexFile)
+}
+
+// The DEDUP_TABLE has a string partition key "sha256", and each item the
+// "archive" and "name" of the entry holding the contents.
+
+// loadDedupTable scans the DEDUP_TABLE.  Entries in the table win over those
+// of the file, as other workers refer to them.
+func loadDedupTable() {
+	var (
+		startKey stateItem
+		count    int
+	)
+	for {
+		in := map[string]any{
+			"TableName":      dedupTable,
+			"ConsistentRead": true,
+		}
+		if startKey != nil {
+			in["ExclusiveStartKey"] = startKey
+		}
+		var out struct {
+			Items            []stateItem
+			LastEvaluatedKey stateItem
+		}
+		if err := awsJSONCall(context.Background(), "dynamodb", "1.0", "DynamoDB_20120810.Scan", in, &out); err != nil {
+			log.Fatalf("failed to scan dedup table: %v", err)
+		}
+		for _, item := range out.Items {
+			dedupIndex[item["sha256"]["S"]] = &DedupRef{Archive: item["archive"]["S"], Name: item["name"]["S"]}
+			count++
+		}
+		if out.LastEvaluatedKey == nil {
+			break
+		}
+		startKey = out.LastEvaluatedKey
+	}
+	log.Printf("Loaded %d entries from dedup table %s", count, dedupTable)
+}
+
+// contentDigest returns the hex digest with h of the contents of task.
+func contentDigest(task *WorkFile, h hash.Hash) (string, error) {
+	if task.TempFile == "" {
+		h.Write(task.Bytes)
+	} else {
+		fh, err := openTempFile(task.TempFile)
+		if err != nil {
+			return "", err
+		}
+		defer fh.Close()
+		if _, err := io.Copy(h, fh); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// findDedup returns the entry already holding the content, if any.
+func findDedup(digest string) *DedupRef {
+	dedupMutex.Lock()
+	defer dedupMutex.Unlock()
+	return dedupIndex[digest]
+}
+
+// addDedup registers an archive entry as the holder of the content so later
+// objects in this run can reference it.
+func addDedup(digest string, archive, name string) {
+	dedupMutex.Lock()
+	defer dedupMutex.Unlock()
+	dedupIndex[digest] = &DedupRef{Archive: archive, Name: name}
+}
+
+// recordDedup adds the entries stored by an uploaded archive to the index
+// file w, when not nil, and to the DEDUP_TABLE.
+func recordDedup(w *os.File, task *ArchiveFile) {
+	for _, entry := range task.Manifest {
+		if entry.SHA256 == "" || entry.Ref != nil {
+			continue
+		}
+		ref := DedupRef{Archive: task.Filename, Name: entry.Name}
+		if w != nil {
+			dat, _ := json.Marshal(dedupRecord{SHA256: entry.SHA256, DedupRef: ref})
+			fmt.Fprintf(w, "%s\n", dat)
+		}
+		if dedupTable != "" {
+			putDedup(entry.SHA256, ref)
+		}
+	}
+}
+
+// putDedup adds an entry to the DEDUP_TABLE unless the contents are already
+// there, so when workers store the same contents at once the first one to be
+// uploaded is the one all later runs refer to.
+func putDedup(digest string, ref DedupRef) {
+	err := awsJSONCall(context.Background(), "dynamodb", "1.0", "DynamoDB_20120810.PutItem", map[string]any{
+		"TableName": dedupTable,
+		"Item": stateItem{
+			"sha256":  {"S": digest},
+			"archive": {"S": ref.Archive},
+			"name":    {"S": ref.Name},
+		},
+		"ConditionExpression": "attribute_not_exists(sha256)",
+	}, nil)
+	var apiErr *awsAPIError
+	if errors.As(err, &apiErr) && strings.HasSuffix(apiErr.Type, "ConditionalCheckFailedException") {
+		return
+	} else if err != nil {
+		log.Printf("failed to add %s to dedup table: %v", digest, err)
+	}
+}
+
+// dropDedupTable removes the entries of the DEDUP_TABLE held by the given
+// archives, unless another worker has since pointed them elsewhere.
+func dropDedupTable(refs map[string]*DedupRef, archives map[string]bool) {
+	if dedupTable == "" {
+		return
+	}
+	for digest, ref := range refs {
+		if !archives[ref.Archive] {
+			continue
+		}
+		err := awsJSONCall(context.Background(), "dynamodb", "1.0", "DynamoDB_20120810.DeleteItem", map[string]any{
+			"TableName":                 dedupTable,
+			"Key":                       stateItem{"sha256": {"S": digest}},
+			"ConditionExpression":       "#a = :a",
+			"ExpressionAttributeNames":  map[string]string{"#a": "archive"},
+			"ExpressionAttributeValues": stateItem{":a": {"S": ref.Archive}},
+		}, nil)
+		var apiErr *awsAPIError
+		if err != nil && !(errors.As(err, &apiErr) && strings.HasSuffix(apiErr.Type, "ConditionalCheckFailedException")) {
+			log.Printf("Repack: failed to drop %s from dedup table: %v", digest, err)
+		}
+	}
+}
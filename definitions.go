@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	clamav "github.com/hexahigh/go-clamav"
+)
+
+var (
+	definitionsMirror  = Env("DEFINITIONS_MIRROR", "", "HTTP(S) URL or s3://bucket/prefix of a mirror the ClamAV definitions are fetched from into DEFINITIONS")
+	definitionsFiles   = Env("DEFINITIONS_FILES", "main.cvd,daily.cvd,bytecode.cvd", "Definition files fetched from DEFINITIONS_MIRROR")
+	definitionsRefresh = EnvInt("DEFINITIONS_REFRESH", 0, "Minutes between checks of DEFINITIONS_MIRROR for newer definitions, which are loaded without stopping (0 to only fetch at startup)")
+
+	definitionsPath string // Directory of the definitions, DEFINITIONS
+	clamavDBVersion string // Version of the definitions loaded, as recorded in the scan metadata
+)
+
+func initDefinitions() {
+	if definitionsMirror == "" {
+		if definitionsRefresh > 0 {
+			clamLog.Fatal("DEFINITIONS_REFRESH needs DEFINITIONS_MIRROR")
+		}
+		return
+	}
+	if !scanningEnabled || !strings.Contains(scannerBackend, "libclamav") {
+		clamLog.Fatal("DEFINITIONS_MIRROR only applies to SCANNER_BACKEND=libclamav, clamd and ICAP services update their own")
+	}
+	if u, err := url.Parse(definitionsMirror); err != nil || (u.Scheme != "https" && u.Scheme != "http" && u.Scheme != "s3") {
+		clamLog.Fatalf("DEFINITIONS_MIRROR must be an http(s):// or s3:// URL: %q", definitionsMirror)
+	}
+}
+
+// updateDefinitions fetches the definition files which changed on the
+// mirror since they were last fetched.  A file is only put in place once
+// ClamAV has checked its signature, and only if it is newer than the one
+// there, so a stale mirror cannot roll the definitions back.  It reports
+// whether any file was replaced.
+func updateDefinitions() (bool, error) {
+	var changed bool
+	for _, name := range strings.Split(definitionsFiles, ",") {
+		dest := filepath.Join(definitionsPath, name)
+		var since time.Time
+		if info, err := os.Stat(dest); err == nil {
+			since = info.ModTime()
+		}
+		tmp := filepath.Join(definitionsPath, "."+name+".tmp")
+		modified, err := fetchDefinition(name, tmp, since)
+		if err != nil {
+			os.Remove(tmp)
+			return changed, fmt.Errorf("%s: %w", name, err)
+		}
+		if modified.IsZero() {
+			continue // Unchanged on the mirror
+		}
+		if err := new(clamav.Clamav).CvdVerify(tmp); err != nil {
+			os.Remove(tmp)
+			return changed, fmt.Errorf("%s failed verification: %w", name, err)
+		}
+		version, _ := cvdVersion(tmp)
+		if current, ok := cvdVersion(dest); ok && version <= current {
+			os.Remove(tmp)
+			os.Chtimes(dest, modified, modified) // Not fetched again until it changes
+			clamLog.Printf("Mirror has %s version %d, keeping version %d", name, version, current)
+			continue
+		}
+		if err := os.Rename(tmp, dest); err != nil {
+			os.Remove(tmp)
+			return changed, err
+		}
+		os.Chtimes(dest, modified, modified)
+		clamLog.Printf("Fetched %s version %d from %s", name, version, definitionsMirror)
+		changed = true
+	}
+	return changed, nil
+}
+
+// fetchDefinition downloads name from the mirror to dest if it was modified
+// after since, returning when it was modified, or the zero time if it was
+// not downloaded.
+func fetchDefinition(name, dest string, since time.Time) (time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+	var (
+		body     io.ReadCloser
+		modified time.Time
+	)
+	if rest, ok := strings.CutPrefix(definitionsMirror, "s3://"); ok {
+		s3Ready.Wait() // Wait for the S3 client to be ready
+		bucket, prefix, _ := strings.Cut(rest, "/")
+		key := strings.TrimPrefix(path.Join(prefix, name), "/")
+		head, err := s3client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+		if err != nil {
+			return time.Time{}, err
+		}
+		if !aws.ToTime(head.LastModified).After(since) {
+			return time.Time{}, nil
+		}
+		out, err := s3client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key), IfMatch: head.ETag})
+		if err != nil {
+			return time.Time{}, err
+		}
+		body, modified = out.Body, aws.ToTime(out.LastModified)
+	} else {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(definitionsMirror, "/")+"/"+name, nil)
+		if err != nil {
+			return time.Time{}, err
+		}
+		// The official mirrors turn away clients not looking like freshclam
+		req.Header.Set("User-Agent", "ClamAV/1.0 (bucket-archiver/"+version+")")
+		if !since.IsZero() {
+			req.Header.Set("If-Modified-Since", since.UTC().Format(http.TimeFormat))
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return time.Time{}, err
+		}
+		switch resp.StatusCode {
+		case http.StatusOK:
+		case http.StatusNotModified:
+			resp.Body.Close()
+			return time.Time{}, nil
+		default:
+			resp.Body.Close()
+			return time.Time{}, fmt.Errorf("%s", resp.Status)
+		}
+		body = resp.Body
+		modified, err = http.ParseTime(resp.Header.Get("Last-Modified"))
+		if err != nil {
+			modified = time.Now()
+		}
+	}
+	defer body.Close()
+	f, err := os.Create(dest)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if _, err := io.Copy(f, body); err != nil {
+		f.Close()
+		return time.Time{}, err
+	}
+	return modified, f.Close()
+}
+
+// cvdVersion reads the version from the header of a CVD or CLD file,
+// "ClamAV-VDB:<build time>:<version>:<signatures>:...".
+func cvdVersion(path string) (int, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+	header := make([]byte, 512)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return 0, false
+	}
+	fields := strings.Split(string(bytes.TrimRight(header, " \x00")), ":")
+	if len(fields) < 3 || fields[0] != "ClamAV-VDB" {
+		return 0, false
+	}
+	v, err := strconv.Atoi(fields[2])
+	return v, err == nil
+}
+
+// refreshDefinitions checks the mirror every DEFINITIONS_REFRESH minutes
+// and, when newer definitions were fetched, compiles an engine with them and
+// swaps it in.  The scans under way finish with the old engine, and new
+// ones wait for the swap.  The scan cache is cleared, as its verdicts were
+// made with the old definitions.
+func refreshDefinitions() {
+	for range time.Tick(time.Duration(definitionsRefresh) * time.Minute) {
+		changed, err := updateDefinitions()
+		if err != nil {
+			clamLog.Printf("Could not refresh the definitions from %s: %v", definitionsMirror, err)
+		}
+		if !changed {
+			continue
+		}
+		engine, dbVersion, dbTime, err := newClamavEngine()
+		if err != nil {
+			clamLog.Printf("Could not reload the definitions, scanning on with DB version %s: %v", clamavDBVersion, err)
+			continue
+		}
+		clamavEngine.Lock()
+		old := clamavInstance
+		clamavInstance = engine
+		setClamavVersion(fmt.Sprintf("%d", dbVersion), dbTime)
+		resetScanCache()
+		clamavEngine.Unlock()
+		old.Free()
+		clamLog.Printf("Reloaded ClamAV with DB version %d of %s", dbVersion, dbTime)
+	}
+}
+
+// setClamavVersion records the version of the definitions loaded in the
+// scan metadata.  The map is replaced rather than changed, as it is read
+// without a lock by the uploads under way.
+func setClamavVersion(db string, date time.Time) {
+	scanEngines.Lock()
+	defer scanEngines.Unlock()
+	m := maps.Clone(virusScanMap)
+	if clamavDBVersion != "" {
+		// Among the versions of other engines, with several
+		versions := strings.Split(m["version"], "+")
+		for i := range versions {
+			if versions[i] == clamavDBVersion {
+				versions[i] = db
+				break
+			}
+		}
+		m["version"] = strings.Join(versions, "+")
+	}
+	m["signature_date"] = date.Format(time.RFC3339)
+	virusScanMap = m
+	clamavDBVersion = db
+}
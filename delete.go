@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+var (
+	deleteSource  = Env("DELETE_SOURCE", "", "Delete source objects once the archive holding them is uploaded") != ""
+	replicaBucket = Env("REPLICA_BUCKET", "", "Only delete source objects which also exist, unchanged, in this replica or backup bucket")
+	replicaPrefix = Env("REPLICA_PREFIX", "", "Prefix of the source keys in REPLICA_BUCKET")
+
+	DeletedFiles  int64 // Source objects deleted
+	RetainedFiles int64 // Source objects kept as they failed a check or were transformed
+)
+
+func initDelete() {
+	if !deleteSource {
+		if replicaBucket != "" {
+			log.Fatal("REPLICA_BUCKET is only used with DELETE_SOURCE")
+		}
+		return
+	}
+	if archiveStdout {
+		log.Fatal("DELETE_SOURCE cannot be used with ARCHIVE_STDOUT, the stream is not known to be stored")
+	}
+	if transformCmd != "" {
+		log.Printf("DELETE_SOURCE is set with TRANSFORM_CMD: objects matching %q will be kept", transformMatch)
+	}
+	if replicaBucket == "" {
+		log.Println("DELETE_SOURCE is set: archived objects will be deleted from", srcBucket)
+	} else {
+		log.Printf("DELETE_SOURCE is set: archived objects also in %s will be deleted from %s", replicaBucket, srcBucket)
+	}
+}
+
+// deleteArchived deletes the source objects held by an uploaded archive.
+// Each object is first checked to be unchanged since it was archived, and
+// with REPLICA_BUCKET against its replica, and kept if either check fails.
+// Objects rewritten by TRANSFORM_CMD are always kept, as the archive does
+// not hold their original contents.  The delete is conditional on the ETag
+// the check found, so an object overwritten after it is removed only if
+// its contents are still those archived.
+func deleteArchived(ctx context.Context, task *ArchiveFile) {
+	if !deleteSource {
+		return
+	}
+	ids := make([]types.ObjectIdentifier, 0, len(task.Manifest))
+	var (
+		mu  sync.Mutex
+		wg  sync.WaitGroup
+		sem = make(chan struct{}, 16)
+	)
+	for _, entry := range task.Manifest {
+		if !lastChunk(entry) || entry.DeleteMarker {
+			continue // The object is deleted with its last chunk, or already gone
+		}
+		if transforms(entry.Key) {
+			atomic.AddInt64(&RetainedFiles, 1)
+			continue // Rewritten on purpose, so the archive is not a copy
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(entry *ManifestEntry) {
+			defer func() { <-sem; wg.Done() }()
+			src, err := checkUnchanged(ctx, entry)
+			if err == nil && replicaBucket != "" {
+				err = verifyReplica(ctx, entry, src)
+			}
+			if err != nil {
+				log.Printf("Refusing to delete %s: %v", entry.Key, err)
+				atomic.AddInt64(&RetainedFiles, 1)
+				return
+			}
+			mu.Lock()
+			ids = append(ids, types.ObjectIdentifier{Key: aws.String(entry.Key), ETag: src.ETag})
+			mu.Unlock()
+		}(entry)
+	}
+	wg.Wait()
+
+	s3Ready.Wait() // Wait for the S3 client to be ready
+	for len(ids) > 0 {
+		batch := ids[:min(len(ids), 1000)] // The most DeleteObjects accepts
+		ids = ids[len(batch):]
+		out, err := s3client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(srcBucket),
+			Delete: &types.Delete{Objects: batch, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			log.Printf("failed to delete %d source objects of %s: %v", len(batch), task.Filename, err)
+			continue
+		}
+		for _, e := range out.Errors {
+			log.Printf("failed to delete source object %s: %s", aws.ToString(e.Key), aws.ToString(e.Message))
+		}
+		atomic.AddInt64(&DeletedFiles, int64(len(batch)-len(out.Errors)))
+	}
+}
+
+// checkUnchanged heads the source object and checks that it still has the
+// LastModified and ETag recorded in the manifest when it was archived.  An
+// entry recording neither cannot be checked, so it is never deleted.
+func checkUnchanged(ctx context.Context, entry *ManifestEntry) (*s3.HeadObjectOutput, error) {
+	if entry.LastModified.IsZero() && entry.ETag == "" {
+		return nil, fmt.Errorf("the manifest records no LastModified or ETag to check the source against")
+	}
+	s3Ready.Wait() // Wait for the S3 client to be ready
+	src, err := s3client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:       aws.String(srcBucket),
+		Key:          aws.String(entry.Key),
+		ChecksumMode: types.ChecksumModeEnabled,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to head source: %w", err)
+	}
+	if !entry.LastModified.IsZero() && !aws.ToTime(src.LastModified).Equal(entry.LastModified) {
+		return nil, fmt.Errorf("source was modified at %s after being archived", aws.ToTime(src.LastModified))
+	}
+	etag, want := strings.Trim(aws.ToString(src.ETag), `"`), strings.Trim(entry.ETag, `"`)
+	if want != "" && etag != want {
+		return nil, fmt.Errorf("source ETag %s differs from %s when archived", etag, want)
+	}
+	return src, nil
+}
+
+// verifyReplica checks that the replica of a source object, already checked
+// to be unchanged, has the same size and checksum, or ETag when the two
+// copies share no checksum.
+func verifyReplica(ctx context.Context, entry *ManifestEntry, src *s3.HeadObjectOutput) error {
+	replica, err := s3client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:       aws.String(replicaBucket),
+		Key:          aws.String(replicaPrefix + entry.Key),
+		ChecksumMode: types.ChecksumModeEnabled,
+	})
+	if err != nil {
+		return fmt.Errorf("not found in replica %s: %w", replicaBucket, err)
+	}
+	if aws.ToInt64(src.ContentLength) != aws.ToInt64(replica.ContentLength) {
+		return fmt.Errorf("replica is %d bytes, source is %d", aws.ToInt64(replica.ContentLength), aws.ToInt64(src.ContentLength))
+	}
+	// Prefer a checksum both copies carry to the ETag, which also depends on
+	// how the object was uploaded
+	for _, sum := range []struct {
+		name            string
+		source, replica *string
+	}{
+		{"SHA256", src.ChecksumSHA256, replica.ChecksumSHA256},
+		{"SHA1", src.ChecksumSHA1, replica.ChecksumSHA1},
+		{"CRC32C", src.ChecksumCRC32C, replica.ChecksumCRC32C},
+		{"CRC32", src.ChecksumCRC32, replica.ChecksumCRC32},
+	} {
+		if sum.source != nil && sum.replica != nil {
+			if *sum.source != *sum.replica {
+				return fmt.Errorf("replica %s checksum %s differs from source %s", sum.name, *sum.replica, *sum.source)
+			}
+			return nil
+		}
+	}
+	if aws.ToString(src.ETag) != aws.ToString(replica.ETag) {
+		return fmt.Errorf("replica ETag %s differs from source %s", aws.ToString(replica.ETag), aws.ToString(src.ETag))
+	}
+	return nil
+}
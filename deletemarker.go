@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+var (
+	recordDeleteMarkers = Env("RECORD_DELETE_MARKERS", "", "In a versioned SRC_BUCKET, archive a .deleted tombstone for each key whose latest version is a delete marker, which import deletes again") != ""
+
+	DeleteMarkerFiles int64
+)
+
+// initDeleteMarkers checks the delete markers can be found, which takes a
+// listing of the object versions as well as of the objects.
+func initDeleteMarkers() {
+	if !recordDeleteMarkers {
+		return
+	}
+	if workList != "" || urlList != "" {
+		log.Fatal("RECORD_DELETE_MARKERS needs the bucket listing and cannot be used with WORK_LIST or URL_LIST")
+	}
+	log.Println("Keys whose latest version is a delete marker are archived as tombstones")
+}
+
+// listDeleteMarkers calls fn with an entry for each key under prefix whose
+// latest version is a delete marker.  Every version of every key is listed to
+// find them, so this is slow in a bucket with a long history.
+func listDeleteMarkers(ctx context.Context, bucket string, prefix, delimiter *string, fn func(MetaEntry)) error {
+	paginator := s3.NewListObjectVersionsPaginator(s3client, &s3.ListObjectVersionsInput{
+		Bucket:    aws.String(bucket),
+		Prefix:    prefix,
+		Delimiter: delimiter,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, marker := range page.DeleteMarkers {
+			if marker.Key == nil || !aws.ToBool(marker.IsLatest) {
+				continue
+			}
+			entry := MetaEntry{Key: *marker.Key, DeleteMarker: true}
+			if marker.LastModified != nil {
+				entry.LastModified = *marker.LastModified
+			}
+			fn(entry)
+		}
+	}
+	return nil
+}
+
+// importDeleteMarker deletes a key from DST_BUCKET as its tombstone is
+// imported, so the restored bucket matches the source at archive time.
+func importDeleteMarker(ctx context.Context, key string) error {
+	out, err := s3client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+		Bucket: aws.String(dstBucket),
+		Delete: &types.Delete{Objects: []types.ObjectIdentifier{{Key: aws.String(key)}}, Quiet: aws.Bool(true)},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete %s: %w", key, err)
+	}
+	if len(out.Errors) > 0 {
+		return fmt.Errorf("failed to delete %s: %s", key, aws.ToString(out.Errors[0].Message))
+	}
+	return nil
+}
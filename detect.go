@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/remeh/sizedwaitgroup"
+)
+
+var (
+	detectRuleNames   = Env("DETECT", "", "Secret and PII detection rules to run before archiving, as all or a list joined by ,")
+	detectRulesFile   = Env("DETECT_RULES", "", "File of additional NAME REGEX detection rules")
+	detectAction      = Env("DETECT_ACTION", "flag", "What to do with files with findings: flag, drop or quarantine")
+	detectQuarantine  = Env("DETECT_QUARANTINE_PREFIX", "quarantine/", "Destination prefix for quarantined files")
+	detectEntropy     = Env("DETECT_ENTROPY", "4.5", "Bits per character above which a token is reported by the entropy rule")
+	concurrentDetects = EnvInt("CONCURRENT_DETECTORS", 2, "How many files can be inspected at once")
+
+	detectRules     []*detectRule
+	entropyRule     bool    // The entropy rule is not a regex and is run separately
+	entropyMinimum  float64 // Parsed DETECT_ENTROPY
+	detectionActive bool
+
+	DetectedFiles int64 // Files with at least one finding
+)
+
+// detectRule finds one kind of sensitive data in file contents.
+type detectRule struct {
+	name string
+	re   *regexp.Regexp
+}
+
+// DetectFinding records which rule matched a file, how often, and where it
+// first matched.  The matched text itself is never recorded.
+type DetectFinding struct {
+	Rule   string `json:"rule"`
+	Count  int    `json:"count"`
+	Offset int64  `json:"offset"`
+}
+
+// builtinDetectRules are available by name in DETECT.
+var builtinDetectRules = []struct{ name, pattern string }{
+	{"ssn", `\b\d{3}-\d{2}-\d{4}\b`},
+	{"aws-access-key", `\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`},
+	{"aws-secret-key", `(?i)aws.{0,20}secret.{0,20}[=:]\s*["']?[A-Za-z0-9/+]{40}\b`},
+	{"private-key", `-----BEGIN (?:[A-Z]+ )?PRIVATE KEY-----`},
+	{"github-token", `\bgh[pousr]_[A-Za-z0-9]{36,}\b`},
+	{"slack-token", `\bxox[abprs]-[A-Za-z0-9-]{10,}`},
+	{"password", `(?i)\b(?:password|passwd|pwd|secret|api[_-]?key|access[_-]?token)\s*[=:]\s*["']?[^\s"']{8,}`},
+}
+
+// entropyToken matches the base64 and hex like runs the entropy rule measures.
+var entropyToken = regexp.MustCompile(`[A-Za-z0-9+/=_-]{20,}`)
+
+const (
+	detectChunk   = 1 << 20 // Contents are inspected a chunk at a time
+	detectOverlap = 4 << 10 // Matches may span the end of a chunk by this much
+)
+
+func initDetect() {
+	if detectRuleNames == "" && detectRulesFile == "" {
+		return
+	}
+	switch detectAction {
+	case "flag", "drop":
+	case "quarantine":
+		if exportDir != "" {
+			log.Fatal("DETECT_ACTION=quarantine uploads to DST_BUCKET and cannot be used with EXPORT_DIR")
+		}
+	default:
+		log.Fatalf("DETECT_ACTION must be flag, drop or quarantine: %q", detectAction)
+	}
+	var err error
+	if entropyMinimum, err = strconv.ParseFloat(detectEntropy, 64); err != nil {
+		log.Fatalf("failed to parse DETECT_ENTROPY: %v", err)
+	}
+
+	for _, name := range strings.Split(detectRuleNames, ",") {
+		name = strings.TrimSpace(name)
+		switch name {
+		case "":
+			continue
+		case "all":
+			for _, r := range builtinDetectRules {
+				detectRules = append(detectRules, &detectRule{name: r.name, re: regexp.MustCompile(r.pattern)})
+			}
+			entropyRule = true
+			continue
+		case "entropy":
+			entropyRule = true
+			continue
+		}
+		found := false
+		for _, r := range builtinDetectRules {
+			if r.name == name {
+				detectRules = append(detectRules, &detectRule{name: r.name, re: regexp.MustCompile(r.pattern)})
+				found = true
+			}
+		}
+		if !found {
+			log.Fatalf("unknown DETECT rule %q", name)
+		}
+	}
+
+	if detectRulesFile != "" {
+		fh, err := os.Open(detectRulesFile)
+		if err != nil {
+			log.Fatalf("failed to open DETECT_RULES: %v", err)
+		}
+		defer fh.Close()
+		scanner := bufio.NewScanner(fh)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			name, pattern, ok := strings.Cut(line, " ")
+			if !ok {
+				log.Fatalf("DETECT_RULES lines must be of the form NAME REGEX: %q", line)
+			}
+			re, err := regexp.Compile(strings.TrimSpace(pattern))
+			if err != nil {
+				log.Fatalf("invalid DETECT_RULES pattern for %s: %v", name, err)
+			}
+			detectRules = append(detectRules, &detectRule{name: name, re: re})
+		}
+		if err := scanner.Err(); err != nil {
+			log.Fatalf("failed to read DETECT_RULES: %v", err)
+		}
+	}
+	detectionActive = true
+	log.Printf("Detecting %s, files with findings are %s", strings.Join(detectRuleList(), ", "), map[string]string{
+		"flag": "flagged in the manifest", "drop": "dropped", "quarantine": "moved to " + detectQuarantine,
+	}[detectAction])
+}
+
+// detectRuleList returns the names of the rules in use.
+func detectRuleList() []string {
+	var names []string
+	for _, r := range detectRules {
+		names = append(names, r.name)
+	}
+	if entropyRule {
+		names = append(names, "entropy")
+	}
+	return names
+}
+
+// Detector listens for WorkFile on tasksCh, inspects the contents with the
+// detection rules, and sends them on to doneCh.  Depending on DETECT_ACTION
+// files with findings are passed on with the findings attached, dropped, or
+// uploaded under DETECT_QUARANTINE_PREFIX instead of being archived.
+func Detector(ctx context.Context, tasksCh <-chan *WorkFile, doneCh chan<- *WorkFile) {
+	log.Println("Starting detector...")
+	swg := sizedwaitgroup.New(concurrentDetects)
+	defer close(doneCh) // Ensure doneCh is closed when the function exits
+
+	for {
+		select {
+		case <-ctx.Done():
+			break
+		case task, ok := <-tasksCh:
+			if debug {
+				log.Printf("Detector task: %#v %v\n", task, ok)
+			}
+
+			if !ok {
+				swg.Wait()
+				Println("Closing detector...")
+				return
+			}
+			if task.Exception != "" || task.DeleteMarker {
+				doneCh <- task // Archived as it failed, or has no contents
+				continue
+			}
+
+			swg.Add()
+			go func(task *WorkFile) {
+				defer swg.Done()
+				detectStage.begin()
+				defer detectStage.end()
+
+				findings, err := detectFile(task)
+				if err == nil && len(findings) == 0 {
+					doneCh <- task
+					return
+				}
+				if err == nil {
+					atomic.AddInt64(&DetectedFiles, 1)
+					var rules []string
+					for _, f := range findings {
+						rules = append(rules, f.Rule)
+					}
+					log.Printf("detect: %s matched %s", task.Filename, strings.Join(rules, ", "))
+					if detectAction == "flag" {
+						task.Findings = findings
+						doneCh <- task
+						return
+					}
+					err = fmt.Errorf("%s matched detection rules %s", task.Filename, strings.Join(rules, ", "))
+					if detectAction == "quarantine" {
+						quarantined := *task
+						quarantined.Filename = detectQuarantine + task.Filename
+						if qerr := uploadWorkFile(ctx, dstBucket, &quarantined); qerr != nil {
+							err = fmt.Errorf("%v, quarantine failed: %v", err, qerr)
+						} else {
+							err = fmt.Errorf("%v, quarantined as %s", err, quarantined.Filename)
+						}
+					}
+					err = noRetry(err) // The rules would match again
+				}
+				// The file will not be archived
+				if task.TempFile == "" {
+					if task.Bytes != nil {
+						putMemory(task.Bytes)
+					}
+				} else {
+					removeTempFile(task)
+				}
+				fileErrCh <- &ErrorEvent{
+					Size:     task.Size,
+					Filename: task.Filename,
+					Err:      err,
+				}
+			}(task)
+		}
+	}
+}
+
+// windowStart moves the start of the next chunk back from limit to just
+// after a whitespace, or failing that a byte which is no part of a token, so
+// that rules anchored with \b do not match from the middle of a word.  A
+// token filling the whole overlap is cut at limit.
+func windowStart(chunk []byte, limit int) int {
+	from := max(limit-detectOverlap, 0)
+	if i := bytes.LastIndexAny(chunk[from:limit], " \t\r\n"); i >= 0 {
+		return from + i + 1
+	}
+	for i := limit; i > from; i-- {
+		if c := chunk[i-1]; !isTokenByte(c) {
+			return i
+		}
+	}
+	return limit
+}
+
+// isTokenByte reports whether c can be part of a word or of the tokens the
+// entropy rule measures.
+func isTokenByte(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("+/=_-", c) >= 0
+}
+
+// detectFile runs the detection rules over the contents of task, a chunk at
+// a time, and returns the findings ordered by rule name.
+func detectFile(task *WorkFile) ([]*DetectFinding, error) {
+	var in io.Reader
+	if task.TempFile == "" {
+		in = bytes.NewReader(task.Bytes)
+	} else {
+		fh, err := openTempFile(task.TempFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open temp file: %w", err)
+		}
+		defer fh.Close()
+		in = fh
+	}
+
+	found := map[string]*DetectFinding{}
+	record := func(rule string, offset int64) {
+		if f, ok := found[rule]; ok {
+			f.Count++
+		} else {
+			found[rule] = &DetectFinding{Rule: rule, Count: 1, Offset: offset}
+		}
+	}
+
+	var (
+		buf  = make([]byte, detectOverlap+detectChunk)
+		kept int   // Bytes carried over from the previous chunk
+		base int64 // Offset of buf[0] in the file
+	)
+	for {
+		n, err := io.ReadFull(in, buf[kept:])
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return nil, err
+		}
+		chunk := buf[:kept+n]
+
+		// Matches starting in the tail are left for the next chunk, which
+		// also holds whatever follows them and starts on a token boundary
+		limit := len(chunk)
+		if !last {
+			limit = windowStart(chunk, len(chunk)-detectOverlap)
+		}
+		for _, r := range detectRules {
+			for _, m := range r.re.FindAllIndex(chunk, -1) {
+				if m[0] < limit {
+					record(r.name, base+int64(m[0]))
+				}
+			}
+		}
+		if entropyRule {
+			for _, m := range entropyToken.FindAllIndex(chunk, -1) {
+				if m[0] < limit && shannonEntropy(chunk[m[0]:m[1]]) >= entropyMinimum {
+					record("entropy", base+int64(m[0]))
+				}
+			}
+		}
+		if last {
+			break
+		}
+		kept = copy(buf, chunk[limit:])
+		base += int64(limit)
+	}
+
+	var findings []*DetectFinding
+	for _, f := range found {
+		findings = append(findings, f)
+	}
+	sort.Slice(findings, func(i, j int) bool { return findings[i].Rule < findings[j].Rule })
+	return findings, nil
+}
+
+// shannonEntropy returns the entropy of b in bits per byte.
+func shannonEntropy(b []byte) float64 {
+	var counts [256]int
+	for _, c := range b {
+		counts[c]++
+	}
+	var h float64
+	for _, n := range counts {
+		if n > 0 {
+			p := float64(n) / float64(len(b))
+			h -= p * math.Log2(p)
+		}
+	}
+	return h
+}
@@ -4,43 +4,106 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"strconv"
 	"sync/atomic"
-
-	"github.com/remeh/sizedwaitgroup"
+	"time"
 )
 
 // DownloadTask represents a file to download.
 type DownloadTask struct {
-	Size     int64
-	Filename string
+	Size         int64
+	Filename     string
+	LastModified time.Time
+	ETag         string       // ETag when listed, downloads fail if the object has changed since
+	Exception    string       // Why the object goes to the exceptions archive, if it does
+	DeleteMarker bool         // Only a tombstone is archived, the key is deleted
+	StorageClass string       // As listed, empty for STANDARD
+	Attrs        *ObjectAttrs // Attributes headed ahead of the download with ENRICH
 }
 
 // WorkFile represents a file that has been downloaded.
 type WorkFile struct {
-	Size     int64
-	Filename string
+	Size         int64
+	Filename     string
+	LastModified time.Time
+	ETag         string // ETag of the downloaded contents, if known
 
 	TempFile string // Temporary file path if the file is large.
 	Bytes    []byte // If the file is small, we can keep it in memory.
+
+	OutputReserve int64 // Temp disk reserved at download for the TRANSFORM_CMD output
+
+	Transformed    bool             // Contents were rewritten by TRANSFORM_CMD
+	Custody        CustodyDigests   // Digests taken at each stage with CUSTODY_HASHES
+	Classification string           // Data classification level, if enabled
+	Findings       []*DetectFinding // Matches of the DETECT rules
+	Retention      *Retention       // Retention policy of the object, if enabled
+	Attrs          *ObjectAttrs     // Attributes of the object with RECORD_ATTRIBUTES
+	Exception      string           // Why the object goes to the exceptions archive, if it does
+	Spent          time.Duration    // Time spent on the object so far, for PER_OBJECT_TIMEOUT
+	DeleteMarker   bool             // A tombstone of a deleted key, with no contents
+	ScanResult     string           // Verdict of the virus scan, for TAR_PAX_SCAN
+	ScanReport     *ScanReport      // The scan in full, for the manifest and scan report
+}
+
+func getMemory(size int64) []byte {
+	// Function to grab memory from the appropriate arena based on size
+	if size <= 32*1024 {
+		return smallArena.get()
+	}
+	if size <= int64(largeArena.size) {
+		return largeArena.get()
+	}
+	// Objects too large for the arena buffers are left to the garbage
+	// collector, putMemory ignores them
+	return make([]byte, size)
 }
 
 func putMemory(mem []byte) {
-	// Function to return memory to the appropriate buffer pool based on size
-	mem = mem[:cap(mem)]
-	if len(mem) <= 32*1024 {
-		bufPool32.Put(mem)
-	} else {
-		bufPoolLarge.Put(mem)
+	// Function to return memory to the arena it came from
+	if !smallArena.put(mem) {
+		largeArena.put(mem)
 	}
 }
 
-var maxMemObject = int64(EnvInt("MAX_IN_MEM", 96, "Maximum in memory object in kb"))
+var (
+	maxMemBytes      = parseMaxInMem(Env("MAX_IN_MEM", "96", "Largest object kept in memory rather than a temp file, in KiB or with a unit such as 4M"))
+	multipartMinSize = parseMultipartThreshold(Env("MULTIPART_THRESHOLD", "8M", "Objects larger than this are downloaded to temp files in parallel ranged parts"))
+
+	smallObjectSize      = Env("SMALL_OBJECT_SIZE", "16K", "Objects up to this size use the small object download lane (0 to disable)")
+	concurrentSmall      = EnvInt("CONCURRENT_SMALL_DOWNLOADS", 64, "How many small objects can be downloaded at once")
+	smallBatchSize       = EnvInt("SMALL_BATCH", 64, "Most small objects sent to the archiver at once")
+	smallObjectSizeLimit int64
+)
 
 // Downloader listens for DownloadTask on tasksCh, downloads them, and sends DownloadedFile to doneCh.
-func Downloader(ctx context.Context, tasksCh <-chan *DownloadTask, doneCh chan<- *WorkFile) {
+// Small objects needing no stage but the scan are scanned in their lane
+// and sent straight to the archiver, in batches on smallCh.  A nil smallCh
+// sends every object to doneCh.
+func Downloader(ctx context.Context, tasksCh <-chan *DownloadTask, doneCh chan<- *WorkFile, smallCh chan<- []*WorkFile) {
 	log.Println("Starting downloader...")
-	swg := sizedwaitgroup.New(16) // Limit to 16 concurrent downloading parts
-	defer close(doneCh)           // Ensure doneCh is closed when the function exits
+	defer close(doneCh) // Ensure doneCh is closed when the function exits
+
+	var smallDone chan *WorkFile // Small objects bound straight for the archiver
+	batched := make(chan struct{})
+	if smallCh != nil {
+		smallDone = make(chan *WorkFile, concurrentSmall)
+		go batchSmallFiles(smallDone, smallCh, batched)
+	} else {
+		close(batched)
+	}
+
+	// Small objects are dominated by per-request latency rather than
+	// bandwidth, so they get their own, wider, lane which large multi-part
+	// downloads cannot starve.
+	var err error
+	smallObjectSizeLimit, err = parseByteSize(smallObjectSize)
+	if err != nil {
+		log.Fatalf("failed to parse SMALL_OBJECT_SIZE: %v", err)
+	}
+	if smallObjectSizeLimit > maxMemBytes {
+		smallObjectSizeLimit = maxMemBytes // The lane downloads to memory only
+	}
 
 	for {
 		select {
@@ -51,49 +114,85 @@ func Downloader(ctx context.Context, tasksCh <-chan *DownloadTask, doneCh chan<-
 				log.Printf("Download task: %#v %v\n", task, ok)
 			}
 			if !ok {
-				swg.Wait()
+				downloadParts.Wait()
+				smallDownloads.Wait()
+				if smallDone != nil {
+					close(smallDone)
+				}
+				<-batched
 				Println("Closing downloader...")
 				return
 			}
 
-			parts := 1
-			if task.Size > 8*1024*1024 {
-				// If file is larger than 8MB, download in parts
-				parts = 8
+			if task.DeleteMarker {
+				// Nothing to download, the archive only records the deletion
+				doneCh <- &WorkFile{Filename: task.Filename, LastModified: task.LastModified, DeleteMarker: true}
+				continue
 			}
-			for i := 0; i < parts; i++ {
-				swg.Add() // Add to the sized wait group for each part
+
+			lane := downloadParts // 16 concurrent downloading parts unless tuned
+			if task.Size > 0 && task.Size <= smallObjectSizeLimit {
+				lane = smallDownloads
 			}
 
-			go func(task *DownloadTask, parts int) {
+			parts := downloadPartsFor(task.Size)
+			lane.Add(parts) // Take a slot of the lane for each part
+
+			go func(task *DownloadTask, parts int, lane *tunedGroup) {
 				defer func() {
 					for i := 0; i < parts; i++ {
-						swg.Done() // Mark the part as done
+						lane.Done() // Mark the part as done
 					}
 				}()
+				downloadStage.begin()
+				defer downloadStage.end()
+				// Cancelled if the watchdog restarts stalled downloads, or at PER_OBJECT_TIMEOUT
+				start := time.Now()
+				ctx, cancel := objectContext(downloadStage.context(ctx), 0)
+				defer cancel()
+
+				tags, err := sourceTags(ctx, task.Filename)
+				var (
+					class     string
+					retention *Retention
+					attrs     *ObjectAttrs
+				)
+				if err == nil {
+					if class, err = classify(task.Filename, tags); err == nil {
+						if retention, err = retentionFor(task, tags); err == nil {
+							attrs, err = sourceAttrs(ctx, task, tags)
+						}
+					}
+				}
+				if err != nil {
+					// An object which cannot be classified cannot be placed in an archive
+					fileErrCh <- &ErrorEvent{Size: task.Size, Filename: task.Filename, Err: objectErr(ctx, err)}
+					return
+				}
 
 				if task.Size == 0 {
 					// Empty files just head a header
-					doneCh <- &WorkFile{Size: task.Size, Filename: task.Filename}
-				} else if task.Size <= maxMemObject*1024 { // If file is less than 32KB, download it in memory.
-					// Use a buffer pool to reuse memory for small files
-					// bufPool32 is for files <= 32KB, bufPoolLarge is for large files
+					wf := &WorkFile{Size: task.Size, Filename: task.Filename, LastModified: task.LastModified, ETag: task.ETag,
+						Classification: class, Retention: retention, Attrs: attrs, Exception: task.Exception}
+					wf.Custody.Downloaded = custodyDigest(wf)
+					wf.Spent = time.Since(start)
+					// Recorded before it is sent, so STATE_FILE never has a later stage first
+					recordStage(task.Filename, "downloaded", "")
+					doneCh <- wf
+				} else if task.Size <= maxMemBytes { // If file is no larger than MAX_IN_MEM, download it in memory.
+					// Use an arena to reuse memory for small files
+					// smallArena is for files <= 32KB, largeArena is for large files
 					// This avoids frequent memory allocations and deallocations.
-					var mem []byte
-					if task.Size <= 32*1024 {
-						mem = bufPool32.Get().([]byte)
-					} else {
-						mem = bufPoolLarge.Get().([]byte)
-					}
+					mem := getMemory(task.Size)
 
 					// If the file size is small enough, we can download it directly in memory
-					n, err := downloadObjectToBuffer(ctx, srcBucket, task.Filename, mem)
+					n, err := downloadObjectToBuffer(ctx, srcBucket, task.Filename, task.ETag, mem)
 					if err != nil {
 						// Log the error and continue to the next file
 						fileErrCh <- &ErrorEvent{
 							Size:     task.Size,
 							Filename: task.Filename,
-							Err:      fmt.Errorf("Error downloading object %s to memory: %v", task.Filename, err),
+							Err:      objectErr(ctx, fmt.Errorf("Error downloading object %s to memory: %v", task.Filename, err)),
 						}
 						putMemory(mem)
 						return
@@ -110,25 +209,123 @@ func Downloader(ctx context.Context, tasksCh <-chan *DownloadTask, doneCh chan<-
 					}
 					// Successfully downloaded the file to memory
 					// Send the downloaded file to doneCh
-					doneCh <- &WorkFile{Size: task.Size, Filename: task.Filename,
-						Bytes: mem[:n]} // Use the buffer directly as Filebytes
+					wf := &WorkFile{Size: task.Size, Filename: task.Filename, LastModified: task.LastModified, ETag: task.ETag,
+						Bytes: mem[:n], Classification: class, Retention: retention, Attrs: attrs, Exception: task.Exception} // Use the buffer directly as Filebytes
+					if err := verifyDownload(ctx, wf); err != nil {
+						fileErrCh <- &ErrorEvent{Size: task.Size, Filename: task.Filename, Err: objectErr(ctx, err)}
+						putMemory(mem)
+						return
+					}
+					wf.Custody.Downloaded = custodyDigest(wf)
+					wf.Spent = time.Since(start)
+					recordStage(task.Filename, "downloaded", "")
+					switch {
+					case smallDone == nil || lane != smallDownloads || !archivesDirect(wf):
+						doneCh <- wf
+					case scanningEnabled:
+						scanInline(wf, smallDone) // Skipping the hand over to the Scanner
+					default:
+						smallDone <- wf
+					}
 				} else {
-					tempFilePath, err := downloadObjectInParts(ctx, srcBucket, task.Filename, task.Size, parts)
+					// Wait for room on the local disk, for a transformed copy too.
+					// The transformer cannot wait for room itself, as the files
+					// holding the disk may be queued behind it.
+					var outputReserve int64
+					if transforms(task.Filename) {
+						outputReserve = task.Size
+					}
+					tempDisk.Reserve(task.Size + outputReserve)
+					tempFilePath, err := downloadObjectInParts(ctx, srcBucket, task.Filename, task.ETag, task.Size, parts)
 					if err != nil {
+						tempDisk.Release(task.Size + outputReserve)
 						// Log the error and continue to the next file
 						fileErrCh <- &ErrorEvent{
 							Size:     task.Size,
 							Filename: task.Filename,
-							Err:      fmt.Errorf("Error downloading object %s to temporary file: %v", task.Filename, err),
+							Err:      objectErr(ctx, fmt.Errorf("Error downloading object %s to temporary file: %v", task.Filename, err)),
 						}
 						return
 					}
 					// Successfully downloaded the file to a temporary file
 					// Send the downloaded file to doneCh
-					doneCh <- &WorkFile{Size: task.Size, Filename: task.Filename, TempFile: tempFilePath}
+					wf := &WorkFile{Size: task.Size, Filename: task.Filename, LastModified: task.LastModified, ETag: task.ETag, TempFile: tempFilePath,
+						OutputReserve: outputReserve, Classification: class, Retention: retention, Attrs: attrs, Exception: task.Exception}
+					if err := verifyDownload(ctx, wf); err != nil {
+						fileErrCh <- &ErrorEvent{Size: task.Size, Filename: task.Filename, Err: objectErr(ctx, err)}
+						removeTempFile(wf)
+						return
+					}
+					wf.Custody.Downloaded = custodyDigest(wf)
+					wf.Spent = time.Since(start)
+					recordStage(task.Filename, "downloaded", "")
+					doneCh <- wf
 				}
 				atomic.AddInt64(&DownloadedFiles, 1)
-			}(task, parts)
+			}(task, parts, lane)
 		}
 	}
 }
+
+// archivesDirect tells whether a small object can go from its download lane
+// straight to the archiver: it must need none of the stages between but the
+// scan, which the lane makes itself from memory.
+func archivesDirect(task *WorkFile) bool {
+	return task.TempFile == "" && !transforms(task.Filename) && !detectionActive
+}
+
+// batchSmallFiles gathers the objects of the small lane into batches for the
+// archiver, which then takes one channel receive for many objects.  A batch
+// is sent once full, or as soon as no more objects are waiting, so a trickle
+// of objects is never held back.  out is closed, and done, once in is.
+func batchSmallFiles(in <-chan *WorkFile, out chan<- []*WorkFile, done chan<- struct{}) {
+	defer close(done)
+	defer close(out)
+	for task := range in {
+		batch := append(make([]*WorkFile, 0, smallBatchSize), task)
+	fill:
+		for len(batch) < smallBatchSize {
+			select {
+			case task, ok := <-in:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, task)
+			default:
+				break fill
+			}
+		}
+		out <- batch
+	}
+}
+
+// parseMaxInMem reads MAX_IN_MEM, a plain number being KiB as it always was.
+func parseMaxInMem(s string) int64 {
+	if kb, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return kb * 1024
+	}
+	size, err := parseByteSize(s)
+	if err != nil {
+		log.Fatalf("failed to parse MAX_IN_MEM: %v", err)
+	}
+	return size
+}
+
+// parseMultipartThreshold reads MULTIPART_THRESHOLD.
+func parseMultipartThreshold(s string) int64 {
+	size, err := parseByteSize(s)
+	if err != nil || size <= 0 {
+		log.Fatalf("invalid MULTIPART_THRESHOLD %q", s)
+	}
+	return size
+}
+
+// downloadPartsFor returns the number of ranged parts an object of the
+// size is downloaded in: one up to MULTIPART_THRESHOLD, eight above it.
+// Objects kept in memory are fetched with a single GET.
+func downloadPartsFor(size int64) int {
+	if size > multipartMinSize && size > maxMemBytes {
+		return 8
+	}
+	return 1
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"log"
+	"maps"
+	"strings"
+)
+
+var (
+	dstTagList      = Env("DST_TAGS", "", "Tags set on the archives and other files uploaded to DST_BUCKET, as KEY=VALUE joined by ,")
+	dstMetadataList = Env("DST_METADATA", "", "User metadata set on the archives and other files uploaded to DST_BUCKET, as KEY=VALUE joined by ,")
+
+	dstTags, dstMetadata map[string]string
+)
+
+// archiveTagKeys are the tags archiveAttrs may set itself, which leaves the
+// rest of the 10 S3 allows an object for DST_TAGS.
+var archiveTagKeys = []string{"archive-type", "classification", "retention-class", "retention-expires"}
+
+// initDstAttrs parses DST_TAGS and DST_METADATA.
+func initDstAttrs() {
+	dstTags = parseKeyValues("DST_TAGS", dstTagList)
+	dstMetadata = parseKeyValues("DST_METADATA", dstMetadataList)
+	if n := len(dstTags); n > 10-len(archiveTagKeys) {
+		log.Fatalf("DST_TAGS has %d tags, at most %d fit beside those of the archiver in the 10 S3 allows", n, 10-len(archiveTagKeys))
+	}
+	for k, v := range dstTags {
+		if len(k) > 128 || len(v) > 256 {
+			log.Fatalf("DST_TAGS tag %q is too long, keys are at most 128 characters and values 256", k)
+		}
+	}
+	lower := make(map[string]string)
+	for k, v := range dstMetadata {
+		lower[strings.ToLower(k)] = v // S3 keeps user metadata names in lower case
+	}
+	dstMetadata = lower
+	if len(dstTags) > 0 || len(dstMetadata) > 0 {
+		log.Printf("Uploads to DST_BUCKET get %d tags and %d metadata fields", len(dstTags), len(dstMetadata))
+	}
+}
+
+// parseKeyValues parses a list of KEY=VALUE joined by commas.
+func parseKeyValues(name, list string) map[string]string {
+	m := make(map[string]string)
+	for _, field := range strings.Split(list, ",") {
+		if strings.TrimSpace(field) == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(field, "=")
+		if key = strings.TrimSpace(key); !ok || key == "" {
+			log.Fatalf("invalid %s entry %q, expected KEY=VALUE", name, field)
+		}
+		m[key] = strings.TrimSpace(value)
+	}
+	return m
+}
+
+// withDstAttrs adds DST_TAGS and DST_METADATA to the attributes of a file
+// uploaded to DST_BUCKET.  Those the archiver sets itself, such as the scan
+// result or classification, are kept.
+func withDstAttrs(attrs uploadAttrs) uploadAttrs {
+	if len(dstTags) > 0 {
+		tags := maps.Clone(dstTags)
+		maps.Copy(tags, attrs.Tags)
+		attrs.Tags = tags
+	}
+	if len(dstMetadata) > 0 {
+		metadata := maps.Clone(dstMetadata)
+		maps.Copy(metadata, attrs.Metadata)
+		attrs.Metadata = metadata
+	}
+	return attrs
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	enrichObjects = Env("ENRICH", "", "Head each object in a stage ahead of the downloads, recording its headers, user metadata and checksums in the manifest") != ""
+	enrichBatch   = EnvInt("ENRICH_BATCH", 32, "Objects headed at once by the ENRICH stage")
+	enrichRate    = EnvInt("ENRICH_RATE", 100, "HeadObject requests per second of the ENRICH stage (0 for no limit)")
+
+	EnrichedFiles int64
+)
+
+// initEnrich checks the objects to enrich are in S3.
+func initEnrich() {
+	if !enrichObjects {
+		return
+	}
+	switch {
+	case urlList != "":
+		log.Fatal("ENRICH needs S3 sources and cannot be used with URL_LIST")
+	case workMode == modeRepack:
+		log.Fatal("ENRICH cannot be used with MODE=repack, the entries are not downloaded")
+	case enrichBatch < 1 || enrichRate < 0:
+		log.Fatalf("invalid ENRICH_BATCH %d or ENRICH_RATE %d", enrichBatch, enrichRate)
+	}
+	log.Printf("Objects are headed ahead of their download, %d at a time", enrichBatch)
+}
+
+// Enricher heads the objects on tasksCh ahead of the Downloader, in batches
+// of up to ENRICH_BATCH at no more than ENRICH_RATE requests a second, and
+// sends them on to doneCh in order with their attributes.  An object which
+// cannot be headed is logged as an error, as its download would fail too.
+func Enricher(ctx context.Context, tasksCh <-chan *DownloadTask, doneCh chan<- *DownloadTask) {
+	log.Println("Starting enricher...")
+	defer close(doneCh)
+
+	var tick <-chan time.Time
+	if enrichRate > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(enrichRate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		// Take the next task, and any more already waiting, as a batch
+		task, ok := <-tasksCh
+		if !ok {
+			Println("Closing enricher...")
+			return
+		}
+		batch := []*DownloadTask{task}
+	fill:
+		for len(batch) < enrichBatch {
+			select {
+			case task, ok := <-tasksCh:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, task)
+			default:
+				break fill
+			}
+		}
+
+		failed := make([]error, len(batch))
+		var wg sync.WaitGroup
+		for i, task := range batch {
+			if task.Exception != "" || task.DeleteMarker {
+				continue // Nothing to head
+			}
+			if tick != nil {
+				select {
+				case <-tick:
+				case <-ctx.Done():
+					return
+				}
+			}
+			wg.Add(1)
+			go func(i int, task *DownloadTask) {
+				defer wg.Done()
+				task.Attrs, failed[i] = headAttrs(ctx, task.Filename)
+			}(i, task)
+		}
+		wg.Wait()
+
+		for i, task := range batch {
+			if failed[i] != nil {
+				fileErrCh <- &ErrorEvent{Size: task.Size, Filename: task.Filename, Err: failed[i]}
+				continue
+			}
+			if task.Attrs != nil {
+				atomic.AddInt64(&EnrichedFiles, 1)
+			}
+			doneCh <- task
+		}
+	}
+}
@@ -9,4 +9,5 @@ type ErrorEvent struct {
 	Size     int64  // Size of the file that caused the error
 	Read     int64  // Number of bytes read before the error occurred
 	Err      error  // The error that occurred
+	Run      string // UUID of the run the error happened in
 }
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const modeEstimate = "estimate"
+
+var (
+	estimateFraction = Env("ESTIMATE_FRACTION", "0.01", "Fraction of the objects downloaded, scanned and compressed in estimate mode")
+	estimateMaxBytes = Env("ESTIMATE_MAX_BYTES", "4G", "Most bytes sampled in estimate mode, lowering ESTIMATE_FRACTION to fit")
+)
+
+// estimateStage is the measurement of one stage over the sample.
+type estimateStage struct {
+	name    string
+	bytes   int64
+	elapsed time.Duration
+}
+
+func (s *estimateStage) rate() float64 {
+	return float64(s.bytes) / max(s.elapsed.Seconds(), 1e-9)
+}
+
+// RunEstimate projects the duration, archive count and local disk needs of
+// the objects in the metadata file not yet uploaded.  A random sample of
+// them is downloaded from SRC_BUCKET, scanned and compressed with the
+// configured settings, and the measured rates and compression ratio are
+// scaled up to the whole.  Nothing is uploaded.
+func RunEstimate(ctx context.Context) {
+	fraction, err := strconv.ParseFloat(estimateFraction, 64)
+	if err != nil || fraction <= 0 || fraction > 1 {
+		log.Fatalf("invalid ESTIMATE_FRACTION %q, expected a number above 0 and at most 1", estimateFraction)
+	}
+	maxBytes, err := parseByteSize(estimateMaxBytes)
+	if err != nil {
+		log.Fatalf("failed to parse ESTIMATE_MAX_BYTES: %v", err)
+	}
+
+	// Only the work left matters, so objects already uploaded are left out
+	loadSkipFiles()
+	var (
+		remaining      []MetaEntry
+		remainingBytes int64
+	)
+	f, err := os.Open(metadataFileName)
+	if err != nil {
+		log.Fatalf("failed to open metadata file: %v", err)
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry MetaEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) != nil || entry.Key == "" {
+			continue // The last line holds the totals
+		}
+		if _, ok := skipFiles[entry.Key]; ok {
+			continue
+		}
+		remaining = append(remaining, entry)
+		remainingBytes += entry.Size
+	}
+	f.Close()
+	if err := scanner.Err(); err != nil {
+		log.Fatalf("error reading metadata file: %v", err)
+	}
+	if len(remaining) == 0 {
+		log.Println("Estimate: nothing left to archive")
+		return
+	}
+
+	if remainingBytes > 0 && float64(remainingBytes)*fraction > float64(maxBytes) {
+		fraction = float64(maxBytes) / float64(remainingBytes)
+		log.Printf("Estimate: sampling %.4f of the objects to stay within ESTIMATE_MAX_BYTES", fraction)
+	}
+	rng := rand.New(rand.NewPCG(uint64(len(remaining)), uint64(remainingBytes)))
+	var sample []*WorkFile
+	for _, entry := range remaining {
+		if rng.Float64() < fraction {
+			sample = append(sample, &WorkFile{Filename: entry.Key, Size: entry.Size, LastModified: entry.LastModified})
+		}
+	}
+	if len(sample) == 0 {
+		log.Fatalf("Estimate: no objects sampled from %d, raise ESTIMATE_FRACTION", len(remaining))
+	}
+	log.Printf("Estimate: sampled %d of %d objects", len(sample), len(remaining))
+	defer func() {
+		for _, wf := range sample {
+			if wf.TempFile != "" {
+				deleteTempFile(wf.TempFile)
+			}
+		}
+	}()
+
+	download := estimateDownload(ctx, sample)
+	stages := []*estimateStage{download}
+	var sampled []*WorkFile
+	for _, wf := range sample {
+		if wf.Bytes != nil || wf.TempFile != "" || wf.Size == 0 {
+			sampled = append(sampled, wf)
+		}
+	}
+	if len(sampled) == 0 {
+		log.Fatal("Estimate: none of the sampled objects could be downloaded")
+	}
+	if scanningEnabled {
+		stages = append(stages, estimateScan(sampled))
+	}
+	compress, ratio := estimateCompress(sampled)
+	stages = append(stages, compress)
+
+	estimateReport(stages, ratio, remaining, remainingBytes)
+}
+
+// estimateDownload downloads the sample as the downloader would, keeping
+// small objects in memory and the rest in temp files.
+func estimateDownload(ctx context.Context, sample []*WorkFile) *estimateStage {
+	log.Printf("Estimate: downloading the sample with %d at once", concurrentSmall)
+	stage := &estimateStage{name: "download"}
+	var (
+		next  int64 = -1
+		wg    sync.WaitGroup
+		start = time.Now()
+	)
+	for w := 0; w < concurrentSmall; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := atomic.AddInt64(&next, 1)
+				if i >= int64(len(sample)) {
+					return
+				}
+				wf := sample[i]
+				var err error
+				switch {
+				case wf.Size == 0:
+				case wf.Size <= maxMemBytes:
+					buf := make([]byte, wf.Size)
+					var n int
+					if n, err = downloadObjectToBuffer(ctx, srcBucket, wf.Filename, "", buf); err == nil {
+						wf.Bytes = buf[:n]
+					}
+				default:
+					parts := downloadPartsFor(wf.Size)
+					wf.TempFile, err = downloadObjectInParts(ctx, srcBucket, wf.Filename, "", wf.Size, parts)
+				}
+				if err != nil {
+					log.Printf("Estimate: failed to download %s: %v", wf.Filename, err)
+					continue
+				}
+				atomic.AddInt64(&stage.bytes, wf.Size)
+			}
+		}()
+	}
+	wg.Wait()
+	stage.elapsed = time.Since(start)
+	return stage
+}
+
+// estimateScan scans the sample with CONCURRENT_SCANNERS at once.
+func estimateScan(sample []*WorkFile) *estimateStage {
+	log.Printf("Estimate: scanning the sample with %d at once", concurrentScans)
+	stage := &estimateStage{name: "scan"}
+	var (
+		next  int64 = -1
+		wg    sync.WaitGroup
+		start = time.Now()
+	)
+	for w := 0; w < concurrentScans; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := atomic.AddInt64(&next, 1)
+				if i >= int64(len(sample)) {
+					return
+				}
+				wf := sample[i]
+				if wf.Size == 0 {
+					continue
+				}
+				if virus, err := scanWorkFile(wf); err != nil {
+					log.Printf("Estimate: failed to scan %s: %v", wf.Filename, err)
+					continue
+				} else if virus != "" {
+					log.Printf("Estimate: %s is infected with %s", wf.Filename, virus)
+				}
+				atomic.AddInt64(&stage.bytes, wf.Size)
+			}
+		}()
+	}
+	wg.Wait()
+	stage.elapsed = time.Since(start)
+	return stage
+}
+
+// estimateCompress writes the sample through the tar writer and
+// ARCHIVE_CODEC, on one goroutine like the archiver, and returns the
+// compressed to uncompressed ratio.
+func estimateCompress(sample []*WorkFile) (*estimateStage, float64) {
+	log.Printf("Estimate: compressing the sample with %s", archiveCodec)
+	stage := &estimateStage{name: "compress"}
+	var out countingWriter
+	compressor, err := newCompressor(&out)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tw := tar.NewWriter(compressor)
+	start := time.Now()
+	for _, wf := range sample {
+		if err := tw.WriteHeader(&tar.Header{Name: entryName(wf.Filename), Size: wf.Size, Mode: 0600,
+			ModTime: wf.LastModified, Format: archiveTarFormat}); err != nil {
+			log.Printf("Estimate: cannot archive %s: %v", wf.Filename, err)
+			continue
+		}
+		if wf.TempFile == "" {
+			tw.Write(wf.Bytes)
+		} else if fh, err := openTempFile(wf.TempFile); err == nil {
+			fh.WriteTo(tw)
+			fh.Close()
+		}
+		stage.bytes += wf.Size
+	}
+	tw.Close()
+	compressor.Close()
+	stage.elapsed = time.Since(start)
+	return stage, float64(out.n) / float64(max(stage.bytes, 1))
+}
+
+// estimateReport scales the sample measurements to the remaining objects.
+// The slowest stage bounds the pipeline; uploads are not measured and are
+// assumed to keep up.
+func estimateReport(stages []*estimateStage, ratio float64, remaining []MetaEntry, remainingBytes int64) {
+	slowest := stages[0]
+	for _, s := range stages {
+		if s.rate() < slowest.rate() {
+			slowest = s
+		}
+	}
+	duration := time.Duration(float64(remainingBytes) / slowest.rate() * float64(time.Second))
+	archives := (remainingBytes + sizeCapLimit - 1) / sizeCapLimit
+
+	// Local disk holds the archives being built, queued and uploaded, and the
+	// large objects between download and archiving
+	sizes := make([]int64, 0, len(remaining))
+	for _, entry := range remaining {
+		if entry.Size > maxMemBytes {
+			sizes = append(sizes, entry.Size)
+		}
+	}
+	slices.Sort(sizes)
+	var inFlight int64
+	for _, size := range sizes[max(len(sizes)-32, 0):] {
+		inFlight += size
+	}
+	archiveDisk := int64(4 * float64(min(sizeCapLimit, remainingBytes)) * ratio)
+
+	fmt.Printf("Estimate for %d objects, %s, from a sample of %s\n", len(remaining), humanizeBytes(remainingBytes), humanizeBytes(stages[0].bytes))
+	for _, s := range stages {
+		fmt.Printf("  %-9s %s\n", s.name+":", humanizeRate(s.bytes, s.elapsed))
+	}
+	fmt.Printf("  Duration: ~%s, limited by %s\n", duration.Round(time.Second), slowest.name)
+	fmt.Printf("  Archives: ~%d with ARCHIVE_CODEC=%s, ~%s in total (%.2f of the source size)\n",
+		archives, archiveCodec, humanizeBytes(int64(float64(remainingBytes)*ratio)), ratio)
+	fmt.Printf("  Temp disk: up to ~%s, %s of archives in progress and %s of large objects in flight\n",
+		humanizeBytes(archiveDisk+inFlight), humanizeBytes(archiveDisk), humanizeBytes(inFlight))
+	if maxTempBytes != "" {
+		if limit, err := parseByteSize(maxTempBytes); err == nil && limit < archiveDisk+inFlight {
+			fmt.Printf("  MAX_TEMP_BYTES=%s is below this and will slow the run\n", maxTempBytes)
+		}
+	}
+}
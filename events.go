@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const modeEvents = "events"
+
+var (
+	eventsWindow = EnvInt("EVENTS_WINDOW", 60, "Minutes of the clock aligned windows whose new objects share an archive in events mode")
+
+	IgnoredEvents int64 // Notifications of other buckets, prefixes or event types
+)
+
+// s3Notification is an S3 event notification, as delivered to SQS directly
+// or inside an SNS envelope.
+type s3Notification struct {
+	Event   string // Set on the s3:TestEvent sent when notifications are configured
+	Type    string // "Notification" for an SNS envelope
+	Message string // The notification inside an SNS envelope
+	Records []struct {
+		EventName string    `json:"eventName"`
+		EventTime time.Time `json:"eventTime"`
+		S3        struct {
+			Bucket struct {
+				Name string `json:"name"`
+			} `json:"bucket"`
+			Object struct {
+				Key  string `json:"key"`
+				Size int64  `json:"size"`
+				ETag string `json:"eTag"`
+			} `json:"object"`
+		} `json:"s3"`
+	}
+}
+
+func initEvents() {
+	if workMode != modeEvents {
+		return
+	}
+	switch {
+	case archiveStdout || exportDir != "" || simulating:
+		log.Fatal("events mode archives to DST_BUCKET and cannot be used with ARCHIVE_STDOUT, EXPORT_DIR or SIMULATE")
+	case workList != "":
+		log.Fatal("WORK_LIST cannot be used in events mode")
+	case eventsWindow <= 0:
+		log.Fatalf("EVENTS_WINDOW must be at least 1 minute, not %d", eventsWindow)
+	}
+	if os.Getenv("ARCHIVE_NAME") == "" {
+		// Every start of the service numbers its archives afresh
+		ArchiveName = "events_" + runStarted.Format("20060102T150405Z") + "_%07d.tgz"
+	}
+}
+
+// windowOf returns the start of the EVENTS_WINDOW holding t.
+func windowOf(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Duration(eventsWindow) * time.Minute)
+}
+
+// ReceiveEvents long polls QUEUE_URL for the S3 event notifications of
+// SRC_BUCKET and sends each created object to doFiles, until SIGINT or
+// SIGTERM.  A message is deleted only once all of its objects are uploaded
+// or logged in error.log, so notifications held when the service stops are
+// delivered again.  Keys already archived are archived again, as a later
+// notification is a new version of the object.
+func ReceiveEvents(ctx context.Context, doFiles chan<- *DownloadTask) {
+	defer close(doFiles)
+	stop, cancel := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	log.Println("Receiving S3 event notifications from", queueURL)
+
+	for stop.Err() == nil {
+		msgs, err := sqsReceiveMessages(stop, queueURL, 10, 20, workVisibility)
+		if stop.Err() != nil {
+			break
+		} else if err != nil {
+			log.Printf("failed to receive event notifications: %v", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		for _, msg := range msgs {
+			entries, err := parseNotification(msg.Body)
+			if err != nil {
+				log.Printf("failed to parse event notification %s: %v", msg.MessageId, err)
+				continue // Left on the queue for the redrive policy to deal with
+			}
+
+			p := &pendingUnit{id: msg.MessageId, receipt: msg.ReceiptHandle, stop: make(chan struct{}),
+				etags: make(map[string]string)}
+			var todo []MetaEntry
+			pendingMutex.Lock()
+			if key, busy := newerVersionInFlight(entries); busy {
+				pendingMutex.Unlock()
+				if debug {
+					log.Printf("Leaving event notification %s on the queue until %s is archived", msg.MessageId, key)
+				}
+				continue // Delivered again once the visibility timeout runs out
+			}
+			for _, entry := range entries {
+				if _, ok := pendingKeys[entry.Key]; ok {
+					continue // Redelivered, or notified twice, while still in flight
+				}
+				pendingKeys[entry.Key] = p
+				p.etags[entry.Key] = entry.ETag
+				p.remaining++
+				todo = append(todo, entry)
+			}
+			pendingMutex.Unlock()
+
+			if p.remaining == 0 {
+				finishUnit(p)
+				continue
+			}
+			go heartbeatUnit(ctx, p)
+
+			for _, entry := range todo {
+				atomic.AddInt64(&TotalBytes, entry.Size)
+				atomic.AddInt64(&TotalFiles, 1)
+				if err := checkTarEntry(entryName(entry.Key), entry.Size, entry.DeleteMarker); err != nil {
+					rejectTarEntry(entry, err, doFiles)
+					continue
+				}
+				doFiles <- &DownloadTask{Filename: entry.Key, Size: entry.Size, LastModified: entry.LastModified, ETag: entry.ETag}
+			}
+		}
+	}
+	log.Println("Stopped receiving event notifications, finishing up")
+}
+
+// newerVersionInFlight returns a key of entries which is still being archived
+// from another notification with a different ETag.  Its message must wait, as
+// acknowledging it now would lose the new version of the object.  It is called
+// with pendingMutex held.
+func newerVersionInFlight(entries []MetaEntry) (string, bool) {
+	for _, entry := range entries {
+		if p, ok := pendingKeys[entry.Key]; ok && p.etags[entry.Key] != entry.ETag {
+			return entry.Key, true
+		}
+	}
+	return "", false
+}
+
+// parseNotification returns the objects created in SRC_BUCKET, under
+// PREFIX_FILTER, by a notification.
+func parseNotification(body string) ([]MetaEntry, error) {
+	var n s3Notification
+	if err := json.Unmarshal([]byte(body), &n); err != nil {
+		return nil, err
+	}
+	if n.Type == "Notification" && n.Message != "" {
+		return parseNotification(n.Message)
+	}
+	var entries []MetaEntry
+	for _, r := range n.Records {
+		key, err := url.QueryUnescape(r.S3.Object.Key) // Keys are form encoded
+		if err != nil {
+			return nil, fmt.Errorf("malformed key %q: %w", r.S3.Object.Key, err)
+		}
+		if _, listed := listingPrefix(key); r.S3.Bucket.Name != srcBucket || !strings.HasPrefix(r.EventName, "ObjectCreated:") || !listed || !keySelected(key) {
+			atomic.AddInt64(&IgnoredEvents, 1)
+			continue
+		}
+		entries = append(entries, MetaEntry{Key: key, Size: r.S3.Object.Size, LastModified: r.EventTime,
+			ETag: strings.Trim(r.S3.Object.ETag, `"`)})
+	}
+	if debug && n.Event != "" {
+		log.Printf("Ignoring %s notification", n.Event)
+	}
+	return entries, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+var (
+	exceptionsPrefix = Env("EXCEPTIONS_PREFIX", "", "Archive objects which failed scanning or do not fit TAR_FORMAT as exceptions_ archives under this prefix, instead of only logging them (empty to disable)")
+
+	exceptionStream *archiveStream // Nil unless EXCEPTIONS_PREFIX is set
+	ExceptionFiles  int64
+)
+
+// initExceptions sets up the stream of exceptions archives, which is kept
+// apart from the others whatever the key or classification of its objects.
+func initExceptions() {
+	if exceptionsPrefix == "" {
+		return
+	}
+	if archiveStdout {
+		log.Fatal("EXCEPTIONS_PREFIX cannot be used with ARCHIVE_STDOUT")
+	}
+	exceptionStream = &archiveStream{name: underDstPrefix(exceptionsPrefix + "exceptions_"), sizeCap: sizeCapLimit}
+	log.Printf("Objects which fail are archived in %s", exceptionStream.name)
+}
+
+// sendException logs the failure of an object whose contents are in hand and,
+// with EXCEPTIONS_PREFIX, sends it on to the exceptions archive rather than
+// dropping it.  The stages between here and the archiver let it through.
+func sendException(task *WorkFile, err error, doneCh chan<- *WorkFile) {
+	fileErrCh <- &ErrorEvent{Size: task.Size, Filename: task.Filename, Err: err}
+	if exceptionStream == nil {
+		if task.TempFile == "" {
+			putMemory(task.Bytes)
+		} else {
+			removeTempFile(task)
+		}
+		return
+	}
+	task.Exception = err.Error()
+	atomic.AddInt64(&ExceptionFiles, 1)
+	doneCh <- task
+}
+
+// rejectTarEntry logs a listed object which cannot be archived in
+// TAR_FORMAT.  With EXCEPTIONS_PREFIX it is downloaded all the same, as the
+// exceptions archives are always written in PAX format.
+func rejectTarEntry(entry MetaEntry, err error, doFiles chan<- *DownloadTask) {
+	err = fmt.Errorf("cannot archive in %s format: %w", tarFormat, err)
+	fileErrCh <- &ErrorEvent{Size: entry.Size, Filename: entry.Key, Err: err}
+	if exceptionStream == nil {
+		return
+	}
+	atomic.AddInt64(&ExceptionFiles, 1)
+	doFiles <- &DownloadTask{Filename: entry.Key, Size: entry.Size, LastModified: entry.LastModified, ETag: entry.ETag,
+		Exception: err.Error()}
+}
+
+// headerFormat is the tar format of the headers of the open archive.
+func headerFormat() tar.Format {
+	if exceptionStream != nil && curStream == exceptionStream {
+		return tar.FormatPAX
+	}
+	return archiveTarFormat
+}
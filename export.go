@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+const mediaManifestName = "MEDIA_MANIFEST.json"
+
+var (
+	exportDir = Env("EXPORT_DIR", "", "Write archives to this mounted removable volume instead of uploading them to DST_BUCKET")
+
+	mediaVolume = &MediaManifest{Volume: 1}
+)
+
+// MediaManifest lists the files written to one removable volume.  It is
+// rewritten at the root of the volume after every file, so it is complete
+// whenever the media is pulled.
+type MediaManifest struct {
+	Volume   int          `json:"volume"`
+	Source   string       `json:"source_bucket"`
+	Started  time.Time    `json:"started"`
+	Finished time.Time    `json:"finished,omitzero"` // Set once the volume is full or the run is done
+	Files    []*MediaFile `json:"files"`
+}
+
+type MediaFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+func initExport() {
+	if exportDir == "" {
+		return
+	}
+	if archiveStdout {
+		log.Fatal("EXPORT_DIR cannot be used with ARCHIVE_STDOUT")
+	}
+	if info, err := os.Stat(exportDir); err != nil || !info.IsDir() {
+		log.Fatalf("EXPORT_DIR %s is not a mounted directory: %v", exportDir, err)
+	}
+}
+
+// exportFiles copies files, an archive and its sidecars, onto the export
+// volume and removes the local copies of all but the first.  When they do
+// not fit, the volume is closed and the operator is asked to swap the media;
+// nothing more is written until a volume without a media manifest is mounted.
+func exportFiles(files []string) {
+	var need int64 = 64 * 1024 // Room for the media manifest to grow
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			log.Fatalf("failed to stat %s for export: %v", file, err)
+		}
+		need += info.Size()
+	}
+
+	for waiting, sealed := false, false; ; {
+		free, total, err := volumeSpace(exportDir)
+		if err != nil {
+			log.Fatalf("failed to stat export volume %s: %v", exportDir, err)
+		}
+		if need > total {
+			log.Fatalf("%s needs %s which is more than the whole export volume holds (%s)", files[0], humanizeBytes(need), humanizeBytes(total))
+		}
+		if sealed {
+			// The sealed volume may still be mounted, with room freed on it
+			if _, err := os.Stat(filepath.Join(exportDir, mediaManifestName)); err == nil {
+				time.Sleep(10 * time.Second)
+				continue
+			}
+		}
+		if need <= free {
+			if waiting {
+				log.Printf("Writing volume %d to %s", mediaVolume.Volume, exportDir)
+			}
+			break
+		}
+		if !waiting {
+			if len(mediaVolume.Files) > 0 {
+				// Seal the full volume and move on to the next one
+				mediaVolume.Finished = time.Now().UTC()
+				writeMediaManifest()
+				mediaVolume = &MediaManifest{Volume: mediaVolume.Volume + 1}
+				sealed = true
+			}
+			Println(fmt.Sprintf("Export volume at %s is full: mount empty media for volume %d (%s free needed)",
+				exportDir, mediaVolume.Volume, humanizeBytes(need)))
+			waiting = true
+		}
+		time.Sleep(10 * time.Second)
+	}
+
+	for i, file := range files {
+		size, digest, err := exportCopy(file, filepath.Join(exportDir, file))
+		if err != nil {
+			log.Fatalf("failed to export %s: %v", file, err)
+		}
+		mediaVolume.Files = append(mediaVolume.Files, &MediaFile{Name: file, Size: size, SHA256: digest})
+		writeMediaManifest()
+		if i > 0 {
+			os.Remove(file)
+		}
+	}
+}
+
+// exportCopy copies src to dst, syncing it to the media, and returns the size
+// and digest of what was written.
+func exportCopy(src, dst string) (int64, string, error) {
+	in, err := openTempFile(src)
+	if err != nil {
+		return 0, "", err
+	}
+	defer in.Close()
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return 0, "", err
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return 0, "", err
+	}
+	defer out.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(out, h), &UploadReader{in}) // Counted as uploaded bytes
+	if err != nil {
+		return 0, "", err
+	}
+	if err := out.Sync(); err != nil {
+		return 0, "", err
+	}
+	return n, fmt.Sprintf("%x", h.Sum(nil)), out.Close()
+}
+
+// closeExport marks the current volume as finished at the end of the run.
+func closeExport() {
+	if exportDir == "" || len(mediaVolume.Files) == 0 {
+		return
+	}
+	mediaVolume.Finished = time.Now().UTC()
+	writeMediaManifest()
+	log.Printf("Export finished on volume %d", mediaVolume.Volume)
+}
+
+func writeMediaManifest() {
+	if mediaVolume.Started.IsZero() {
+		mediaVolume.Started = time.Now().UTC()
+		mediaVolume.Source = srcBucket
+	}
+	dat, _ := json.MarshalIndent(mediaVolume, "", "  ")
+	tmp := filepath.Join(exportDir, mediaManifestName+".tmp")
+	if err := os.WriteFile(tmp, append(dat, '\n'), 0644); err != nil {
+		log.Fatalf("failed to write media manifest: %v", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(exportDir, mediaManifestName)); err != nil {
+		log.Fatalf("failed to write media manifest: %v", err)
+	}
+}
+
+// volumeSpace returns the bytes available and the total size of the volume
+// holding dir.
+func volumeSpace(dir string) (free, total int64, err error) {
+	var st syscall.Statfs_t
+	if err = syscall.Statfs(dir, &st); err != nil {
+		return
+	}
+	return int64(st.Bavail) * int64(st.Bsize), int64(st.Blocks) * int64(st.Bsize), nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"crypto/fips140"
+	"log"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+var fipsMode = Env("FIPS", "", "Require FIPS 140-3 validated crypto and use the AWS FIPS endpoints") != ""
+
+// initFIPS checks the Go FIPS 140-3 module is in use when FIPS is set.  A
+// binary built with GOFIPS140, or run with GODEBUG=fips140=on, turns on the
+// FIPS endpoints by itself.
+func initFIPS() {
+	if fips140.Enabled() {
+		fipsMode = true
+	} else if fipsMode {
+		log.Fatal("FIPS is set but the FIPS 140-3 module is not enabled, build with GOFIPS140=v1.0.0 or run with GODEBUG=fips140=on")
+	}
+	if fipsMode {
+		log.Println("FIPS mode: using FIPS 140-3 crypto and AWS FIPS endpoints")
+	}
+}
+
+// fipsEndpointState selects the FIPS variant of the AWS service endpoints.
+func fipsEndpointState() aws.FIPSEndpointState {
+	if fipsMode {
+		return aws.FIPSEndpointStateEnabled
+	}
+	return aws.FIPSEndpointStateUnset
+}
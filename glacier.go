@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+var (
+	glacierTier = Env("GLACIER_RESTORE_TIER", "", "Restore objects in GLACIER, DEEP_ARCHIVE or an archive tier of INTELLIGENT_TIERING before downloading them, with the Expedited, Standard or Bulk retrieval tier (empty to let them fail)")
+	glacierDays = EnvInt("GLACIER_RESTORE_DAYS", 1, "Days the restored copies are kept, long enough for the run to download them")
+	glacierWait = EnvInt("GLACIER_RESTORE_POLL", 10, "Minutes between checks of the restores under way")
+
+	glacierPoll time.Duration
+
+	RestoringFiles int64 // Objects waiting for their restore
+	RestoredFiles  int64 // Objects restored and sent on to download
+)
+
+func initGlacier() {
+	if glacierTier == "" {
+		return
+	}
+	switch glacierTier {
+	case string(types.TierExpedited), string(types.TierStandard), string(types.TierBulk):
+	default:
+		log.Fatalf("GLACIER_RESTORE_TIER must be Expedited, Standard or Bulk: %q", glacierTier)
+	}
+	if glacierDays < 1 || glacierWait < 1 {
+		log.Fatal("GLACIER_RESTORE_DAYS and GLACIER_RESTORE_POLL must be at least 1")
+	}
+	glacierPoll = time.Duration(glacierWait) * time.Minute
+	log.Printf("Restoring archived objects with the %s tier for %d days, checking every %s", glacierTier, glacierDays, glacierPoll)
+}
+
+// inGlacier reports whether an object was listed in a storage class
+// which may need a restore before it can be read.
+func inGlacier(task *DownloadTask) bool {
+	switch types.ObjectStorageClass(task.StorageClass) {
+	case types.ObjectStorageClassGlacier, types.ObjectStorageClassDeepArchive, types.ObjectStorageClassIntelligentTiering:
+		return !task.DeleteMarker
+	}
+	return false
+}
+
+// glacierGate passes the listed objects on, holding back those which must
+// be restored first.  Their restores are requested as they arrive, and they
+// are sent on as the checks every GLACIER_RESTORE_POLL find them restored,
+// so the run downloads the other objects meanwhile rather than failing these
+// with InvalidObjectState.  The gate closes once the listing is done and
+// every restore has completed or failed.
+func glacierGate(ctx context.Context, in <-chan *DownloadTask, out chan<- *DownloadTask) {
+	defer close(out)
+	held := make(map[string]*DownloadTask)
+	ticker := time.NewTicker(glacierPoll)
+	defer ticker.Stop()
+	send := func(task *DownloadTask) bool {
+		select {
+		case out <- task:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	fail := func(task *DownloadTask, err error) {
+		fileErrCh <- &ErrorEvent{Size: task.Size, Filename: task.Filename, Err: fmt.Errorf("restoring from %s: %w", task.StorageClass, err)}
+	}
+
+	for in != nil || len(held) > 0 {
+		select {
+		case task, ok := <-in:
+			if !ok {
+				in = nil
+				if len(held) > 0 {
+					log.Printf("Glacier: the listing is done, waiting for %d restores", len(held))
+				}
+				continue
+			}
+			if inGlacier(task) {
+				ready, err := startGlacierRestore(ctx, task)
+				if err != nil {
+					fail(task, err)
+					continue
+				}
+				if !ready {
+					held[task.Filename] = task
+					atomic.AddInt64(&RestoringFiles, 1)
+					continue
+				}
+			}
+			if !send(task) {
+				return
+			}
+		case <-ticker.C:
+			var restored int
+			for _, key := range slices.Sorted(maps.Keys(held)) {
+				task := held[key]
+				ready, ongoing, err := glacierState(ctx, task)
+				if err == nil && !ready && !ongoing {
+					// The restored copy expired before it was read, so it is asked for again
+					_, err = startGlacierRestore(ctx, task)
+				}
+				if err == nil && !ready {
+					continue
+				}
+				delete(held, key)
+				atomic.AddInt64(&RestoringFiles, -1)
+				if err != nil {
+					fail(task, err)
+					continue
+				}
+				restored++
+				atomic.AddInt64(&RestoredFiles, 1)
+				if !send(task) {
+					return
+				}
+			}
+			log.Printf("Glacier: %d objects restored, %d still restoring", restored, len(held))
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// startGlacierRestore requests the restore of an object unless it can be read
+// already, or its restore is under way, and reports whether it can be read.
+func startGlacierRestore(ctx context.Context, task *DownloadTask) (bool, error) {
+	ready, ongoing, err := glacierState(ctx, task)
+	if err != nil || ready || ongoing {
+		return ready, err
+	}
+	input := &s3.RestoreObjectInput{Bucket: aws.String(srcBucket), Key: aws.String(task.Filename), RestoreRequest: &types.RestoreRequest{}}
+	tier := types.Tier(glacierTier)
+	switch types.ObjectStorageClass(task.StorageClass) {
+	case types.ObjectStorageClassIntelligentTiering:
+		// Restored into the frequent access tier, where it stays without a number of days
+	case types.ObjectStorageClassDeepArchive:
+		if tier == types.TierExpedited {
+			tier = types.TierStandard // Expedited retrievals are not offered from DEEP_ARCHIVE
+		}
+		fallthrough
+	default:
+		input.RestoreRequest.Days = aws.Int32(int32(glacierDays))
+		input.RestoreRequest.GlacierJobParameters = &types.GlacierJobParameters{Tier: tier}
+	}
+	_, err = s3client.RestoreObject(ctx, input)
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "RestoreAlreadyInProgress" {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if debug {
+		log.Printf("Glacier: requested %s from %s with the %s tier", task.Filename, task.StorageClass, tier)
+	}
+	return false, nil
+}
+
+// glacierState heads an object and reports whether it can be read, as it
+// is not archived or a restored copy is there, and whether a restore of it
+// is under way.
+func glacierState(ctx context.Context, task *DownloadTask) (ready, ongoing bool, err error) {
+	head, err := s3client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(srcBucket), Key: aws.String(task.Filename)})
+	if err != nil {
+		return false, false, err
+	}
+	restore := aws.ToString(head.Restore) // ongoing-request="false", expiry-date="..."
+	switch {
+	case strings.Contains(restore, `ongoing-request="false"`):
+		return true, false, nil
+	case strings.Contains(restore, `ongoing-request="true"`):
+		return false, true, nil
+	case head.ArchiveStatus != "": // In an archive tier of INTELLIGENT_TIERING
+		return false, false, nil
+	case head.StorageClass == types.StorageClassGlacier, head.StorageClass == types.StorageClassDeepArchive:
+		return false, false, nil
+	}
+	return true, false, nil // Moved out of the archive class since the listing
+}
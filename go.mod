@@ -1,4 +1,4 @@
-module main
+module github.com/pschou/bucket-archiver
 
 go 1.24
 
@@ -12,6 +12,7 @@ require (
 	github.com/hexahigh/go-clamav v0.7.1
 	github.com/klauspost/compress v1.18.0
 	github.com/remeh/sizedwaitgroup v1.0.0
+	github.com/zeebo/blake3 v0.2.4
 )
 
 require (
@@ -23,4 +24,5 @@ require (
 	github.com/aws/aws-sdk-go-v2/service/internal/checksum v1.7.4 // indirect
 	github.com/aws/aws-sdk-go-v2/service/internal/presigned-url v1.12.17 // indirect
 	github.com/aws/aws-sdk-go-v2/service/internal/s3shared v1.18.17 // indirect
+	github.com/klauspost/cpuid/v2 v2.0.12 // indirect
 )
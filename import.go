@@ -0,0 +1,568 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+const modeImport = "import"
+
+var (
+	importDir = Env("IMPORT_DIR", "", "Directory or mounted media holding the archives to import in import mode")
+	importAs  = Env("IMPORT_AS", "contents", "Import the archive \"contents\" as objects, or the \"archives\" themselves")
+	verifyKey = Env("VERIFY_KEY", "", "Require valid manifest signatures on import, checked with kms:<key-id> or a PEM public key file")
+)
+
+// importSidecars are the files written next to an archive, in the order they
+// are checked.  The checksum file is named after its algorithm.
+var importSidecars = []string{".sha256", ".sha1", ".crc32c", ".blake3", ".manifest.jsonl", ".manifest.jsonl.sig", ".scan-report.jsonl", ".info.json"}
+
+func initImport() {
+	if importDir == "" {
+		log.Fatal("IMPORT_DIR must be set in import mode")
+	}
+	if importAs != "contents" && importAs != "archives" {
+		log.Fatalf("invalid IMPORT_AS %q, must be contents or archives", importAs)
+	}
+}
+
+// RunImport verifies every archive under IMPORT_DIR against its media
+// manifest, checksums and manifest signature, optionally scans the entries
+// again, and uploads either the objects or the archives to DST_BUCKET.
+// Imported archives are listed in import.log so a restart skips them.
+func RunImport(ctx context.Context) {
+	s3Ready.Wait() // Wait for the S3 client to be ready
+
+	files, mediaDigests := importFileList()
+	done := make(map[string]struct{})
+	if dat, err := os.ReadFile("import.log"); err == nil {
+		for _, line := range strings.Split(string(dat), "\n") {
+			done[line] = struct{}{}
+		}
+	}
+	f, err := os.OpenFile("import.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Fatalf("failed to open import log: %v", err)
+	}
+	defer f.Close()
+
+	imported := make(map[string]string) // Archive and entry name to the key it was uploaded as
+	for _, name := range files {
+		if archiveExt(name) == "" {
+			continue // Sidecars are handled with their archive
+		}
+		if _, ok := done[name]; ok {
+			continue
+		}
+		log.Println("Importing", name)
+		if err := importArchive(ctx, name, mediaDigests, imported); err != nil {
+			fileErrCh <- &ErrorEvent{Filename: name, Err: fmt.Errorf("failed to import %s: %w", name, err)}
+			continue
+		}
+		fmt.Fprintln(f, name)
+		atomic.AddInt64(&UploadedFiles, 1)
+	}
+	reportIncompleteChunks()
+}
+
+// importFileList returns the files to import, relative to IMPORT_DIR, with
+// their digests from the media manifest if there is one.
+func importFileList() ([]string, map[string]string) {
+	digests := make(map[string]string)
+	if dat, err := os.ReadFile(filepath.Join(importDir, mediaManifestName)); err == nil {
+		var media MediaManifest
+		if err := json.Unmarshal(dat, &media); err != nil {
+			log.Fatalf("failed to unmarshal media manifest: %v", err)
+		}
+		log.Printf("Importing volume %d from %s with %d files", media.Volume, importDir, len(media.Files))
+		var files []string
+		for _, file := range media.Files {
+			files = append(files, file.Name)
+			digests[file.Name] = file.SHA256
+		}
+		return files, digests
+	}
+
+	log.Printf("No %s in %s, importing every archive found", mediaManifestName, importDir)
+	var files []string
+	err := filepath.WalkDir(importDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, _ := filepath.Rel(importDir, path)
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("failed to list %s: %v", importDir, err)
+	}
+	return files, digests
+}
+
+func importArchive(ctx context.Context, name string, mediaDigests, imported map[string]string) error {
+	path := filepath.Join(importDir, name)
+
+	// Check the sidecars which describe the archive before trusting them
+	present := make(map[string]string)
+	for _, ext := range importSidecars {
+		sidecar := filepath.Join(importDir, name+ext)
+		if _, err := os.Stat(sidecar); err != nil {
+			continue
+		}
+		if err := checkMediaDigest(name+ext, sidecar, mediaDigests); err != nil {
+			return err
+		}
+		present[ext] = sidecar
+	}
+	if verifyKey != "" {
+		manifest, sig := present[".manifest.jsonl"], present[".manifest.jsonl.sig"]
+		if manifest == "" || sig == "" {
+			return fmt.Errorf("VERIFY_KEY is set but the manifest or its signature is missing")
+		}
+		if err := verifySignature(manifest, sig); err != nil {
+			return fmt.Errorf("manifest signature: %w", err)
+		}
+	}
+
+	// The archive is hashed with the algorithm of its checksum file
+	sumAlgorithm := checksumAlgorithm
+	for algorithm := range checksumAlgorithms {
+		if present["."+algorithm] != "" {
+			sumAlgorithm = algorithm
+		}
+	}
+	if present["."+sumAlgorithm] == "" || present[".manifest.jsonl"] == "" {
+		return fmt.Errorf("the checksum file or the manifest is missing")
+	}
+	archiveSum, entrySums, err := readChecksums(present["."+sumAlgorithm])
+	if err != nil {
+		return err
+	}
+	entries, err := readManifest(present[".manifest.jsonl"])
+	if err != nil {
+		return err
+	}
+
+	// The whole archive is verified before anything is uploaded, then read
+	// again checking each entry as it is scanned and, for contents, uploaded
+	newHash := checksumAlgorithms[sumAlgorithm].new
+	for _, upload := range []bool{false, true} {
+		archiveHash := newHash()
+		if err := importEntries(ctx, name, path, sumAlgorithm, archiveHash, entrySums, entries, imported, upload); err != nil {
+			return err
+		}
+		digest := fmt.Sprintf("%x", archiveHash.Sum(nil))
+		if want, ok := mediaDigests[name]; ok && want != digest {
+			return fmt.Errorf("archive digest %s does not match the media manifest %s", digest, want)
+		}
+		if archiveSum != digest {
+			return fmt.Errorf("archive digest %s does not match the checksum file %s", digest, archiveSum)
+		}
+	}
+
+	if importAs == "archives" {
+		if err := uploadFileInParts(ctx, dstBucket, name, path, withDstAttrs(uploadAttrs{
+			ContentType: archiveCodecs[codecForName(name)].contentType,
+			Metadata:    virusScanMap,
+		})); err != nil {
+			return err
+		}
+		for ext, sidecar := range present {
+			if err := uploadFileInParts(ctx, dstBucket, name+ext, sidecar, withDstAttrs(uploadAttrs{Metadata: virusScanMap})); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Entries stored once and referenced by later ones are copied in place
+	for _, entry := range entries {
+		if entry.Ref == nil {
+			continue
+		}
+		src, ok := imported[entry.Ref.Archive+"\x00"+entry.Ref.Name]
+		if !ok {
+			fileErrCh <- &ErrorEvent{Filename: entry.Key, Size: entry.Size,
+				Err: fmt.Errorf("contents of %s are in %s which was not imported", entry.Key, entry.Ref.Archive)}
+			continue
+		}
+		if err := copyObject(ctx, dstBucket, src, entry.Key, entry.Attributes); err != nil {
+			fileErrCh <- &ErrorEvent{Filename: entry.Key, Size: entry.Size, Err: err}
+			continue
+		}
+		atomic.AddInt64(&UploadedArchivedFiles, 1)
+	}
+	return nil
+}
+
+// importEntries reads the archive at path, hashing all of it into archiveHash
+// and checking each entry against the checksum file and the manifest.  Only
+// when upload is set are the entries scanned and, for contents, uploaded.
+func importEntries(ctx context.Context, name, path, sumAlgorithm string, archiveHash hash.Hash,
+	entrySums map[string]string, entries map[string]*ManifestEntry, imported map[string]string, upload bool) error {
+	fh, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	in := io.TeeReader(bufio.NewReader(fh), archiveHash)
+
+	r, closeReader, err := decompressArchive(name, in)
+	if err != nil {
+		return err
+	}
+	defer closeReader()
+
+	var dictDecoder *zstd.Decoder
+	seen := make(map[string]bool)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		seen[hdr.Name] = true
+
+		task, err := readEntry(tr, hdr, checksumAlgorithms[sumAlgorithm].new())
+		if err != nil {
+			return err
+		}
+		if want, ok := entrySums[hdr.Name]; !ok {
+			discardEntry(task)
+			return fmt.Errorf("entry %s is not in the checksum file", hdr.Name)
+		} else if want != task.Custody.Archived {
+			discardEntry(task)
+			return fmt.Errorf("entry %s digest %s does not match the checksum file %s", hdr.Name, task.Custody.Archived, want)
+		}
+
+		if hdr.Name == zstdDictName {
+			dictDecoder, err = zstd.NewReader(nil, zstd.WithDecoderDicts(task.Bytes))
+			if err != nil {
+				return fmt.Errorf("failed to load zstd dictionary: %w", err)
+			}
+			defer dictDecoder.Close()
+			continue // Only needed to restore the entries
+		}
+		if isManifestEntry(hdr.Name, entries) {
+			continue // A copy of the manifest sidecar
+		}
+
+		// The manifest maps entry names back to the original keys
+		entry, ok := entries[hdr.Name]
+		if !ok {
+			discardEntry(task)
+			return fmt.Errorf("entry %s is not in the manifest", hdr.Name)
+		}
+		compressed, decoded := dictDecoder != nil && strings.HasSuffix(hdr.Name, ".zst"), false
+		if compressed && task.TempFile == "" {
+			if task.Bytes, err = dictDecoder.DecodeAll(task.Bytes, nil); err != nil {
+				return fmt.Errorf("failed to decompress %s: %w", hdr.Name, err)
+			}
+			task.Size = int64(len(task.Bytes))
+			compressed, decoded = false, true
+		}
+		if err := checkManifestDigests(task, entry, sumAlgorithm, compressed, decoded); err != nil {
+			discardEntry(task)
+			return err
+		}
+		if !upload {
+			discardEntry(task)
+			continue
+		}
+		key := entry.Key
+		task.Filename, task.Attrs = key, entry.Attributes
+
+		if entry.Chunk != nil && importAs == "contents" {
+			// The object is scanned and uploaded once all its chunks are in
+			if err := importChunk(ctx, task, entry); err != nil {
+				fileErrCh <- &ErrorEvent{Filename: key, Size: entry.Chunk.ObjectSize, Err: err}
+			}
+			discardEntry(task)
+			continue
+		}
+
+		if entry.DeleteMarker {
+			// The key was deleted in the source, so it is deleted here too
+			discardEntry(task)
+			if importAs == "contents" {
+				if err := importDeleteMarker(ctx, key); err != nil {
+					fileErrCh <- &ErrorEvent{Filename: key, Err: err}
+					continue
+				}
+				imported[name+"\x00"+hdr.Name] = key
+			}
+			continue
+		}
+
+		if scanningEnabled && task.Size > 0 && scanSkipReason(task) == "" {
+			virus, err := scanWorkFile(task)
+			if virus != "" || err != nil {
+				discardEntry(task)
+				if importAs == "archives" {
+					return fmt.Errorf("scanning %s: virus %q: %v", hdr.Name, virus, err)
+				}
+				fileErrCh <- &ErrorEvent{Filename: key, Size: task.Size,
+					Err: fmt.Errorf("virus found in %s: %s %v", key, virus, err)}
+				continue
+			}
+		}
+
+		if importAs == "contents" {
+			if err := uploadWorkFile(ctx, dstBucket, task); err != nil {
+				discardEntry(task)
+				fileErrCh <- &ErrorEvent{Filename: key, Size: task.Size, Err: err}
+				continue
+			}
+			imported[name+"\x00"+hdr.Name] = key
+			atomic.AddInt64(&UploadedArchivedFiles, 1)
+		}
+		discardEntry(task)
+	}
+
+	if upload && importAs == "contents" {
+		importDirMarkers(ctx, entries, seen)
+	}
+
+	// Read to the end so the whole archive is hashed
+	_, err = io.Copy(io.Discard, in)
+	return err
+}
+
+// importDirMarkers recreates the folder markers which were archived as tar
+// directories, or only in the manifest, as empty objects under their keys.
+func importDirMarkers(ctx context.Context, entries map[string]*ManifestEntry, seen map[string]bool) {
+	for _, name := range slices.Sorted(maps.Keys(entries)) {
+		entry := entries[name]
+		if !isDirMarker(entry) || seen[name] {
+			continue
+		}
+		task := &WorkFile{Filename: entry.Key, LastModified: entry.LastModified, Attrs: entry.Attributes}
+		if err := uploadWorkFile(ctx, dstBucket, task); err != nil {
+			fileErrCh <- &ErrorEvent{Filename: entry.Key, Err: err}
+			continue
+		}
+		atomic.AddInt64(&UploadedArchivedFiles, 1)
+	}
+}
+
+// checkManifestDigests compares an entry with the digests its manifest line
+// records: the checksum and custody digest of the bytes in the tar and the
+// SHA-256 of the contents, which is only known once any dictionary
+// compression is undone.  The checksum file is not signed, so with VERIFY_KEY
+// every entry must be bound to the signed manifest by at least one of them.
+func checkManifestDigests(task *WorkFile, entry *ManifestEntry, sumAlgorithm string, compressed, decoded bool) error {
+	checked := false
+	if entry.Custody != nil && entry.Custody.Archived != "" {
+		if entry.Custody.Archived != task.Custody.Archived {
+			return fmt.Errorf("entry %s digest %s does not match the manifest custody digest %s", entry.Name, task.Custody.Archived, entry.Custody.Archived)
+		}
+		checked = true
+	}
+	if algorithm, want, ok := strings.Cut(entry.Checksum, ":"); ok && !compressed {
+		info, known := checksumAlgorithms[algorithm]
+		if !known {
+			return fmt.Errorf("entry %s has an unknown checksum algorithm %q", entry.Name, algorithm)
+		}
+		got := task.Custody.Archived
+		if algorithm != sumAlgorithm || decoded {
+			var err error
+			if got, err = contentDigest(task, info.new()); err != nil {
+				return err
+			}
+		}
+		if got != want {
+			return fmt.Errorf("entry %s digest %s does not match the manifest checksum %s", entry.Name, got, want)
+		}
+		checked = true
+	}
+	if entry.SHA256 != "" && !compressed {
+		got := task.Custody.Archived
+		if sumAlgorithm != "sha256" || decoded {
+			var err error
+			if got, err = contentDigest(task, sha256.New()); err != nil {
+				return err
+			}
+		}
+		if got != entry.SHA256 {
+			return fmt.Errorf("entry %s digest %s does not match the manifest sha256 %s", entry.Name, got, entry.SHA256)
+		}
+		checked = true
+	}
+	if verifyKey != "" && !checked {
+		return fmt.Errorf("entry %s has no digest in the signed manifest", entry.Name)
+	}
+	return nil
+}
+
+// decompressArchive returns the tar stream of an archive read from in, with
+// the codec its name calls for.
+func decompressArchive(name string, in io.Reader) (io.Reader, func(), error) {
+	switch codecForName(name) {
+	case "gzip":
+		gz, err := gzip.NewReader(in)
+		if err != nil {
+			return nil, nil, err
+		}
+		return gz, func() { gz.Close() }, nil
+	case "zstd":
+		zr, err := zstd.NewReader(in)
+		if err != nil {
+			return nil, nil, err
+		}
+		return zr, zr.Close, nil
+	}
+	return in, func() {}, nil
+}
+
+// readEntry reads a tar entry into memory or, if large, a temp file, and
+// records its digest with h as the archived custody digest.
+func readEntry(tr *tar.Reader, hdr *tar.Header, h hash.Hash) (*WorkFile, error) {
+	task := &WorkFile{Filename: hdr.Name, Size: hdr.Size, LastModified: hdr.ModTime}
+	if hdr.Size <= maxMemBytes {
+		var buf bytes.Buffer
+		if _, err := io.Copy(io.MultiWriter(&buf, h), tr); err != nil {
+			return nil, err
+		}
+		task.Bytes = buf.Bytes()
+	} else {
+		tmp, err := createTempFile("s3import-*")
+		if err != nil {
+			return nil, err
+		}
+		task.TempFile = tmp.Name()
+		_, err = io.Copy(io.MultiWriter(tmp, h), tr)
+		if cerr := tmp.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			deleteTempFile(task.TempFile)
+			return nil, err
+		}
+	}
+	task.Custody.Archived = fmt.Sprintf("%x", h.Sum(nil))
+	return task, nil
+}
+
+func discardEntry(task *WorkFile) {
+	if task.TempFile != "" {
+		deleteTempFile(task.TempFile)
+	}
+}
+
+// checkMediaDigest compares a file with its digest in the media manifest.
+func checkMediaDigest(name, path string, mediaDigests map[string]string) error {
+	want, ok := mediaDigests[name]
+	if !ok {
+		return nil
+	}
+	dat, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if got := fmt.Sprintf("%x", sha256.Sum256(dat)); got != want {
+		return fmt.Errorf("%s digest %s does not match the media manifest %s", name, got, want)
+	}
+	return nil
+}
+
+// readChecksums parses a checksum sidecar into the digest of the archive and
+// of each entry.
+func readChecksums(path string) (string, map[string]string, error) {
+	sums := make(map[string]string)
+	if path == "" {
+		return "", sums, nil
+	}
+	dat, err := os.ReadFile(path)
+	if err != nil {
+		return "", nil, err
+	}
+	return parseChecksums(dat)
+}
+
+// parseChecksums parses the contents of a checksum sidecar.
+func parseChecksums(dat []byte) (string, map[string]string, error) {
+	sums := make(map[string]string)
+	var archiveSum string
+	for i, line := range strings.Split(strings.TrimSpace(string(dat)), "\n") {
+		digest, name, ok := strings.Cut(line, "  ")
+		if !ok {
+			return "", nil, fmt.Errorf("malformed checksum line %q", line)
+		}
+		if i == 0 {
+			archiveSum = digest // The archive itself comes first
+			continue
+		}
+		sums[name] = digest
+	}
+	return archiveSum, sums, nil
+}
+
+// readManifest parses a .manifest.jsonl sidecar keyed by entry name.
+func readManifest(path string) (map[string]*ManifestEntry, error) {
+	entries := make(map[string]*ManifestEntry)
+	if path == "" {
+		return entries, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseManifest(f)
+}
+
+// parseManifest parses the lines of a manifest keyed by entry name, and the
+// deduplicated entries, which are not in the tar, by NUL and their key.
+func parseManifest(r io.Reader) (map[string]*ManifestEntry, error) {
+	entries := make(map[string]*ManifestEntry)
+	scanner := bufio.NewScanner(r)
+	for i := 0; scanner.Scan(); i++ {
+		var entry ManifestEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("manifest line %d: %w", i+1, err)
+		}
+		if entry.Ref != nil {
+			// Not in the tar, keyed so they cannot collide with an entry
+			entries["\x00"+entry.Key] = &entry
+			continue
+		}
+		entries[entry.Name] = &entry
+	}
+	return entries, scanner.Err()
+}
+
+// codecForName returns the codec an archive was written with from its name.
+func codecForName(name string) string {
+	ext := archiveExt(name)
+	for codec, info := range archiveCodecs {
+		for _, e := range info.exts {
+			if e == ext {
+				return codec
+			}
+		}
+	}
+	return "none"
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var archiveInfoSidecar = Env("DISABLE_ARCHIVE_INFO", "", "Disable the .info.json file uploaded with each archive") == ""
+
+// ArchiveInfo summarizes an archive for downstream catalogs so they do not
+// need to open the tarball.
+type ArchiveInfo struct {
+	Archive          string         `json:"archive"`
+	Objects          int            `json:"objects"`
+	UncompressedSize int64          `json:"uncompressed_size"`
+	CompressedSize   int64          `json:"compressed_size"`
+	Codec            string         `json:"codec"`
+	Checksum         string         `json:"checksum_algorithm"`
+	OldestModified   time.Time      `json:"oldest_last_modified,omitzero"`
+	NewestModified   time.Time      `json:"newest_last_modified,omitzero"`
+	Scan             *ScanSummary   `json:"scan"`
+	Detection        *DetectSummary `json:"detection,omitempty"`
+	ToolVersion      string         `json:"tool_version"`
+	FIPS             bool           `json:"fips"`
+	Classification   string         `json:"classification,omitempty"`
+	Retention        *Retention     `json:"retention,omitempty"`
+	Created          time.Time      `json:"created"`
+}
+
+// ScanSummary records how the contents of an archive were scanned.
+type ScanSummary struct {
+	Enabled       bool   `json:"enabled"`
+	Scanned       int    `json:"scanned"`           // Entries given a verdict by the scanner, empty ones included
+	Skipped       int    `json:"skipped,omitempty"` // Entries archived unscanned with SCAN_EXCLUDE or SCAN_MAX_SIZE
+	Failed        int    `json:"failed,omitempty"`  // Entries found infected, which could not be scanned or are exceptions
+	Vendor        string `json:"vendor,omitempty"`
+	DBVersion     string `json:"db_version,omitempty"`
+	SignatureDate string `json:"signature_date,omitempty"`
+	Result        string `json:"result,omitempty"`
+}
+
+// DetectSummary records which detection rules the contents of an archive
+// passed through and how many entries were flagged.
+type DetectSummary struct {
+	Rules   []string `json:"rules"`
+	Action  string   `json:"action"`
+	Flagged int      `json:"flagged"`
+}
+
+// WriteInfo writes a <archive>.info.json file describing the closed archive
+// from the entries recorded in its manifest.
+func WriteInfo(tgzFile string) []string {
+	if !archiveInfoSidecar {
+		return nil
+	}
+	info := &ArchiveInfo{
+		Archive:        filepath.Base(tgzFile),
+		Objects:        len(archiveManifest),
+		Codec:          archiveCodec,
+		Checksum:       checksumAlgorithm,
+		ToolVersion:    version,
+		FIPS:           fipsMode,
+		Classification: archiveClass,
+		Retention:      archiveRetention,
+		Created:        time.Now().UTC(),
+		Scan:           &ScanSummary{Enabled: scanningEnabled},
+	}
+	if streamUpload {
+		info.CompressedSize = streamedSize
+	} else if fi, err := os.Stat(tgzFile); err == nil {
+		info.CompressedSize = fi.Size()
+	}
+	if detectionActive {
+		info.Detection = &DetectSummary{Rules: detectRuleList(), Action: detectAction}
+	}
+	for _, entry := range archiveManifest {
+		info.UncompressedSize += entry.Size
+		if len(entry.Findings) > 0 {
+			if info.Detection == nil {
+				// Findings carried over from an earlier run, such as by repack
+				info.Detection = &DetectSummary{Rules: []string{}}
+			}
+			info.Detection.Flagged++
+		}
+		if entry.LastModified.IsZero() {
+			continue
+		}
+		if info.OldestModified.IsZero() || entry.LastModified.Before(info.OldestModified) {
+			info.OldestModified = entry.LastModified
+		}
+		if entry.LastModified.After(info.NewestModified) {
+			info.NewestModified = entry.LastModified
+		}
+	}
+	if scanningEnabled {
+		// Counted from the verdicts of the entries, as an exceptions archive
+		// holds the objects which failed
+		info.Scan.Result = "pass"
+		for _, entry := range archiveManifest {
+			switch {
+			case entry.Exception != "" || strings.HasPrefix(entry.Scan, "virus") || strings.HasPrefix(entry.Scan, "error"):
+				info.Scan.Failed++
+				info.Scan.Result = "fail"
+				if strings.HasPrefix(entry.Scan, "virus") {
+					info.Scan.Scanned++
+				}
+			case strings.HasPrefix(entry.Scan, "skipped"):
+				info.Scan.Skipped++
+			case entry.Scan != "":
+				info.Scan.Scanned++
+			}
+		}
+		info.Scan.Vendor = virusScanMap["vendor"]
+		info.Scan.DBVersion = virusScanMap["version"]
+		info.Scan.SignatureDate = virusScanMap["signature_date"]
+	}
+
+	infoFile := tgzFile + ".info.json"
+	dat, _ := json.MarshalIndent(info, "", "  ")
+	if err := os.WriteFile(infoFile, append(dat, '\n'), 0644); err != nil {
+		log.Fatalf("failed to write archive info file: %v", err)
+	}
+	return []string{infoFile}
+}
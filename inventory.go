@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/klauspost/compress/gzip"
+)
+
+var inventoryManifest = Env("INVENTORY_MANIFEST", "", "manifest.json of a CSV or Parquet S3 Inventory report of SRC_BUCKET (ORC is not supported), a local path or s3://bucket/key, which metadata.jsonl is built from in place of listing the bucket")
+
+// inventoryReport is the manifest.json S3 Inventory writes with each report.
+type inventoryReport struct {
+	SourceBucket      string `json:"sourceBucket"`
+	DestinationBucket string `json:"destinationBucket"` // arn:aws:s3:::bucket
+	FileFormat        string `json:"fileFormat"`        // CSV, ORC or Parquet
+	FileSchema        string `json:"fileSchema"`        // Column names of CSV files
+	Files             []struct {
+		Key  string `json:"key"`
+		Size int64  `json:"size"`
+		MD5  string `json:"MD5checksum"`
+	} `json:"files"`
+}
+
+// inventoryRow is an object of an inventory report.
+type inventoryRow struct {
+	Bucket, Key, ETag        string
+	StorageClass             string
+	Size                     int64
+	HasSize                  bool
+	LastModified             time.Time
+	IsLatest, IsDeleteMarker bool
+}
+
+func initInventory() {
+	if inventoryManifest == "" {
+		return
+	}
+	if workList != "" || urlList != "" {
+		log.Fatal("INVENTORY_MANIFEST cannot be used with WORK_LIST or URL_LIST, which replace the listing too")
+	}
+}
+
+// loadInventory writes the metadata file from the inventory report of
+// INVENTORY_MANIFEST rather than listing the bucket, which for a bucket of
+// billions of objects takes days and costs a request per thousand.  The
+// report is as old as its last daily or weekly run, so objects written since
+// are not archived, and those deleted since fail to download.
+func loadInventory(ctx context.Context) (totalSize, objectCount int64, err error) {
+	s3Ready.Wait() // Wait for the S3 client to be ready
+	report, err := readInventoryManifest(ctx)
+	if err != nil {
+		return 0, 0, fmt.Errorf("reading INVENTORY_MANIFEST: %w", err)
+	}
+	if report.SourceBucket != srcBucket {
+		return 0, 0, fmt.Errorf("INVENTORY_MANIFEST is an inventory of bucket %q, not SRC_BUCKET %q", report.SourceBucket, srcBucket)
+	}
+	if format := strings.ToLower(report.FileFormat); format != "csv" && format != "parquet" {
+		return 0, 0, fmt.Errorf("%s inventories are not supported, configure the inventory as CSV or Parquet", report.FileFormat)
+	}
+	bucket := strings.TrimPrefix(report.DestinationBucket, "arn:aws:s3:::")
+	log.Printf("Loading metadata from the %s inventory of %s, %d files in %s", report.FileFormat, srcBucket, len(report.Files), bucket)
+
+	partialName := metadataFileName + ".partial"
+	metadataFile, err := os.Create(partialName)
+	if err != nil {
+		log.Fatalf("failed to create metadata.json: %v", err)
+	}
+	metadataBuf := bufio.NewWriter(metadataFile)
+
+	add := func(row inventoryRow) {
+		prefix, listed := listingPrefix(row.Key)
+		if (row.Bucket != "" && row.Bucket != srcBucket) || !listed || !row.IsLatest || !keySelected(row.Key) {
+			return
+		}
+		if Env("PREFIX_DELIM", "", "Use delimitor") != "" && strings.Contains(strings.TrimPrefix(row.Key, prefix), "/") {
+			return // Not listed with a delimiter
+		}
+		entry := MetaEntry{Key: row.Key, Size: row.Size, LastModified: row.LastModified, ETag: row.ETag}
+		if row.StorageClass != "STANDARD" {
+			entry.StorageClass = row.StorageClass
+		}
+		switch {
+		case row.IsDeleteMarker && recordDeleteMarkers:
+			entry = MetaEntry{Key: row.Key, LastModified: row.LastModified, DeleteMarker: true}
+		case row.IsDeleteMarker || !row.HasSize:
+			return
+		default:
+			totalSize += row.Size
+		}
+		objectCount++
+		dat, _ := json.Marshal(entry)
+		metadataBuf.Write(dat)
+		metadataBuf.WriteByte('\n')
+	}
+	for _, file := range report.Files {
+		if err := readInventoryFile(ctx, report, bucket, file.Key, file.MD5, add); err != nil {
+			metadataFile.Close()
+			os.Remove(partialName)
+			return 0, 0, fmt.Errorf("inventory file %s: %w", file.Key, err)
+		}
+	}
+
+	summaryLine := fmt.Sprintf(`{"total_objects":%d,"total_size":%d}`+"\n", objectCount, totalSize)
+	metadataBuf.WriteString(summaryLine)
+	if err := metadataBuf.Flush(); err != nil {
+		log.Fatalln("Error writing metadata,", err)
+	}
+	if err := metadataFile.Close(); err != nil {
+		log.Fatalln("Error closing metadata file,", err)
+	}
+	if err := os.Rename(partialName, metadataFileName); err != nil {
+		log.Fatalln("Error renaming metadata file,", err)
+	}
+	log.Printf("Metadata file %s created from the inventory with %d objects and total size %d bytes.\n", metadataFileName, objectCount, totalSize)
+	return
+}
+
+// readInventoryManifest reads the manifest.json of INVENTORY_MANIFEST.
+func readInventoryManifest(ctx context.Context) (*inventoryReport, error) {
+	var dat []byte
+	if rest, ok := strings.CutPrefix(inventoryManifest, "s3://"); ok {
+		bucket, key, _ := strings.Cut(rest, "/")
+		out, err := s3client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+		if err != nil {
+			return nil, err
+		}
+		defer out.Body.Close()
+		if dat, err = io.ReadAll(out.Body); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if dat, err = os.ReadFile(inventoryManifest); err != nil {
+			return nil, err
+		}
+	}
+	report := &inventoryReport{}
+	if err := json.Unmarshal(dat, report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// readInventoryFile downloads a data file of the report, checks it against
+// the checksum of the manifest and passes each of its rows to add.
+func readInventoryFile(ctx context.Context, report *inventoryReport, bucket, key, sum string, add func(inventoryRow)) error {
+	out, err := s3client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		return err
+	}
+	defer out.Body.Close()
+	hash := md5.New()
+	body := io.TeeReader(out.Body, hash)
+	checked := func() error {
+		io.Copy(io.Discard, body)
+		if got := hex.EncodeToString(hash.Sum(nil)); sum != "" && got != sum {
+			return fmt.Errorf("MD5 %s does not match %s in the manifest", got, sum)
+		}
+		return nil
+	}
+
+	switch strings.ToLower(report.FileFormat) {
+	case "csv":
+		// The rows are read as they arrive, and only used once the whole file checks out
+		var rows []inventoryRow
+		if err := readInventoryCSV(body, report.FileSchema, func(row inventoryRow) { rows = append(rows, row) }); err != nil {
+			return err
+		}
+		if err := checked(); err != nil {
+			return err
+		}
+		for _, row := range rows {
+			add(row)
+		}
+		return nil
+	case "parquet":
+		// Parquet is read from its footer, so the file is downloaded first
+		f, err := os.CreateTemp("", "inventory-*.parquet")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		size, err := io.Copy(f, body)
+		if err != nil {
+			return err
+		}
+		if err := checked(); err != nil {
+			return err
+		}
+		return readInventoryParquet(f, size, add)
+	}
+	return fmt.Errorf("%s inventories are not supported, configure the inventory as CSV or Parquet", report.FileFormat)
+}
+
+// readInventoryCSV reads a gzipped CSV data file, without a header, whose
+// columns are named by the fileSchema of the manifest.
+func readInventoryCSV(r io.Reader, schema string, add func(inventoryRow)) error {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	columns := make(map[string]int)
+	for i, name := range strings.Split(schema, ",") {
+		columns[strings.TrimSpace(name)] = i
+	}
+	field := func(record []string, name string) (string, bool) {
+		i, ok := columns[name]
+		if !ok || i >= len(record) {
+			return "", false
+		}
+		return record[i], true
+	}
+	cr := csv.NewReader(zr)
+	cr.FieldsPerRecord = -1
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		var row inventoryRow
+		row.Bucket, _ = field(record, "Bucket")
+		key, _ := field(record, "Key")
+		// Keys are URL encoded, as they may hold anything
+		if row.Key, err = url.QueryUnescape(key); err != nil {
+			return fmt.Errorf("key %q: %w", key, err)
+		}
+		if size, ok := field(record, "Size"); ok && size != "" {
+			if row.Size, err = strconv.ParseInt(size, 10, 64); err != nil {
+				return fmt.Errorf("key %q: size %q: %w", row.Key, size, err)
+			}
+			row.HasSize = true
+		}
+		if modified, ok := field(record, "LastModifiedDate"); ok && modified != "" {
+			if row.LastModified, err = time.Parse(time.RFC3339, modified); err != nil {
+				return fmt.Errorf("key %q: last modified %q: %w", row.Key, modified, err)
+			}
+		}
+		etag, _ := field(record, "ETag")
+		row.ETag = strings.Trim(etag, `"`)
+		latest, ok := field(record, "IsLatest")
+		row.IsLatest = !ok || latest == "true" // Inventories of current versions only have no IsLatest
+		row.StorageClass, _ = field(record, "StorageClass")
+		marker, _ := field(record, "IsDeleteMarker")
+		row.IsDeleteMarker = marker == "true"
+		add(row)
+	}
+}
+
+// readInventoryParquet reads a Parquet data file of the report.
+func readInventoryParquet(r io.ReaderAt, size int64, add func(inventoryRow)) error {
+	names := []string{"bucket", "key", "size", "last_modified_date", "e_tag", "is_latest", "is_delete_marker", "storage_class"}
+	return readParquet(r, size, names, func(v []any) error {
+		row := inventoryRow{IsLatest: true}
+		row.Bucket, _ = v[0].(string)
+		row.Key, _ = v[1].(string)
+		row.Size, row.HasSize = v[2].(int64)
+		switch modified := v[3].(type) {
+		case int64: // TIMESTAMP_MILLIS
+			row.LastModified = time.UnixMilli(modified).UTC()
+		case time.Time:
+			row.LastModified = modified
+		}
+		etag, _ := v[4].(string)
+		row.ETag = strings.Trim(etag, `"`)
+		if latest, ok := v[5].(bool); ok {
+			row.IsLatest = latest
+		}
+		row.IsDeleteMarker, _ = v[6].(bool)
+		row.StorageClass, _ = v[7].(string)
+		add(row)
+		return nil
+	})
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"log"
+	"path"
+	"regexp"
+	"strings"
+)
+
+var (
+	includeKeys = Env("INCLUDE", "", "Comma separated patterns of the keys archived, globs matched on the key, or on the base name for a glob without a slash, with ** across slashes, or re:<RE2> on the key")
+	excludeKeys = Env("EXCLUDE", "", "Comma separated patterns of keys not archived, as for INCLUDE, taking precedence over it")
+
+	includePatterns, excludePatterns []keyPattern
+	keyFilterActive                  bool
+)
+
+// keyPattern is a pattern of INCLUDE or EXCLUDE compiled to a regexp.
+type keyPattern struct {
+	re       *regexp.Regexp
+	baseName bool // A glob without a slash, matched on the base name
+}
+
+func initKeyFilter() {
+	includePatterns = compileKeyPatterns("INCLUDE", includeKeys)
+	excludePatterns = compileKeyPatterns("EXCLUDE", excludeKeys)
+	keyFilterActive = len(includePatterns) > 0 || len(excludePatterns) > 0
+	if keyFilterActive && (workList != "" || urlList != "") {
+		log.Fatal("INCLUDE and EXCLUDE filter the listing, and cannot be used with WORK_LIST or URL_LIST")
+	}
+}
+
+func compileKeyPatterns(name, list string) []keyPattern {
+	var patterns []keyPattern
+	for _, p := range strings.Split(list, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		expr, baseName := globRegexp(p), !strings.Contains(p, "/")
+		if rest, ok := strings.CutPrefix(p, "re:"); ok {
+			expr, baseName = rest, false
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			log.Fatalf("invalid %s pattern %q: %v", name, p, err)
+		}
+		patterns = append(patterns, keyPattern{re: re, baseName: baseName})
+	}
+	return patterns
+}
+
+// globRegexp translates a glob to an anchored regexp: * and ? match within
+// a path element, and ** across them, so tmp/** is everything under tmp/.
+func globRegexp(glob string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if strings.HasPrefix(glob[i:], "**/") {
+				b.WriteString("(?:.*/)?") // Any depth, including none
+				i += 2
+			} else if strings.HasPrefix(glob[i:], "**") {
+				b.WriteString(".*")
+				i++
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			if j := strings.IndexByte(glob[i+1:], ']'); j >= 0 {
+				class := glob[i+1 : i+1+j]
+				if strings.HasPrefix(class, "!") {
+					class = "^" + class[1:]
+				}
+				b.WriteString("[" + class + "]")
+				i += j + 1
+				continue
+			}
+			b.WriteString(`\[`)
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+func matchKeyPatterns(patterns []keyPattern, key string) bool {
+	for _, p := range patterns {
+		name := key
+		if p.baseName {
+			name = path.Base(key)
+		}
+		if p.re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// keySelected reports whether a key passes INCLUDE and EXCLUDE.
+func keySelected(key string) bool {
+	if !keyFilterActive {
+		return true
+	}
+	if len(includePatterns) > 0 && !matchKeyPatterns(includePatterns, key) {
+		return false
+	}
+	return !matchKeyPatterns(excludePatterns, key)
+}
+
+// listingSelected reports whether an object of the listing is archived by
+// the filters applied as metadata.jsonl is read: INCLUDE and EXCLUDE, SINCE
+// and UNTIL, and MIN_OBJECT_SIZE and MAX_OBJECT_SIZE.
+func listingSelected(entry MetaEntry) bool {
+	return keySelected(entry.Key) && inModifiedWindow(entry) && objectSizeReason(entry) == ""
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var (
+	keyStripPrefix = Env("KEY_STRIP_PREFIX", "", "Prefix removed from keys when naming tar entries")
+	keyRewrite     = Env("KEY_REWRITE", "", "Regex applied to tar entry names, as PATTERN=>REPLACEMENT")
+	keyAddPrefix   = Env("KEY_ADD_PREFIX", "", "Prefix added to tar entry names")
+
+	keyRewriteRegexp  *regexp.Regexp
+	keyRewriteReplace string
+)
+
+func initKeyRewrite() {
+	if keyRewrite == "" {
+		return
+	}
+	pattern, replace, ok := strings.Cut(keyRewrite, "=>")
+	if !ok {
+		log.Fatalf("KEY_REWRITE must be of the form PATTERN=>REPLACEMENT: %q", keyRewrite)
+	}
+	var err error
+	if keyRewriteRegexp, err = regexp.Compile(pattern); err != nil {
+		log.Fatalf("invalid KEY_REWRITE pattern %q: %v", pattern, err)
+	}
+	keyRewriteReplace = replace
+}
+
+// entryName maps an object key to the name of its tar entry by stripping
+// KEY_STRIP_PREFIX, applying KEY_REWRITE and prepending KEY_ADD_PREFIX.  If
+// the rules leave nothing behind the key is used instead.  Leading slashes are
+// dropped and "." and ".." segments escaped as %2E, so no entry can be
+// extracted outside the target directory.
+func entryName(key string) string {
+	name := strings.TrimPrefix(key, keyStripPrefix)
+	if keyRewriteRegexp != nil {
+		name = keyRewriteRegexp.ReplaceAllString(name, keyRewriteReplace)
+	}
+	name = safeEntryName(keyAddPrefix + name)
+	if name == "" {
+		if name = safeEntryName(key); name == "" {
+			return url.PathEscape(key) // Nothing but slashes
+		}
+	}
+	return name
+}
+
+// safeEntryName escapes the segments of name which would climb out of, or
+// point at, the extraction directory.
+func safeEntryName(name string) string {
+	segments := strings.Split(strings.TrimLeft(name, "/"), "/")
+	for i, seg := range segments {
+		if seg == "." || seg == ".." {
+			segments[i] = strings.ReplaceAll(seg, ".", "%2E")
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// uniqueEntryName returns name with ext, or with a ~N suffix before ext if
+// an entry of the open archive already has that name, so two keys mapping to
+// one name do not overwrite each other on extraction.  The manifest maps each
+// key to its entry either way.
+func uniqueEntryName(key, name, ext string) string {
+	unique := name + ext
+	for n := 2; ; n++ {
+		if _, ok := archiveNames[unique]; !ok {
+			break
+		}
+		unique = fmt.Sprintf("%s~%d%s", name, n, ext)
+	}
+	if unique != name+ext {
+		log.Printf("Entry %s of %s is already in the archive, storing it as %s", name+ext, key, unique)
+	}
+	archiveNames[unique] = struct{}{}
+	return unique
+}
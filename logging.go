@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+var (
+	// Read before the settings are printed, which happens as they are read
+	logJSON    = os.Getenv("LOG_FORMAT") == "json"
+	jsonLogger = slog.New(levelHandler{slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})})
+
+	progressInterval = EnvInt("PROGRESS_INTERVAL", 60, "Seconds between the progress lines logged when stderr is not a terminal (0 to disable)")
+	progressTTY      bool // The progress line is redrawn in place on a terminal
+)
+
+// initLogging routes the log package, and the clamav and awscli loggers,
+// through slog with LOG_FORMAT=json, and shows the progress line only when
+// stderr is a terminal.
+func initLogging() {
+	switch Env("LOG_FORMAT", "text", "Format of the log on stderr: text, or json for one object per line with time, level and msg") {
+	case "text":
+		if fi, err := os.Stderr.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+			progressTTY = true
+		}
+	case "json":
+		slog.SetDefault(jsonLogger)
+		clamLog = slog.NewLogLogger(jsonLogger.Handler().WithAttrs([]slog.Attr{slog.String("component", "clamav")}), slog.LevelInfo)
+		awscliLog = slog.NewLogLogger(jsonLogger.Handler().WithAttrs([]slog.Attr{slog.String("component", "awscli")}), slog.LevelInfo)
+	default:
+		log.Fatalf("unknown LOG_FORMAT %q, must be text or json", os.Getenv("LOG_FORMAT"))
+	}
+}
+
+// levelHandler sets the level of the lines written with the log package,
+// which all arrive as INFO, from how the message starts, so failures can be
+// picked out by level.
+type levelHandler struct {
+	slog.Handler
+}
+
+func (h levelHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level == slog.LevelInfo {
+		r.Level = messageLevel(r.Message)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return levelHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h levelHandler) WithGroup(name string) slog.Handler {
+	return levelHandler{h.Handler.WithGroup(name)}
+}
+
+// messageLevel tells failures and warnings from the rest of the log lines.
+func messageLevel(msg string) slog.Level {
+	lower := strings.ToLower(msg)
+	for _, prefix := range []string{"failed", "error", "invalid", "unknown", "unable", "could not", "couldn't", "cannot"} {
+		if strings.HasPrefix(lower, prefix) {
+			return slog.LevelError
+		}
+	}
+	for _, prefix := range []string{"warning", "warn:"} {
+		if strings.HasPrefix(lower, prefix) {
+			return slog.LevelWarn
+		}
+	}
+	return slog.LevelInfo
+}
+
+// printSetting prints a setting as it is read, as a line of the table at the
+// top of the log or, with LOG_FORMAT=json, as a "setting" record.
+func printSetting(env string, value any, isDefault bool, usage string) {
+	if logJSON {
+		jsonLogger.Info("setting", "env", env, "value", value, "default", isDefault, "usage", usage)
+		return
+	}
+	setting := fmt.Sprintf("%s=%q", env, value)
+	if _, ok := value.(int); ok {
+		setting = fmt.Sprintf("%s=%d", env, value)
+	}
+	if isDefault {
+		setting += " (default)"
+	}
+	fmt.Fprintf(os.Stderr, "  %-30s # %s\n", setting, usage)
+}
+
+// logProgress logs the progress line, on its own line, when stderr is not a
+// terminal.  With LOG_FORMAT=json the counters are fields of the record.
+func logProgress(line string) {
+	if !logJSON {
+		log.Println("Progress:", line)
+		return
+	}
+	slog.Info("progress",
+		"downloaded_files", DownloadedFiles, "total_files", TotalFiles,
+		"downloaded_bytes", DownloadedBytes, "total_bytes", TotalBytes,
+		"scanned_files", ScannedFiles,
+		"uploaded_archives", UploadedFiles, "uploaded_files", UploadedArchivedFiles, "uploaded_bytes", UploadedBytes,
+		"errored_files", ErroredFiles,
+		"line", line)
+}
@@ -9,11 +9,13 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"sync/atomic"
 	"time"
 )
 
 var (
-	metadataFileName = "metadata.jsonl"
+	metadataFileName = Env("METADATA_FILE", "metadata.jsonl", "Listing of the source objects, built on the first run and read on restarts")
+	errorLogName     = Env("ERROR_LOG", "error.log", "Log of the objects which failed, one JSON record per line")
 	sizeCapLimit     int64
 	debug            = Env("DEBUG", "", "Enable debugging") != ""
 	ArchiveName      = Env("ARCHIVE_NAME", "archive_%07d.tgz", "Output template")
@@ -22,9 +24,61 @@ var (
 )
 
 func main() {
-	fmt.Printf("Starting bucket-archiver v%s: downloading, archiving, and uploading S3 objects.\n", version)
+	initLogging()
+	Println(fmt.Sprintf("Starting bucket-archiver v%s: downloading, archiving, and uploading S3 objects.", version))
+	initFIPS()
+	initChecksum()
+	initSimulate()
+	initAssumeRole()
 	initS3()
-	initScan()
+	initBudget()
+	initCDN()
+	initURLList()
+	initPriority()
+	initEnrich()
+	initReconcile()
+	initCatalog()
+	initDeleteMarkers()
+	initPrefixes()
+	initInventory()
+	initModifiedWindow()
+	initKeyFilter()
+	initSizeFilter()
+	initGlacier()
+	initSSE()
+	initRepack()
+	initEvents()
+	initArchiveTemplate()
+	initDstAttrs()
+	initArchiveName()
+	initArchiveNaming()
+	initWorkQueue()
+	initStateTable()
+	runPreflight(context.Background())
+	if workMode != modeCoordinator && workMode != modeServe {
+		initDefinitions()
+		initScan()
+		initScanSkip()
+	}
+	initTempDisk()
+	initTempEncryption()
+	initObjectTimeout()
+	initKeyRewrite()
+	initClassification()
+	initDetect()
+	initRetention()
+	initExport()
+	initDelete()
+	initSigning()
+	initTarFormat()
+	initArchiveVerify()
+	initCanary()
+	initStreamUpload()
+	enterWorkDir()
+	enterSimulateDir()
+	initUploadLog()
+	initStateFile()
+	loadDedupIndex()
 
 	// Parse SIZECAP environment variable if set, otherwise use default
 	sizeCapStr := Env("SIZECAP", "2G", "Limit the size of the uncompressed archive payload")
@@ -36,6 +90,9 @@ func main() {
 	} else if sizeCapLimit < 100 {
 		log.Fatalf("SIZECAP value %d is too small; must be at least 100 bytes", sizeCapLimit)
 	}
+	initArchiveStreams()
+	initExceptions()
+	initChunking()
 
 	log.Println("Making pipeline channels.")
 	var (
@@ -51,45 +108,105 @@ func main() {
 	// Default context for processing
 	ctx := context.Background()
 
-	// Check if metadata file exists locally, if not, load metadata from S3
-	//
-	// If the metadata file exists, read it to get total size and object count
-	// If it doesn't exist, create it by listing objects in the source bucket
-	if _, err := os.Stat(metadataFileName); err == nil {
-		log.Printf("metadata file %s already exists in the local filesystem", metadataFileName)
+	if workMode == modeServe {
+		// Answer catalog queries instead of archiving
+		RunServe(ctx)
+		return
+	}
 
-		// Read metadata from local file
-		fileStats, err := ReadLastLineJSONStats(metadataFileName)
-		if err != nil {
-			log.Printf("failed to read metadata file: %v", err)
+	// Pick the source of the objects to archive
+	readTasks, streaming := ReadMetadata, false
+	if urlList != "" {
+		readTasks = ReadURLList
+	} else if workList != "" {
+		if workMode == modeWorker {
+			log.Fatal("WORK_LIST cannot be used in worker mode")
+		}
+		readTasks = ReadWorkList
+	} else if workMode != modeWorker && workMode != modeImport && workMode != modeRestore && workMode != modeVerify && workMode != modeBench && workMode != modeRepack && workMode != modeEvents {
+		// Check if metadata file exists locally, if not, load metadata from S3
+		//
+		// If the metadata file exists, read it to get total size and object count
+		// If it doesn't exist, create it by listing objects in the source bucket
+		if _, err := os.Stat(metadataFileName); err == nil {
+			log.Printf("metadata file %s already exists in the local filesystem", metadataFileName)
+
+			// Read metadata from local file
+			fileStats, err := ReadLastLineJSONStats(metadataFileName)
+			if err != nil {
+				log.Printf("failed to read metadata file: %v", err)
+			} else {
+				TotalBytes = fileStats.Size
+				TotalFiles = fileStats.Count
+			}
+		} else if os.IsNotExist(err) && overlapListing && inventoryManifest == "" && subSetFiles == "" && workMode == "" && !priorityActive {
+			// Process the objects as they are listed
+			log.Printf("creating metadata file %q while processing", metadataFileName)
+			readTasks, streaming = StreamMetadata, true
+		} else if os.IsNotExist(err) {
+			log.Printf("creating metadata file %q", metadataFileName)
+			if overlapListing {
+				log.Println("OVERLAP_LISTING is ignored with INVENTORY_MANIFEST, SUBSET, PRIORITY_PREFIXES and PRIORITY_LIST and in coordinator and estimate modes, which need the full listing")
+			}
+			// Create metadata file if it doesn't exist
+			if inventoryManifest != "" {
+				TotalBytes, TotalFiles, err = loadInventory(ctx)
+			} else {
+				TotalBytes, TotalFiles, err = loadMetadata(ctx, srcBucket, nil)
+			}
+			if err != nil {
+				log.Fatalf("failed to load metadata: %v", err)
+			}
 		} else {
-			TotalBytes = fileStats.Size
-			TotalFiles = fileStats.Count
+			log.Fatalf("error generating metadata file: %v", err)
 		}
-	} else if os.IsNotExist(err) {
-		log.Printf("creating metadata file %q", metadataFileName)
-		// Create metadata file if it doesn't exist
-		TotalBytes, TotalFiles, err = loadMetadata(ctx, srcBucket)
-		if err != nil {
-			log.Fatalf("failed to load metadata: %v", err)
+		if !streaming {
+			log.Printf("Total objects: %d, Total size: %s", TotalFiles, humanizeBytes(TotalBytes))
+			validateTarEntries()
 		}
-	} else {
-		log.Fatalf("error generating metadata file: %v", err)
+		reportResume()
+	}
+
+	if workMode == modeCoordinator {
+		// Read the metadata and pack it into work units for the workers
+		go readTasks(ctx, toDownload)
+		EnqueueWork(ctx, toDownload)
+		return
 	}
-	log.Printf("Total objects: %d, Total size: %s", TotalFiles, humanizeBytes(TotalBytes))
 
 	scanReady.Wait() // Wait for the ClamAV instance to be ready
 
+	if workMode == modeBench {
+		// Measure this host with synthetic objects instead of archiving
+		RunBench(ctx)
+		return
+	}
+
+	if workMode == modeEstimate {
+		// Project the run from a sample of the objects instead of archiving
+		RunEstimate(ctx)
+		return
+	}
+
+	// Clean up the multipart uploads left behind by runs which crashed
+	abortOrphanedUploads(ctx)
+
+	// Number the archives after those of earlier runs
+	continueNumbering(ctx)
+
 	// Create a channel for error events to be handled by the error logger goroutine
+	errLogDone := make(chan struct{})
 	go func() {
+		defer close(errLogDone)
 		log.Println("Watching for errors...")
-		f, err := os.OpenFile("error.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		f, err := os.OpenFile(errorLogName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 		if err != nil {
 			log.Fatalf("failed to open err log file: %v", err)
 		}
 		defer f.Close()
 
 		for errEvent := range fileErrCh {
+			errEvent.Run = runUUID
 			data, err := json.Marshal(errEvent)
 			if err != nil {
 				log.Printf("failed to marshal error event: %v", err)
@@ -98,33 +215,161 @@ func main() {
 			if _, err := fmt.Fprintf(f, "%s\n", data); err != nil {
 				log.Printf("failed to write error event to file: %v", err)
 			}
+			atomic.AddInt64(&ErroredFiles, 1)
+			recordState(stateObject, errEvent.Filename, "failed", errEvent.Size, "", errEvent.Err)
+			objectFinished(errEvent.Filename)
+			if retryPasses > 0 {
+				retryFailed(errEvent)
+			}
 		}
 	}()
 
-	// Read the metadata and send it to the toDownload pipline
-	go ReadMetadata(ctx, toDownload)
+	if workMode == modeImport {
+		// Verify and upload archives brought in on local media
+		RunImport(ctx)
+		abortOrphanedUploads(ctx)
+		close(fileErrCh)
+		<-errLogDone
+		log.Println("Import completed.")
+		return
+	}
+	if workMode == modeRestore {
+		// Put the objects held by the archives of SRC_BUCKET back into DST_BUCKET
+		RunRestore(ctx)
+		close(fileErrCh)
+		<-errLogDone
+		log.Println("Restore completed.")
+		return
+	}
+	if workMode == modeVerify {
+		// Read back the archives of DST_BUCKET and compare them with SRC_BUCKET
+		r := RunVerify(ctx)
+		close(fileErrCh)
+		<-errLogDone
+		log.Printf("Verify: %d archives read back, %d unreadable; of %d objects in %s, %d matched, %d missing and %d mismatched, with %d archived objects no longer there",
+			r.Archives, r.Unreadable, r.Objects, srcBucket, r.Matched, r.Missing, r.Mismatched, r.Extra)
+		if r.Unreadable+r.Missing+r.Mismatched+r.Extra > 0 {
+			log.Fatalf("Verify: found problems, see %s", verifyReport)
+		}
+		log.Println("Verify completed.")
+		return
+	}
 
-	StartMetrics(ctx)
+	switch workMode {
+	case modeWorker:
+		// Receive work units from the coordinator and send them to the toDownload pipeline
+		go ReceiveWork(ctx, toDownload)
+	case modeEvents:
+		// Receive the objects created in the source bucket until stopped
+		go ReceiveEvents(ctx, toDownload)
+	case modeRepack:
+		// The entries of the small archives take the place of downloads
+	default:
+		// Read the metadata and send it to the toDownload pipline
+		// through the canary, retry and restore gates when they are enabled
+		out := chan<- *DownloadTask(toDownload)
+		if glacierTier != "" {
+			gated := make(chan *DownloadTask, cap(toDownload))
+			go glacierGate(ctx, gated, out)
+			out = gated
+		}
+		if retryPasses > 0 {
+			gated := make(chan *DownloadTask, cap(toDownload))
+			go retryGate(ctx, gated, out)
+			out = gated
+		}
+		if canaryObjects > 0 {
+			gated := make(chan *DownloadTask, cap(toDownload))
+			go canaryGate(ctx, gated, out)
+			out = gated
+		}
+		go readTasks(ctx, out)
+	}
 
-	// Consume the toDownload, download the file, and send to the downloaded pipeline
-	go Downloader(ctx, toDownload, downloadedFiles)
+	StartMetrics(ctx)
+	StartAutotune(toDownload, downloadedFiles, scannedFiles, ArchiveFiles)
+	startSlowStart(ctx)
 
+	queues := []stageQueue{queueOf("toDownload", toDownload)}
+	var smallFiles chan []*WorkFile // Batches of small objects sent straight to the archiver
+	if workMode == modeRepack {
+		// Read the small archives in DST_BUCKET and send their entries to the downloaded pipeline
+		go RepackArchives(ctx, downloadedFiles)
+	} else {
+		var toFetch <-chan *DownloadTask = toDownload
+		if enrichObjects {
+			// Head the objects for their attributes ahead of the downloads
+			enrichedFiles := make(chan *DownloadTask, EnvInt("CHAN_ENRICHED_FILES", 10, "Buffer size for enrichedFiles channel"))
+			go Enricher(ctx, toDownload, enrichedFiles)
+			toFetch = enrichedFiles
+			queues = append(queues, queueOf("enriched", enrichedFiles))
+		}
+		// Consume the toDownload, download the file, and send to the downloaded pipeline
+		smallFiles = make(chan []*WorkFile, EnvInt("CHAN_SMALL_FILES", 4, "Buffer size for the batches of the smallFiles channel"))
+		go Downloader(ctx, toFetch, downloadedFiles, smallFiles)
+	}
+	if smallFiles != nil {
+		queues = append(queues, queueOf("small", smallFiles))
+	}
+	queues = append(queues, queueOf("downloaded", downloadedFiles))
+	var toArchive <-chan *WorkFile = downloadedFiles
 	if scanningEnabled {
 		// Consume the downloaded, scan, and then send to the scannedFiles pipeline
 		go Scanner(ctx, downloadedFiles, scannedFiles)
+		toArchive = scannedFiles
+		queues = append(queues, queueOf("scanned", scannedFiles))
+	}
 
-		// Consume the scanned files pipeline and put in archive
-		go Archiver(ctx, scannedFiles, ArchiveFiles)
-	} else {
-		// Consume the scanned files pipeline and put in archive
-		go Archiver(ctx, downloadedFiles, ArchiveFiles)
+	if transformCmd != "" {
+		// Consume the scanned files, rewrite their contents, and send to the transformedFiles pipeline
+		transformedFiles := make(chan *WorkFile, EnvInt("CHAN_TRANSFORMED_FILES", 10, "Buffer size for transformedFiles channel"))
+		go Transformer(ctx, toArchive, transformedFiles)
+		toArchive = transformedFiles
+		queues = append(queues, queueOf("transformed", transformedFiles))
 	}
 
-	go Uploader(ctx, ArchiveFiles, Done)
+	if detectionActive {
+		// Inspect the files about to be archived for secrets and personal data
+		detectedFiles := make(chan *WorkFile, EnvInt("CHAN_DETECTED_FILES", 10, "Buffer size for detectedFiles channel"))
+		go Detector(ctx, toArchive, detectedFiles)
+		toArchive = detectedFiles
+		queues = append(queues, queueOf("detected", detectedFiles))
+	}
+
+	// Consume the scanned files pipeline and put in archive
+	go Archiver(ctx, toArchive, smallFiles, ArchiveFiles)
+
+	queues = append(queues, queueOf("archives", ArchiveFiles))
+	var toUpload <-chan *ArchiveFile = ArchiveFiles
+	if verifyArchives {
+		// Read each archive back before it is uploaded
+		verifiedFiles := make(chan *ArchiveFile, EnvInt("CHAN_VERIFIED_FILES", 2, "Buffer size for verifiedFiles channel"))
+		go Verifier(ctx, ArchiveFiles, verifiedFiles)
+		toUpload = verifiedFiles
+		queues = append(queues, queueOf("verified", verifiedFiles))
+	}
+
+	go Uploader(ctx, toUpload, Done)
+	StartWatchdog(ctx, queues)
 
 	<-Done // Wait for all uploads to finish
+	finishRepack(ctx)
+	runSpotChecks(ctx)
+	abortOrphanedUploads(ctx)
 
 	close(fileErrCh) // Close error channel to ensure the logs are written to disk
+	<-errLogDone
+	saveCheckpoint()
+	writeFailedObjects()
+	closeSkipped()
+	flushCatalog(ctx)
+	reconcileListing(ctx)
+	writeRunSummary(ctx)
+	closeStateTable()
+	closeStateFile()
+	if simulating {
+		simulateReport()
+	}
 
 	// Stop the metrics collection and clean up any resources
 	StopMetrics()
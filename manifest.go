@@ -0,0 +1,118 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+const manifestEntryName = ".manifest.jsonl" // Tar entry holding the manifest with EMBED_MANIFEST
+
+var (
+	manifestSidecar = Env("DISABLE_MANIFEST", "", "Disable the .manifest.jsonl file uploaded with each archive") == ""
+	embedManifest   = Env("EMBED_MANIFEST", "", "Also write the manifest as the last entry of each archive, "+manifestEntryName+", so it describes itself once restored") != ""
+
+	archiveManifest []*ManifestEntry // Entries written to the open archive
+)
+
+// ManifestEntry records how an object was stored in an archive.
+type ManifestEntry struct {
+	Key          string           `json:"key"`                     // Original object key
+	Name         string           `json:"name"`                    // Name of the tar entry
+	Size         int64            `json:"size"`                    // Size of the tar entry
+	LastModified time.Time        `json:"last_modified,omitzero"`  // Source object LastModified
+	ETag         string           `json:"etag,omitempty"`          // Source object ETag
+	SHA256       string           `json:"sha256,omitempty"`        // Digest of the object contents
+	Checksum     string           `json:"checksum,omitempty"`      // <algorithm>:<digest> of the contents with CHECKSUM_ALGORITHM
+	Ref          *DedupRef        `json:"ref,omitempty"`           // Entry already holding identical contents
+	Custody      *CustodyDigests  `json:"custody,omitempty"`       // Digests taken at each stage of the pipeline
+	Scan         string           `json:"scan,omitempty"`          // Verdict of the ClamAV scan: clean, empty, virus:, error: or skipped:
+	ScanReport   *ScanReport      `json:"scan_report,omitempty"`   // Engine, signatures and time of the scan
+	Findings     []*DetectFinding `json:"findings,omitempty"`      // Matches of the DETECT rules
+	Retention    *Retention       `json:"retention,omitempty"`     // Records retention policy
+	Attributes   *ObjectAttrs     `json:"attributes,omitempty"`    // Headers, metadata, tags and storage class with RECORD_ATTRIBUTES
+	Run          string           `json:"run"`                     // UUID of the run which archived the object
+	Exception    string           `json:"exception,omitempty"`     // Why the object is in an exceptions archive
+	Chunk        *ChunkInfo       `json:"chunk,omitempty"`         // Part of the object held, when split by CHUNK_THRESHOLD
+	DeleteMarker bool             `json:"delete_marker,omitempty"` // The key was deleted, the entry is a tombstone
+}
+
+// isDirMarker reports whether entry is a folder marker, an empty object whose
+// key ends in a slash.  With EMIT_DIRS it is archived as a tar directory, or
+// only recorded in the manifest when its directory was already written, so
+// it is recreated from the manifest rather than from a regular entry.
+func isDirMarker(entry *ManifestEntry) bool {
+	return entry.Ref == nil && entry.Size == 0 && !entry.DeleteMarker && strings.HasSuffix(entry.Key, "/")
+}
+
+// WriteManifest writes a <archive>.manifest.jsonl file with one line per
+// entry mapping the original object key to its name in the archive.
+func WriteManifest(tgzFile string) []string {
+	if !manifestSidecar {
+		return nil
+	}
+	manifestFile := tgzFile + ".manifest.jsonl"
+	f, err := os.Create(manifestFile)
+	if err != nil {
+		log.Fatalf("failed to create manifest file: %v", err)
+	}
+	buf := bufio.NewWriter(f)
+	writeManifestLines(buf)
+	if err := buf.Flush(); err != nil {
+		log.Fatalf("failed to write manifest file: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatalf("failed to close manifest file: %v", err)
+	}
+	return []string{manifestFile}
+}
+
+// writeManifestLines writes a line for each entry of the open archive.
+func writeManifestLines(w io.Writer) {
+	for _, entry := range archiveManifest {
+		dat, _ := json.Marshal(entry)
+		w.Write(append(dat, '\n'))
+	}
+}
+
+// writeManifestEntry writes the manifest of the open archive as its last
+// entry, so an archive restored without its sidecars still maps its entries
+// back to the original keys, sizes, checksums and scan results.  The name is
+// held back when the archive is opened, so no object can take it.
+func writeManifestEntry() {
+	if !embedManifest || archiveManifest == nil {
+		return
+	}
+	var buf bytes.Buffer
+	writeManifestLines(&buf)
+	header := &tar.Header{
+		Name:    manifestEntryName,
+		Size:    int64(buf.Len()),
+		Mode:    0600,
+		ModTime: tarTime(time.Now()),
+		Format:  archiveTarFormat,
+	}
+	if err := archiveTar.WriteHeader(header); err != nil {
+		log.Fatalf("failed to write tar header for %s: %v", manifestEntryName, err)
+	}
+	h := newChecksum()
+	if _, err := archiveTar.Write(buf.Bytes()); err != nil {
+		log.Fatalf("failed to write %s to tar: %v", manifestEntryName, err)
+	}
+	h.Write(buf.Bytes())
+	archiveSums = append(archiveSums, fmt.Sprintf("%x  %s", h.Sum(nil), manifestEntryName))
+}
+
+// isManifestEntry reports whether an entry read back from an archive is the
+// embedded manifest rather than an object which happens to share its name.
+func isManifestEntry(name string, entries map[string]*ManifestEntry) bool {
+	_, ok := entries[name]
+	return name == manifestEntryName && !ok
+}
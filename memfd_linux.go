@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// sysMemfdCreate is the number of the memfd_create system call, which the
+// syscall package does not define on most architectures.
+var sysMemfdCreate = map[string]uintptr{
+	"386": 356, "amd64": 319, "arm": 385, "arm64": 279, "loong64": 279, "riscv64": 279,
+	"mips": 4354, "mipsle": 4354, "mips64": 5314, "mips64le": 5314,
+	"ppc64": 360, "ppc64le": 360, "s390x": 350,
+}[runtime.GOARCH]
+
+const mfdCloexec = 0x1 // MFD_CLOEXEC
+
+// memFile creates an anonymous file held in memory, which has no path on
+// any filesystem and is freed once its last descriptor is closed.
+func memFile(name string) (*os.File, error) {
+	if sysMemfdCreate == 0 {
+		return nil, errors.New("memfd_create is not known on " + runtime.GOARCH)
+	}
+	p, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return nil, err
+	}
+	fd, _, errno := syscall.Syscall(sysMemfdCreate, uintptr(unsafe.Pointer(p)), mfdCloexec, 0)
+	if errno != 0 {
+		return nil, os.NewSyscallError("memfd_create", errno)
+	}
+	return os.NewFile(fd, "memfd:"+name), nil
+}
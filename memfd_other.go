@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// memFile needs memfd_create, which only Linux has.
+func memFile(name string) (*os.File, error) {
+	return nil, errors.New("memory backed files are only supported on Linux")
+}
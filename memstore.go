@@ -0,0 +1,569 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// memStore is an in-memory ObjectStore.  Buckets are created on first write
+// and everything is lost on exit, which is all tests and offline development
+// of the pipeline need.
+type memStore struct {
+	mu      sync.Mutex
+	buckets map[string]map[string]*memObject
+	uploads map[string]*memUpload
+	markers map[string]map[string]time.Time // Delete markers left by deleted keys, as in a versioned bucket
+	nextID  int
+
+	restoreDelay time.Duration // How long a restore of an archived object takes
+}
+
+type memObject struct {
+	data         []byte
+	contentType  string
+	metadata     map[string]string
+	tags         map[string]string
+	lastModified time.Time
+	etag         string
+	parts        []int64 // Part sizes of a multipart upload
+
+	storageClass string    // GLACIER or DEEP_ARCHIVE for an object which must be restored to be read
+	restoreAsked time.Time // When its restore was requested
+
+	sseCKeyMD5       string // MD5 of the SSE-C key the object is encrypted with
+	sse, sseKMSKeyID string // Server-side encryption it was written with
+}
+
+type memUpload struct {
+	bucket, key string
+	object      *memObject // Attributes of the object once completed
+	parts       map[int32][]byte
+	initiated   time.Time
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		buckets: make(map[string]map[string]*memObject),
+		uploads: make(map[string]*memUpload),
+		markers: make(map[string]map[string]time.Time),
+	}
+}
+
+// seed loads the files under dir into bucket, keyed by their relative path.
+func (m *memStore) seed(bucket, dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		obj := &memObject{data: data, lastModified: info.ModTime().UTC()}
+		obj.etag = memETag(data)
+		m.mu.Lock()
+		m.put(bucket, filepath.ToSlash(rel), obj)
+		m.mu.Unlock()
+		return nil
+	})
+}
+
+func memETag(data []byte) string {
+	return fmt.Sprintf("\"%x\"", md5.Sum(data))
+}
+
+// put stores obj, the caller holds m.mu.
+func (m *memStore) put(bucket, key string, obj *memObject) {
+	b, ok := m.buckets[bucket]
+	if !ok {
+		b = make(map[string]*memObject)
+		m.buckets[bucket] = b
+	}
+	b[key] = obj
+	delete(m.markers[bucket], key) // The new version is the latest
+}
+
+func (m *memStore) get(bucket, key string) (*memObject, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	obj, ok := m.buckets[bucket][key]
+	return obj, ok
+}
+
+func noSuchKey(bucket, key string) error {
+	return &types.NoSuchKey{Message: aws.String(fmt.Sprintf("no such key %s in %s", key, bucket))}
+}
+
+// checkSSEC fails a read of obj made without the SSE-C key it is encrypted
+// with, or with one when it has none, as S3 does.
+func checkSSEC(obj *memObject, keyMD5 *string) error {
+	switch {
+	case obj.sseCKeyMD5 == "" && keyMD5 == nil:
+		return nil
+	case obj.sseCKeyMD5 == "":
+		return &smithy.GenericAPIError{Code: "InvalidRequest", Message: "The encryption parameters are not applicable to this object"}
+	case keyMD5 == nil:
+		return &smithy.GenericAPIError{Code: "InvalidRequest", Message: "The object was stored using a form of Server Side Encryption"}
+	case *keyMD5 != obj.sseCKeyMD5:
+		return &smithy.GenericAPIError{Code: "AccessDenied", Message: "Access Denied"}
+	}
+	return nil
+}
+
+func parseTagging(tagging *string) map[string]string {
+	if tagging == nil {
+		return nil
+	}
+	values, err := url.ParseQuery(*tagging)
+	if err != nil {
+		return nil
+	}
+	tags := make(map[string]string)
+	for k := range values {
+		tags[k] = values.Get(k)
+	}
+	return tags
+}
+
+func (m *memStore) GetObject(ctx context.Context, in *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	bucket, key := aws.ToString(in.Bucket), aws.ToString(in.Key)
+	obj, ok := m.get(bucket, key)
+	if !ok {
+		return nil, noSuchKey(bucket, key)
+	}
+	if in.IfMatch != nil && strings.Trim(*in.IfMatch, `"`) != strings.Trim(obj.etag, `"`) {
+		return nil, fmt.Errorf("PreconditionFailed: %s no longer has ETag %s", key, *in.IfMatch)
+	}
+	if err := checkSSEC(obj, in.SSECustomerKeyMD5); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	_, restored := m.restoreState(obj)
+	m.mu.Unlock()
+	if !restored {
+		return nil, &types.InvalidObjectState{Message: aws.String("The operation is not valid for the object's storage class"),
+			StorageClass: types.StorageClass(obj.storageClass)}
+	}
+	data := obj.data
+	out := &s3.GetObjectOutput{
+		ContentType:  aws.String(obj.contentType),
+		ETag:         aws.String(obj.etag),
+		LastModified: aws.Time(obj.lastModified),
+		Metadata:     maps.Clone(obj.metadata),
+	}
+	if r := aws.ToString(in.Range); r != "" {
+		first, last, ok := strings.Cut(strings.TrimPrefix(r, "bytes="), "-")
+		start, err1 := strconv.ParseInt(first, 10, 64)
+		end, err2 := strconv.ParseInt(last, 10, 64)
+		if last == "" {
+			end, err2 = int64(len(data))-1, nil
+		}
+		if !ok || err1 != nil || err2 != nil || start > end || start >= int64(len(data)) {
+			return nil, fmt.Errorf("invalid range %q for %s of %d bytes", r, key, len(data))
+		}
+		end = min(end, int64(len(data))-1)
+		out.ContentRange = aws.String(fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+		data = data[start : end+1]
+	}
+	out.ContentLength = aws.Int64(int64(len(data)))
+	out.Body = io.NopCloser(bytes.NewReader(data))
+	return out, nil
+}
+
+func (m *memStore) HeadObject(ctx context.Context, in *s3.HeadObjectInput, _ ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	obj, ok := m.get(aws.ToString(in.Bucket), aws.ToString(in.Key))
+	if !ok {
+		return nil, &types.NotFound{Message: aws.String("not found")}
+	}
+	if err := checkSSEC(obj, in.SSECustomerKeyMD5); err != nil {
+		return nil, err
+	}
+	out := &s3.HeadObjectOutput{
+		ContentLength: aws.Int64(int64(len(obj.data))),
+		ContentType:   aws.String(obj.contentType),
+		ETag:          aws.String(obj.etag),
+		LastModified:  aws.Time(obj.lastModified),
+		Metadata:      maps.Clone(obj.metadata),
+
+		ServerSideEncryption: types.ServerSideEncryption(obj.sse),
+		SSEKMSKeyId:          header(obj.sseKMSKeyID),
+	}
+	if obj.sseCKeyMD5 != "" {
+		out.SSECustomerAlgorithm, out.SSECustomerKeyMD5 = aws.String("AES256"), aws.String(obj.sseCKeyMD5)
+	}
+	if obj.storageClass != "" {
+		out.StorageClass = types.StorageClass(obj.storageClass)
+		m.mu.Lock()
+		out.Restore, _ = m.restoreState(obj)
+		m.mu.Unlock()
+	}
+	if n := int(aws.ToInt32(in.PartNumber)); n > 0 {
+		// The length is that of the part, as for a ranged GET of it
+		switch {
+		case len(obj.parts) == 0 && n == 1:
+		case n <= len(obj.parts):
+			out.ContentLength = aws.Int64(obj.parts[n-1])
+			out.PartsCount = aws.Int32(int32(len(obj.parts)))
+		default:
+			return nil, fmt.Errorf("part %d of %s does not exist", n, aws.ToString(in.Key))
+		}
+	}
+	return out, nil
+}
+
+func (m *memStore) GetObjectAttributes(ctx context.Context, in *s3.GetObjectAttributesInput, _ ...func(*s3.Options)) (*s3.GetObjectAttributesOutput, error) {
+	bucket, key := aws.ToString(in.Bucket), aws.ToString(in.Key)
+	obj, ok := m.get(bucket, key)
+	if !ok {
+		return nil, noSuchKey(bucket, key)
+	}
+	if err := checkSSEC(obj, in.SSECustomerKeyMD5); err != nil {
+		return nil, err
+	}
+	out := &s3.GetObjectAttributesOutput{
+		ETag:         aws.String(strings.Trim(obj.etag, "\"")),
+		LastModified: aws.Time(obj.lastModified),
+		ObjectSize:   aws.Int64(int64(len(obj.data))),
+	}
+	if len(obj.parts) > 0 {
+		parts := &types.GetObjectAttributesParts{TotalPartsCount: aws.Int32(int32(len(obj.parts)))}
+		for i, size := range obj.parts {
+			parts.Parts = append(parts.Parts, types.ObjectPart{PartNumber: aws.Int32(int32(i + 1)), Size: aws.Int64(size)})
+		}
+		out.ObjectParts = parts
+	}
+	return out, nil
+}
+
+func (m *memStore) PutObject(ctx context.Context, in *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	var data []byte
+	if in.Body != nil {
+		var err error
+		if data, err = io.ReadAll(in.Body); err != nil {
+			return nil, err
+		}
+	}
+	obj := &memObject{
+		data:         data,
+		contentType:  aws.ToString(in.ContentType),
+		metadata:     maps.Clone(in.Metadata),
+		tags:         parseTagging(in.Tagging),
+		lastModified: time.Now().UTC(),
+		etag:         memETag(data),
+		sse:          string(in.ServerSideEncryption),
+		sseKMSKeyID:  aws.ToString(in.SSEKMSKeyId),
+	}
+	m.mu.Lock()
+	m.put(aws.ToString(in.Bucket), aws.ToString(in.Key), obj)
+	m.mu.Unlock()
+	return &s3.PutObjectOutput{ETag: aws.String(obj.etag)}, nil
+}
+
+func (m *memStore) CopyObject(ctx context.Context, in *s3.CopyObjectInput, _ ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	source, err := url.PathUnescape(strings.TrimPrefix(aws.ToString(in.CopySource), "/"))
+	if err != nil {
+		return nil, err
+	}
+	srcBucket, srcKey, _ := strings.Cut(source, "/")
+	src, ok := m.get(srcBucket, srcKey)
+	if !ok {
+		return nil, noSuchKey(srcBucket, srcKey)
+	}
+	obj := *src
+	obj.lastModified = time.Now().UTC()
+	if in.MetadataDirective == types.MetadataDirectiveReplace {
+		obj.contentType, obj.metadata = aws.ToString(in.ContentType), maps.Clone(in.Metadata)
+	}
+	if in.TaggingDirective == types.TaggingDirectiveReplace {
+		obj.tags = parseTagging(in.Tagging)
+	}
+	if in.ServerSideEncryption != "" {
+		obj.sse, obj.sseKMSKeyID = string(in.ServerSideEncryption), aws.ToString(in.SSEKMSKeyId)
+	}
+	m.mu.Lock()
+	m.put(aws.ToString(in.Bucket), aws.ToString(in.Key), &obj)
+	m.mu.Unlock()
+	return &s3.CopyObjectOutput{CopyObjectResult: &types.CopyObjectResult{
+		ETag: aws.String(obj.etag), LastModified: aws.Time(obj.lastModified)}}, nil
+}
+
+func (m *memStore) DeleteObjects(ctx context.Context, in *s3.DeleteObjectsInput, _ ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+	out := &s3.DeleteObjectsOutput{}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	bucket := aws.ToString(in.Bucket)
+	for _, id := range in.Delete.Objects {
+		if obj, ok := m.buckets[bucket][aws.ToString(id.Key)]; ok && id.ETag != nil && strings.Trim(*id.ETag, `"`) != strings.Trim(obj.etag, `"`) {
+			out.Errors = append(out.Errors, types.Error{Key: id.Key, Code: aws.String("PreconditionFailed"),
+				Message: aws.String("At least one of the pre-conditions you specified did not hold")})
+			continue
+		}
+		if _, ok := m.buckets[bucket][aws.ToString(id.Key)]; ok {
+			if m.markers[bucket] == nil {
+				m.markers[bucket] = make(map[string]time.Time)
+			}
+			m.markers[bucket][aws.ToString(id.Key)] = time.Now().UTC()
+		}
+		delete(m.buckets[bucket], aws.ToString(id.Key))
+		out.Deleted = append(out.Deleted, types.DeletedObject{Key: id.Key})
+	}
+	return out, nil
+}
+
+func (m *memStore) GetObjectTagging(ctx context.Context, in *s3.GetObjectTaggingInput, _ ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error) {
+	bucket, key := aws.ToString(in.Bucket), aws.ToString(in.Key)
+	obj, ok := m.get(bucket, key)
+	if !ok {
+		return nil, noSuchKey(bucket, key)
+	}
+	out := &s3.GetObjectTaggingOutput{TagSet: []types.Tag{}}
+	for _, k := range slices.Sorted(maps.Keys(obj.tags)) {
+		out.TagSet = append(out.TagSet, types.Tag{Key: aws.String(k), Value: aws.String(obj.tags[k])})
+	}
+	return out, nil
+}
+
+// ListObjectsV2 lists keys in order, grouping them into common prefixes by
+// the delimiter.  The continuation token is the last key or prefix returned.
+func (m *memStore) ListObjectsV2(ctx context.Context, in *s3.ListObjectsV2Input, _ ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	bucket := m.buckets[aws.ToString(in.Bucket)]
+	keys := slices.Sorted(maps.Keys(bucket))
+
+	prefix, delimiter := aws.ToString(in.Prefix), aws.ToString(in.Delimiter)
+	after := max(aws.ToString(in.StartAfter), aws.ToString(in.ContinuationToken))
+	maxKeys := int(aws.ToInt32(in.MaxKeys))
+	if maxKeys <= 0 {
+		maxKeys = 1000
+	}
+	out := &s3.ListObjectsV2Output{
+		Name:      in.Bucket,
+		Prefix:    in.Prefix,
+		Delimiter: in.Delimiter,
+		MaxKeys:   aws.Int32(int32(maxKeys)),
+	}
+	var last string
+	for _, key := range keys {
+		if !strings.HasPrefix(key, prefix) || key <= after ||
+			(delimiter != "" && strings.HasSuffix(after, delimiter) && strings.HasPrefix(key, after)) {
+			continue
+		}
+		if len(out.Contents)+len(out.CommonPrefixes) == maxKeys {
+			out.IsTruncated = aws.Bool(true)
+			out.NextContinuationToken = aws.String(last)
+			break
+		}
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				common := key[:len(prefix)+i+len(delimiter)]
+				if common != last {
+					out.CommonPrefixes = append(out.CommonPrefixes, types.CommonPrefix{Prefix: aws.String(common)})
+					last = common
+				}
+				continue
+			}
+		}
+		obj := bucket[key]
+		out.Contents = append(out.Contents, types.Object{
+			Key:          aws.String(key),
+			Size:         aws.Int64(int64(len(obj.data))),
+			ETag:         aws.String(obj.etag),
+			LastModified: aws.Time(obj.lastModified),
+			StorageClass: types.ObjectStorageClass(cmp.Or(obj.storageClass, string(types.ObjectStorageClassStandard))),
+		})
+		last = key
+	}
+	out.KeyCount = aws.Int32(int32(len(out.Contents) + len(out.CommonPrefixes)))
+	if out.IsTruncated == nil {
+		out.IsTruncated = aws.Bool(false)
+	}
+	return out, nil
+}
+
+func (m *memStore) CreateMultipartUpload(ctx context.Context, in *s3.CreateMultipartUploadInput, _ ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nextID++
+	id := strconv.Itoa(m.nextID)
+	m.uploads[id] = &memUpload{
+		bucket: aws.ToString(in.Bucket),
+		key:    aws.ToString(in.Key),
+		object: &memObject{
+			contentType: aws.ToString(in.ContentType),
+			metadata:    maps.Clone(in.Metadata),
+			tags:        parseTagging(in.Tagging),
+			sse:         string(in.ServerSideEncryption),
+			sseKMSKeyID: aws.ToString(in.SSEKMSKeyId),
+		},
+		parts:     make(map[int32][]byte),
+		initiated: time.Now().UTC(),
+	}
+	return &s3.CreateMultipartUploadOutput{Bucket: in.Bucket, Key: in.Key, UploadId: aws.String(id)}, nil
+}
+
+func (m *memStore) UploadPart(ctx context.Context, in *s3.UploadPartInput, _ ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	data, err := io.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	upload, ok := m.uploads[aws.ToString(in.UploadId)]
+	if !ok {
+		return nil, &types.NoSuchUpload{Message: aws.String("no such upload")}
+	}
+	upload.parts[aws.ToInt32(in.PartNumber)] = data
+	return &s3.UploadPartOutput{ETag: aws.String(memETag(data))}, nil
+}
+
+func (m *memStore) CompleteMultipartUpload(ctx context.Context, in *s3.CompleteMultipartUploadInput, _ ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := aws.ToString(in.UploadId)
+	upload, ok := m.uploads[id]
+	if !ok {
+		return nil, &types.NoSuchUpload{Message: aws.String("no such upload")}
+	}
+	numbers := slices.Sorted(maps.Keys(upload.parts))
+	if in.MultipartUpload != nil && len(in.MultipartUpload.Parts) > 0 {
+		numbers = numbers[:0]
+		for _, part := range in.MultipartUpload.Parts {
+			numbers = append(numbers, aws.ToInt32(part.PartNumber))
+		}
+	}
+	// Multipart ETags are the digest of the part digests and the part count
+	var data, sums []byte
+	for _, n := range numbers {
+		part, ok := upload.parts[n]
+		if !ok {
+			return nil, &types.NoSuchUpload{Message: aws.String(fmt.Sprintf("part %d was not uploaded", n))}
+		}
+		data = append(data, part...)
+		upload.object.parts = append(upload.object.parts, int64(len(part)))
+		sum := md5.Sum(part)
+		sums = append(sums, sum[:]...)
+	}
+	obj := upload.object
+	obj.data, obj.lastModified = data, time.Now().UTC()
+	obj.etag = fmt.Sprintf("\"%x-%d\"", md5.Sum(sums), len(numbers))
+	m.put(upload.bucket, upload.key, obj)
+	delete(m.uploads, id)
+	return &s3.CompleteMultipartUploadOutput{Bucket: in.Bucket, Key: in.Key, ETag: aws.String(obj.etag)}, nil
+}
+
+func (m *memStore) AbortMultipartUpload(ctx context.Context, in *s3.AbortMultipartUploadInput, _ ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.uploads, aws.ToString(in.UploadId))
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+// ListMultipartUploads returns every upload in progress under the prefix in
+// one page.
+func (m *memStore) ListMultipartUploads(ctx context.Context, in *s3.ListMultipartUploadsInput, _ ...func(*s3.Options)) (*s3.ListMultipartUploadsOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := &s3.ListMultipartUploadsOutput{Bucket: in.Bucket, Prefix: in.Prefix, IsTruncated: aws.Bool(false)}
+	for _, id := range slices.Sorted(maps.Keys(m.uploads)) {
+		upload := m.uploads[id]
+		if upload.bucket != aws.ToString(in.Bucket) || !strings.HasPrefix(upload.key, aws.ToString(in.Prefix)) {
+			continue
+		}
+		out.Uploads = append(out.Uploads, types.MultipartUpload{
+			Key:       aws.String(upload.key),
+			UploadId:  aws.String(id),
+			Initiated: aws.Time(upload.initiated),
+		})
+	}
+	slices.SortStableFunc(out.Uploads, func(a, b types.MultipartUpload) int {
+		return strings.Compare(aws.ToString(a.Key), aws.ToString(b.Key))
+	})
+	return out, nil
+}
+
+// ListObjectVersions lists the live objects and the delete markers under the
+// prefix in one page.  Only the latest version of each key is kept.
+func (m *memStore) ListObjectVersions(ctx context.Context, in *s3.ListObjectVersionsInput, _ ...func(*s3.Options)) (*s3.ListObjectVersionsOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	bucket, prefix := aws.ToString(in.Bucket), aws.ToString(in.Prefix)
+	out := &s3.ListObjectVersionsOutput{Name: in.Bucket, Prefix: in.Prefix, IsTruncated: aws.Bool(false)}
+	for _, key := range slices.Sorted(maps.Keys(m.buckets[bucket])) {
+		if obj := m.buckets[bucket][key]; strings.HasPrefix(key, prefix) {
+			out.Versions = append(out.Versions, types.ObjectVersion{Key: aws.String(key), VersionId: aws.String("null"), IsLatest: aws.Bool(true),
+				Size: aws.Int64(int64(len(obj.data))), ETag: aws.String(obj.etag), LastModified: aws.Time(obj.lastModified)})
+		}
+	}
+	for _, key := range slices.Sorted(maps.Keys(m.markers[bucket])) {
+		if strings.HasPrefix(key, prefix) {
+			out.DeleteMarkers = append(out.DeleteMarkers, types.DeleteMarkerEntry{Key: aws.String(key), VersionId: aws.String("marker"),
+				IsLatest: aws.Bool(true), LastModified: aws.Time(m.markers[bucket][key])})
+		}
+	}
+	return out, nil
+}
+
+// RestoreObject starts the restore of an archived object, which completes
+// restoreDelay later.
+func (m *memStore) RestoreObject(ctx context.Context, in *s3.RestoreObjectInput, _ ...func(*s3.Options)) (*s3.RestoreObjectOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	bucket, key := aws.ToString(in.Bucket), aws.ToString(in.Key)
+	obj, ok := m.buckets[bucket][key]
+	switch {
+	case !ok:
+		return nil, noSuchKey(bucket, key)
+	case obj.storageClass == "":
+		return nil, &types.InvalidObjectState{Message: aws.String("Restore is not allowed for the object's current storage class")}
+	case !obj.restoreAsked.IsZero() && time.Since(obj.restoreAsked) < m.restoreDelay:
+		return nil, &smithy.GenericAPIError{Code: "RestoreAlreadyInProgress", Message: "Object restore is already in progress"}
+	}
+	if obj.restoreAsked.IsZero() {
+		obj.restoreAsked = time.Now()
+	}
+	return &s3.RestoreObjectOutput{}, nil
+}
+
+// restoreState returns the x-amz-restore header of an object and whether it
+// can be read, the caller holds m.mu.
+func (m *memStore) restoreState(obj *memObject) (*string, bool) {
+	switch {
+	case obj.storageClass == "":
+		return nil, true
+	case obj.restoreAsked.IsZero():
+		return nil, false
+	case time.Since(obj.restoreAsked) < m.restoreDelay:
+		return aws.String(`ongoing-request="true"`), false
+	}
+	expiry := obj.restoreAsked.Add(m.restoreDelay + 24*time.Hour).UTC().Format(http.TimeFormat)
+	return aws.String(`ongoing-request="false", expiry-date="` + expiry + `"`), true
+}
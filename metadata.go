@@ -9,44 +9,44 @@ import (
 	"log"
 	"os"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
 type MetaEntry struct {
-	Key  string `json:"key"`
-	Size int64  `json:"size"`
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified,omitzero"`
+	ETag         string    `json:"etag,omitempty"`
+	DeleteMarker bool      `json:"delete_marker,omitempty"` // The latest version is a delete marker, with RECORD_DELETE_MARKERS
+	StorageClass string    `json:"storage_class,omitempty"` // Empty for STANDARD
 }
 
 var (
-	subSetFiles = Env("SUBSET", "", "Subset the files by START:STRIDE or START:STRIDE:END")
-	skipFiles   = make(map[string]struct{})
+	subSetFiles    = Env("SUBSET", "", "Subset the files by START:STRIDE or START:STRIDE:END")
+	prefixFilter   = Env("PREFIX_FILTER", "", "Bucket prefix selector, or several joined by ,")
+	overlapListing = Env("OVERLAP_LISTING", "", "Start downloading objects while the bucket is still being listed") != ""
+	skipFiles      = make(map[string]struct{})
+	skipStateOnce  sync.Once
 )
 
-func loadMetadata(ctx context.Context, srcBucket string) (totalSize, objectCount int64, err error) {
+// loadMetadata lists the bucket into the metadata file.  With doFiles set,
+// each object is also sent for processing as soon as it is listed, and the
+// totals grow as the listing goes.  The listing is written to a partial file
+// which only takes the place of the metadata file once it is complete, so an
+// interrupted listing is started again rather than taken for the whole bucket.
+func loadMetadata(ctx context.Context, srcBucket string, doFiles chan<- *DownloadTask) (totalSize, objectCount int64, err error) {
 	s3Ready.Wait() // Wait for the S3 client to be ready
 	log.Println("Loading metadata from S3 bucket:", srcBucket)
 
-	prefixFilter := Env("PREFIX_FILTER", "", "Bucket prefix selector")
-	var prefix, slash *string
-	if prefixFilter != "" {
-		prefix = aws.String(prefixFilter)
-	}
-	if Env("PREFIX_DELIM", "", "Use delimitor") != "" {
-		slash = aws.String("/")
-	}
-
-	// List objects in source bucket
-	paginator := s3.NewListObjectsV2Paginator(s3client, &s3.ListObjectsV2Input{
-		Bucket:    aws.String(srcBucket),
-		Prefix:    prefix,
-		Delimiter: slash,
-	})
-
 	// Open metadata.json for writing
-	metadataFile, err := os.Create(metadataFileName)
+	partialName := metadataFileName + ".partial"
+	metadataFile, err := os.Create(partialName)
 	if err != nil {
 		log.Fatalf("failed to create metadata.json: %v", err)
 	}
@@ -63,8 +63,102 @@ func loadMetadata(ctx context.Context, srcBucket string) (totalSize, objectCount
 		if err := metadataFile.Close(); err != nil {
 			log.Fatalln("Error closing metadata file,", err)
 		}
+		if err := os.Rename(partialName, metadataFileName); err != nil {
+			log.Fatalln("Error renaming metadata file,", err)
+		}
 	}()
 
+	// List each prefix in source bucket, several at once into part files
+	// joined in order once they are all listed, so the file stays in key order
+	inputs := listingInputs(srcBucket)
+	if listingParallel <= 1 || len(inputs) == 1 {
+		for _, input := range inputs {
+			size, count := listPrefix(ctx, input, metadataBuf, doFiles)
+			totalSize, objectCount = totalSize+size, objectCount+count
+		}
+	} else {
+		parts := make([]string, len(inputs))
+		sizes, counts := make([]int64, len(inputs)), make([]int64, len(inputs))
+		var wg sync.WaitGroup
+		sem := make(chan struct{}, listingParallel)
+		for i, input := range inputs {
+			parts[i] = fmt.Sprintf("%s.%d", partialName, i)
+			wg.Add(1)
+			sem <- struct{}{}
+			go func() {
+				defer func() { <-sem; wg.Done() }()
+				f, err := os.Create(parts[i])
+				if err != nil {
+					log.Fatalf("failed to create %s: %v", parts[i], err)
+				}
+				w := bufio.NewWriter(f)
+				sizes[i], counts[i] = listPrefix(ctx, input, w, doFiles)
+				if err := w.Flush(); err != nil {
+					log.Fatalln("Error writing metadata,", err)
+				}
+				if err := f.Close(); err != nil {
+					log.Fatalln("Error closing metadata file,", err)
+				}
+			}()
+		}
+		wg.Wait()
+		for i, part := range parts {
+			f, err := os.Open(part)
+			if err != nil {
+				log.Fatalf("failed to open %s: %v", part, err)
+			}
+			if _, err := io.Copy(metadataBuf, f); err != nil {
+				log.Fatalln("Error writing metadata,", err)
+			}
+			f.Close()
+			os.Remove(part)
+			totalSize, objectCount = totalSize+sizes[i], objectCount+counts[i]
+		}
+	}
+
+	if recordDeleteMarkers {
+		// Keys deleted from a versioned bucket are archived as tombstones
+		for _, input := range inputs {
+			err := listDeleteMarkers(ctx, srcBucket, input.Prefix, input.Delimiter, func(entry MetaEntry) {
+				if !keySelected(entry.Key) {
+					return
+				}
+				objectCount++
+				dat, _ := json.Marshal(entry)
+				metadataBuf.Write(dat)
+				metadataBuf.WriteByte('\n')
+				if doFiles != nil {
+					sendListed(entry, doFiles)
+				}
+			})
+			if err != nil {
+				log.Fatalf("failed to list delete markers: %v", err)
+			}
+		}
+	}
+
+	// Write summary metadata
+	summaryLine := fmt.Sprintf(`{"total_objects":%d,"total_size":%d}`+"\n", objectCount, totalSize)
+	metadataBuf.WriteString(summaryLine)
+	log.Printf("Metadata written: %d objects, total size %d bytes\n", objectCount, totalSize)
+
+	log.Println("Metadata file created successfully:", metadataFileName)
+	// Print summary
+	log.Printf("Total objects: %d, Total size: %d bytes\n", objectCount, totalSize)
+	if objectCount == 0 {
+		log.Println("No objects found in the source bucket.")
+	} else {
+		log.Printf("Metadata file %s created with %d objects and total size %d bytes.\n", metadataFileName, objectCount, totalSize)
+	}
+
+	return
+}
+
+// listPrefix lists the objects of a prefix into w, sending each for
+// processing too with doFiles set, and returns their total size and count.
+func listPrefix(ctx context.Context, input *s3.ListObjectsV2Input, w *bufio.Writer, doFiles chan<- *DownloadTask) (totalSize, objectCount int64) {
+	paginator := s3.NewListObjectsV2Paginator(s3client, input)
+
 	// Iterate through all pages of objects
 	for paginator.HasMorePages() {
 		// Get the next page of objects
@@ -78,48 +172,106 @@ func loadMetadata(ctx context.Context, srcBucket string) (totalSize, objectCount
 			if obj.Key == nil || obj.Size == nil {
 				continue
 			}
+			if !keySelected(*obj.Key) {
+				continue // Left out of the metadata file by INCLUDE or EXCLUDE
+			}
 
 			// Count objects and accumulate total size
 			objectCount++
 			totalSize += *obj.Size
 
 			// Write metadata line
-			// Format: {"name":"object_key","size":object_size}
-			dat, _ := json.Marshal(MetaEntry{Key: *obj.Key, Size: *obj.Size})
-			metadataBuf.Write(dat)
-			metadataBuf.WriteByte('\n')
+			// Format: {"key":"object_key","size":object_size,"last_modified":"RFC3339 time"}
+			entry := MetaEntry{Key: *obj.Key, Size: *obj.Size}
+			if obj.LastModified != nil {
+				entry.LastModified = *obj.LastModified
+			}
+			entry.ETag = strings.Trim(aws.ToString(obj.ETag), `"`)
+			if obj.StorageClass != types.ObjectStorageClassStandard {
+				entry.StorageClass = string(obj.StorageClass)
+			}
+			dat, _ := json.Marshal(entry)
+			w.Write(dat)
+			w.WriteByte('\n')
+			if doFiles != nil {
+				sendListed(entry, doFiles)
+			}
 		}
 	}
+	return
+}
 
-	// Write summary metadata
-	summaryLine := fmt.Sprintf(`{"total_objects":%d,"total_size":%d}`+"\n", objectCount, totalSize)
-	metadataBuf.WriteString(summaryLine)
-	log.Printf("Metadata written: %d objects, total size %d bytes\n", objectCount, totalSize)
-
-	log.Println("Metadata file created successfully:", metadataFileName)
-	// Print summary
-	log.Printf("Total objects: %d, Total size: %d bytes\n", objectCount, totalSize)
-	if objectCount == 0 {
-		log.Println("No objects found in the source bucket.")
-	} else {
-		log.Printf("Metadata file %s created with %d objects and total size %d bytes.\n", metadataFileName, objectCount, totalSize)
+// listingInputs returns the listings of the source bucket, one for each
+// prefix of PREFIX_FILTER and PREFIX_FILE, with PREFIX_DELIM applied.
+func listingInputs(srcBucket string) []*s3.ListObjectsV2Input {
+	var inputs []*s3.ListObjectsV2Input
+	for _, prefix := range listingPrefixes {
+		input := &s3.ListObjectsV2Input{Bucket: aws.String(srcBucket)}
+		if prefix != "" {
+			input.Prefix = aws.String(prefix)
+		}
+		if Env("PREFIX_DELIM", "", "Use delimitor") != "" {
+			input.Delimiter = aws.String("/")
+		}
+		inputs = append(inputs, input)
 	}
-
-	return
+	return inputs
 }
 
-func ReadMetadata(ctx context.Context, doFiles chan<- *DownloadTask) {
+// loadSkipFiles adds the keys marked uploaded in STATE_TABLE to those read
+// from upload.log at startup, once.
+func loadSkipFiles() {
+	skipStateOnce.Do(loadStateSkips)
+}
 
-	f, err := os.Open("upload.log")
-	if err == nil {
-		scanner := bufio.NewScanner(f)
-		for scanner.Scan() {
-			skipFiles[strings.TrimSpace(scanner.Text())] = struct{}{}
+// sendListed sends an object found by a listing still in progress for
+// processing, unless a previous run uploaded it.  Without the full listing the
+// tar format limits cannot be checked up front, so an object which cannot be
+// archived is logged as an error instead.
+func sendListed(entry MetaEntry, doFiles chan<- *DownloadTask) {
+	if !listingSelected(entry) {
+		recordSkipped(entry)
+		return
+	}
+	if _, ok := skipFiles[entry.Key]; ok {
+		if debug {
+			log.Printf("skipping dup: %#v\n", entry)
 		}
-		f.Close()
+		return
+	}
+	atomic.AddInt64(&TotalBytes, entry.Size)
+	atomic.AddInt64(&TotalFiles, 1)
+	if err := checkTarEntry(entryName(entry.Key), entry.Size, entry.DeleteMarker); err != nil {
+		rejectTarEntry(entry, err, doFiles)
+		return
 	}
+	doFiles <- &DownloadTask{Filename: entry.Key, Size: entry.Size, LastModified: entry.LastModified, ETag: entry.ETag,
+		DeleteMarker: entry.DeleteMarker, StorageClass: entry.StorageClass}
+}
+
+// StreamMetadata lists the bucket and sends its objects for processing while
+// the listing is still paginating, so downloads start with the first page.
+func StreamMetadata(ctx context.Context, doFiles chan<- *DownloadTask) {
+	loadSkipFiles()
+	defer close(doFiles)
+	if _, _, err := loadMetadata(ctx, srcBucket, doFiles); err != nil {
+		log.Fatalf("failed to load metadata: %v", err)
+	}
+}
+
+func ReadMetadata(ctx context.Context, doFiles chan<- *DownloadTask) {
+	loadSkipFiles()
 
 	log.Println("Reading in", metadataFileName, "for processing...")
+
+	// Priority objects are read by a second pass and merged in ahead of the
+	// others, which this pass sends to the bulk lane
+	lanes := doFiles
+	var bulk chan *DownloadTask
+	if priorityActive {
+		bulk = make(chan *DownloadTask)
+		doFiles = bulk
+	}
 	defer close(doFiles)
 
 	// Open metadata file and parse each line for file size and name
@@ -140,8 +292,10 @@ func ReadMetadata(ctx context.Context, doFiles chan<- *DownloadTask) {
 			// Try START:STRIDE
 			end = -1 // Use -1 or another sentinel value to indicate "no end"
 		}
-
-		// First pass to do size accounting with the stride accounting
+	}
+	if subSetFiles != "" || windowActive || keyFilterActive || sizeFilterActive {
+		// First pass to do size accounting with the stride and filter accounting
+		start := start
 		TotalBytes = 0
 		TotalFiles = 0
 
@@ -178,6 +332,9 @@ func ReadMetadata(ctx context.Context, doFiles chan<- *DownloadTask) {
 			if entry.Key == "" {
 				break
 			}
+			if !listingSelected(entry) {
+				continue
+			}
 			atomic.AddInt64(&TotalBytes, entry.Size)
 			atomic.AddInt64(&TotalFiles, 1)
 		}
@@ -185,18 +342,44 @@ func ReadMetadata(ctx context.Context, doFiles chan<- *DownloadTask) {
 
 	metadataFile.Seek(io.SeekStart, 0) // Back the the start
 
+	if priorityActive {
+		high := make(chan *DownloadTask)
+		go readPriority(ctx, high, start, stride, end)
+		go mergeLanes(high, bulk, lanes)
+	}
+
+	lineNumber := 0
+	strider := 0
+	var offset int64
+	if cp := loadCheckpoint(metadataFile); cp != nil {
+		// Seek past the lines which are already done, keeping the subset in step
+		if _, err := metadataFile.Seek(cp.Offset, io.SeekStart); err != nil {
+			log.Fatalf("failed to seek metadata file: %v", err)
+		}
+		offset, lineNumber = cp.Offset, cp.Line
+		skipped := min(start, lineNumber)
+		start -= skipped
+		if stride > 1 {
+			strider = (lineNumber - skipped) % stride
+		}
+		if cp.ArchiveCount > archiveCount {
+			archiveCount = cp.ArchiveCount
+		}
+		atomic.AddInt64(&TotalBytes, -cp.Bytes)
+		atomic.AddInt64(&TotalFiles, -cp.Files)
+	}
+
 	scanner := bufio.NewScanner(metadataFile)
 	if debug {
 		log.Println("start:", start, "stride:", stride, "end:", end)
 	}
 
-	lineNumber := 0
-	strider := 0
 	for scanner.Scan() {
 		if debug {
 			log.Println("scanned:", scanner.Text())
 		}
 		lineNumber++
+		offset += int64(len(scanner.Bytes())) + 1
 		if start > 0 {
 			start--
 			continue
@@ -222,10 +405,19 @@ func ReadMetadata(ctx context.Context, doFiles chan<- *DownloadTask) {
 		if entry.Key == "" {
 			break
 		}
+		if !listingSelected(entry) {
+			recordSkipped(entry)
+			continue // Filtered out, and not counted in the totals
+		}
+		if priorityActive && isPriority(entry.Key) {
+			continue // Sent by readPriority
+		}
+		checkpointAdd(entry.Key, lineNumber, offset, entry.Size)
 		if _, ok := skipFiles[entry.Key]; ok {
 			if debug {
 				log.Printf("skipping dup: %#v\n", entry)
 			}
+			checkpointFinished(entry.Key)
 			atomic.AddInt64(&TotalBytes, -entry.Size)
 			atomic.AddInt64(&TotalFiles, -1)
 			continue
@@ -238,7 +430,8 @@ func ReadMetadata(ctx context.Context, doFiles chan<- *DownloadTask) {
 		if debug {
 			log.Printf("sent task: %#v\n", entry)
 		}
-		doFiles <- &DownloadTask{Filename: entry.Key, Size: entry.Size}
+		doFiles <- &DownloadTask{Filename: entry.Key, Size: entry.Size, LastModified: entry.LastModified, ETag: entry.ETag,
+			DeleteMarker: entry.DeleteMarker, StorageClass: entry.StorageClass}
 	}
 
 	if err := scanner.Err(); err != nil {
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"log/slog"
 	"os"
 	"strings"
 	"sync"
@@ -36,6 +37,7 @@ func StartMetrics(ctx context.Context) {
 		lastBytes, lastUpBytes int64
 		lastTime               = time.Now()
 		startTime              = time.Now()
+		lastLogged             = time.Now()
 	)
 
 	metricsTicker = time.NewTicker(100 * time.Millisecond)
@@ -90,10 +92,63 @@ func StartMetrics(ctx context.Context) {
 					humanizeRate(curUpBytes-lastUpBytes, elapsed),
 					//
 					remaining)
+				if tempDisk.limit > 0 {
+					statsLine += fmt.Sprintf("  Temp: %s/%s", humanizeBytes(atomic.LoadInt64(&TempBytes)), humanizeBytes(tempDisk.limit))
+				}
+				if dedupIndex != nil {
+					statsLine += fmt.Sprintf("  Deduped: %d", atomic.LoadInt64(&DedupedFiles))
+				}
+				if transformCmd != "" {
+					statsLine += fmt.Sprintf("  Transformed: %d", atomic.LoadInt64(&TransformedFiles))
+				}
+				if budgetCost > 0 || budgetMaxRequests > 0 {
+					u := s3Usage()
+					statsLine += fmt.Sprintf("  S3: %d req ~$%.2f", u.GetRequests+u.PutRequests+u.ListRequests, u.EstimatedCost)
+					if budgetPaused() {
+						statsLine += " PAUSED"
+					}
+				}
+				if priorityActive {
+					statsLine += fmt.Sprintf("  Priority: %d", atomic.LoadInt64(&PriorityFiles))
+				}
+				if chunkAbove > 0 {
+					statsLine += fmt.Sprintf("  Chunked: %d", atomic.LoadInt64(&ChunkedFiles))
+				}
+				if enrichObjects {
+					statsLine += fmt.Sprintf("  Enriched: %d", atomic.LoadInt64(&EnrichedFiles))
+				}
+				if verifyArchives {
+					statsLine += fmt.Sprintf("  Verified: %d", atomic.LoadInt64(&VerifiedArchives))
+				}
+				if glacierTier != "" {
+					statsLine += fmt.Sprintf("  Restoring: %d", atomic.LoadInt64(&RestoringFiles))
+				}
+				if recordDeleteMarkers {
+					statsLine += fmt.Sprintf("  Deleted: %d", atomic.LoadInt64(&DeleteMarkerFiles))
+				}
+				if perObjectTimeout > 0 {
+					statsLine += fmt.Sprintf("  Timed out: %d", atomic.LoadInt64(&TimedOutFiles))
+				}
+				if exceptionStream != nil {
+					statsLine += fmt.Sprintf("  Exceptions: %d", atomic.LoadInt64(&ExceptionFiles))
+				}
+				if debug {
+					statsLine += fmt.Sprintf("  Arena: %s", humanizeBytes(atomic.LoadInt64(&ArenaBytes)))
+					statsLine += fmt.Sprintf("  Active: %s", activeStages())
+				}
+				if detectionActive {
+					statsLine += fmt.Sprintf("  Detected: %d", atomic.LoadInt64(&DetectedFiles))
+				}
 
-				fmt.Fprintf(os.Stderr, "\r%s", statsLine)
-				for i := len(statsLine); i < lastlen; i++ {
-					fmt.Fprintf(os.Stderr, " ")
+				if progressTTY {
+					fmt.Fprintf(os.Stderr, "\r%s", statsLine)
+					for i := len(statsLine); i < lastlen; i++ {
+						fmt.Fprintf(os.Stderr, " ")
+					}
+				} else if progressInterval > 0 && now.Sub(lastLogged) >= time.Duration(progressInterval)*time.Second {
+					// Redrawing in place would leave control characters in the log
+					lastLogged = now
+					logProgress(statsLine)
 				}
 
 				statsMutex.Unlock()
@@ -107,10 +162,16 @@ func StartMetrics(ctx context.Context) {
 }
 
 func Println(v ...any) {
+	if logJSON {
+		slog.Info(strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+		return
+	}
 	statsMutex.Lock()
 
-	fmt.Fprintf(os.Stderr, "\r%s\r", spaces(len(statsLine)))
-	fmt.Println(v...)
+	if progressTTY {
+		fmt.Fprintf(os.Stderr, "\r%s\r", spaces(len(statsLine)))
+	}
+	fmt.Fprintln(os.Stderr, v...)
 
 	statsMutex.Unlock()
 }
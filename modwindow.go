@@ -0,0 +1,79 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+)
+
+var (
+	modifiedSince = Env("SINCE", "", "Only archive objects last modified at or after this time: RFC3339, a date such as 2025-01-31, or a period ago such as 30d or 1m")
+	modifiedUntil = Env("UNTIL", "", "Only archive objects last modified before this time, given as for SINCE")
+
+	windowSince, windowUntil time.Time
+	windowActive             bool
+)
+
+// initModifiedWindow parses SINCE and UNTIL, against a single now so a
+// period given to both is measured from the same instant.
+func initModifiedWindow() {
+	if modifiedSince == "" && modifiedUntil == "" {
+		return
+	}
+	if workList != "" || urlList != "" {
+		log.Fatal("SINCE and UNTIL filter the listing, and cannot be used with WORK_LIST or URL_LIST")
+	}
+	now := time.Now()
+	var err error
+	if windowSince, err = parseWindowTime(modifiedSince, now); err != nil {
+		log.Fatalf("invalid SINCE %q: %v", modifiedSince, err)
+	}
+	if windowUntil, err = parseWindowTime(modifiedUntil, now); err != nil {
+		log.Fatalf("invalid UNTIL %q: %v", modifiedUntil, err)
+	}
+	if !windowSince.IsZero() && !windowUntil.IsZero() && !windowSince.Before(windowUntil) {
+		log.Fatalf("SINCE %s is not before UNTIL %s", windowSince.Format(time.RFC3339), windowUntil.Format(time.RFC3339))
+	}
+	windowActive = true
+	log.Printf("Archiving objects modified from %s until %s", windowEdge(windowSince, "the start"), windowEdge(windowUntil, "now"))
+}
+
+// parseWindowTime parses a time of SINCE or UNTIL, with a date taken as its
+// midnight in UTC and a period as that long before now.
+func parseWindowTime(s string, now time.Time) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.DateOnly, s); err == nil {
+		return t, nil
+	}
+	p, err := parsePeriod(s)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return now.AddDate(-p.years, -p.months, -p.days), nil
+}
+
+func windowEdge(t time.Time, none string) string {
+	if t.IsZero() {
+		return none
+	}
+	return t.Format(time.RFC3339)
+}
+
+// inModifiedWindow reports whether an object of the listing was modified
+// within SINCE and UNTIL.  Objects with no modification time, as from a
+// metadata file of an older version, are kept rather than silently dropped.
+func inModifiedWindow(entry MetaEntry) bool {
+	if !windowActive || entry.LastModified.IsZero() {
+		return true
+	}
+	if !windowSince.IsZero() && entry.LastModified.Before(windowSince) {
+		return false
+	}
+	return windowUntil.IsZero() || entry.LastModified.Before(windowUntil)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+var (
+	mpuAbortAge    = EnvInt("MPU_ABORT_AGE", 24, "Abort incomplete multipart uploads of archives in DST_BUCKET older than this many hours at startup and shutdown (0 to disable)")
+	mpuAbortPrefix = Env("MPU_ABORT_PREFIX", "", "Only abort the incomplete multipart uploads under this prefix of DST_BUCKET, DST_PREFIX when not set")
+)
+
+// abortOrphanedUploads aborts the multipart uploads of archives and their
+// sidecars left in DST_BUCKET by runs which crashed, as S3 keeps charging
+// for their parts until they are aborted.  Only uploads older than
+// MPU_ABORT_AGE are touched, so those of other running workers are left be,
+// and only under DST_PREFIX, so the uploads of other jobs sharing the bucket
+// are left alone too.
+func abortOrphanedUploads(ctx context.Context) {
+	if mpuAbortAge <= 0 || archiveStdout || exportDir != "" {
+		return
+	}
+	s3Ready.Wait() // Wait for the S3 client to be ready
+	cutoff := time.Now().Add(-time.Duration(mpuAbortAge) * time.Hour)
+
+	var aborted int
+	p := s3.NewListMultipartUploadsPaginator(s3client, &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(dstBucket),
+		Prefix: aws.String(cmp.Or(mpuAbortPrefix, dstPrefix)),
+	})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			log.Printf("failed to list multipart uploads in %s: %v", dstBucket, err)
+			return
+		}
+		for _, upload := range page.Uploads {
+			key := aws.ToString(upload.Key)
+			if !archiveUpload(key) || upload.Initiated == nil || upload.Initiated.After(cutoff) {
+				continue
+			}
+			if _, err := s3client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(dstBucket),
+				Key:      upload.Key,
+				UploadId: upload.UploadId,
+			}); err != nil {
+				log.Printf("failed to abort multipart upload of %s: %v", key, err)
+				continue
+			}
+			log.Printf("Aborted multipart upload of %s started %s", key, upload.Initiated.UTC().Format(time.RFC3339))
+			aborted++
+		}
+	}
+	if aborted > 0 {
+		log.Printf("Aborted %d orphaned multipart uploads in %s", aborted, dstBucket)
+	}
+}
+
+// archiveUpload reports whether a key is one this tool uploads: an archive,
+// a sidecar of one, or a run summary.
+func archiveUpload(key string) bool {
+	for _, ext := range importSidecars {
+		key = strings.TrimSuffix(key, ext)
+	}
+	return archiveExt(key) != "" || strings.HasPrefix(path.Base(key), "run_summary")
+}
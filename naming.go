@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	archiveNamingKind = Env("ARCHIVE_NAMING", "counter", "What the %d of ARCHIVE_NAME is replaced with: counter, timestamp, ulid or content-hash")
+	dstPrefix         = Env("DST_PREFIX", "", "Prefix of the keys the archives and their sidecars are uploaded to in DST_BUCKET")
+
+	archiveNaming archiveNamer = counterNamer{}
+
+	archiveNameField = regexp.MustCompile(`\{(\w+)\}`)
+)
+
+// initArchiveTemplate expands the fields of ARCHIVE_NAME and puts it under
+// DST_PREFIX.  The archives are written locally under the same name as
+// their key, so the directories of the key are made in the working
+// directory too.
+func initArchiveTemplate() {
+	ArchiveName = dstPrefix + expandArchiveName(ArchiveName)
+	if _, _, _, ok := splitTemplate(ArchiveName); !ok {
+		log.Fatalf("ARCHIVE_NAME %q needs {seq} or a %%d verb to tell the archives apart", ArchiveName)
+	}
+	if dstPrefix != "" {
+		log.Println("Archives are uploaded as", ArchiveName)
+	}
+}
+
+// expandArchiveName replaces the fields of an ARCHIVE_NAME template such as
+// "backups/{date}/{prefix}/archive_{seq}.tgz": {date} is the day the run
+// started, {prefix} the PREFIX_FILTER listed, without its slashes, {run} the
+// run UUID and {seq} the %07d verb.  Without a prefix the {prefix} directory
+// is left out.
+func expandArchiveName(template string) string {
+	if !archiveNameField.MatchString(template) {
+		return template
+	}
+	name := archiveNameField.ReplaceAllStringFunc(template, func(field string) string {
+		switch field {
+		case "{date}":
+			return runStarted.Format(time.DateOnly)
+		case "{prefix}":
+			if len(listingPrefixes) > 1 {
+				log.Fatal("ARCHIVE_NAME cannot hold {prefix} when several prefixes are listed, use ARCHIVE_STREAMS to keep their archives apart")
+			}
+			return strings.Trim(listingPrefixes[0], "/")
+		case "{run}":
+			return runUUID
+		case "{seq}":
+			return "%07d"
+		}
+		log.Fatalf("unknown field %s in ARCHIVE_NAME, expected {date}, {prefix}, {run} or {seq}", field)
+		return ""
+	})
+	for strings.Contains(name, "//") {
+		name = strings.ReplaceAll(name, "//", "/")
+	}
+	return strings.TrimPrefix(name, "/")
+}
+
+// underDstPrefix returns ArchiveName with prefix inserted after DST_PREFIX.
+func underDstPrefix(prefix string) string {
+	return dstPrefix + prefix + strings.TrimPrefix(ArchiveName, dstPrefix)
+}
+
+// archiveNamer names archives from a template such as ARCHIVE_NAME, in which
+// the %d verb stands for what tells the archives apart.
+type archiveNamer interface {
+	// open returns the name of a new archive, the nth opened.
+	open(template string, n int) string
+	// finish returns the name a closed archive is uploaded as, given the
+	// hex digest of its contents.
+	finish(name, digest string) string
+}
+
+// initArchiveNaming selects the ARCHIVE_NAMING strategy.
+func initArchiveNaming() {
+	switch archiveNamingKind {
+	case "counter":
+		return
+	case "timestamp":
+		archiveNaming = timestampNamer{}
+	case "ulid":
+		archiveNaming = ulidNamer{}
+	case "content-hash":
+		if dedupIndexFile != "" || dedupTable != "" {
+			// Entries referring to the archive are recorded before its name is known
+			log.Fatal("ARCHIVE_NAMING=content-hash cannot be used with DEDUP_INDEX or DEDUP_TABLE")
+		}
+		archiveNaming = hashNamer{}
+	default:
+		log.Fatalf("unknown ARCHIVE_NAMING %q, must be counter, timestamp, ulid or content-hash", archiveNamingKind)
+	}
+	log.Println("Archives are named by", archiveNamingKind)
+}
+
+// splitTemplate splits an archive name template around its %d verb.
+func splitTemplate(template string) (prefix, verb, suffix string, ok bool) {
+	i := strings.Index(template, "%")
+	j := strings.IndexByte(template[max(i, 0):], 'd')
+	if i < 0 || j < 0 {
+		return "", "", "", false
+	}
+	return template[:i], template[i : i+j+1], template[i+j+1:], true
+}
+
+// withVerb returns template with its %d verb replaced by s.
+func withVerb(template, s string) string {
+	prefix, _, suffix, ok := splitTemplate(template)
+	if !ok {
+		return template
+	}
+	return prefix + s + suffix
+}
+
+// counterNamer numbers the archives in the order they are opened, carrying on
+// from ARCHIVE_OFFSET, a checkpoint or the archives of earlier runs.
+type counterNamer struct{}
+
+func (counterNamer) open(template string, n int) string { return fmt.Sprintf(template, n) }
+func (counterNamer) finish(name, digest string) string  { return name }
+
+// timestampNamer names archives by the UTC time they were opened, followed by
+// the counter so those opened within a second still sort in order.
+type timestampNamer struct{}
+
+func (timestampNamer) open(template string, n int) string {
+	_, verb, _, ok := splitTemplate(template)
+	if !ok {
+		return fmt.Sprintf(template, n)
+	}
+	return withVerb(template, time.Now().UTC().Format("20060102T150405Z")+"_"+fmt.Sprintf(verb, n))
+}
+func (timestampNamer) finish(name, digest string) string { return name }
+
+// ulidNamer names archives by a ULID: 26 characters which sort by the time
+// they were made, to the millisecond, and are unique without coordination,
+// as between workers sharing a destination.
+type ulidNamer struct{}
+
+func (ulidNamer) open(template string, n int) string { return withVerb(template, newULID(time.Now())) }
+func (ulidNamer) finish(name, digest string) string  { return name }
+
+// hashNamer names archives by the digest of their contents in
+// CHECKSUM_ALGORITHM, so the same archive always has the same name.  Until
+// it is closed the archive is named by the counter.
+type hashNamer struct{}
+
+func (hashNamer) open(template string, n int) string {
+	return withVerb(template, fmt.Sprintf("partial%07d", n))
+}
+
+func (hashNamer) finish(name, digest string) string {
+	i := strings.LastIndex(name, "partial")
+	j := i + len("partial")
+	for j < len(name) && name[j] >= '0' && name[j] <= '9' {
+		j++
+	}
+	return name[:i] + digest + name[j:]
+}
+
+// newULID returns a ULID for t: the milliseconds since the epoch in 48 bits
+// and 80 random bits, in Crockford's base32.
+func newULID(t time.Time) string {
+	const alphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+	var id [16]byte
+	ms := uint64(t.UnixMilli())
+	binary.BigEndian.PutUint16(id[0:], uint16(ms>>32))
+	binary.BigEndian.PutUint32(id[2:], uint32(ms))
+	rand.Read(id[6:])
+
+	// 128 bits in 26 characters of 5 bits, the first holding the top 3
+	hi, lo := binary.BigEndian.Uint64(id[:8]), binary.BigEndian.Uint64(id[8:])
+	out := make([]byte, 26)
+	for i := 25; i >= 0; i-- {
+		out[i] = alphabet[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out)
+}
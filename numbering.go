@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+var archiveHistory = Env("DISABLE_ARCHIVE_HISTORY", "", "Do not look for the archives of earlier runs in DST_BUCKET, EXPORT_DIR or STATE_TABLE before numbering new ones") == ""
+
+// continueNumbering moves the archive numbering on past the highest numbered
+// archive already in DST_BUCKET, or EXPORT_DIR, and in STATE_TABLE, so that a
+// repeated run never overwrites the archives of an earlier one.  Events and
+// repack runs, and ARCHIVE_NAMING other than counter, name their archives
+// apart already.
+func continueNumbering(ctx context.Context) {
+	if !archiveHistory || archiveNamingKind != "counter" || archiveStdout || simulating || (workMode != "" && workMode != modeWorker) {
+		return
+	}
+	var highest int
+	note := func(name string) {
+		if n, ok := archiveNumber(name); ok && n > highest {
+			highest = n
+		}
+	}
+	if exportDir != "" {
+		err := filepath.WalkDir(exportDir, func(path string, d fs.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				note(path)
+			}
+			return err
+		})
+		if err != nil {
+			log.Fatalf("failed to look for earlier archives in %s: %v", exportDir, err)
+		}
+	} else {
+		s3Ready.Wait() // Wait for the S3 client to be ready
+		paginator := s3.NewListObjectsV2Paginator(s3client, &s3.ListObjectsV2Input{Bucket: aws.String(dstBucket), Prefix: aws.String(dstPrefix)})
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				log.Fatalf("failed to look for earlier archives in %s: %v", dstBucket, err)
+			}
+			for _, obj := range page.Contents {
+				note(aws.ToString(obj.Key))
+			}
+		}
+	}
+	if stateTable != "" {
+		queryState(stateArchive, "", note)
+	}
+	if highest > archiveCount {
+		log.Printf("Archives numbered up to %d exist from earlier runs, numbering carries on after them", highest)
+		archiveCount = highest
+	}
+}
+
+// archiveNumber returns the number of an archive named by ArchiveName, in
+// any stream.  The extension is not compared, so archives written with
+// another ARCHIVE_CODEC are counted too.
+func archiveNumber(key string) (int, bool) {
+	prefix, _, suffix, ok := splitTemplate(ArchiveName)
+	if !ok {
+		return 0, false
+	}
+	suffix = strings.TrimSuffix(suffix, archiveExt(suffix))
+	ext := archiveExt(key)
+	if ext == "" || !strings.HasSuffix(key, suffix+ext) {
+		return 0, false
+	}
+	key = strings.TrimSuffix(key, suffix+ext)
+	digits := len(key)
+	for digits > 0 && key[digits-1] >= '0' && key[digits-1] <= '9' {
+		digits--
+	}
+	if digits == len(key) || !strings.HasSuffix(key[:digits], prefix) {
+		return 0, false
+	}
+	n, err := strconv.Atoi(key[digits:])
+	return n, err == nil
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Parquet physical and converted types used by the catalog, from the
+// parquet-format Thrift definitions.
+const (
+	parquetInt64     = 2
+	parquetByteArray = 6
+
+	parquetUTF8            = 0
+	parquetTimestampMillis = 9
+
+	parquetPlain = 0
+	parquetRLE   = 3
+	parquetZstd  = 6
+)
+
+// parquetColumn describes one flat column of a parquetWriter.
+type parquetColumn struct {
+	Name      string
+	Type      int32 // parquetInt64 or parquetByteArray
+	Converted int32 // Converted type, or -1 for none
+	Optional  bool  // Values may be nil
+}
+
+// parquetWriter buffers rows column by column and writes them as a Parquet
+// file with a single row group.  Only what the catalog needs is supported:
+// flat INT64 and BYTE_ARRAY columns, PLAIN encoded and ZSTD compressed.
+type parquetWriter struct {
+	columns []parquetColumn
+	values  []bytes.Buffer // PLAIN encoded values of each column
+	defs    [][]byte       // Definition levels of each optional column
+	rows    int64
+}
+
+func newParquetWriter(columns []parquetColumn) *parquetWriter {
+	return &parquetWriter{
+		columns: columns,
+		values:  make([]bytes.Buffer, len(columns)),
+		defs:    make([][]byte, len(columns)),
+	}
+}
+
+// add appends a row, holding an int64, string or nil for each column.
+func (p *parquetWriter) add(row ...any) {
+	for i, col := range p.columns {
+		v := row[i]
+		if col.Optional {
+			if v == nil {
+				p.defs[i] = append(p.defs[i], 0)
+				continue
+			}
+			p.defs[i] = append(p.defs[i], 1)
+		}
+		buf := &p.values[i]
+		switch col.Type {
+		case parquetInt64:
+			binary.Write(buf, binary.LittleEndian, v.(int64))
+		case parquetByteArray:
+			s := v.(string)
+			binary.Write(buf, binary.LittleEndian, uint32(len(s)))
+			buf.WriteString(s)
+		}
+	}
+	p.rows++
+}
+
+// writeTo writes the buffered rows to w as a Parquet file.
+func (p *parquetWriter) writeTo(w io.Writer) error {
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		return err
+	}
+	defer enc.Close()
+
+	out := &offsetWriter{w: w}
+	if _, err := io.WriteString(out, "PAR1"); err != nil {
+		return err
+	}
+	var chunks []func(t *thriftWriter)
+	var groupSize int64
+	for i, col := range p.columns {
+		var page bytes.Buffer
+		if col.Optional {
+			levels := rleLevels(p.defs[i])
+			binary.Write(&page, binary.LittleEndian, uint32(len(levels)))
+			page.Write(levels)
+		}
+		page.Write(p.values[i].Bytes())
+		compressed := enc.EncodeAll(page.Bytes(), nil)
+
+		header := &thriftWriter{}
+		header.i32(1, 0) // DATA_PAGE
+		header.i32(2, int32(page.Len()))
+		header.i32(3, int32(len(compressed)))
+		header.begin(5)
+		header.i32(1, int32(p.rows))
+		header.i32(2, parquetPlain)
+		header.i32(3, parquetRLE)
+		header.i32(4, parquetRLE)
+		header.end()
+		header.stop()
+
+		offset := out.n
+		if _, err := out.Write(header.buf.Bytes()); err != nil {
+			return err
+		}
+		if _, err := out.Write(compressed); err != nil {
+			return err
+		}
+		uncompressed := int64(header.buf.Len() + page.Len())
+		size := out.n - offset
+		groupSize += uncompressed
+
+		chunks = append(chunks, func(t *thriftWriter) {
+			t.i64(2, offset)
+			t.begin(3)
+			t.i32(1, col.Type)
+			t.list(2, thriftI32, 2)
+			t.varint(parquetPlain)
+			t.varint(parquetRLE)
+			t.list(3, thriftBinary, 1)
+			t.str(col.Name)
+			t.i32(4, parquetZstd)
+			t.i64(5, p.rows)
+			t.i64(6, uncompressed)
+			t.i64(7, size)
+			t.i64(9, offset)
+			t.end()
+		})
+	}
+
+	meta := &thriftWriter{}
+	meta.i32(1, 1)
+	meta.list(2, thriftStruct, len(p.columns)+1)
+	meta.elem()
+	meta.binary(4, "schema")
+	meta.i32(5, int32(len(p.columns)))
+	meta.end()
+	for _, col := range p.columns {
+		meta.elem()
+		meta.i32(1, col.Type)
+		repetition := int32(0) // REQUIRED
+		if col.Optional {
+			repetition = 1 // OPTIONAL
+		}
+		meta.i32(3, repetition)
+		meta.binary(4, col.Name)
+		if col.Converted >= 0 {
+			meta.i32(6, col.Converted)
+		}
+		meta.end()
+	}
+	meta.i64(3, p.rows)
+	meta.list(4, thriftStruct, 1)
+	meta.elem()
+	meta.list(1, thriftStruct, len(chunks))
+	for _, chunk := range chunks {
+		meta.elem()
+		chunk(meta)
+		meta.end()
+	}
+	meta.i64(2, groupSize)
+	meta.i64(3, p.rows)
+	meta.end()
+	meta.binary(6, "bucket-archiver "+version)
+	meta.stop()
+
+	if _, err := out.Write(meta.buf.Bytes()); err != nil {
+		return err
+	}
+	if err := binary.Write(out, binary.LittleEndian, uint32(meta.buf.Len())); err != nil {
+		return err
+	}
+	_, err = io.WriteString(out, "PAR1")
+	return err
+}
+
+// rleLevels encodes definition levels of bit width one with the runs of the
+// RLE / bit-packed hybrid encoding.
+func rleLevels(levels []byte) []byte {
+	var out []byte
+	for i := 0; i < len(levels); {
+		j := i
+		for j < len(levels) && levels[j] == levels[i] {
+			j++
+		}
+		out = binary.AppendUvarint(out, uint64(j-i)<<1)
+		out = append(out, levels[i])
+		i = j
+	}
+	return out
+}
+
+// offsetWriter tracks the offset written so far, for the column chunks.
+type offsetWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *offsetWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Thrift compact protocol types.
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes the Thrift compact protocol structures of the Parquet
+// page headers and footer.
+type thriftWriter struct {
+	buf  bytes.Buffer
+	last []int16 // Last field id written in each open struct
+}
+
+func (t *thriftWriter) field(id int16, typ byte) {
+	if len(t.last) == 0 {
+		t.last = []int16{0}
+	}
+	top := len(t.last) - 1
+	if delta := id - t.last[top]; delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		t.buf.WriteByte(typ)
+		t.varint(int64(id))
+	}
+	t.last[top] = id
+}
+
+// varint writes a zigzag encoded integer.
+func (t *thriftWriter) varint(v int64) {
+	t.buf.Write(binary.AppendUvarint(nil, uint64(v<<1^v>>63)))
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.varint(int64(v))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.varint(v)
+}
+
+func (t *thriftWriter) binary(id int16, s string) {
+	t.field(id, thriftBinary)
+	t.str(s)
+}
+
+// str writes a string without a field header, as a list element.
+func (t *thriftWriter) str(s string) {
+	t.buf.Write(binary.AppendUvarint(nil, uint64(len(s))))
+	t.buf.WriteString(s)
+}
+
+// list starts a list field of n elements of type elem.
+func (t *thriftWriter) list(id int16, elem byte, n int) {
+	t.field(id, thriftList)
+	if n < 15 {
+		t.buf.WriteByte(byte(n)<<4 | elem)
+	} else {
+		t.buf.WriteByte(0xf0 | elem)
+		t.buf.Write(binary.AppendUvarint(nil, uint64(n)))
+	}
+}
+
+// begin starts a struct field, elem a struct element of a list.
+func (t *thriftWriter) begin(id int16) {
+	t.field(id, thriftStruct)
+	t.last = append(t.last, 0)
+}
+
+func (t *thriftWriter) elem() {
+	if len(t.last) == 0 {
+		t.last = []int16{0}
+	}
+	t.last = append(t.last, 0)
+}
+
+// end closes the innermost struct.
+func (t *thriftWriter) end() {
+	t.buf.WriteByte(0)
+	t.last = t.last[:len(t.last)-1]
+}
+
+// stop closes the outermost struct.
+func (t *thriftWriter) stop() {
+	t.buf.WriteByte(0)
+}
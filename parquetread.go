@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Further Parquet types and codecs met in files written by others.
+const (
+	parquetBoolean = 0
+	parquetInt32   = 1
+	parquetInt96   = 3
+	parquetDouble  = 5
+
+	parquetPlainDictionary = 2
+	parquetRLEDictionary   = 8
+
+	parquetUncompressed = 0
+	parquetSnappy       = 1
+	parquetGzip         = 2
+)
+
+// parquetLeaf is a column of a flat Parquet schema.
+type parquetLeaf struct {
+	name     string
+	typ      int64
+	optional bool
+}
+
+// readParquet reads the columns named from a flat Parquet file, such as
+// those of S3 Inventory, calling row with the values of each row in the
+// order of names.  Values are an int64, bool, float64, string, time.Time for
+// INT96 timestamps, or nil, and a column missing from the file is all nil.
+// Only what flat files need is supported: PLAIN and dictionary encodings,
+// and the uncompressed, SNAPPY, GZIP and ZSTD codecs.
+func readParquet(r io.ReaderAt, size int64, names []string, row func(values []any) error) error {
+	if size < 12 {
+		return fmt.Errorf("parquet: file too short")
+	}
+	tail := make([]byte, 8)
+	if _, err := r.ReadAt(tail, size-8); err != nil {
+		return err
+	}
+	footerLen := int64(binary.LittleEndian.Uint32(tail))
+	if string(tail[4:]) != "PAR1" || footerLen > size-12 {
+		return fmt.Errorf("parquet: not a Parquet file")
+	}
+	footer := make([]byte, footerLen)
+	if _, err := r.ReadAt(footer, size-8-footerLen); err != nil {
+		return err
+	}
+	t := &thriftReader{b: footer}
+	meta := t.structure()
+	if t.err != nil {
+		return fmt.Errorf("parquet: footer: %w", t.err)
+	}
+
+	// The leaves of the schema, after its root
+	leaves := make(map[string]parquetLeaf)
+	for i, el := range thriftGetList(meta, 2) {
+		el, _ := el.(map[int16]any)
+		if i == 0 {
+			continue // The root
+		}
+		if _, group := el[5]; group {
+			return fmt.Errorf("parquet: nested schemas are not supported")
+		}
+		if thriftGetInt(el, 3) == 2 {
+			return fmt.Errorf("parquet: repeated column %s is not supported", thriftGetString(el, 4))
+		}
+		name := thriftGetString(el, 4)
+		leaves[name] = parquetLeaf{name: name, typ: thriftGetInt(el, 1), optional: thriftGetInt(el, 3) == 1}
+	}
+
+	for _, group := range thriftGetList(meta, 4) {
+		group, _ := group.(map[int16]any)
+		rows := int(thriftGetInt(group, 3))
+		columns := make([][]any, len(names))
+		for _, chunk := range thriftGetList(group, 1) {
+			chunk, _ := chunk.(map[int16]any)
+			chunkMeta := thriftGetStruct(chunk, 3)
+			path := thriftGetList(chunkMeta, 3)
+			if len(path) != 1 {
+				continue
+			}
+			name, _ := path[0].([]byte)
+			for i := range names {
+				if names[i] != string(name) {
+					continue
+				}
+				values, err := readParquetChunk(r, chunkMeta, leaves[string(name)])
+				if err != nil {
+					return fmt.Errorf("parquet: column %s: %w", name, err)
+				}
+				if len(values) != rows {
+					return fmt.Errorf("parquet: column %s has %d values for %d rows", name, len(values), rows)
+				}
+				columns[i] = values
+			}
+		}
+		values := make([]any, len(names))
+		for j := 0; j < rows; j++ {
+			for i := range names {
+				values[i] = nil
+				if columns[i] != nil {
+					values[i] = columns[i][j]
+				}
+			}
+			if err := row(values); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readParquetChunk decodes the pages of a column chunk.
+func readParquetChunk(r io.ReaderAt, meta map[int16]any, leaf parquetLeaf) ([]any, error) {
+	codec, count := thriftGetInt(meta, 4), thriftGetInt(meta, 5)
+	start := thriftGetInt(meta, 9)
+	if dict := thriftGetInt(meta, 11); dict > 0 && dict < start {
+		start = dict
+	}
+	buf := make([]byte, thriftGetInt(meta, 7))
+	if _, err := r.ReadAt(buf, start); err != nil {
+		return nil, err
+	}
+	var dict []any
+	values := make([]any, 0, count)
+	for off := 0; int64(len(values)) < count && off < len(buf); {
+		t := &thriftReader{b: buf, off: off}
+		header := t.structure()
+		if t.err != nil {
+			return nil, fmt.Errorf("page header: %w", t.err)
+		}
+		size, uncompressed := int(thriftGetInt(header, 3)), int(thriftGetInt(header, 2))
+		if size < 0 || t.off+size > len(buf) {
+			return nil, fmt.Errorf("page overruns the column chunk")
+		}
+		page := buf[t.off : t.off+size]
+		off = t.off + size
+
+		var (
+			n, encoding int64
+			defs        []int64
+			data        []byte
+			err         error
+		)
+		switch thriftGetInt(header, 1) {
+		case 2: // DICTIONARY_PAGE
+			if data, err = parquetDecompress(codec, page, uncompressed); err != nil {
+				return nil, err
+			}
+			if dict, err = parquetPlainValues(leaf.typ, data, int(thriftGetInt(thriftGetStruct(header, 7), 1))); err != nil {
+				return nil, err
+			}
+			continue
+		case 0: // DATA_PAGE, levels compressed with the values
+			if data, err = parquetDecompress(codec, page, uncompressed); err != nil {
+				return nil, err
+			}
+			h := thriftGetStruct(header, 5)
+			n, encoding = thriftGetInt(h, 1), thriftGetInt(h, 2)
+			if leaf.optional {
+				if len(data) < 4 {
+					return nil, fmt.Errorf("short data page")
+				}
+				l := int(binary.LittleEndian.Uint32(data))
+				if 4+l > len(data) {
+					return nil, fmt.Errorf("definition levels overrun the page")
+				}
+				defs, data = parquetHybrid(data[4:4+l], 1, int(n)), data[4+l:]
+			}
+		case 3: // DATA_PAGE_V2, levels stored uncompressed ahead of the values
+			h := thriftGetStruct(header, 8)
+			n, encoding = thriftGetInt(h, 1), thriftGetInt(h, 4)
+			defLen, repLen := int(thriftGetInt(h, 5)), int(thriftGetInt(h, 6))
+			if defLen+repLen > len(page) {
+				return nil, fmt.Errorf("levels overrun the page")
+			}
+			if leaf.optional {
+				defs = parquetHybrid(page[repLen:repLen+defLen], 1, int(n))
+			}
+			data = page[repLen+defLen:]
+			if compressed, ok := h[7].(bool); !ok || compressed {
+				if data, err = parquetDecompress(codec, data, uncompressed-repLen-defLen); err != nil {
+					return nil, err
+				}
+			}
+		default:
+			continue // Index pages
+		}
+
+		present := int(n)
+		if defs != nil {
+			present = 0
+			for _, d := range defs {
+				present += int(d)
+			}
+		}
+		var decoded []any
+		switch encoding {
+		case parquetPlain:
+			decoded, err = parquetPlainValues(leaf.typ, data, present)
+		case parquetPlainDictionary, parquetRLEDictionary:
+			if len(data) == 0 && present > 0 {
+				return nil, fmt.Errorf("empty dictionary indices")
+			}
+			if present > 0 {
+				for _, i := range parquetHybrid(data[1:], int(data[0]), present) {
+					if i >= int64(len(dict)) {
+						return nil, fmt.Errorf("dictionary index %d out of range", i)
+					}
+					decoded = append(decoded, dict[i])
+				}
+			}
+		default:
+			err = fmt.Errorf("encoding %d is not supported", encoding)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if defs == nil {
+			values = append(values, decoded...)
+			continue
+		}
+		for _, d := range defs {
+			if d == 0 || len(decoded) == 0 {
+				values = append(values, nil)
+				continue
+			}
+			values, decoded = append(values, decoded[0]), decoded[1:]
+		}
+	}
+	return values, nil
+}
+
+// parquetDecompress decompresses a page with the codec of its column.
+func parquetDecompress(codec int64, data []byte, size int) ([]byte, error) {
+	switch codec {
+	case parquetUncompressed:
+		return data, nil
+	case parquetSnappy:
+		return snappy.Decode(nil, data)
+	case parquetGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		return io.ReadAll(zr)
+	case parquetZstd:
+		dec, err := zstd.NewReader(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer dec.Close()
+		return dec.DecodeAll(data, make([]byte, 0, max(size, 0)))
+	}
+	return nil, fmt.Errorf("compression codec %d is not supported", codec)
+}
+
+// parquetPlainValues decodes n PLAIN encoded values.
+func parquetPlainValues(typ int64, data []byte, n int) ([]any, error) {
+	values := make([]any, 0, n)
+	short := fmt.Errorf("short PLAIN values")
+	for i := 0; i < n; i++ {
+		switch typ {
+		case parquetBoolean:
+			if i/8 >= len(data) {
+				return nil, short
+			}
+			values = append(values, data[i/8]>>(i%8)&1 == 1)
+		case parquetInt32:
+			if len(data) < 4 {
+				return nil, short
+			}
+			values, data = append(values, int64(int32(binary.LittleEndian.Uint32(data)))), data[4:]
+		case parquetInt64:
+			if len(data) < 8 {
+				return nil, short
+			}
+			values, data = append(values, int64(binary.LittleEndian.Uint64(data))), data[8:]
+		case parquetInt96:
+			// Nanoseconds of the day, then the Julian day
+			if len(data) < 12 {
+				return nil, short
+			}
+			nanos, day := int64(binary.LittleEndian.Uint64(data)), int64(binary.LittleEndian.Uint32(data[8:]))
+			values, data = append(values, time.Unix((day-2440588)*86400, nanos).UTC()), data[12:]
+		case parquetDouble:
+			if len(data) < 8 {
+				return nil, short
+			}
+			values, data = append(values, math.Float64frombits(binary.LittleEndian.Uint64(data))), data[8:]
+		case parquetByteArray:
+			if len(data) < 4 {
+				return nil, short
+			}
+			l := int(binary.LittleEndian.Uint32(data))
+			if 4+l > len(data) {
+				return nil, short
+			}
+			values, data = append(values, string(data[4:4+l])), data[4+l:]
+		default:
+			return nil, fmt.Errorf("type %d is not supported", typ)
+		}
+	}
+	return values, nil
+}
+
+// parquetHybrid decodes n values of the RLE / bit-packed hybrid encoding of
+// levels and dictionary indices.
+func parquetHybrid(data []byte, width, n int) []int64 {
+	out := make([]int64, 0, n)
+	for len(out) < n && len(data) > 0 {
+		h, k := binary.Uvarint(data)
+		if k <= 0 {
+			break
+		}
+		data = data[k:]
+		if h&1 == 1 {
+			// Groups of eight values packed least significant bit first
+			end := min(int(h>>1)*width, len(data))
+			for bit := 0; bit+width <= end*8 && len(out) < n; bit += width {
+				var v int64
+				for b := 0; b < width; b++ {
+					v |= int64(data[(bit+b)/8]>>((bit+b)%8)&1) << b
+				}
+				out = append(out, v)
+			}
+			data = data[end:]
+			continue
+		}
+		w := (width + 7) / 8
+		if w > len(data) {
+			break
+		}
+		var v int64
+		for b := 0; b < w; b++ {
+			v |= int64(data[b]) << (8 * b)
+		}
+		data = data[w:]
+		for run := int(h >> 1); run > 0 && len(out) < n; run-- {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// thriftReader decodes Thrift compact protocol structures into maps of field
+// id to value: int64, bool, float64, []byte, []any or map[int16]any.
+type thriftReader struct {
+	b   []byte
+	off int
+	err error
+}
+
+func (t *thriftReader) byte() byte {
+	if t.off >= len(t.b) {
+		t.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	t.off++
+	return t.b[t.off-1]
+}
+
+func (t *thriftReader) uvarint() uint64 {
+	v, k := binary.Uvarint(t.b[min(t.off, len(t.b)):])
+	if k <= 0 {
+		t.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	t.off += k
+	return v
+}
+
+func (t *thriftReader) varint() int64 {
+	u := t.uvarint()
+	return int64(u>>1) ^ -int64(u&1)
+}
+
+func (t *thriftReader) structure() map[int16]any {
+	m := make(map[int16]any)
+	var id int16
+	for t.err == nil {
+		h := t.byte()
+		if h == 0 {
+			break
+		}
+		if delta := int16(h >> 4); delta != 0 {
+			id += delta
+		} else {
+			id = int16(t.varint())
+		}
+		m[id] = t.value(h & 0x0f)
+	}
+	return m
+}
+
+func (t *thriftReader) value(typ byte) any {
+	switch typ {
+	case 1:
+		return true
+	case 2:
+		return false
+	case 3:
+		return int64(int8(t.byte()))
+	case 4, thriftI32, thriftI64:
+		return t.varint()
+	case 7:
+		if t.off+8 > len(t.b) {
+			t.err = io.ErrUnexpectedEOF
+			return nil
+		}
+		t.off += 8
+		return math.Float64frombits(binary.LittleEndian.Uint64(t.b[t.off-8:]))
+	case thriftBinary:
+		n := t.uvarint()
+		if n > uint64(len(t.b)-t.off) {
+			t.err = io.ErrUnexpectedEOF
+			return nil
+		}
+		t.off += int(n)
+		return t.b[t.off-int(n) : t.off]
+	case thriftList, 10: // Lists and sets
+		h := t.byte()
+		n, elem := uint64(h>>4), h&0x0f
+		if n == 15 {
+			n = t.uvarint()
+		}
+		if n > uint64(len(t.b)-t.off) {
+			t.err = io.ErrUnexpectedEOF
+			return nil
+		}
+		list := make([]any, 0, n)
+		for i := uint64(0); i < n && t.err == nil; i++ {
+			if elem == 1 || elem == 2 {
+				list = append(list, t.byte() == 1) // Booleans are a byte each in lists
+			} else {
+				list = append(list, t.value(elem))
+			}
+		}
+		return list
+	case 11: // Maps, not used by Parquet, skipped
+		n := t.uvarint()
+		if n == 0 {
+			return nil
+		}
+		kv := t.byte()
+		for i := uint64(0); i < n && t.err == nil; i++ {
+			t.value(kv >> 4)
+			t.value(kv & 0x0f)
+		}
+		return nil
+	case thriftStruct:
+		return t.structure()
+	}
+	t.err = fmt.Errorf("unknown thrift type %d", typ)
+	return nil
+}
+
+func thriftGetInt(m map[int16]any, id int16) int64 {
+	v, _ := m[id].(int64)
+	return v
+}
+
+func thriftGetString(m map[int16]any, id int16) string {
+	v, _ := m[id].([]byte)
+	return string(v)
+}
+
+func thriftGetList(m map[int16]any, id int16) []any {
+	v, _ := m[id].([]any)
+	return v
+}
+
+func thriftGetStruct(m map[int16]any, id int16) map[int16]any {
+	v, _ := m[id].(map[int16]any)
+	return v
+}
@@ -0,0 +1,2270 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// testObjects returns objects of assorted sizes, from empty to several times
+// MAX_IN_MEM so both in memory and temp file downloads are taken.
+func testObjects() map[string][]byte {
+	rng := rand.New(rand.NewPCG(1, 2))
+	objects := make(map[string][]byte)
+	for i, size := range []int64{0, 1, 1000, 40 << 10, maxMemBytes, maxMemBytes + 1, 3 * maxMemBytes, 700 << 10} {
+		data := make([]byte, size)
+		for j := range data {
+			data[j] = byte(rng.UintN(16)) // Compressible, like most real data
+		}
+		objects[fmt.Sprintf("dir%d/object-%02d.bin", i%3, i)] = data
+	}
+	objects["top level.txt"] = []byte("plain text at the top of the bucket\n")
+	return objects
+}
+
+// setupPipeline runs in a temp directory with a memStore holding objects in
+// SRC_BUCKET, with scanning off and a small SIZECAP so several archives are
+// written.
+func setupPipeline(t *testing.T, objects map[string][]byte) *memStore {
+	t.Chdir(t.TempDir())
+	store := newMemStore()
+	now := time.Now().UTC().Truncate(time.Second)
+	store.mu.Lock()
+	for key, data := range objects {
+		store.put("src", key, &memObject{data: data, lastModified: now, etag: memETag(data)})
+	}
+	store.mu.Unlock()
+
+	s3client, srcBucket, dstBucket = store, "src", "dst"
+	scanningEnabled = false
+	sizeCapLimit = 1 << 20
+	initArchiveStreams()
+	return store
+}
+
+// runPipeline sends every object of SRC_BUCKET through the download, archive
+// and upload stages as main does, and waits for the uploads to finish.
+func runPipeline(t *testing.T, store *memStore) {
+	if errs := runPipelineErrors(t, store); len(errs) > 0 {
+		t.Fatalf("unexpected error for %s: %v", errs[0].Filename, errs[0].Err)
+	}
+}
+
+// runPipelineErrors runs the pipeline as runPipeline does and returns the
+// errors logged on the way.
+func runPipelineErrors(t *testing.T, store *memStore) []*ErrorEvent {
+	return runStages(t, func(toDownload chan<- *DownloadTask) {
+		defer close(toDownload)
+		store.mu.Lock()
+		var entries []MetaEntry
+		for key, obj := range store.buckets["src"] {
+			entries = append(entries, MetaEntry{Key: key, Size: int64(len(obj.data)), LastModified: obj.lastModified, ETag: strings.Trim(obj.etag, `"`)})
+		}
+		store.mu.Unlock()
+		for _, entry := range entries {
+			sendListed(entry, toDownload)
+		}
+	})
+}
+
+// runStages runs the download, archive and upload stages on the objects sent
+// by feed, which closes the channel when done, and returns the errors logged.
+func runStages(t *testing.T, feed func(chan<- *DownloadTask)) []*ErrorEvent {
+	ctx := context.Background()
+	var (
+		toDownload = make(chan *DownloadTask, 10)
+		downloaded = make(chan *WorkFile, 10)
+		small      = make(chan []*WorkFile, 2)
+		archives   = make(chan *ArchiveFile, 2)
+		done       = make(chan struct{})
+	)
+	go feed(toDownload)
+	go Downloader(ctx, toDownload, downloaded, small)
+	go Archiver(ctx, downloaded, small, archives)
+	go Uploader(ctx, archives, done)
+
+	select {
+	case <-done:
+	case <-time.After(time.Minute):
+		t.Fatal("pipeline did not finish")
+	}
+	var errs []*ErrorEvent
+	for {
+		select {
+		case ev := <-fileErrCh:
+			errs = append(errs, ev)
+		default:
+			return errs
+		}
+	}
+}
+
+// archivesIn returns the archives stored in a bucket of the store.
+func archivesIn(store *memStore, bucket string) []string {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	var names []string
+	for key := range store.buckets[bucket] {
+		if archiveExt(key) != "" {
+			names = append(names, key)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+func getObject(t *testing.T, bucket, key string) []byte {
+	t.Helper()
+	out, err := s3client.GetObject(context.Background(), &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		t.Fatalf("failed to get s3://%s/%s: %v", bucket, key, err)
+	}
+	defer out.Body.Close()
+	dat, err := io.ReadAll(out.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dat
+}
+
+// TestPipelineArchivesEveryObject checks that the uploaded archives, read back
+// through their manifests, hold every source object unchanged.
+func TestPipelineArchivesEveryObject(t *testing.T) {
+	objects := testObjects()
+	store := setupPipeline(t, objects)
+	runPipeline(t, store)
+
+	names := archivesIn(store, "dst")
+	if len(names) < 2 {
+		t.Fatalf("expected the objects to span several archives, got %v", names)
+	}
+	got := make(map[string][]byte)
+	for _, name := range names {
+		entries, err := parseManifest(bytes.NewReader(getObject(t, "dst", name+".manifest.jsonl")))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		archiveSum, entrySums, err := parseChecksums(getObject(t, "dst", name+".sha256"))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		dat := getObject(t, "dst", name)
+		if digest := fmt.Sprintf("%x", sha256.Sum256(dat)); digest != archiveSum {
+			t.Errorf("%s: digest %s does not match the checksum file %s", name, digest, archiveSum)
+		}
+		r, closeReader, err := decompressArchive(name, bytes.NewReader(dat))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		tr := tar.NewReader(r)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if hdr.Typeflag != tar.TypeReg {
+				continue
+			}
+			entry, ok := entries[hdr.Name]
+			if !ok {
+				t.Errorf("%s: entry %s is not in the manifest", name, hdr.Name)
+				continue
+			}
+			if _, ok := entrySums[hdr.Name]; !ok {
+				t.Errorf("%s: entry %s is not in the checksum file", name, hdr.Name)
+			}
+			contents, err := io.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got[entry.Key] = contents
+		}
+		closeReader()
+	}
+	for key, want := range objects {
+		if contents, ok := got[key]; !ok {
+			t.Errorf("%s is in no archive", key)
+		} else if !bytes.Equal(contents, want) {
+			t.Errorf("%s was archived with different contents", key)
+		}
+	}
+	if len(got) != len(objects) {
+		t.Errorf("archived %d objects, want %d", len(got), len(objects))
+	}
+}
+
+// importArchives copies the archives and their sidecars out of DST_BUCKET,
+// as EXPORT_DIR would, and imports their contents into the bucket restored.
+func importArchives(t *testing.T, store *memStore) {
+	importDir = t.TempDir()
+	store.mu.Lock()
+	for key, obj := range store.buckets["dst"] {
+		if strings.HasPrefix(key, "run-") || key == uploadLogName {
+			continue
+		}
+		path := filepath.Join(importDir, key)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, obj.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.mu.Unlock()
+
+	dstBucket, importAs = "restored", "contents"
+	RunImport(context.Background())
+	select {
+	case ev := <-fileErrCh:
+		t.Fatalf("unexpected error for %s: %v", ev.Filename, ev.Err)
+	default:
+	}
+}
+
+// TestImportRestoresObjects archives the objects and imports them into
+// another bucket, which must then hold every object under its original key.
+func TestImportRestoresObjects(t *testing.T) {
+	objects := testObjects()
+	store := setupPipeline(t, objects)
+	runPipeline(t, store)
+	importArchives(t, store)
+
+	for key, want := range objects {
+		if got := getObject(t, "restored", key); !bytes.Equal(got, want) {
+			t.Errorf("%s was restored with different contents", key)
+		}
+	}
+}
+
+// TestImportReappliesAttributes checks that the attributes recorded with
+// RECORD_ATTRIBUTES are set again on the restored objects.
+func TestImportReappliesAttributes(t *testing.T) {
+	objects := testObjects()
+	store := setupPipeline(t, objects)
+	const key = "top level.txt"
+	store.mu.Lock()
+	obj := store.buckets["src"][key]
+	obj.contentType = "text/plain"
+	obj.metadata = map[string]string{"owner": "ops"}
+	obj.tags = map[string]string{"team": "data"}
+	store.mu.Unlock()
+
+	recordAttributes = true
+	defer func() { recordAttributes = false }()
+	runPipeline(t, store)
+	importArchives(t, store)
+
+	restored, ok := store.get("restored", key)
+	if !ok {
+		t.Fatalf("%s was not restored", key)
+	}
+	if restored.contentType != "text/plain" {
+		t.Errorf("restored content type %q, want text/plain", restored.contentType)
+	}
+	if restored.metadata["owner"] != "ops" {
+		t.Errorf("restored metadata %v, want owner=ops", restored.metadata)
+	}
+	if !maps.Equal(restored.tags, obj.tags) {
+		t.Errorf("restored tags %v, want %v", restored.tags, obj.tags)
+	}
+}
+
+// TestDeleteSourceKeepsChangedObjects deletes the sources of the uploaded
+// archives after one of them was overwritten, which must be kept.
+func TestDeleteSourceKeepsChangedObjects(t *testing.T) {
+	objects := testObjects()
+	store := setupPipeline(t, objects)
+	runPipeline(t, store)
+
+	const changed = "top level.txt"
+	store.mu.Lock()
+	data := []byte("rewritten after it was archived\n")
+	store.put("src", changed, &memObject{data: data, lastModified: time.Now().UTC().Add(time.Second), etag: memETag(data)})
+	store.mu.Unlock()
+
+	deleteSource = true
+	defer func() { deleteSource = false }()
+	for _, name := range archivesIn(store, "dst") {
+		entries, err := parseManifest(bytes.NewReader(getObject(t, "dst", name+".manifest.jsonl")))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		task := &ArchiveFile{Filename: name}
+		for _, entry := range entries {
+			task.Manifest = append(task.Manifest, entry)
+		}
+		deleteArchived(context.Background(), task)
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if left := slices.Collect(maps.Keys(store.buckets["src"])); len(left) != 1 || left[0] != changed {
+		t.Errorf("source objects left %v, want only %s", left, changed)
+	}
+}
+
+// TestDeleteSourceKeepsTransformedObjects deletes the sources of the
+// uploaded archives, keeping those which TRANSFORM_CMD would rewrite.
+func TestDeleteSourceKeepsTransformedObjects(t *testing.T) {
+	objects := testObjects()
+	store := setupPipeline(t, objects)
+	runPipeline(t, store)
+
+	const transformed = "top level.txt"
+	deleteSource, transformCmd, transformMatch = true, "cat", transformed
+	defer func() { deleteSource, transformCmd, transformMatch = false, "", "*" }()
+	for _, name := range archivesIn(store, "dst") {
+		entries, err := parseManifest(bytes.NewReader(getObject(t, "dst", name+".manifest.jsonl")))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		deleteArchived(context.Background(), &ArchiveFile{Filename: name, Manifest: slices.Collect(maps.Values(entries))})
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if left := slices.Collect(maps.Keys(store.buckets["src"])); len(left) != 1 || left[0] != transformed {
+		t.Errorf("source objects left %v, want only %s", left, transformed)
+	}
+}
+
+// TestImportRestoresFolderMarkers checks that folder markers are recreated
+// by an import, whether EMIT_DIRS wrote them as directories or, for the
+// parents of earlier keys, only in the manifest.
+func TestImportRestoresFolderMarkers(t *testing.T) {
+	objects := testObjects()
+	markers := []string{"dir0/", "dir1/nested/", "empty/"}
+	for _, key := range markers {
+		objects[key] = []byte{}
+	}
+	store := setupPipeline(t, objects)
+	modified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	store.mu.Lock()
+	for _, obj := range store.buckets["src"] {
+		obj.lastModified = modified
+	}
+	store.mu.Unlock()
+	emitDirs = true
+	defer func() { emitDirs = false }()
+	runPipeline(t, store)
+
+	// The marker of an empty folder keeps its time, and the folders implied
+	// by keys take theirs, so archives are reproducible
+	marker, _ := store.get("src", "empty/")
+	var found bool
+	for _, name := range archivesIn(store, "dst") {
+		r, closeReader, err := decompressArchive(name, bytes.NewReader(getObject(t, "dst", name)))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		tr := tar.NewReader(r)
+		for hdr, err := tr.Next(); err == nil; hdr, err = tr.Next() {
+			if hdr.Typeflag == tar.TypeDir && !hdr.ModTime.Equal(modified) {
+				t.Errorf("directory %s written at %v, want %v", hdr.Name, hdr.ModTime, modified)
+			}
+			if hdr.Name == "empty/" {
+				found = true
+				if hdr.Typeflag != tar.TypeDir || !hdr.ModTime.Equal(marker.lastModified) {
+					t.Errorf("folder marker written as type %c at %v, want a directory at %v", hdr.Typeflag, hdr.ModTime, marker.lastModified)
+				}
+			}
+		}
+		closeReader()
+
+		// Directories cannot be checked by sha256sum -c once extracted
+		_, entrySums, err := parseChecksums(getObject(t, "dst", name+".sha256"))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for entry := range entrySums {
+			if strings.HasSuffix(entry, "/") {
+				t.Errorf("%s.sha256 lists the directory %s", name, entry)
+			}
+		}
+	}
+	if !found {
+		t.Error("folder marker empty/ not archived")
+	}
+	importArchives(t, store)
+
+	for key, want := range objects {
+		if got, ok := store.get("restored", key); !ok {
+			t.Errorf("%s was not restored", key)
+		} else if !bytes.Equal(got.data, want) {
+			t.Errorf("%s was restored with different contents", key)
+		}
+	}
+}
+
+// TestExceptionsArchiveHoldsRejectedObjects archives in ustar format, which
+// cannot hold a long key, with EXCEPTIONS_PREFIX: the object is logged and
+// archived apart in PAX format, the others as usual.
+func TestExceptionsArchiveHoldsRejectedObjects(t *testing.T) {
+	objects := testObjects()
+	long := strings.Repeat("long-directory-name/", 15) + "object.bin"
+	objects[long] = []byte("too long for ustar\n")
+	store := setupPipeline(t, objects)
+	archiveTarFormat, exceptionsPrefix = tar.FormatUSTAR, "exceptions/"
+	defer func() { archiveTarFormat, exceptionsPrefix, exceptionStream = tar.FormatPAX, "", nil }()
+	initExceptions()
+	errs := runPipelineErrors(t, store)
+	if len(errs) != 1 || errs[0].Filename != long {
+		t.Fatalf("errors %v, want one for the long key", errs)
+	}
+
+	var exceptions []string
+	for _, name := range archivesIn(store, "dst") {
+		entries, err := parseManifest(bytes.NewReader(getObject(t, "dst", name+".manifest.jsonl")))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for _, entry := range entries {
+			if isException := entry.Exception != ""; isException != (entry.Key == long) {
+				t.Errorf("%s in %s has exception %q", entry.Key, name, entry.Exception)
+			} else if isException {
+				exceptions = append(exceptions, name)
+			}
+		}
+	}
+	if len(exceptions) != 1 || !strings.HasPrefix(exceptions[0], "exceptions/exceptions_") {
+		t.Fatalf("long key archived in %v, want one exceptions archive", exceptions)
+	}
+	store.mu.Lock()
+	tags := store.buckets["dst"][exceptions[0]].tags
+	store.mu.Unlock()
+	if tags["archive-type"] != "exceptions" {
+		t.Errorf("exceptions archive tagged %v", tags)
+	}
+}
+
+// TestAbortOrphanedUploads checks that only the stale multipart uploads of
+// archives are aborted.
+func TestAbortOrphanedUploads(t *testing.T) {
+	store := setupPipeline(t, nil)
+	ctx := context.Background()
+	for _, key := range []string{"archive_0000001.tgz", "archive_0000002.tgz", "other/data.bin"} {
+		store.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{Bucket: aws.String("dst"), Key: aws.String(key)})
+	}
+	store.mu.Lock()
+	for _, upload := range store.uploads {
+		if upload.key != "archive_0000002.tgz" {
+			upload.initiated = upload.initiated.Add(-48 * time.Hour)
+		}
+	}
+	store.mu.Unlock()
+
+	abortOrphanedUploads(ctx)
+	out, err := store.ListMultipartUploads(ctx, &s3.ListMultipartUploadsInput{Bucket: aws.String("dst")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var left []string
+	for _, upload := range out.Uploads {
+		left = append(left, aws.ToString(upload.Key))
+	}
+	if want := []string{"archive_0000002.tgz", "other/data.bin"}; !slices.Equal(left, want) {
+		t.Errorf("uploads left %v, want %v", left, want)
+	}
+
+	// With DST_PREFIX the uploads of other jobs in the bucket are left alone
+	dstPrefix = "tenant/"
+	defer func() { dstPrefix = "" }()
+	for _, key := range []string{"tenant/archive_0000003.tgz", "archive_0000004.tgz"} {
+		store.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{Bucket: aws.String("dst"), Key: aws.String(key)})
+	}
+	store.mu.Lock()
+	for _, upload := range store.uploads {
+		upload.initiated = upload.initiated.Add(-48 * time.Hour)
+	}
+	store.mu.Unlock()
+	abortOrphanedUploads(ctx)
+	out, err = store.ListMultipartUploads(ctx, &s3.ListMultipartUploadsInput{Bucket: aws.String("dst")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	left = left[:0]
+	for _, upload := range out.Uploads {
+		left = append(left, aws.ToString(upload.Key))
+	}
+	if want := []string{"archive_0000002.tgz", "archive_0000004.tgz", "other/data.bin"}; !slices.Equal(left, want) {
+		t.Errorf("uploads left with DST_PREFIX %v, want %v", left, want)
+	}
+}
+
+// TestPriorityObjectsSentAhead checks that objects under PRIORITY_PREFIXES
+// are read ahead of the others, wherever they are in the metadata file.
+func TestPriorityObjectsSentAhead(t *testing.T) {
+	t.Chdir(t.TempDir())
+	var metadata []byte
+	for i := range 12 {
+		key := fmt.Sprintf("bulk/%02d", i)
+		if i >= 8 {
+			key = fmt.Sprintf("crit/%02d", i)
+		}
+		metadata = fmt.Appendf(metadata, "{\"key\":%q,\"size\":1}\n", key)
+	}
+	if err := os.WriteFile(metadataFileName, metadata, 0644); err != nil {
+		t.Fatal(err)
+	}
+	priorityPrefixes, priorityActive = "crit/", true
+	defer func() { priorityPrefixes, priorityActive = "", false }()
+
+	toDownload := make(chan *DownloadTask)
+	go ReadMetadata(context.Background(), toDownload)
+	var keys []string
+	for task := range toDownload {
+		keys = append(keys, task.Filename)
+		time.Sleep(10 * time.Millisecond) // Let both lanes fill
+	}
+	if len(keys) != 12 {
+		t.Fatalf("read %d objects, want 12: %v", len(keys), keys)
+	}
+	var crit int
+	for _, key := range keys[:6] {
+		if strings.HasPrefix(key, "crit/") {
+			crit++
+		}
+	}
+	if crit != 4 {
+		t.Errorf("%d of the 4 priority objects in the first 6 sent: %v", crit, keys)
+	}
+}
+
+// TestChunkedObjectSpansArchives checks that an object above CHUNK_THRESHOLD
+// is split into entries across several archives and imported whole.
+func TestChunkedObjectSpansArchives(t *testing.T) {
+	objects := testObjects()
+	huge := make([]byte, 6<<20)
+	rng := rand.New(rand.NewPCG(1, 2))
+	for i := range huge {
+		huge[i] = byte(rng.Uint32())
+	}
+	objects["huge.bin"] = huge
+	chunkThreshold, chunkAvgSize = "2M", "1M"
+	initChunking()
+	defer func() { chunkThreshold, chunkAbove = "", 0 }()
+
+	store := setupPipeline(t, objects)
+	runPipeline(t, store)
+
+	holding := make(map[string]bool)
+	var chunks int
+	for _, name := range archivesIn(store, "dst") {
+		entries, err := parseManifest(bytes.NewReader(getObject(t, "dst", name+".manifest.jsonl")))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for _, entry := range entries {
+			if entry.Key == "huge.bin" {
+				if entry.Chunk == nil {
+					t.Fatalf("%s holds huge.bin whole", name)
+				}
+				holding[name] = true
+				chunks++
+			}
+		}
+	}
+	if chunks < 3 || len(holding) < 2 {
+		t.Fatalf("huge.bin is in %d chunks in %d archives, want it split across archives", chunks, len(holding))
+	}
+
+	importArchives(t, store)
+	if got := getObject(t, "restored", "huge.bin"); !bytes.Equal(got, huge) {
+		t.Error("huge.bin was restored with different contents")
+	}
+}
+
+// TestResumeReport checks the counts and inconsistencies reported when a run
+// is resumed.
+func TestResumeReport(t *testing.T) {
+	t.Chdir(t.TempDir())
+	metadata := "{\"key\":\"a\",\"size\":10}\n{\"key\":\"b\",\"size\":20}\n{\"key\":\"c\",\"size\":30}\n"
+	if err := os.WriteFile(metadataFileName, []byte(metadata), 0644); err != nil {
+		t.Fatal(err)
+	}
+	saved := skipFiles
+	skipFiles = map[string]struct{}{"a": {}, "gone": {}}
+	uploadLogLines = 2
+	defer func() { skipFiles, uploadLogLines = saved, 0 }()
+
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+	reportResume()
+	for _, want := range []string{
+		"2 objects in upload.log",
+		"1 objects (10 B) of metadata.jsonl done, 2 objects (50 B) left",
+		"1 objects done are not in metadata.jsonl",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("report is missing %q:\n%s", want, out.String())
+		}
+	}
+}
+
+// TestDeleteMarkerTombstone checks a key deleted from a versioned source is
+// archived as a tombstone which import deletes again.
+func TestDeleteMarkerTombstone(t *testing.T) {
+	objects := testObjects()
+	objects["gone.txt"] = []byte("deleted later")
+	store := setupPipeline(t, objects)
+	ctx := context.Background()
+	if _, err := store.DeleteObjects(ctx, &s3.DeleteObjectsInput{Bucket: aws.String("src"),
+		Delete: &types.Delete{Objects: []types.ObjectIdentifier{{Key: aws.String("gone.txt")}}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	errs := runStages(t, func(toDownload chan<- *DownloadTask) {
+		defer close(toDownload)
+		err := listDeleteMarkers(ctx, "src", nil, nil, func(entry MetaEntry) { sendListed(entry, toDownload) })
+		if err != nil {
+			t.Error(err)
+		}
+	})
+	if len(errs) > 0 {
+		t.Fatalf("unexpected error for %s: %v", errs[0].Filename, errs[0].Err)
+	}
+
+	var found bool
+	for _, name := range archivesIn(store, "dst") {
+		entries, err := parseManifest(bytes.NewReader(getObject(t, "dst", name+".manifest.jsonl")))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for _, entry := range entries {
+			if entry.Key == "gone.txt" {
+				found = entry.DeleteMarker && strings.HasSuffix(entry.Name, ".deleted")
+			}
+		}
+	}
+	if !found {
+		t.Fatal("no tombstone archived for gone.txt")
+	}
+
+	store.mu.Lock()
+	store.put("restored", "gone.txt", &memObject{data: objects["gone.txt"]})
+	store.mu.Unlock()
+	importArchives(t, store)
+	if _, ok := store.get("restored", "gone.txt"); ok {
+		t.Error("import did not delete gone.txt")
+	}
+}
+
+// TestScanRecordsInTarEntries checks TAR_PAX_SCAN records the scan verdict
+// and database version in the PAX header of each entry.
+func TestScanRecordsInTarEntries(t *testing.T) {
+	store := setupPipeline(t, nil)
+	paxScan, virusScanMap["version"] = true, "27500"
+	defer func() { paxScan = false; delete(virusScanMap, "version") }()
+
+	ctx := context.Background()
+	scanned := make(chan *WorkFile, 1)
+	archives := make(chan *ArchiveFile, 1)
+	done := make(chan struct{})
+	go Archiver(ctx, scanned, nil, archives)
+	go Uploader(ctx, archives, done)
+	contents := []byte("scanned contents")
+	scanned <- &WorkFile{Filename: "clean.txt", Size: int64(len(contents)), Bytes: contents, ScanResult: "clean"}
+	close(scanned)
+	<-done
+
+	names := archivesIn(store, "dst")
+	if len(names) != 1 {
+		t.Fatalf("expected one archive, got %v", names)
+	}
+	r, closeReader, err := decompressArchive(names[0], bytes.NewReader(getObject(t, "dst", names[0])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeReader()
+	hdr, err := tar.NewReader(r).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hdr.PAXRecords["x-scan-result"]; got != "clean" {
+		t.Errorf("x-scan-result is %q, want clean", got)
+	}
+	if got := hdr.PAXRecords["x-scan-db"]; got != "27500" {
+		t.Errorf("x-scan-db is %q, want 27500", got)
+	}
+}
+
+// TestVerifyArchiveCatchesCorruption checks a finished archive passes
+// verification, and fails it once a byte of it is changed on disk.
+func TestVerifyArchiveCatchesCorruption(t *testing.T) {
+	setupPipeline(t, nil)
+	ctx := context.Background()
+	scanned := make(chan *WorkFile, 1)
+	archives := make(chan *ArchiveFile, 1)
+	go Archiver(ctx, scanned, nil, archives)
+	contents := bytes.Repeat([]byte("archived contents "), 100)
+	scanned <- &WorkFile{Filename: "a.txt", Size: int64(len(contents)), Bytes: contents}
+	close(scanned)
+	task := <-archives
+
+	if err := verifyArchive(task); err != nil {
+		t.Fatalf("verifying a sound archive: %v", err)
+	}
+	dat, err := os.ReadFile(task.Filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dat[len(dat)/2] ^= 0xff
+	if err := os.WriteFile(task.Filename, dat, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyArchive(task); err == nil {
+		t.Error("a corrupted archive passed verification")
+	}
+}
+
+// TestEnricherHeadsObjectsInOrder checks ENRICH attaches the attributes of
+// each object, keeps the order, and logs objects which cannot be headed.
+func TestEnricherHeadsObjectsInOrder(t *testing.T) {
+	store := setupPipeline(t, nil)
+	store.mu.Lock()
+	for _, key := range []string{"a", "b", "c"} {
+		store.put("src", key, &memObject{data: []byte(key), contentType: "text/plain", metadata: map[string]string{"owner": key}})
+	}
+	store.mu.Unlock()
+
+	tasks := make(chan *DownloadTask, 4)
+	enriched := make(chan *DownloadTask, 4)
+	for _, key := range []string{"a", "missing", "b", "c"} {
+		tasks <- &DownloadTask{Filename: key, Size: 1}
+	}
+	close(tasks)
+	Enricher(context.Background(), tasks, enriched)
+
+	var keys []string
+	for task := range enriched {
+		keys = append(keys, task.Filename)
+		if task.Attrs == nil || task.Attrs.ContentType != "text/plain" || task.Attrs.Metadata["owner"] != task.Filename {
+			t.Errorf("%s enriched with %+v", task.Filename, task.Attrs)
+		}
+	}
+	if !slices.Equal(keys, []string{"a", "b", "c"}) {
+		t.Errorf("enriched %v, want a, b, c in order", keys)
+	}
+	select {
+	case ev := <-fileErrCh:
+		if ev.Filename != "missing" {
+			t.Errorf("unexpected error for %s: %v", ev.Filename, ev.Err)
+		}
+	default:
+		t.Error("no error logged for the missing object")
+	}
+}
+
+// TestArchiveNumberAcrossStreams checks archive numbers are found in the
+// names of every stream, whatever the codec they were written with.
+func TestArchiveNumberAcrossStreams(t *testing.T) {
+	saved := ArchiveName
+	ArchiveName = "archive_%07d.tgz"
+	defer func() { ArchiveName = saved }()
+	for key, want := range map[string]int{
+		"archive_0000007.tgz":                       7,
+		"logs/archive_0000012.tgz":                  12,
+		"secret/archive_0000003.tar.zst":            3,
+		"exceptions/exceptions_archive_0000009.tgz": 9,
+		"archive_0000007.tgz.sha256":                0,
+		"archive_.tgz":                              0,
+		"other_0000005.tgz":                         0,
+	} {
+		n, ok := archiveNumber(key)
+		if ok != (want > 0) || n != want {
+			t.Errorf("archiveNumber(%q) = %d, %v, want %d", key, n, ok, want)
+		}
+	}
+}
+
+// TestPreflightPassesAndLeavesNothing checks the preflight checks pass on a
+// store allowing everything, and leave no upload or object behind.
+func TestPreflightPassesAndLeavesNothing(t *testing.T) {
+	store := setupPipeline(t, testObjects())
+	for _, r := range preflightChecks(context.Background()) {
+		if r.err != nil {
+			t.Errorf("%s: %v", r.check, r.err)
+		}
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if len(store.uploads) > 0 || len(store.buckets["dst"]) > 0 {
+		t.Errorf("preflight left %d uploads and %d objects behind", len(store.uploads), len(store.buckets["dst"]))
+	}
+}
+
+// TestReconcileByList checks RECONCILE=list counts the objects added, removed
+// and changed since the listing, and lists those to archive again.
+func TestReconcileByList(t *testing.T) {
+	store := setupPipeline(t, testObjects())
+	ctx := context.Background()
+	if _, _, err := loadMetadata(ctx, "src", nil); err != nil {
+		t.Fatal(err)
+	}
+	store.mu.Lock()
+	store.put("src", "added.txt", &memObject{data: []byte("new"), etag: memETag([]byte("new"))})
+	store.put("src", "dir0/object-03.bin", &memObject{data: []byte("changed"), etag: memETag([]byte("changed"))})
+	delete(store.buckets["src"], "dir1/object-01.bin")
+	store.mu.Unlock()
+
+	reconcileWith = "list"
+	defer func() { reconcileWith, reconcileResult = "", nil }()
+	reconcileListing(ctx)
+	r := reconcileResult
+	if r == nil || r.Added != 1 || r.Removed != 1 || r.Changed != 1 || !r.Flagged {
+		t.Fatalf("reconciled %+v, want 1 added, 1 removed and 1 changed, flagged", r)
+	}
+	dat, err := os.ReadFile(r.MissedFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(dat), "\n"); lines != 2 || !strings.Contains(string(dat), `"added.txt"`) {
+		t.Errorf("missed file holds %q, want added.txt and the changed object", dat)
+	}
+}
+
+// TestContentHashNaming checks ARCHIVE_NAMING=content-hash uploads each
+// archive under the digest in its checksum file.
+func TestContentHashNaming(t *testing.T) {
+	store := setupPipeline(t, testObjects())
+	archiveNaming = hashNamer{}
+	defer func() { archiveNaming = counterNamer{} }()
+	runPipeline(t, store)
+
+	names := archivesIn(store, "dst")
+	if len(names) < 2 {
+		t.Fatalf("expected several archives, got %v", names)
+	}
+	for _, name := range names {
+		archiveSum, _, err := parseChecksums(getObject(t, "dst", name+".sha256"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "archive_" + archiveSum + ".tgz"; name != want {
+			t.Errorf("archive uploaded as %s, want %s", name, want)
+		}
+	}
+}
+
+// TestULIDSortsByTime checks ULIDs are 26 characters which sort by time.
+func TestULIDSortsByTime(t *testing.T) {
+	now := time.Now()
+	a, b := newULID(now), newULID(now.Add(time.Millisecond))
+	if len(a) != 26 || a >= b {
+		t.Errorf("ULIDs %s and %s do not sort by time", a, b)
+	}
+}
+
+// TestCatalogParquet checks CATALOG_PARQUET uploads a Parquet file whose
+// footer and key column read back as the objects archived.
+func TestCatalogParquet(t *testing.T) {
+	store := setupPipeline(t, testObjects())
+	catalogPrefix = "catalog"
+	defer func() { catalogPrefix, catalogWriter, catalogFiles, catalogParts = "", nil, nil, 0 }()
+	initCatalog()
+	runPipeline(t, store)
+	flushCatalog(context.Background())
+
+	if len(catalogFiles) != 1 {
+		t.Fatalf("wrote catalog files %v, want one", catalogFiles)
+	}
+	dat := getObject(t, "dst", catalogFiles[0])
+	if string(dat[:4]) != "PAR1" || string(dat[len(dat)-4:]) != "PAR1" {
+		t.Fatal("catalog is missing the PAR1 magic")
+	}
+	footerLen := int(binary.LittleEndian.Uint32(dat[len(dat)-8:]))
+	meta := readThrift(t, bytes.NewReader(dat[len(dat)-8-footerLen:len(dat)-8]))
+	if rows := meta[3].(int64); rows != int64(len(testObjects())) {
+		t.Fatalf("catalog holds %d rows, want %d", rows, len(testObjects()))
+	}
+	schema := meta[2].([]any)
+	if name := string(schema[1].(map[int16]any)[4].([]byte)); name != "key" {
+		t.Fatalf("first column is %q, want key", name)
+	}
+
+	// Read back the page of the key column
+	chunk := meta[4].([]any)[0].(map[int16]any)[1].([]any)[0].(map[int16]any)[3].(map[int16]any)
+	r := bytes.NewReader(dat[chunk[9].(int64):])
+	header := readThrift(t, r)
+	page := make([]byte, header[3].(int64))
+	io.ReadFull(r, page)
+	dec, _ := zstd.NewReader(nil)
+	defer dec.Close()
+	values, err := dec.DecodeAll(page, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{}
+	for key := range testObjects() {
+		want[key] = true
+	}
+	for len(values) > 0 {
+		n := binary.LittleEndian.Uint32(values)
+		key := string(values[4 : 4+n])
+		if !want[key] {
+			t.Errorf("unexpected key %q in the catalog", key)
+		}
+		delete(want, key)
+		values = values[4+n:]
+	}
+	if len(want) > 0 {
+		t.Errorf("keys missing from the catalog: %v", want)
+	}
+}
+
+// readThrift decodes a Thrift compact protocol struct into its fields by id.
+func readThrift(t *testing.T, r *bytes.Reader) map[int16]any {
+	t.Helper()
+	fields := map[int16]any{}
+	var last int16
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b == 0 {
+			return fields
+		}
+		if delta := int16(b >> 4); delta != 0 {
+			last += delta
+		} else {
+			last = int16(readZigzag(t, r))
+		}
+		fields[last] = readThriftValue(t, r, b&0x0f)
+	}
+}
+
+func readThriftValue(t *testing.T, r *bytes.Reader, typ byte) any {
+	switch typ {
+	case thriftI32, thriftI64:
+		return readZigzag(t, r)
+	case thriftBinary:
+		n, _ := binary.ReadUvarint(r)
+		b := make([]byte, n)
+		io.ReadFull(r, b)
+		return b
+	case thriftList:
+		h, _ := r.ReadByte()
+		n := uint64(h >> 4)
+		if n == 15 {
+			n, _ = binary.ReadUvarint(r)
+		}
+		list := make([]any, n)
+		for i := range list {
+			list[i] = readThriftValue(t, r, h&0x0f)
+		}
+		return list
+	case thriftStruct:
+		return readThrift(t, r)
+	}
+	t.Fatalf("unexpected thrift type %d", typ)
+	return nil
+}
+
+func readZigzag(t *testing.T, r *bytes.Reader) int64 {
+	u, err := binary.ReadUvarint(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return int64(u>>1) ^ -int64(u&1)
+}
+
+// TestCanaryPausesAfterFirstObjects checks CANARY uploads and verifies an
+// archive of the first objects, and holds the rest until confirmed.
+func TestCanaryPausesAfterFirstObjects(t *testing.T) {
+	store := setupPipeline(t, testObjects())
+	canaryObjects = 3
+	defer func() {
+		canaryObjects, canaryArrived, canaryUploaded, canaryArchives = 0, 0, 0, nil
+		canaryDone.Store(false)
+	}()
+	baseExceptions := ExceptionFiles
+	ExceptionFiles = 0
+	defer func() { ExceptionFiles = baseExceptions }()
+
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		runStages(t, func(toDownload chan<- *DownloadTask) {
+			fed := make(chan *DownloadTask)
+			go func() {
+				defer close(fed)
+				for key, data := range testObjects() {
+					sendListed(MetaEntry{Key: key, Size: int64(len(data)), ETag: strings.Trim(memETag(data), `"`)}, fed)
+				}
+			}()
+			canaryGate(context.Background(), fed, toDownload)
+		})
+	}()
+
+	select {
+	case canaryConfirm <- struct{}{}:
+	case <-time.After(time.Minute):
+		t.Fatal("canary did not wait for confirmation")
+	}
+	if n := atomic.LoadInt64(&canaryUploaded); n != 3 {
+		t.Fatalf("canary archives hold %d objects, want 3", n)
+	}
+	if len(canaryArchives) != 1 || archivesIn(store, "dst")[0] != canaryArchives[0].Filename {
+		t.Fatalf("canary archives %d, want the first one uploaded", len(canaryArchives))
+	}
+	<-finished
+	importArchives(t, store)
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if n := len(store.buckets["restored"]); n != len(testObjects()) {
+		t.Errorf("restored %d objects after the canary, want %d", n, len(testObjects()))
+	}
+}
+
+// TestStateFileResume checks STATE_FILE records each object through the
+// pipeline, and RESUME skips the uploaded ones and numbers after the
+// archives.
+func TestStateFileResume(t *testing.T) {
+	store := setupPipeline(t, testObjects())
+	stateFileName = "state.jsonl"
+	savedSkips := skipFiles
+	defer func() {
+		stateFileName, resumeRun, stateResume, skipFiles = "", false, nil, savedSkips
+	}()
+	initStateFile()
+	runPipeline(t, store)
+	closeStateFile()
+
+	dat, err := os.ReadFile(stateFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key := range testObjects() {
+		// Each stage is recorded before the object is handed to the next
+		last := -1
+		for _, state := range []string{"downloaded", "archived", "uploaded"} {
+			i := strings.Index(string(dat), `{"item":"object#`+key+`","state":"`+state+`"`)
+			if i < 0 {
+				t.Errorf("state file is missing %s for %s", state, key)
+			} else if i < last {
+				t.Errorf("state file records %s for %s before the stage ahead of it", state, key)
+			}
+			last = max(last, i)
+		}
+	}
+
+	skipFiles, archiveCount, resumeRun = make(map[string]struct{}), 0, true
+	initStateFile()
+	closeStateFile()
+	if len(skipFiles) != len(testObjects()) {
+		t.Errorf("resume skips %d objects, want %d", len(skipFiles), len(testObjects()))
+	}
+	var highest int
+	for _, name := range archivesIn(store, "dst") {
+		if n, ok := archiveNumber(name); ok {
+			highest = max(highest, n)
+		}
+	}
+	if archiveCount != highest {
+		t.Errorf("resume numbers after archive %d, want %d", archiveCount, highest)
+	}
+}
+
+// TestStreamUpload checks STREAM_UPLOAD uploads archives matching their
+// checksum files, which restore every object, without any on local disk.
+func TestStreamUpload(t *testing.T) {
+	objects := testObjects()
+	store := setupPipeline(t, objects)
+	streamUpload = true
+	defer func() { streamUpload = false }()
+	runPipeline(t, store)
+
+	names := archivesIn(store, "dst")
+	if len(names) < 2 {
+		t.Fatalf("expected several archives, got %v", names)
+	}
+	for _, name := range names {
+		if _, err := os.Stat(name); err == nil {
+			t.Errorf("%s was staged on local disk", name)
+		}
+		archiveSum, _, err := parseChecksums(getObject(t, "dst", name+".sha256"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if digest := fmt.Sprintf("%x", sha256.Sum256(getObject(t, "dst", name))); digest != archiveSum {
+			t.Errorf("%s: digest %s does not match the checksum file %s", name, digest, archiveSum)
+		}
+	}
+	if len(streamUploads) != 0 {
+		t.Errorf("%d uploads left open", len(streamUploads))
+	}
+
+	importArchives(t, store)
+	for key, want := range objects {
+		if got := getObject(t, "restored", key); !bytes.Equal(got, want) {
+			t.Errorf("%s restored with different contents", key)
+		}
+	}
+}
+
+// TestEmbedManifest checks EMBED_MANIFEST ends each archive with a copy of
+// its manifest sidecar, and that the archives still import.
+func TestEmbedManifest(t *testing.T) {
+	objects := testObjects()
+	store := setupPipeline(t, objects)
+	embedManifest = true
+	defer func() { embedManifest = false }()
+	runPipeline(t, store)
+
+	for _, name := range archivesIn(store, "dst") {
+		r, closeReader, err := decompressArchive(name, bytes.NewReader(getObject(t, "dst", name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var last string
+		var embedded []byte
+		tr := tar.NewReader(r)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if last = hdr.Name; last == manifestEntryName {
+				embedded, _ = io.ReadAll(tr)
+			}
+		}
+		closeReader()
+		if last != manifestEntryName {
+			t.Errorf("%s ends with %s, not the manifest", name, last)
+		} else if sidecar := getObject(t, "dst", name+".manifest.jsonl"); !bytes.Equal(embedded, sidecar) {
+			t.Errorf("%s: embedded manifest differs from the sidecar", name)
+		}
+		_, entrySums, err := parseChecksums(getObject(t, "dst", name+".sha256"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := entrySums[manifestEntryName]; !ok {
+			t.Errorf("%s: embedded manifest is not in the checksum file", name)
+		}
+	}
+
+	importArchives(t, store)
+	for key, want := range objects {
+		if got := getObject(t, "restored", key); !bytes.Equal(got, want) {
+			t.Errorf("%s restored with different contents", key)
+		}
+	}
+}
+
+// TestRestoreFromBucket checks MODE=restore puts the objects of the archives
+// in a bucket back under their keys, with only the embedded manifest.
+func TestRestoreFromBucket(t *testing.T) {
+	objects := testObjects()
+	store := setupPipeline(t, objects)
+	embedManifest, manifestSidecar = true, false
+	defer func() { embedManifest, manifestSidecar = false, true }()
+	runPipeline(t, store)
+	if _, err := store.HeadObject(context.Background(), &s3.HeadObjectInput{Bucket: aws.String("dst"), Key: aws.String(archivesIn(store, "dst")[0] + ".manifest.jsonl")}); err == nil {
+		t.Fatal("the manifest sidecar was uploaded")
+	}
+
+	srcBucket, dstBucket = "dst", "restored"
+	RunRestore(context.Background())
+	select {
+	case ev := <-fileErrCh:
+		t.Fatalf("unexpected error for %s: %v", ev.Filename, ev.Err)
+	default:
+	}
+	for key, want := range objects {
+		if got := getObject(t, "restored", key); !bytes.Equal(got, want) {
+			t.Errorf("%s restored with different contents", key)
+		}
+	}
+	if dat, _ := os.ReadFile("restore.log"); strings.Count(string(dat), "\n") != len(archivesIn(store, "dst")) {
+		t.Errorf("restore.log lists %q", dat)
+	}
+}
+
+// TestVerifyModeReportsDifferences checks MODE=verify reads the archives
+// back and reports the objects added, changed and removed at the source.
+func TestVerifyModeReportsDifferences(t *testing.T) {
+	objects := testObjects()
+	store := setupPipeline(t, objects)
+	runPipeline(t, store)
+
+	now := time.Now().UTC()
+	store.mu.Lock()
+	store.put("src", "dir1/object-01.bin", &memObject{data: []byte("changed"), lastModified: now, etag: memETag([]byte("changed"))})
+	store.put("src", "added.txt", &memObject{data: []byte("added"), lastModified: now, etag: memETag([]byte("added"))})
+	delete(store.buckets["src"], "top level.txt")
+	store.mu.Unlock()
+
+	verifyReport = "verify_report.jsonl"
+	r := RunVerify(context.Background())
+	want := VerifyResult{Archives: len(archivesIn(store, "dst")), Objects: len(objects), Matched: len(objects) - 2, Missing: 1, Extra: 1, Mismatched: 1}
+	if *r != want {
+		t.Errorf("got %+v, want %+v", *r, want)
+	}
+	dat, err := os.ReadFile(verifyReport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{`{"key":"added.txt","problem":"missing"`, `{"key":"dir1/object-01.bin","problem":"mismatched"`, `{"key":"top level.txt","problem":"extra"`} {
+		if !strings.Contains(string(dat), line) {
+			t.Errorf("report is missing %s in:\n%s", line, dat)
+		}
+	}
+}
+
+func TestRetryFailedObjects(t *testing.T) {
+	t.Chdir(t.TempDir())
+	retryPasses, retryDelay = 2, 0
+	defer func() {
+		retryPasses, retryDelay = 0, 30
+		clear(retry.pending)
+		clear(retry.failed)
+		clear(retry.attempts)
+	}()
+
+	in, out := make(chan *DownloadTask), make(chan *DownloadTask)
+	go func() {
+		defer close(in)
+		for _, key := range []string{"flaky", "broken", "virus"} {
+			in <- &DownloadTask{Filename: key, Size: 4}
+		}
+	}()
+	go retryGate(context.Background(), in, out)
+
+	sent := make(map[string]int)
+	for task := range out {
+		sent[task.Filename]++
+		switch {
+		case task.Filename == "virus":
+			retryFailed(&ErrorEvent{Filename: task.Filename, Size: task.Size, Err: noRetry(fmt.Errorf("virus found"))})
+		case task.Filename == "broken" || sent[task.Filename] == 1:
+			retryFailed(&ErrorEvent{Filename: task.Filename, Size: task.Size, Err: fmt.Errorf("connection reset")})
+		default:
+			retryArrived(&WorkFile{Filename: task.Filename, Size: task.Size})
+		}
+	}
+	if sent["flaky"] != 2 || sent["broken"] != 3 || sent["virus"] != 1 {
+		t.Fatalf("sent %v, want flaky twice, broken three times and virus once", sent)
+	}
+
+	writeFailedObjects()
+	dat, err := os.ReadFile(failedObjectsName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var failed []FailedObject
+	for _, line := range strings.Split(strings.TrimSpace(string(dat)), "\n") {
+		var f FailedObject
+		if err := json.Unmarshal([]byte(line), &f); err != nil {
+			t.Fatal(err)
+		}
+		failed = append(failed, f)
+	}
+	if len(failed) != 2 || failed[0].Key != "broken" || failed[0].Attempts != 3 || failed[1].Key != "virus" || failed[1].Attempts != 1 {
+		t.Fatalf("failed objects %+v, want broken after 3 attempts and virus after 1", failed)
+	}
+}
+
+func TestRemoteScanBackends(t *testing.T) {
+	// Fake clamd on a unix socket, finding a virus in contents holding "EICAR"
+	sock := filepath.Join(t.TempDir(), "clamd.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			r := bufio.NewReader(conn)
+			cmd, _ := r.ReadString(0)
+			var body []byte
+			for cmd == "zINSTREAM\x00" {
+				var n uint32
+				binary.Read(r, binary.BigEndian, &n)
+				if n == 0 {
+					break
+				}
+				chunk := make([]byte, n)
+				io.ReadFull(r, chunk)
+				body = append(body, chunk...)
+			}
+			switch {
+			case cmd == "zINSTREAM\x00" && bytes.Contains(body, []byte("EICAR")):
+				conn.Write([]byte("stream: Eicar-Signature FOUND\x00"))
+			case cmd == "zINSTREAM\x00":
+				conn.Write([]byte("stream: OK\x00"))
+			}
+			conn.Close()
+		}
+	}()
+
+	// Fake ICAP service, answering 204 unless the body holds "EICAR"
+	iln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer iln.Close()
+	go func() {
+		for {
+			conn, err := iln.Accept()
+			if err != nil {
+				return
+			}
+			tp := textproto.NewReader(bufio.NewReader(conn))
+			tp.ReadLine()
+			tp.ReadMIMEHeader()
+			tp.ReadLine() // Encapsulated GET
+			tp.ReadMIMEHeader()
+			tp.ReadLine() // Encapsulated response
+			tp.ReadMIMEHeader()
+			var body []byte
+			for {
+				line, _ := tp.ReadLine()
+				n, _ := strconv.ParseInt(line, 16, 64)
+				if n == 0 {
+					break
+				}
+				chunk := make([]byte, n+2)
+				io.ReadFull(tp.R, chunk)
+				body = append(body, chunk[:n]...)
+			}
+			if bytes.Contains(body, []byte("EICAR")) {
+				conn.Write([]byte("ICAP/1.0 200 OK\r\nX-Infection-Found: Type=0; Resolution=2; Threat=Eicar-Test-Signature;\r\nEncapsulated: null-body=0\r\n\r\n"))
+			} else {
+				conn.Write([]byte("ICAP/1.0 204 No Content\r\n\r\n"))
+			}
+			conn.Close()
+		}
+	}()
+
+	clamd, err := newClamdBackend("unix://"+sock, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	icap, err := newICAPBackend("icap://"+iln.Addr().String()+"/avscan", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, backend := range []scanBackend{clamd, icap} {
+		clean := bytes.Repeat([]byte("clean contents "), 10000) // Several chunks
+		if virus, err := backend.scan(&WorkFile{Filename: "clean.txt", Size: int64(len(clean)), Bytes: clean}); virus != "" || err != nil {
+			t.Fatalf("%T: clean contents scanned as %q, %v", backend, virus, err)
+		}
+		infected := []byte("X5O!P%@AP[4\\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*")
+		virus, err := backend.scan(&WorkFile{Filename: "eicar.com", Size: int64(len(infected)), Bytes: infected})
+		if err != nil || !strings.HasPrefix(virus, "Eicar") {
+			t.Fatalf("%T: infected contents scanned as %q, %v", backend, virus, err)
+		}
+	}
+}
+
+// stubScan finds a virus in contents holding needle, or fails with err.
+type stubScan struct {
+	needle string
+	err    error
+}
+
+func (s stubScan) scan(task *WorkFile) (string, error) {
+	if s.err != nil {
+		return "", s.err
+	}
+	if bytes.Contains(task.Bytes, []byte(s.needle)) {
+		return "Stub." + s.needle, nil
+	}
+	return "", nil
+}
+
+func TestScanChainPolicies(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "scan.sh")
+	os.WriteFile(script, []byte("#!/bin/sh\ngrep -q EICAR \"$1\" || exit 0\necho scanning\necho Script.EICAR\nexit 1\n"), 0755)
+	command := &commandBackend{args: []string{script, "{}"}, timeout: time.Minute}
+
+	eicar := &WorkFile{Filename: "eicar.com", Size: 5, Bytes: []byte("EICAR")}
+	other := &WorkFile{Filename: "other.bin", Size: 5, Bytes: []byte("OTHER")}
+	clean := &WorkFile{Filename: "clean.txt", Size: 5, Bytes: []byte("clean")}
+	for _, tc := range []struct {
+		policy  string
+		engines []scanBackend
+		task    *WorkFile
+		virus   string
+		err     bool
+	}{
+		{"all", []scanBackend{stubScan{needle: "OTHER"}, command}, eicar, "Script.EICAR (command)", false},
+		{"all", []scanBackend{stubScan{needle: "OTHER"}, command}, other, "Stub.OTHER (stub)", false},
+		{"all", []scanBackend{stubScan{needle: "OTHER"}, command}, clean, "", false},
+		{"all", []scanBackend{stubScan{err: io.ErrUnexpectedEOF}, command}, clean, "", true},
+		{"any", []scanBackend{stubScan{needle: "OTHER"}, command}, eicar, "", false},
+		{"any", []scanBackend{stubScan{needle: "EICAR"}, command}, eicar, "Stub.EICAR (stub), Script.EICAR (command)", false},
+		{"any", []scanBackend{stubScan{err: io.ErrUnexpectedEOF}, command}, clean, "", false},
+	} {
+		scanPolicy = tc.policy
+		virus, err := newScanChain([]string{"stub", "command"}, tc.engines).scan(tc.task)
+		if virus != tc.virus || (err != nil) != tc.err {
+			t.Errorf("%s of %s: got %q, %v, want %q", tc.policy, tc.task.Filename, virus, err, tc.virus)
+		}
+	}
+	scanPolicy = "all"
+}
+
+func TestScanReport(t *testing.T) {
+	t.Chdir(t.TempDir())
+	scanEngine, scanningEnabled = stubScan{needle: "EICAR"}, true
+	virusScanMap["vendor"], virusScanMap["version"] = "Stub", "42"
+	defer func() {
+		scanEngine, scanningEnabled = libclamavBackend{}, false
+		delete(virusScanMap, "vendor")
+		delete(virusScanMap, "version")
+	}()
+
+	in, out := make(chan *WorkFile, 2), make(chan *WorkFile, 2)
+	for _, contents := range []string{"clean", "EICAR"} {
+		mem := getMemory(int64(len(contents)))
+		n := copy(mem, contents)
+		in <- &WorkFile{Filename: contents + ".txt", Size: int64(n), Bytes: mem[:n]}
+	}
+	close(in)
+	Scanner(context.Background(), in, out)
+	clean := <-out
+	if r := clean.ScanReport; clean.ScanResult != "clean" || r == nil || r.Verdict != "clean" || r.Engine != "Stub" || r.DBVersion != "42" || r.ScannedAt.IsZero() {
+		t.Fatalf("clean scan recorded as %q, %+v", clean.ScanResult, clean.ScanReport)
+	}
+	if ev := <-fileErrCh; ev.Filename != "EICAR.txt" {
+		t.Fatalf("virus reported for %s", ev.Filename)
+	}
+
+	archiveManifest = []*ManifestEntry{
+		{Key: "clean.txt", Name: "clean.txt", ScanReport: clean.ScanReport},
+		{Key: "gone.txt", Name: "gone.txt", DeleteMarker: true},
+	}
+	defer func() { archiveManifest = nil }()
+	files := WriteScanReport("archive.tar.gz")
+	if len(files) != 1 || files[0] != "archive.tar.gz.scan-report.jsonl" {
+		t.Fatalf("scan report files %v", files)
+	}
+	dat, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var line map[string]any
+	if err := json.Unmarshal(dat, &line); err != nil {
+		t.Fatalf("scan report %q: %v", dat, err)
+	}
+	if line["key"] != "clean.txt" || line["verdict"] != "clean" || line["engine"] != "Stub" || line["db_version"] != "42" {
+		t.Fatalf("scan report line %s", dat)
+	}
+}
+
+func TestFetchDefinitions(t *testing.T) {
+	dir := t.TempDir()
+	header := []byte(fmt.Sprintf("%-512s", "ClamAV-VDB:01 May 2024 08-00 +0000:27262:2064810:90:md5:sig:builder:1714550400"))
+	modified := time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/daily.cvd" || !strings.HasPrefix(r.UserAgent(), "ClamAV/") {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "daily.cvd", modified, bytes.NewReader(append(header, "signatures"...)))
+	}))
+	defer srv.Close()
+	definitionsMirror = srv.URL
+	defer func() { definitionsMirror = "" }()
+
+	dest := filepath.Join(dir, "daily.cvd")
+	got, err := fetchDefinition("daily.cvd", dest, time.Time{})
+	if err != nil || !got.Equal(modified) {
+		t.Fatalf("fetched daily.cvd modified %v, %v", got, err)
+	}
+	if v, ok := cvdVersion(dest); !ok || v != 27262 {
+		t.Fatalf("daily.cvd version %d %v, want 27262", v, ok)
+	}
+	if got, err := fetchDefinition("daily.cvd", dest, modified); err != nil || !got.IsZero() || requests != 2 {
+		t.Fatalf("unchanged daily.cvd fetched again: %v, %v after %d requests", got, err, requests)
+	}
+	if _, err := fetchDefinition("main.cvd", filepath.Join(dir, "main.cvd"), time.Time{}); err == nil {
+		t.Fatal("missing main.cvd fetched")
+	}
+}
+
+func TestScanSkipPolicy(t *testing.T) {
+	scanEngine = stubScan{needle: "EICAR"}
+	scanExclude, scanMaxSize = "*.parquet,logs/*.gz", "8B"
+	defer func() { scanEngine, scanExclude, scanMaxSize, scanMaxBytes = libclamavBackend{}, "", "", 0 }()
+	initScanSkip()
+
+	in, out := make(chan *WorkFile, 4), make(chan *WorkFile, 4)
+	for _, name := range []string{"data/table.parquet", "logs/app.gz", "other/app.gz", "big.txt"} {
+		contents := "EICAR"
+		if name == "big.txt" {
+			contents = "EICAR, and more than 8 bytes"
+		}
+		mem := getMemory(int64(len(contents)))
+		n := copy(mem, contents)
+		in <- &WorkFile{Filename: name, Size: int64(n), Bytes: mem[:n]}
+	}
+	close(in)
+	Scanner(context.Background(), in, out)
+
+	results := make(map[string]string)
+	for task := range out {
+		results[task.Filename] = task.ScanResult
+		if task.ScanReport == nil || task.ScanReport.Verdict != "skipped" || task.ScanReport.SkipReason == "" {
+			t.Errorf("%s scan report %+v", task.Filename, task.ScanReport)
+		}
+	}
+	want := map[string]string{
+		"data/table.parquet": "skipped: matches SCAN_EXCLUDE *.parquet",
+		"logs/app.gz":        "skipped: matches SCAN_EXCLUDE logs/*.gz",
+		"big.txt":            "skipped: larger than SCAN_MAX_SIZE 8B",
+	}
+	if !maps.Equal(results, want) {
+		t.Fatalf("scan results %v, want %v", results, want)
+	}
+	if ev := <-fileErrCh; ev.Filename != "other/app.gz" {
+		t.Fatalf("virus reported for %s, want other/app.gz", ev.Filename)
+	}
+}
+
+func TestInventoryManifest(t *testing.T) {
+	store := setupPipeline(t, nil)
+	inventoryManifest = "manifest.json"
+	defer func() { inventoryManifest = "" }()
+	modified := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	var csvFile bytes.Buffer
+	zw := gzip.NewWriter(&csvFile)
+	fmt.Fprintf(zw, "\"src\",\"a+b%%2Bc.txt\",\"v2\",\"true\",\"false\",\"5\",\"%s\",\"e1\"\n", modified.Format(time.RFC3339))
+	fmt.Fprintf(zw, "\"src\",\"a+b%%2Bc.txt\",\"v1\",\"false\",\"false\",\"3\",\"%s\",\"e0\"\n", modified.Format(time.RFC3339))
+	fmt.Fprintf(zw, "\"src\",\"gone.txt\",\"v3\",\"true\",\"true\",\"\",\"%s\",\"\"\n", modified.Format(time.RFC3339))
+	zw.Close()
+
+	pw := newParquetWriter([]parquetColumn{
+		{Name: "bucket", Type: parquetByteArray, Converted: parquetUTF8},
+		{Name: "key", Type: parquetByteArray, Converted: parquetUTF8},
+		{Name: "size", Type: parquetInt64, Converted: -1, Optional: true},
+		{Name: "last_modified_date", Type: parquetInt64, Converted: parquetTimestampMillis},
+		{Name: "e_tag", Type: parquetByteArray, Converted: parquetUTF8, Optional: true},
+	})
+	pw.add("src", "dir/p1.bin", int64(7), modified.UnixMilli(), "e2")
+	pw.add("src", "dir/p2.bin", int64(11), modified.UnixMilli(), nil)
+	pw.add("src", "dir/marker", nil, modified.UnixMilli(), nil)
+	var parquetFile bytes.Buffer
+	if err := pw.writeTo(&parquetFile); err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string][]byte{"data/one.csv.gz": csvFile.Bytes(), "data/two.parquet": parquetFile.Bytes()}
+	write := func(format string, keys ...string) {
+		report := inventoryReport{SourceBucket: "src", DestinationBucket: "arn:aws:s3:::inv", FileFormat: format,
+			FileSchema: "Bucket, Key, VersionId, IsLatest, IsDeleteMarker, Size, LastModifiedDate, ETag"}
+		for _, key := range keys {
+			sum := md5.Sum(files[key])
+			store.mu.Lock()
+			store.put("inv", key, &memObject{data: files[key], lastModified: modified, etag: memETag(files[key])})
+			store.mu.Unlock()
+			report.Files = append(report.Files, struct {
+				Key  string `json:"key"`
+				Size int64  `json:"size"`
+				MD5  string `json:"MD5checksum"`
+			}{key, int64(len(files[key])), hex.EncodeToString(sum[:])})
+		}
+		dat, _ := json.Marshal(report)
+		os.WriteFile("manifest.json", dat, 0o644)
+	}
+	read := func() []MetaEntry {
+		size, count, err := loadInventory(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		dat, _ := os.ReadFile(metadataFileName)
+		lines := strings.Split(strings.TrimSpace(string(dat)), "\n")
+		if want := fmt.Sprintf(`{"total_objects":%d,"total_size":%d}`, count, size); lines[len(lines)-1] != want {
+			t.Fatalf("summary %s, want %s", lines[len(lines)-1], want)
+		}
+		var entries []MetaEntry
+		for _, line := range lines[:len(lines)-1] {
+			var entry MetaEntry
+			json.Unmarshal([]byte(line), &entry)
+			entries = append(entries, entry)
+		}
+		return entries
+	}
+
+	write("CSV", "data/one.csv.gz")
+	if got, want := read(), []MetaEntry{{Key: "a b+c.txt", Size: 5, LastModified: modified, ETag: "e1"}}; !slices.Equal(got, want) {
+		t.Fatalf("CSV inventory %+v, want %+v", got, want)
+	}
+
+	write("Parquet", "data/two.parquet")
+	want := []MetaEntry{
+		{Key: "dir/p1.bin", Size: 7, LastModified: modified, ETag: "e2"},
+		{Key: "dir/p2.bin", Size: 11, LastModified: modified},
+	}
+	if got := read(); !slices.Equal(got, want) {
+		t.Fatalf("Parquet inventory %+v, want %+v", got, want)
+	}
+
+	store.mu.Lock()
+	store.put("inv", "data/two.parquet", &memObject{data: []byte("PAR1 tampered"), lastModified: modified})
+	store.mu.Unlock()
+	if _, _, err := loadInventory(context.Background()); err == nil || !strings.Contains(err.Error(), "MD5") {
+		t.Fatalf("tampered inventory file: %v", err)
+	}
+}
+
+func TestModifiedWindow(t *testing.T) {
+	t.Chdir(t.TempDir())
+	var metadata []byte
+	for day := 1; day <= 10; day++ {
+		modified := time.Date(2025, 9, day, 12, 0, 0, 0, time.UTC)
+		metadata = fmt.Appendf(metadata, "{\"key\":\"day-%02d\",\"size\":%d,\"last_modified\":%q}\n", day, day, modified.Format(time.RFC3339))
+	}
+	metadata = fmt.Appendf(metadata, "{\"key\":\"undated\",\"size\":100}\n")
+	if err := os.WriteFile(metadataFileName, metadata, 0644); err != nil {
+		t.Fatal(err)
+	}
+	modifiedSince, modifiedUntil = "2025-09-03", "2025-09-05T12:00:00Z"
+	defer func() {
+		modifiedSince, modifiedUntil, windowActive = "", "", false
+		windowSince, windowUntil = time.Time{}, time.Time{}
+	}()
+	initModifiedWindow()
+
+	toDownload := make(chan *DownloadTask)
+	go ReadMetadata(context.Background(), toDownload)
+	var keys []string
+	for task := range toDownload {
+		keys = append(keys, task.Filename)
+	}
+	if want := []string{"day-03", "day-04", "undated"}; !slices.Equal(keys, want) {
+		t.Fatalf("read %v, want %v", keys, want)
+	}
+	if TotalFiles != 3 || TotalBytes != 107 {
+		t.Errorf("totals of %d objects and %d bytes, want 3 and 107", TotalFiles, TotalBytes)
+	}
+
+	if since, _ := parseWindowTime("1m", time.Date(2025, 10, 1, 0, 0, 0, 0, time.UTC)); !since.Equal(time.Date(2025, 9, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("SINCE=1m gives %s", since)
+	}
+}
+
+func TestKeyFilter(t *testing.T) {
+	includeKeys, excludeKeys = `*.log,re:^data/[0-9]+\.csv$`, "tmp/**,**/old-?.log"
+	defer func() {
+		includeKeys, excludeKeys = "", ""
+		initKeyFilter()
+	}()
+	initKeyFilter()
+	for key, want := range map[string]bool{
+		"app.log":          true,
+		"var/log/app.log":  true,
+		"tmp/app.log":      false,
+		"tmp/deep/app.log": false,
+		"old-1.log":        false,
+		"a/b/old-2.log":    false,
+		"a/b/old-22.log":   true,
+		"data/42.csv":      true,
+		"data/x/42.csv":    false,
+		"app.log.gz":       false,
+	} {
+		if got := keySelected(key); got != want {
+			t.Errorf("keySelected(%q) = %v, want %v", key, got, want)
+		}
+	}
+
+	t.Chdir(t.TempDir())
+	metadata := []byte("{\"key\":\"a.log\",\"size\":1}\n{\"key\":\"tmp/b.log\",\"size\":2}\n{\"key\":\"c.txt\",\"size\":4}\n{\"total_objects\":3,\"total_size\":7}\n")
+	if err := os.WriteFile(metadataFileName, metadata, 0644); err != nil {
+		t.Fatal(err)
+	}
+	toDownload := make(chan *DownloadTask)
+	go ReadMetadata(context.Background(), toDownload)
+	var keys []string
+	for task := range toDownload {
+		keys = append(keys, task.Filename)
+	}
+	if !slices.Equal(keys, []string{"a.log"}) || TotalFiles != 1 || TotalBytes != 1 {
+		t.Fatalf("read %v, %d objects of %d bytes, want [a.log] of 1 byte", keys, TotalFiles, TotalBytes)
+	}
+}
+
+func TestMultiplePrefixes(t *testing.T) {
+	store := setupPipeline(t, testObjects())
+	os.WriteFile("prefixes.txt", []byte("# listed too\ndir0/\n"), 0o644)
+	prefixFilter, prefixFile, listingParallel = "dir2/, dir0/object-0", "prefixes.txt", 2
+	defer func() {
+		prefixFilter, prefixFile, listingParallel = "", "", 1
+		initPrefixes()
+	}()
+	initPrefixes()
+	if want := []string{"dir0/", "dir2/"}; !slices.Equal(listingPrefixes, want) {
+		t.Fatalf("prefixes %q, want %q", listingPrefixes, want)
+	}
+
+	var want []string
+	var wantSize int64
+	for key, obj := range store.buckets["src"] {
+		if strings.HasPrefix(key, "dir0/") || strings.HasPrefix(key, "dir2/") {
+			want = append(want, key)
+			wantSize += int64(len(obj.data))
+		}
+	}
+	slices.Sort(want)
+	size, count, err := loadMetadata(context.Background(), "src", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != int64(len(want)) || size != wantSize {
+		t.Errorf("listed %d objects of %d bytes, want %d of %d", count, size, len(want), wantSize)
+	}
+	f, err := os.Open(metadataFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var keys []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry MetaEntry
+		json.Unmarshal(scanner.Bytes(), &entry)
+		if entry.Key != "" {
+			keys = append(keys, entry.Key)
+		}
+	}
+	if !slices.Equal(keys, want) {
+		t.Fatalf("metadata keys %v, want %v in order", keys, want)
+	}
+	if parts, _ := filepath.Glob(metadataFileName + ".partial*"); len(parts) > 0 {
+		t.Errorf("part files left behind: %v", parts)
+	}
+}
+
+func TestObjectSizeFilter(t *testing.T) {
+	t.Chdir(t.TempDir())
+	metadata := []byte(`{"key":"folder/","size":0}
+{"key":"small.txt","size":10}
+{"key":"huge.bin","size":5000}
+{"key":"gone.txt","size":0,"delete_marker":true}
+{"total_objects":4,"total_size":5010}
+`)
+	if err := os.WriteFile(metadataFileName, metadata, 0644); err != nil {
+		t.Fatal(err)
+	}
+	minObjectSize, maxObjectSize = "1B", "1K"
+	defer func() {
+		minObjectSize, maxObjectSize = "", ""
+		minObjectBytes, maxObjectBytes, sizeFilterActive, SkippedObjects = 0, 0, false, 0
+	}()
+	initSizeFilter()
+
+	toDownload := make(chan *DownloadTask)
+	go ReadMetadata(context.Background(), toDownload)
+	var keys []string
+	for task := range toDownload {
+		keys = append(keys, task.Filename)
+	}
+	closeSkipped()
+	if want := []string{"small.txt", "gone.txt"}; !slices.Equal(keys, want) {
+		t.Fatalf("read %v, want %v", keys, want)
+	}
+	if TotalFiles != 2 || TotalBytes != 10 || SkippedObjects != 2 {
+		t.Errorf("totals of %d objects and %d bytes with %d skipped, want 2, 10 and 2", TotalFiles, TotalBytes, SkippedObjects)
+	}
+	dat, err := os.ReadFile(skippedObjectsName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reasons []string
+	for _, line := range strings.Split(strings.TrimSpace(string(dat)), "\n") {
+		var s SkippedObject
+		json.Unmarshal([]byte(line), &s)
+		reasons = append(reasons, s.Key+": "+s.Reason)
+	}
+	if want := []string{"folder/: smaller than MIN_OBJECT_SIZE 1B", "huge.bin: larger than MAX_OBJECT_SIZE 1K"}; !slices.Equal(reasons, want) {
+		t.Errorf("skipped %q, want %q", reasons, want)
+	}
+}
+
+func TestGlacierRestore(t *testing.T) {
+	store := setupPipeline(t, map[string][]byte{"hot": []byte("hot"), "cold": []byte("cold"), "deep": []byte("deep")})
+	store.mu.Lock()
+	store.buckets["src"]["cold"].storageClass = "GLACIER"
+	store.buckets["src"]["deep"].storageClass = "DEEP_ARCHIVE"
+	store.restoreDelay = 150 * time.Millisecond
+	store.mu.Unlock()
+	glacierTier, glacierPoll = "Expedited", 50*time.Millisecond
+	defer func() { glacierTier, glacierPoll, RestoredFiles = "", 0, 0 }()
+
+	if _, err := store.GetObject(context.Background(), &s3.GetObjectInput{Bucket: aws.String("src"), Key: aws.String("cold")}); err == nil {
+		t.Fatal("archived object read before its restore")
+	}
+	in, out := make(chan *DownloadTask), make(chan *DownloadTask)
+	go func() {
+		defer close(in)
+		for _, entry := range []MetaEntry{{Key: "cold", StorageClass: "GLACIER"}, {Key: "deep", StorageClass: "DEEP_ARCHIVE"}, {Key: "hot"}} {
+			in <- &DownloadTask{Filename: entry.Key, Size: 4, StorageClass: entry.StorageClass}
+		}
+	}()
+	go glacierGate(context.Background(), in, out)
+
+	var keys []string
+	for task := range out {
+		keys = append(keys, task.Filename)
+		if _, err := store.GetObject(context.Background(), &s3.GetObjectInput{Bucket: aws.String("src"), Key: aws.String(task.Filename)}); err != nil {
+			t.Errorf("%s sent on before it could be read: %v", task.Filename, err)
+		}
+	}
+	if want := []string{"hot", "cold", "deep"}; !slices.Equal(keys, want) {
+		t.Fatalf("sent %v, want %v, the restored objects last", keys, want)
+	}
+	if RestoredFiles != 2 || RestoringFiles != 0 {
+		t.Errorf("%d restored and %d restoring, want 2 and 0", RestoredFiles, RestoringFiles)
+	}
+}
+
+func TestServerSideEncryption(t *testing.T) {
+	store := setupPipeline(t, map[string][]byte{"a": []byte("alpha"), "b": []byte("bravo")})
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))
+	sum := md5.Sum(bytes.Repeat([]byte{7}, 32))
+	store.mu.Lock()
+	for _, obj := range store.buckets["src"] {
+		obj.sseCKeyMD5 = base64.StdEncoding.EncodeToString(sum[:])
+	}
+	store.mu.Unlock()
+	if _, err := store.GetObject(context.Background(), &s3.GetObjectInput{Bucket: aws.String("src"), Key: aws.String("a")}); err == nil {
+		t.Fatal("SSE-C object read without its key")
+	}
+
+	sseCKey, sseCKeyMD5 = key, base64.StdEncoding.EncodeToString(sum[:])
+	dstSSE, dstSSEKMSKeyID = "aws:kms", "arn:aws:kms:us-east-1:111122223333:key/test"
+	defer func() { sseCKey, sseCKeyMD5, dstSSE, dstSSEKMSKeyID = "", "", "", "" }()
+	s3client = withSSE(store)
+	runPipeline(t, store)
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if len(store.buckets["dst"]) == 0 {
+		t.Fatal("nothing was uploaded")
+	}
+	for key, obj := range store.buckets["dst"] {
+		if obj.sse != "aws:kms" || obj.sseKMSKeyID != dstSSEKMSKeyID {
+			t.Errorf("%s uploaded with encryption %q and key %q", key, obj.sse, obj.sseKMSKeyID)
+		}
+	}
+}
+
+func TestArchiveNameTemplate(t *testing.T) {
+	store := setupPipeline(t, map[string][]byte{"logs/a": []byte("alpha"), "logs/b": []byte("bravo")})
+	saved := ArchiveName
+	ArchiveName, dstPrefix, listingPrefixes = "backups/{date}/{prefix}/archive_{seq}.tgz", "tenant/", []string{"logs/"}
+	defer func() { ArchiveName, dstPrefix, listingPrefixes = saved, "", []string{""}; initArchiveStreams() }()
+	initArchiveTemplate()
+	want := "tenant/backups/" + runStarted.Format(time.DateOnly) + "/logs/archive_%07d.tgz"
+	if ArchiveName != want {
+		t.Fatalf("ARCHIVE_NAME expanded to %q, want %q", ArchiveName, want)
+	}
+	initArchiveStreams()
+	runPipeline(t, store)
+
+	names := archivesIn(store, "dst")
+	if len(names) != 1 {
+		t.Fatalf("archives uploaded as %v, want one", names)
+	}
+	if n, ok := archiveNumber(names[0]); !ok || names[0] != fmt.Sprintf(want, n) {
+		t.Errorf("archive uploaded as %s, want %s", names[0], want)
+	}
+	getObject(t, "dst", names[0]+".manifest.jsonl")
+
+	listingPrefixes = []string{""}
+	if got := expandArchiveName("{prefix}/{run}_{seq}.tgz"); got != runUUID+"_%07d.tgz" {
+		t.Errorf("without a prefix expanded to %q", got)
+	}
+}
+
+func TestDestinationTagsAndMetadata(t *testing.T) {
+	store := setupPipeline(t, map[string][]byte{"a": []byte("alpha")})
+	dstTagList, dstMetadataList = "retention=7y, job-id=nightly", "Team=storage,compression=override"
+	defer func() { dstTagList, dstMetadataList = "", ""; initDstAttrs() }()
+	initDstAttrs()
+	runPipeline(t, store)
+
+	names := archivesIn(store, "dst")
+	if len(names) != 1 {
+		t.Fatalf("archives uploaded as %v, want one", names)
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	for _, key := range []string{names[0], names[0] + ".manifest.jsonl"} {
+		obj := store.buckets["dst"][key]
+		if obj == nil {
+			t.Fatalf("%s was not uploaded", key)
+		}
+		if obj.tags["retention"] != "7y" || obj.tags["job-id"] != "nightly" || obj.metadata["team"] != "storage" {
+			t.Errorf("%s uploaded with tags %v and metadata %v", key, obj.tags, obj.metadata)
+		}
+	}
+	if got := store.buckets["dst"][names[0]].metadata["compression"]; got != archiveCodec {
+		t.Errorf("compression metadata %q replaced by DST_METADATA", got)
+	}
+}
+
+func TestUploadVerification(t *testing.T) {
+	store := setupPipeline(t, nil)
+	defer func(old int) { uploadPartSize = old }(uploadPartSize)
+	uploadPartSize = 5
+	data := bytes.Repeat([]byte("0123456789abcdef"), 11<<16) // 11 MiB, three parts
+	if err := os.WriteFile("archive.tgz", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := uploadFileInParts(context.Background(), "dst", "archive.tgz", "archive.tgz", uploadAttrs{}); err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+	store.mu.Lock()
+	obj := store.buckets["dst"]["archive.tgz"]
+	store.mu.Unlock()
+	if obj == nil || len(obj.parts) != 3 || !bytes.Equal(obj.data, data) {
+		t.Fatal("archive not uploaded in three parts")
+	}
+
+	ctx := context.Background()
+	if err := verifyUpload(ctx, "dst", "archive.tgz", int64(len(data)-1), &manager.UploadOutput{}); err == nil {
+		t.Error("upload of another size passed verification")
+	}
+	if err := verifyUpload(ctx, "dst", "archive.tgz", int64(len(data)), &manager.UploadOutput{ETag: aws.String(`"0123"`)}); err == nil {
+		t.Error("upload with another ETag passed verification")
+	}
+}
+
+func TestEnvSecretMasked(t *testing.T) {
+	t.Setenv("TEST_SECRET", "c2VjcmV0LWtleQ==")
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr := os.Stderr
+	os.Stderr = w
+	got := EnvSecret("TEST_SECRET", "A secret")
+	os.Stderr = stderr
+	w.Close()
+	printed, _ := io.ReadAll(r)
+	if got != "c2VjcmV0LWtleQ==" {
+		t.Errorf("read %q", got)
+	}
+	if strings.Contains(string(printed), "c2VjcmV0") || !strings.Contains(string(printed), "TEST_SECRET") {
+		t.Errorf("setting printed as %q", printed)
+	}
+}
+
+func TestCheckpointSavesInOrder(t *testing.T) {
+	t.Chdir(t.TempDir())
+	checkpointMutex.Lock()
+	checkpointActive, checkpointState = true, Checkpoint{}
+	checkpointMutex.Unlock()
+	defer func() {
+		checkpointMutex.Lock()
+		checkpointActive, checkpointState = false, Checkpoint{}
+		checkpointMutex.Unlock()
+	}()
+
+	var wg sync.WaitGroup
+	for i := 1; i <= 50; i++ {
+		wg.Add(2)
+		go func() { defer wg.Done(); checkpointArchive(i) }()
+		go func() { defer wg.Done(); saveCheckpoint() }()
+	}
+	wg.Wait()
+	dat, err := os.ReadFile(checkpointFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cp Checkpoint
+	if err := json.Unmarshal(dat, &cp); err != nil {
+		t.Fatalf("checkpoint %q: %v", dat, err)
+	}
+	if cp.ArchiveCount != 50 {
+		t.Errorf("checkpoint saved archive count %d, want 50", cp.ArchiveCount)
+	}
+}
+
+// TestScanPathInMemory checks that an encrypted temp file is given to the
+// scanners as a plaintext copy in memory, readable by other processes and
+// gone once released, and that one too large for TEMP_SCAN_MEMORY is not.
+func TestScanPathInMemory(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	tempEncryption, scanReadsFiles, tempScanMemory = true, true, "1K"
+	defer func() { tempEncryption, scanReadsFiles, tempScanMemory, tempScanBytes = false, false, "2G", 0 }()
+	initTempEncryption()
+
+	want := []byte("scanned from memory\n")
+	f, err := createTempFile("scan-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer deleteTempFile(f.Name())
+	if _, err := f.Write(want); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	path, done, err := scanPath(&WorkFile{Filename: "scan.txt", TempFile: f.Name(), Size: int64(len(want))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := exec.Command("cat", path).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done()
+	if !bytes.Equal(got, want) {
+		t.Errorf("scanner read %q, want %q", got, want)
+	}
+	if entries, _ := os.ReadDir(tmp); len(entries) != 1 {
+		t.Errorf("temp dir holds %d files, want only the encrypted temp file", len(entries))
+	}
+	if _, err := os.Stat(path); err == nil {
+		t.Errorf("%s still exists once released", path)
+	}
+	if scanCopies.used != 0 {
+		t.Errorf("%d bytes of copies still held once released", scanCopies.used)
+	}
+	if reason := scanSkipReason(&WorkFile{Filename: "big.bin", TempFile: f.Name(), Size: 2048}); reason != "larger than TEMP_SCAN_MEMORY 1K" {
+		t.Errorf("object over TEMP_SCAN_MEMORY skipped for %q", reason)
+	}
+}
+
+// TestBatchSmallFiles checks that the objects waiting in the small lane are
+// sent to the archiver in batches of at most SMALL_BATCH.
+func TestBatchSmallFiles(t *testing.T) {
+	defer func(old int) { smallBatchSize = old }(smallBatchSize)
+	smallBatchSize = 2
+
+	in := make(chan *WorkFile, 5)
+	for i := range 5 {
+		in <- &WorkFile{Filename: fmt.Sprintf("small-%d", i)}
+	}
+	close(in)
+	out, done := make(chan []*WorkFile, 5), make(chan struct{})
+	batchSmallFiles(in, out, done)
+	<-done
+
+	var sizes []int
+	for batch := range out {
+		sizes = append(sizes, len(batch))
+	}
+	if !slices.Equal(sizes, []int{2, 2, 1}) {
+		t.Errorf("batch sizes %v, want [2 2 1]", sizes)
+	}
+}
+
+// TestScanSummaryFromEntries checks the scan summary of .info.json is counted
+// from the verdicts of the entries, and that an exceptions archive is never
+// described as passed.
+func TestScanSummaryFromEntries(t *testing.T) {
+	t.Chdir(t.TempDir())
+	defer func(enabled bool, m map[string]string) {
+		scanningEnabled, virusScanMap, archiveManifest = enabled, m, nil
+	}(scanningEnabled, virusScanMap)
+	scanningEnabled, virusScanMap = true, map[string]string{"result": "pass", "vendor": "test"}
+	archiveManifest = []*ManifestEntry{
+		{Key: "clean", Scan: "clean"},
+		{Key: "empty", Scan: "empty"},
+		{Key: "skipped", Scan: "skipped: SCAN_MAX_SIZE"},
+		{Key: "virus", Scan: "virus: Eicar-Signature", Exception: "virus found"},
+		{Key: "long", Exception: "name too long for ustar"},
+	}
+	files := WriteInfo("archive.tgz")
+	dat, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info ArchiveInfo
+	if err := json.Unmarshal(dat, &info); err != nil {
+		t.Fatal(err)
+	}
+	if got := *info.Scan; got.Scanned != 3 || got.Skipped != 1 || got.Failed != 2 || got.Result != "fail" {
+		t.Errorf("scan summary %+v, want 3 scanned, 1 skipped, 2 failed and fail", got)
+	}
+	if result := scanMetadata(true)["result"]; result != "fail" {
+		t.Errorf("exceptions archive scan metadata result %q, want fail", result)
+	}
+	if virusScanMap["result"] != "pass" {
+		t.Error("scanMetadata changed the scan metadata of the run")
+	}
+}
+
+// TestTransformRunsInLaunchDir checks that a relative TRANSFORM_CMD is run
+// from the directory the run started in, not from WORKDIR.
+func TestTransformRunsInLaunchDir(t *testing.T) {
+	start := t.TempDir()
+	if err := os.WriteFile(filepath.Join(start, "upper.sh"), []byte("#!/bin/sh\ntr a-z A-Z\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer func(dir, cmd string) { launchDir, transformCmd = dir, cmd }(launchDir, transformCmd)
+	launchDir, transformCmd = start, "./upper.sh"
+	t.Chdir(t.TempDir()) // As if WORKDIR had been entered
+
+	out, err := transformFile(context.Background(), &WorkFile{Filename: "a.txt", Size: 5, Bytes: []byte("hello")}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out.Bytes) != "HELLO" {
+		t.Errorf("transformed to %q, want HELLO", out.Bytes)
+	}
+}
+
+// TestDictInEveryStream checks that each archive holding dictionary compressed
+// entries carries the dictionary, whichever stream it belongs to and whether
+// it was open when training finished.
+func TestDictInEveryStream(t *testing.T) {
+	objects := make(map[string][]byte)
+	for i := 0; i < 24; i++ {
+		doc := fmt.Sprintf(`{"id":%d,"name":"object-%d","tags":["alpha","bravo"],"size":%d}`, i, i*7, i*131)
+		objects[fmt.Sprintf("logs/%02d.json", i)] = []byte(doc)
+		objects[fmt.Sprintf("data/%02d.json", i)] = []byte(strings.Repeat(doc, 1+i%3))
+	}
+	store := setupPipeline(t, objects)
+	archiveStreams, zstdDictSamples = "logs/=>logs/", 8
+	defer func() {
+		archiveStreams, zstdDictSamples = "", 0
+		zstdDict, zstdDictEncoder, zstdDictSampled = nil, nil, nil
+		initArchiveStreams()
+	}()
+	initArchiveStreams()
+	runPipeline(t, store)
+
+	var compressed int
+	for _, name := range archivesIn(store, "dst") {
+		r, closeReader, err := decompressArchive(name, bytes.NewReader(getObject(t, "dst", name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var dict, zst bool
+		tr := tar.NewReader(r)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if hdr.Name == zstdDictName {
+				dict = true
+			} else if strings.HasSuffix(hdr.Name, ".zst") {
+				zst = true
+				compressed++
+			}
+		}
+		closeReader()
+		if zst && !dict {
+			t.Errorf("%s holds compressed entries without the dictionary", name)
+		}
+		entries, err := parseManifest(bytes.NewReader(getObject(t, "dst", name+".manifest.jsonl")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range entries {
+			if sum := sha256.Sum256(objects[entry.Key]); entry.SHA256 != hex.EncodeToString(sum[:]) {
+				t.Errorf("%s recorded as %s with sha256 %q, not that of its contents", entry.Key, entry.Name, entry.SHA256)
+			}
+		}
+	}
+	if compressed == 0 {
+		t.Fatal("no entry was dictionary compressed")
+	}
+
+	importArchives(t, store)
+	for key, want := range objects {
+		if got := getObject(t, "restored", key); !bytes.Equal(got, want) {
+			t.Errorf("%s restored with different contents", key)
+		}
+	}
+}
+
+// TestTarEntrySuffixRoom checks that keys are validated against TAR_FORMAT
+// with room for the suffixes the archiver may add to their entry names.
+func TestTarEntrySuffixRoom(t *testing.T) {
+	defer func() { archiveTarFormat, zstdDictSamples = tar.FormatPAX, 0 }()
+	archiveTarFormat, zstdDictSamples = tar.FormatUSTAR, 8
+	for _, c := range []struct {
+		name         string
+		size         int64
+		deleteMarker bool
+		ok           bool
+	}{
+		{strings.Repeat("a", 90), 10, false, true},
+		{strings.Repeat("a", 97), 10, false, false}, // Fits, but not as a.zst or a~2
+		{strings.Repeat("a", 90), 0, true, false},   // Fits, but not as a.deleted
+		{strings.Repeat("a", 99) + "/", 0, false, true},
+	} {
+		if err := checkTarEntry(c.name, c.size, c.deleteMarker); (err == nil) != c.ok {
+			t.Errorf("checkTarEntry of a %d character name gave %v, want ok %v", len(c.name), err, c.ok)
+		}
+	}
+}
+
+// TestDetectChunkStartsOnBoundary checks that a token crossing the end of a
+// detection chunk is matched whole, not from where the next chunk would cut
+// into it.
+func TestDetectChunkStartsOnBoundary(t *testing.T) {
+	defer func(rules []*detectRule) { detectRules = rules }(detectRules)
+	detectRules = []*detectRule{{name: "ssn", re: regexp.MustCompile(builtinDetectRules[0].pattern)}}
+
+	// The next chunk would start at the lookalike SSN ending the token
+	for _, token := range []string{"order-9999123-45-6789", "9999123-45-6789"} {
+		cut := len(token) - len("123-45-6789")
+		data := append(bytes.Repeat([]byte(" "), detectChunk-cut), token...)
+		data = append(data, bytes.Repeat([]byte(" "), detectOverlap)...)
+		findings, err := detectFile(&WorkFile{Filename: "notes.txt", Size: int64(len(data)), Bytes: data})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(findings) != 0 {
+			t.Errorf("%q crossing a chunk end found %+v", token, findings[0])
+		}
+	}
+}
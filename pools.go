@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+var (
+	listConns     = EnvInt("S3_LIST_CONNS", 0, "Most connections to S3 for listing (0 for no limit)")
+	downloadConns = EnvInt("S3_DOWNLOAD_CONNS", 0, "Most connections to S3 for downloading and looking up objects (0 for no limit)")
+	uploadConns   = EnvInt("S3_UPLOAD_CONNS", 0, "Most connections to S3 for uploading, copying and deleting objects (0 for no limit)")
+)
+
+// pooledStore sends listings, downloads and uploads through S3 clients of
+// their own, each with a separate connection pool, so a peak of downloads
+// cannot take the connections the upload PUTs need.
+type pooledStore struct {
+	list, download, upload *s3.Client
+}
+
+var _ ObjectStore = pooledStore{}
+
+// newPooledStore makes the clients of a pooledStore from the same options.
+func newPooledStore(opts s3.Options) ObjectStore {
+	client := func(conns int, throttled func()) *s3.Client {
+		o := opts
+		if throttled != nil {
+			o.APIOptions = append(o.APIOptions, watchThrottles(throttled))
+		}
+		o.HTTPClient = awshttp.NewBuildableClient().WithTransportOptions(func(tr *http.Transport) {
+			if conns > 0 {
+				tr.MaxConnsPerHost = conns
+				tr.MaxIdleConnsPerHost = conns
+			}
+		})
+		return s3.New(o)
+	}
+	awscliLog.Printf("  Connections: %s listing, %s downloading, %s uploading", connLimit(listConns), connLimit(downloadConns), connLimit(uploadConns))
+	return pooledStore{
+		list:     client(listConns, nil),
+		download: client(downloadConns, downloadThrottled),
+		upload:   client(uploadConns, uploadThrottled),
+	}
+}
+
+func connLimit(conns int) string {
+	if conns <= 0 {
+		return "unlimited"
+	}
+	return strconv.Itoa(conns)
+}
+
+func (p pooledStore) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	return p.download.GetObject(ctx, params, optFns...)
+}
+
+func (p pooledStore) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	return p.download.HeadObject(ctx, params, optFns...)
+}
+
+func (p pooledStore) GetObjectAttributes(ctx context.Context, params *s3.GetObjectAttributesInput, optFns ...func(*s3.Options)) (*s3.GetObjectAttributesOutput, error) {
+	return p.download.GetObjectAttributes(ctx, params, optFns...)
+}
+
+func (p pooledStore) GetObjectTagging(ctx context.Context, params *s3.GetObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error) {
+	return p.download.GetObjectTagging(ctx, params, optFns...)
+}
+
+func (p pooledStore) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	return p.list.ListObjectsV2(ctx, params, optFns...)
+}
+
+func (p pooledStore) ListMultipartUploads(ctx context.Context, params *s3.ListMultipartUploadsInput, optFns ...func(*s3.Options)) (*s3.ListMultipartUploadsOutput, error) {
+	return p.list.ListMultipartUploads(ctx, params, optFns...)
+}
+
+func (p pooledStore) ListObjectVersions(ctx context.Context, params *s3.ListObjectVersionsInput, optFns ...func(*s3.Options)) (*s3.ListObjectVersionsOutput, error) {
+	return p.list.ListObjectVersions(ctx, params, optFns...)
+}
+
+func (p pooledStore) RestoreObject(ctx context.Context, params *s3.RestoreObjectInput, optFns ...func(*s3.Options)) (*s3.RestoreObjectOutput, error) {
+	return p.download.RestoreObject(ctx, params, optFns...)
+}
+
+func (p pooledStore) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	return p.upload.PutObject(ctx, params, optFns...)
+}
+
+func (p pooledStore) CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	return p.upload.CopyObject(ctx, params, optFns...)
+}
+
+func (p pooledStore) DeleteObjects(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+	return p.upload.DeleteObjects(ctx, params, optFns...)
+}
+
+func (p pooledStore) CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	return p.upload.CreateMultipartUpload(ctx, params, optFns...)
+}
+
+func (p pooledStore) UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	return p.upload.UploadPart(ctx, params, optFns...)
+}
+
+func (p pooledStore) CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	return p.upload.CompleteMultipartUpload(ctx, params, optFns...)
+}
+
+func (p pooledStore) AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	return p.upload.AbortMultipartUpload(ctx, params, optFns...)
+}
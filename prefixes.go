@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"slices"
+	"strings"
+)
+
+var (
+	prefixFile      = Env("PREFIX_FILE", "", "File of bucket prefixes, one per line, listed along with those of PREFIX_FILTER")
+	listingParallel = EnvInt("LISTING_PARALLEL", 1, "Prefixes of PREFIX_FILTER and PREFIX_FILE listed at once")
+
+	listingPrefixes = []string{""} // Prefixes listed, in order, none covering another
+)
+
+// initPrefixes reads the prefixes of PREFIX_FILTER, a comma separated list,
+// and of PREFIX_FILE.  They are sorted, and any under another dropped, so
+// the listings of the prefixes one after another are in key order and list
+// each key once.
+func initPrefixes() {
+	var prefixes []string
+	for _, p := range strings.Split(prefixFilter, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			prefixes = append(prefixes, p)
+		}
+	}
+	if prefixFile != "" {
+		f, err := os.Open(prefixFile)
+		if err != nil {
+			log.Fatalf("failed to open PREFIX_FILE: %v", err)
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if p := strings.TrimSpace(scanner.Text()); p != "" && !strings.HasPrefix(p, "#") {
+				prefixes = append(prefixes, p)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			log.Fatalf("failed to read PREFIX_FILE: %v", err)
+		}
+		f.Close()
+		if len(prefixes) == 0 {
+			log.Fatalf("PREFIX_FILE %s lists no prefixes", prefixFile)
+		}
+	}
+	if listingParallel < 1 {
+		log.Fatalf("LISTING_PARALLEL must be at least 1: %d", listingParallel)
+	}
+	if len(prefixes) == 0 {
+		return
+	}
+	slices.Sort(prefixes)
+	listingPrefixes = listingPrefixes[:0]
+	for _, p := range prefixes {
+		if n := len(listingPrefixes); n > 0 && strings.HasPrefix(p, listingPrefixes[n-1]) {
+			continue // Listed with the prefix before
+		}
+		listingPrefixes = append(listingPrefixes, p)
+	}
+	if len(listingPrefixes) > 1 {
+		log.Printf("Listing %d prefixes, %d at once", len(listingPrefixes), min(listingParallel, len(listingPrefixes)))
+	}
+}
+
+// listingPrefix returns the prefix listed which key is under, for keys not
+// found by listing, such as those of an inventory or events.
+func listingPrefix(key string) (string, bool) {
+	for _, p := range listingPrefixes {
+		if strings.HasPrefix(key, p) {
+			return p, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+var preflightEnabled = Env("DISABLE_PREFLIGHT", "", "Do not check the S3 permissions the run needs at startup") == ""
+
+// runPreflight checks, before the listing or ClamAV are started, that the
+// credentials allow the S3 calls the run will make, reporting each check and
+// failing with all those denied.  Nothing is written: the destination is
+// checked with a multipart upload which is aborted.
+func runPreflight(ctx context.Context) {
+	if !preflightEnabled || simulating {
+		return
+	}
+	switch workMode {
+	case modeBench, modeServe:
+		return
+	}
+	results := preflightChecks(ctx)
+	var failed int
+	for _, r := range results {
+		if r.err != nil {
+			failed++
+			log.Printf("Preflight: %s: DENIED: %v", r.check, r.err)
+		} else {
+			log.Printf("Preflight: %s: ok", r.check)
+		}
+	}
+	if failed > 0 {
+		log.Fatalf("Preflight: %d of %d permission checks failed, set DISABLE_PREFLIGHT=1 to skip them", failed, len(results))
+	}
+}
+
+type preflightResult struct {
+	check string
+	err   error
+}
+
+// preflightChecks makes the S3 calls the configured run depends on, each on
+// as little as possible.
+func preflightChecks(ctx context.Context) []preflightResult {
+	s3Ready.Wait() // Wait for the S3 client to be ready
+	var results []preflightResult
+	check := func(name string, err error) {
+		results = append(results, preflightResult{check: name, err: preflightErr(err)})
+	}
+
+	lists := workList == "" && urlList == "" && workMode != modeWorker && workMode != modeImport && workMode != modeRepack
+	if lists {
+		out, err := s3client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{Bucket: aws.String(srcBucket), MaxKeys: aws.Int32(100)})
+		check("s3:ListBucket on "+srcBucket, err)
+		var key string
+		if err == nil {
+			// A range of an empty object is refused whatever the permissions
+			if i := slices.IndexFunc(out.Contents, func(obj types.Object) bool { return aws.ToInt64(obj.Size) > 0 }); i >= 0 {
+				key = aws.ToString(out.Contents[i].Key)
+			}
+		}
+		if key != "" && downloadURL == "" {
+			get, err := s3client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(srcBucket), Key: aws.String(key), Range: aws.String("bytes=0-0")})
+			if err == nil {
+				get.Body.Close()
+			}
+			check("s3:GetObject on "+srcBucket+"/"+key, err)
+		}
+	}
+
+	if archiveStdout || exportDir != "" || workMode == modeCoordinator || workMode == modeEstimate {
+		return results // Nothing is uploaded
+	}
+	if archiveHistory || workMode == modeRepack || workMode == modeVerify {
+		_, err := s3client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{Bucket: aws.String(dstBucket), MaxKeys: aws.Int32(1)})
+		check("s3:ListBucket on "+dstBucket, err)
+	}
+	if workMode == modeVerify {
+		return results // The archives are only read back
+	}
+	if mpuAbortAge > 0 {
+		_, err := s3client.ListMultipartUploads(ctx, &s3.ListMultipartUploadsInput{Bucket: aws.String(dstBucket), MaxUploads: aws.Int32(1)})
+		check("s3:ListBucketMultipartUploads on "+dstBucket, err)
+	}
+
+	// The archives are tagged with their type, classification and retention
+	key := "bucket-archiver-preflight-" + runUUID
+	create := &s3.CreateMultipartUploadInput{Bucket: aws.String(dstBucket), Key: aws.String(key), ChecksumAlgorithm: uploadChecksum()}
+	what := "s3:PutObject"
+	if exceptionsPrefix != "" || classificationTag != "" || classificationMap != "" || retentionTag != "" || retentionClass != "" {
+		create.Tagging = aws.String("archive-type=preflight")
+		what += " with tags"
+	}
+	mpu, err := s3client.CreateMultipartUpload(ctx, create)
+	check(what+" (multipart) on "+dstBucket, err)
+	if err != nil {
+		return results
+	}
+	_, err = s3client.UploadPart(ctx, &s3.UploadPartInput{Bucket: aws.String(dstBucket), Key: aws.String(key),
+		UploadId: mpu.UploadId, PartNumber: aws.Int32(1), Body: bytes.NewReader([]byte{0}), ChecksumAlgorithm: uploadChecksum()})
+	check("s3:PutObject of a part, with the bucket's encryption, on "+dstBucket, err)
+	_, err = s3client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{Bucket: aws.String(dstBucket), Key: aws.String(key), UploadId: mpu.UploadId})
+	check("s3:AbortMultipartUpload on "+dstBucket, err)
+	return results
+}
+
+// preflightErr shortens an S3 error to its code and message.
+func preflightErr(err error) error {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return fmt.Errorf("%s: %s", apiErr.ErrorCode(), apiErr.ErrorMessage())
+	}
+	return err
+}
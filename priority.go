@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+var (
+	priorityPrefixes = Env("PRIORITY_PREFIXES", "", "Comma separated key prefixes archived ahead of the other objects")
+	priorityList     = Env("PRIORITY_LIST", "", "File of keys, one per line, archived ahead of the other objects")
+	priorityWeight   = EnvInt("PRIORITY_WEIGHT", 4, "Priority objects sent on for each other object while both are waiting")
+
+	priorityActive bool
+	priorityKeys   map[string]struct{}
+	PriorityFiles  int64
+)
+
+func initPriority() {
+	if priorityPrefixes == "" && priorityList == "" {
+		return
+	}
+	switch {
+	case workList != "" || urlList != "":
+		log.Fatal("PRIORITY_PREFIXES and PRIORITY_LIST need the metadata file and cannot be used with WORK_LIST or URL_LIST")
+	case workMode != "" && workMode != modeCoordinator:
+		log.Fatal("PRIORITY_PREFIXES and PRIORITY_LIST can only be used in a standalone run or by the coordinator")
+	case priorityWeight < 1:
+		log.Fatalf("invalid PRIORITY_WEIGHT %d", priorityWeight)
+	}
+	if priorityList != "" {
+		f, err := os.Open(priorityList)
+		if err != nil {
+			log.Fatalf("failed to open priority list: %v", err)
+		}
+		defer f.Close()
+		priorityKeys = make(map[string]struct{})
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if key := strings.TrimSpace(scanner.Text()); key != "" {
+				priorityKeys[key] = struct{}{}
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			log.Fatalf("error reading priority list: %v", err)
+		}
+	}
+	priorityActive = true
+	log.Printf("Objects under %q and %d listed keys are sent ahead, %d for each other object", priorityPrefixes, len(priorityKeys), priorityWeight)
+}
+
+// isPriority reports whether key is in PRIORITY_PREFIXES or PRIORITY_LIST.
+func isPriority(key string) bool {
+	if _, ok := priorityKeys[key]; ok {
+		return true
+	}
+	for _, prefix := range strings.Split(priorityPrefixes, ",") {
+		if prefix = strings.TrimSpace(prefix); prefix != "" && strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// readPriority sends the priority objects of the metadata file, selected by
+// SUBSET as ReadMetadata does, to the high lane.  They are not checkpointed,
+// a restart sends them again and those already uploaded are skipped.
+func readPriority(ctx context.Context, high chan<- *DownloadTask, start, stride, end int) {
+	defer close(high)
+	metadataFile, err := os.Open(metadataFileName)
+	if err != nil {
+		log.Fatalf("failed to open metadata file: %v", err)
+	}
+	defer metadataFile.Close()
+
+	scanner := bufio.NewScanner(metadataFile)
+	lineNumber := 0
+	strider := 0
+	for scanner.Scan() {
+		lineNumber++
+		if start > 0 {
+			start--
+			continue
+		}
+		if end != -1 && lineNumber > end {
+			break
+		}
+		if stride > 1 {
+			strider = (strider + 1) % stride
+			if strider != 1 {
+				continue
+			}
+		}
+
+		var entry MetaEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil || entry.Key == "" {
+			break // Reported by ReadMetadata
+		}
+		if !isPriority(entry.Key) || !listingSelected(entry) {
+			continue
+		}
+		if _, ok := skipFiles[entry.Key]; ok {
+			atomic.AddInt64(&TotalBytes, -entry.Size)
+			atomic.AddInt64(&TotalFiles, -1)
+			continue
+		}
+		atomic.AddInt64(&PriorityFiles, 1)
+		select {
+		case high <- &DownloadTask{Filename: entry.Key, Size: entry.Size, LastModified: entry.LastModified, ETag: entry.ETag,
+			DeleteMarker: entry.DeleteMarker, StorageClass: entry.StorageClass}:
+		case <-ctx.Done():
+			return
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatalf("error reading metadata file: %v", err)
+	}
+}
+
+// mergeLanes sends the tasks of the high and bulk lanes on to out, giving the
+// high lane PRIORITY_WEIGHT turns for each turn of the bulk lane while both
+// have tasks waiting.  Neither lane waits on the other when it is empty.
+func mergeLanes(high, bulk <-chan *DownloadTask, out chan<- *DownloadTask) {
+	defer close(out)
+	var turns int // High lane tasks sent since the last bulk one
+	for high != nil || bulk != nil {
+		if high != nil && turns < priorityWeight {
+			select {
+			case task, ok := <-high:
+				if !ok {
+					high = nil
+					continue
+				}
+				turns++
+				out <- task
+				continue
+			default:
+			}
+		}
+
+		// The bulk lane's turn, or no priority object is waiting
+		highCh := high
+		if turns >= priorityWeight && bulk != nil {
+			highCh = nil
+		}
+		select {
+		case task, ok := <-highCh:
+			if !ok {
+				high = nil
+				continue
+			}
+			turns++
+			out <- task
+		case task, ok := <-bulk:
+			if !ok {
+				bulk = nil
+				continue
+			}
+			turns = 0
+			out <- task
+		}
+	}
+}
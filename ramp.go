@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+var (
+	slowStart         = Env("DISABLE_SLOW_START", "", "Start downloads and uploads at full concurrency instead of ramping up") == ""
+	slowStartInitial  = EnvInt("SLOW_START_INITIAL", 1, "Concurrency each download and upload setting starts from when ramping up")
+	slowStartInterval = EnvInt("SLOW_START_INTERVAL", 5, "Seconds between raises of the download and upload concurrency when ramping up")
+
+	// Slow start ceilings of the download and upload settings
+	downloadRamps     []*ramp
+	uploadRamps       []*ramp
+	uploadCeiling     int64 // Cap on uploadConcurrency while ramping, 0 for none
+	ThrottledRequests int64
+)
+
+// ramp brings one concurrency setting up to its configured value the way TCP
+// grows its window: doubling each interval up to a threshold, then one step
+// at a time.  A throttled request halves it and sets the threshold there.
+type ramp struct {
+	name    string
+	get     func() int // The setting, as configured or autotuned
+	set     func(int)  // Caps the setting, 0 lifts the cap
+	mu      sync.Mutex
+	ceiling int       // Current ceiling, 0 once ramped up
+	high    int       // Threshold below which the ceiling doubles
+	cut     time.Time // Last time it was halved
+}
+
+func newRamp(name string, get func() int, set func(int)) *ramp {
+	r := &ramp{name: name, get: get, set: set, ceiling: max(slowStartInitial, 1), high: get()}
+	if r.ceiling >= r.high {
+		r.ceiling = 0
+	}
+	r.set(r.ceiling)
+	return r
+}
+
+// step raises the ceiling at the end of an interval.
+func (r *ramp) step() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ceiling == 0 {
+		return
+	}
+	full := r.get()
+	next := r.ceiling * 2
+	if r.ceiling >= r.high {
+		next = r.ceiling + max(1, full/8)
+	} else if next > r.high {
+		next = r.high
+	}
+	if next >= full {
+		next = 0
+		log.Printf("Slow start: %s ramped up to %d", r.name, full)
+	}
+	r.ceiling = next
+	r.set(next)
+}
+
+// throttled halves the ceiling, at most once an interval as the requests in
+// flight are throttled together.
+func (r *ramp) throttled() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	interval := time.Duration(slowStartInterval) * time.Second
+	if time.Since(r.cut) < interval {
+		return
+	}
+	r.cut = time.Now()
+	cur := r.get()
+	if r.ceiling > 0 && r.ceiling < cur {
+		cur = r.ceiling
+	}
+	r.high = max(cur/2, 1)
+	r.ceiling = r.high
+	r.set(r.ceiling)
+	log.Printf("Slow start: %s throttled, %d -> %d", r.name, cur, r.ceiling)
+}
+
+// startSlowStart ramps the download and upload concurrency up from
+// SLOW_START_INITIAL every SLOW_START_INTERVAL seconds, and keeps cutting it
+// back on throttling for the rest of the run.
+func startSlowStart(ctx context.Context) {
+	if !slowStart {
+		return
+	}
+	if slowStartInterval <= 0 {
+		log.Fatal("SLOW_START_INTERVAL must be positive")
+	}
+	downloadRamps = []*ramp{
+		newRamp("download parts", downloadParts.Limit, downloadParts.SetCeiling),
+		newRamp("small downloads", smallDownloads.Limit, smallDownloads.SetCeiling),
+	}
+	uploadRamps = []*ramp{
+		newRamp("upload parts", func() int { return int(atomic.LoadInt64(&uploadConcurrency)) },
+			func(n int) { atomic.StoreInt64(&uploadCeiling, int64(n)) }),
+	}
+	go func() {
+		ticker := time.NewTicker(time.Duration(slowStartInterval) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				for _, r := range append(downloadRamps, uploadRamps...) {
+					r.step()
+				}
+			}
+		}
+	}()
+}
+
+// uploadParts is the number of parts of an archive to upload at once.
+func uploadParts() int {
+	n := int(atomic.LoadInt64(&uploadConcurrency))
+	if c := int(atomic.LoadInt64(&uploadCeiling)); c > 0 && c < n {
+		return c
+	}
+	return n
+}
+
+func downloadThrottled() {
+	for _, r := range downloadRamps {
+		r.throttled()
+	}
+}
+
+func uploadThrottled() {
+	for _, r := range uploadRamps {
+		r.throttled()
+	}
+}
+
+// watchThrottles calls throttled for every attempt S3 answers with SlowDown
+// or another throttling status, including those the SDK retries.
+func watchThrottles(throttled func()) func(*middleware.Stack) error {
+	return func(stack *middleware.Stack) error {
+		return stack.Deserialize.Add(middleware.DeserializeMiddlewareFunc("WatchThrottles",
+			func(ctx context.Context, in middleware.DeserializeInput, next middleware.DeserializeHandler) (middleware.DeserializeOutput, middleware.Metadata, error) {
+				out, md, err := next.HandleDeserialize(ctx, in)
+				if resp, ok := out.RawResponse.(*smithyhttp.Response); ok &&
+					(resp.StatusCode == http.StatusServiceUnavailable || resp.StatusCode == http.StatusTooManyRequests) {
+					atomic.AddInt64(&ThrottledRequests, 1)
+					throttled()
+				}
+				return out, md, err
+			}), middleware.After)
+	}
+}
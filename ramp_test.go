@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// TestRampDoublesThenHalves checks slow start doubles the ceiling up to the
+// configured limit, and a throttle halves it into one step at a time.
+func TestRampDoublesThenHalves(t *testing.T) {
+	g := newTunedGroup(16)
+	r := newRamp("test", g.Limit, g.SetCeiling)
+	var seen []int
+	for range 5 {
+		seen = append(seen, g.effective())
+		r.step()
+	}
+	if want := []int{1, 2, 4, 8, 16}; !slices.Equal(seen, want) {
+		t.Fatalf("ramped through %v, want %v", seen, want)
+	}
+
+	r.throttled()
+	if n := g.effective(); n != 8 {
+		t.Fatalf("throttled to %d, want 8", n)
+	}
+	r.throttled() // In the same interval
+	r.step()
+	if n := g.effective(); n != 10 {
+		t.Fatalf("stepped to %d after the throttle, want 10", n)
+	}
+}
+
+// TestWatchThrottles checks every attempt answered with SlowDown is seen,
+// including the ones the SDK retries.
+func TestWatchThrottles(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("<Error><Code>SlowDown</Code><Message>Please reduce your request rate.</Message></Error>"))
+	}))
+	defer srv.Close()
+
+	var throttles int
+	client := s3.New(s3.Options{
+		Region:           "us-east-1",
+		BaseEndpoint:     aws.String(srv.URL),
+		UsePathStyle:     true,
+		Credentials:      aws.AnonymousCredentials{},
+		APIOptions:       []func(*middleware.Stack) error{watchThrottles(func() { throttles++ })},
+		RetryMaxAttempts: 2,
+	})
+	if _, err := client.HeadObject(context.Background(), &s3.HeadObjectInput{Bucket: aws.String("src"), Key: aws.String("k")}); err == nil {
+		t.Fatal("expected the request to fail")
+	}
+	if throttles != 2 {
+		t.Fatalf("saw %d throttles, want 2", throttles)
+	}
+}
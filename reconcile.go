@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+var (
+	reconcileWith  = Env("RECONCILE", "", "At the end of the run compare the objects listed with those now in SRC_BUCKET: \"list\" lists the bucket again, \"cloudwatch\" reads its daily object count metric")
+	reconcileDrift = Env("RECONCILE_DRIFT", "1", "Percentage of objects added, removed or changed since the listing above which RECONCILE flags the run")
+
+	reconcileLimit  float64
+	reconcileResult *Reconciliation
+)
+
+// Reconciliation compares the objects listed in metadata.jsonl with those in
+// the source bucket at the end of the run.
+type Reconciliation struct {
+	Source     string  `json:"source"`                // list or cloudwatch
+	Listed     int64   `json:"listed"`                // Objects in metadata.jsonl
+	Current    int64   `json:"current"`               // Objects in the bucket now
+	Added      int64   `json:"added,omitempty"`       // In the bucket but not listed, with list
+	Removed    int64   `json:"removed,omitempty"`     // Listed but no longer in the bucket, with list
+	Changed    int64   `json:"changed,omitempty"`     // Listed with another size or ETag, with list
+	Drift      float64 `json:"drift_percent"`         // Added, removed and changed, or the count difference, per listed object
+	Flagged    bool    `json:"flagged"`               // Drift above RECONCILE_DRIFT
+	MissedFile string  `json:"missed_file,omitempty"` // WORK_LIST of the objects added or changed, with list
+}
+
+// initReconcile checks the run lists the bucket, so there is something to
+// reconcile.
+func initReconcile() {
+	if reconcileWith == "" {
+		return
+	}
+	var err error
+	if reconcileLimit, err = strconv.ParseFloat(reconcileDrift, 64); err != nil || reconcileLimit < 0 {
+		log.Fatalf("invalid RECONCILE_DRIFT %q", reconcileDrift)
+	}
+	switch {
+	case reconcileWith != "list" && reconcileWith != "cloudwatch":
+		log.Fatalf("unknown RECONCILE %q, must be list or cloudwatch", reconcileWith)
+	case workList != "" || urlList != "" || workMode != "":
+		log.Fatal("RECONCILE needs the bucket listing of a standalone run")
+	case reconcileWith == "cloudwatch" && (prefixFilter != "" || prefixFile != "" || subSetFiles != "" || includeKeys != "" || excludeKeys != ""):
+		log.Fatal("RECONCILE=cloudwatch counts the whole bucket and cannot be used with PREFIX_FILTER, PREFIX_FILE, INCLUDE, EXCLUDE or SUBSET")
+	case reconcileWith == "cloudwatch" && objectStoreKind != "":
+		log.Fatal("RECONCILE=cloudwatch needs S3 and cannot be used with OBJECT_STORE")
+	}
+}
+
+// reconcileListing compares the listing with the source bucket as it is at
+// the end of the run, logging the drift and flagging it when above
+// RECONCILE_DRIFT.
+func reconcileListing(ctx context.Context) {
+	if reconcileWith == "" {
+		return
+	}
+	var (
+		r   *Reconciliation
+		err error
+	)
+	if reconcileWith == "list" {
+		r, err = reconcileByList(ctx)
+	} else {
+		r, err = reconcileByMetrics(ctx)
+	}
+	if err != nil {
+		log.Printf("Reconcile: failed: %v", err)
+		return
+	}
+	if r.Listed > 0 {
+		r.Drift = 100 * float64(r.Added+r.Removed+r.Changed) / float64(r.Listed)
+	} else if r.Added+r.Removed+r.Changed > 0 {
+		r.Drift = 100
+	}
+	r.Flagged = r.Drift > reconcileLimit
+	reconcileResult = r
+
+	log.Printf("Reconcile: %d objects listed, %d in %s now by %s", r.Listed, r.Current, srcBucket, r.Source)
+	if r.Source == "list" {
+		log.Printf("Reconcile: %d added, %d removed and %d changed since the listing", r.Added, r.Removed, r.Changed)
+	}
+	if r.Flagged {
+		log.Printf("Reconcile: DRIFT of %.2f%% is above RECONCILE_DRIFT of %s%%", r.Drift, reconcileDrift)
+	}
+	if r.MissedFile != "" {
+		log.Printf("Reconcile: the objects added or changed are in %s, archive them with WORK_LIST=%s", r.MissedFile, r.MissedFile)
+	}
+}
+
+// reconcileByList lists the bucket again and walks it alongside the metadata
+// file, which is in the same order, so neither is held in memory.  Objects
+// added or changed since are written to a file which can be given as
+// WORK_LIST.
+func reconcileByList(ctx context.Context) (*Reconciliation, error) {
+	f, err := os.Open(metadataFileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	next := func() (MetaEntry, bool) {
+		for scanner.Scan() {
+			var entry MetaEntry
+			if json.Unmarshal(scanner.Bytes(), &entry) != nil || entry.Key == "" || entry.DeleteMarker {
+				continue // The summary line, and the tombstones listed after the objects
+			}
+			return entry, true
+		}
+		return MetaEntry{}, false
+	}
+
+	r := &Reconciliation{Source: "list"}
+	missedName := "reconcile_missed_" + runStarted.Format("20060102T150405Z") + ".jsonl"
+	missedFile, err := os.Create(missedName)
+	if err != nil {
+		return nil, err
+	}
+	missed := bufio.NewWriter(missedFile)
+	miss := func(entry MetaEntry) {
+		dat, _ := json.Marshal(entry)
+		missed.Write(dat)
+		missed.WriteByte('\n')
+	}
+
+	listed, more := next()
+	// The listings of the prefixes one after another are in key order
+	for _, input := range listingInputs(srcBucket) {
+		paginator := s3.NewListObjectsV2Paginator(s3client, input)
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				missedFile.Close()
+				return nil, err
+			}
+			for _, obj := range page.Contents {
+				if !keySelected(aws.ToString(obj.Key)) {
+					continue // Left out of the metadata file too
+				}
+				entry := MetaEntry{Key: aws.ToString(obj.Key), Size: aws.ToInt64(obj.Size), LastModified: aws.ToTime(obj.LastModified),
+					ETag: strings.Trim(aws.ToString(obj.ETag), `"`)}
+				for more && listed.Key < entry.Key {
+					r.Listed++
+					r.Removed++
+					listed, more = next()
+				}
+				r.Current++
+				if more && listed.Key == entry.Key {
+					r.Listed++
+					if listed.Size != entry.Size || listed.ETag != entry.ETag {
+						r.Changed++
+						miss(entry)
+					}
+					listed, more = next()
+				} else {
+					r.Added++
+					miss(entry)
+				}
+			}
+		}
+	}
+	for more {
+		r.Listed++
+		r.Removed++
+		listed, more = next()
+	}
+	if err := scanner.Err(); err != nil {
+		missedFile.Close()
+		return nil, err
+	}
+
+	if err := missed.Flush(); err != nil {
+		return nil, err
+	}
+	if err := missedFile.Close(); err != nil {
+		return nil, err
+	}
+	if r.Added+r.Changed > 0 {
+		r.MissedFile = missedName
+	} else {
+		os.Remove(missedName)
+	}
+	return r, nil
+}
+
+// reconcileByMetrics compares the number of objects listed with the latest
+// daily NumberOfObjects metric CloudWatch holds for the bucket.  The metric
+// lags by a day or more, so only a drift beyond the objects written in that
+// time is telling.
+func reconcileByMetrics(ctx context.Context) (*Reconciliation, error) {
+	f, err := os.Open(metadataFileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := &Reconciliation{Source: "cloudwatch"}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var entry MetaEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) == nil && entry.Key != "" && !entry.DeleteMarker {
+			r.Listed++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	params := url.Values{
+		"Namespace":                 {"AWS/S3"},
+		"MetricName":                {"NumberOfObjects"},
+		"Dimensions.member.1.Name":  {"BucketName"},
+		"Dimensions.member.1.Value": {srcBucket},
+		"Dimensions.member.2.Name":  {"StorageType"},
+		"Dimensions.member.2.Value": {"AllStorageTypes"},
+		"StartTime":                 {now.Add(-3 * 24 * time.Hour).Format(time.RFC3339)},
+		"EndTime":                   {now.Format(time.RFC3339)},
+		"Period":                    {"86400"},
+		"Statistics.member.1":       {"Average"},
+	}
+	var out struct {
+		Datapoints []struct {
+			Timestamp time.Time
+			Average   float64
+		} `xml:"GetMetricStatisticsResult>Datapoints>member"`
+	}
+	s3Ready.Wait() // Credentials and region are resolved with the S3 client
+	if err := awsQueryCall(ctx, awsCredentials, "monitoring", "2010-08-01", "GetMetricStatistics", params, &out); err != nil {
+		return nil, err
+	}
+	if len(out.Datapoints) == 0 {
+		return nil, fmt.Errorf("CloudWatch has no NumberOfObjects metric for %s in the last 3 days", srcBucket)
+	}
+	latest := out.Datapoints[0]
+	for _, dp := range out.Datapoints[1:] {
+		if dp.Timestamp.After(latest.Timestamp) {
+			latest = dp
+		}
+	}
+	r.Current = int64(math.Round(latest.Average))
+	if r.Current > r.Listed {
+		r.Added = r.Current - r.Listed
+	} else {
+		r.Removed = r.Listed - r.Current
+	}
+	log.Printf("Reconcile: CloudWatch counted %d objects in %s on %s", r.Current, srcBucket, latest.Timestamp.Format(time.DateOnly))
+	return r, nil
+}
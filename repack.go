@@ -0,0 +1,514 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/klauspost/compress/zstd"
+)
+
+const modeRepack = "repack"
+
+var (
+	repackPrefix = Env("REPACK_PREFIX", "", "Prefix in DST_BUCKET of the archives considered in repack mode")
+	repackBelow  = Env("REPACK_BELOW", "", "Archives smaller than this are rewritten in repack mode (default a quarter of SIZECAP)")
+
+	repack struct {
+		sync.Mutex
+		pending map[string]int       // Archive being repacked to its entries not yet uploaded again
+		failed  map[string]bool      // Archives which could not be read in full
+		holders map[string][]string  // Key to the archives being repacked which hold it
+		sizes   map[string]int64     // Objects of DST_BUCKET under REPACK_PREFIX
+		dropped map[string]*DedupRef // Dedup entries no longer referred to, held by the archives being repacked
+	}
+	RepackedArchives int64 // Small archives replaced by repacked ones
+)
+
+func initRepack() {
+	if workMode != modeRepack {
+		return
+	}
+	switch {
+	case archiveStreams != "":
+		log.Fatal("ARCHIVE_STREAMS cannot be used in repack mode")
+	case archiveStdout || exportDir != "" || simulating:
+		log.Fatal("repack mode replaces archives in DST_BUCKET and cannot be used with ARCHIVE_STDOUT, EXPORT_DIR or SIMULATE")
+	case deleteSource:
+		log.Fatal("DELETE_SOURCE cannot be used in repack mode")
+	}
+	if os.Getenv("ARCHIVE_NAME") == "" {
+		// Keep the new archives apart from those of the original runs
+		ArchiveName = "repacked_%07d.tgz"
+	}
+}
+
+// RepackArchives reads the entries of the small archives in DST_BUCKET and
+// sends them to doneCh in place of downloaded objects, so the rest of the
+// pipeline writes them into full size archives.  Archives whose entries
+// cannot be moved safely are left alone: those without a manifest, those
+// holding deduplicated entries, and those other archives refer to.
+func RepackArchives(ctx context.Context, doneCh chan<- *WorkFile) {
+	defer close(doneCh)
+	s3Ready.Wait() // Wait for the S3 client to be ready
+
+	below := sizeCapLimit / 4
+	if repackBelow != "" {
+		var err error
+		if below, err = parseByteSize(repackBelow); err != nil {
+			log.Fatalf("failed to parse REPACK_BELOW: %v", err)
+		}
+	}
+
+	repack.pending = make(map[string]int)
+	repack.failed = make(map[string]bool)
+	repack.dropped = make(map[string]*DedupRef)
+	repack.holders = make(map[string][]string)
+	repack.sizes = make(map[string]int64)
+	var archives []string
+	paginator := s3.NewListObjectsV2Paginator(s3client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(dstBucket),
+		Prefix: aws.String(repackPrefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			log.Fatalf("failed to list %s: %v", dstBucket, err)
+		}
+		for _, obj := range page.Contents {
+			key := aws.ToString(obj.Key)
+			repack.sizes[key] = aws.ToInt64(obj.Size)
+			if archiveExt(key) != "" {
+				archives = append(archives, key)
+			}
+			// Carry on the numbering of archives repacked before
+			if n, ok := archiveNumber(key); ok && n > archiveCount {
+				archiveCount = n
+			}
+		}
+	}
+
+	manifests := fetchManifests(ctx, archives, repack.sizes)
+	referenced := make(map[string]bool)
+	for _, entries := range manifests {
+		for _, entry := range entries {
+			if entry.Ref != nil {
+				referenced[entry.Ref.Archive] = true
+			}
+		}
+	}
+	var candidates []string
+	for _, name := range archives {
+		entries, ok := manifests[name]
+		switch {
+		case repack.sizes[name] >= below:
+		case !ok:
+			log.Printf("Repack: leaving %s, it has no manifest to restore the keys from", name)
+		case referenced[name]:
+			log.Printf("Repack: leaving %s, other archives refer to its entries", name)
+		case slices.ContainsFunc(entries, func(e *ManifestEntry) bool { return e.Ref != nil }):
+			log.Printf("Repack: leaving %s, it refers to entries of other archives", name)
+		case slices.ContainsFunc(entries, func(e *ManifestEntry) bool { return e.Chunk != nil }):
+			log.Printf("Repack: leaving %s, it holds chunks of an object split across archives", name)
+		default:
+			candidates = append(candidates, name)
+		}
+	}
+	if len(candidates) < 2 {
+		log.Printf("Repack: %d archives below %s, nothing to repack", len(candidates), humanizeBytes(below))
+		return
+	}
+	log.Printf("Repack: rewriting %d archives below %s", len(candidates), humanizeBytes(below))
+
+	// Contents are stored afresh rather than referenced in archives which
+	// are about to go
+	if dedupIndex != nil {
+		dedupMutex.Lock()
+		for digest, ref := range dedupIndex {
+			if slices.Contains(candidates, ref.Archive) {
+				repack.dropped[digest] = ref
+				delete(dedupIndex, digest)
+			}
+		}
+		dedupMutex.Unlock()
+	}
+
+	for _, name := range candidates {
+		if err := repackArchive(ctx, name, doneCh); err != nil {
+			log.Printf("Repack: failed to read %s, it will be kept: %v", name, err)
+			repack.Lock()
+			repack.failed[name] = true
+			repack.Unlock()
+		}
+	}
+}
+
+// fetchManifests fetches the manifests of the archives from DST_BUCKET, of
+// those which have one among the listed objects.
+func fetchManifests(ctx context.Context, archives []string, objects map[string]int64) map[string][]*ManifestEntry {
+	var (
+		mu        sync.Mutex
+		wg        sync.WaitGroup
+		sem       = make(chan struct{}, 16)
+		manifests = make(map[string][]*ManifestEntry)
+	)
+	for _, name := range archives {
+		if _, ok := objects[name+".manifest.jsonl"]; !ok {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(name string) {
+			defer func() { <-sem; wg.Done() }()
+			dat, err := getDestObject(ctx, name+".manifest.jsonl")
+			if err != nil {
+				log.Printf("failed to fetch the manifest of %s: %v", name, err)
+				return
+			}
+			var entries []*ManifestEntry
+			scanner := bufio.NewScanner(bytes.NewReader(dat))
+			for scanner.Scan() {
+				var entry ManifestEntry
+				if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+					log.Printf("malformed manifest of %s: %v", name, err)
+					return
+				}
+				entries = append(entries, &entry)
+			}
+			mu.Lock()
+			manifests[name] = entries
+			mu.Unlock()
+		}(name)
+	}
+	wg.Wait()
+	return manifests
+}
+
+// getDestObject reads a small object of DST_BUCKET into memory.
+func getDestObject(ctx context.Context, key string) ([]byte, error) {
+	out, err := s3client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(dstBucket), Key: aws.String(key)})
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+	return io.ReadAll(out.Body)
+}
+
+// repackArchive downloads an archive and sends its entries, checked against
+// its checksum sidecar and restored to their keys and attributes from its
+// manifest, for archiving again.  The whole archive is verified before any
+// entry is sent, so one which fails part way is not archived twice.
+func repackArchive(ctx context.Context, name string, doneCh chan<- *WorkFile) error {
+	dat, err := getDestObject(ctx, name+".manifest.jsonl")
+	if err != nil {
+		return err
+	}
+	entries, err := parseManifest(bytes.NewReader(dat))
+	if err != nil {
+		return err
+	}
+	sumAlgorithm, entrySums, archiveSum := checksumAlgorithm, map[string]string{}, ""
+	for algorithm := range checksumAlgorithms {
+		if _, ok := repack.sizes[name+"."+algorithm]; ok {
+			sumAlgorithm = algorithm
+			dat, err := getDestObject(ctx, name+"."+algorithm)
+			if err != nil {
+				return err
+			}
+			if archiveSum, entrySums, err = parseChecksums(dat); err != nil {
+				return err
+			}
+		}
+	}
+
+	size := repack.sizes[name]
+	parts := downloadPartsFor(size)
+	tempDisk.Reserve(size)
+	defer tempDisk.Release(size)
+	path, err := downloadObjectInParts(ctx, dstBucket, name, "", size, parts)
+	if err != nil {
+		return err
+	}
+	defer deleteTempFile(path)
+
+	newHash := checksumAlgorithms[sumAlgorithm].new
+	if err := verifyArchiveContents(name, path, newHash, entries, entrySums, archiveSum); err != nil {
+		return err
+	}
+	return sendRepackEntries(name, path, newHash, entries, entrySums, doneCh)
+}
+
+// verifyArchiveContents reads an archive through, checking its digest and that
+// of each entry against the checksum file, and that it holds every entry of
+// its manifest and nothing else.
+func verifyArchiveContents(name, path string, newHash func() hash.Hash, entries map[string]*ManifestEntry, entrySums map[string]string, archiveSum string) error {
+	fh, err := openTempFile(path)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	archiveHash := newHash()
+	r, closeReader, err := decompressArchive(name, io.TeeReader(bufio.NewReader(fh), archiveHash))
+	if err != nil {
+		return err
+	}
+	defer closeReader()
+
+	seen := make(map[string]bool)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if _, ok := entries[hdr.Name]; ok {
+			seen[hdr.Name] = true
+		} else if hdr.Name != zstdDictName && !isManifestEntry(hdr.Name, entries) {
+			return fmt.Errorf("entry %s is not in the manifest", hdr.Name)
+		}
+		h := newHash()
+		if _, err := io.Copy(h, tr); err != nil {
+			return err
+		}
+		if want, ok := entrySums[hdr.Name]; ok && want != fmt.Sprintf("%x", h.Sum(nil)) {
+			return fmt.Errorf("entry %s digest %x does not match the checksum file %s", hdr.Name, h.Sum(nil), want)
+		}
+	}
+	for key, entry := range entries {
+		if entry.Ref == nil && !seen[key] && !isDirMarker(entry) {
+			return fmt.Errorf("entry %s of the manifest is not in the archive", key)
+		}
+	}
+
+	// Read to the end so the whole archive is hashed
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return err
+	}
+	if digest := fmt.Sprintf("%x", archiveHash.Sum(nil)); archiveSum != "" && digest != archiveSum {
+		return fmt.Errorf("archive digest %s does not match the checksum file %s", digest, archiveSum)
+	}
+	return nil
+}
+
+// sendRepackEntries reads a verified archive again, sending its entries for
+// archiving.  Entries are still checked against the checksum file as they
+// are read, in case the temp file changed.
+func sendRepackEntries(name, path string, newHash func() hash.Hash, entries map[string]*ManifestEntry, entrySums map[string]string, doneCh chan<- *WorkFile) error {
+	fh, err := openTempFile(path)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	r, closeReader, err := decompressArchive(name, bufio.NewReader(fh))
+	if err != nil {
+		return err
+	}
+	defer closeReader()
+
+	var dictDecoder *zstd.Decoder
+	seen := make(map[string]bool)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		seen[hdr.Name] = true
+		entry := entries[hdr.Name]
+
+		large := hdr.Size > maxMemBytes
+		if large {
+			tempDisk.Reserve(hdr.Size)
+		}
+		task, err := readEntry(tr, hdr, newHash())
+		if err != nil {
+			if large {
+				tempDisk.Release(hdr.Size)
+			}
+			return err
+		}
+		if want, ok := entrySums[hdr.Name]; ok && want != task.Custody.Archived {
+			if large {
+				removeTempFile(task)
+			}
+			return fmt.Errorf("entry %s digest %s does not match the checksum file %s", hdr.Name, task.Custody.Archived, want)
+		}
+		if hdr.Name == zstdDictName {
+			if dictDecoder, err = zstd.NewReader(nil, zstd.WithDecoderDicts(task.Bytes)); err != nil {
+				return fmt.Errorf("failed to load zstd dictionary: %w", err)
+			}
+			defer dictDecoder.Close()
+			continue
+		}
+		if isManifestEntry(hdr.Name, entries) {
+			continue // Written afresh to the new archive
+		}
+		if dictDecoder != nil && strings.HasSuffix(hdr.Name, ".zst") && task.TempFile == "" {
+			if task.Bytes, err = dictDecoder.DecodeAll(task.Bytes, nil); err != nil {
+				return fmt.Errorf("failed to decompress %s: %w", hdr.Name, err)
+			}
+			task.Size = int64(len(task.Bytes))
+		}
+
+		if err := checkTarEntry(entryName(entry.Key), task.Size, entry.DeleteMarker); err != nil {
+			// The archive is kept, as this entry is not archived again
+			fileErrCh <- &ErrorEvent{Size: task.Size, Filename: entry.Key,
+				Err: fmt.Errorf("cannot archive in %s format: %w", tarFormat, err)}
+			if large {
+				removeTempFile(task)
+			}
+			repack.Lock()
+			repack.failed[name] = true
+			repack.Unlock()
+			continue
+		}
+
+		sendRepackEntry(name, task, entry, doneCh)
+	}
+
+	// Folder markers held only as directories, or in the manifest, go along
+	for _, key := range slices.Sorted(maps.Keys(entries)) {
+		if entry := entries[key]; isDirMarker(entry) && !seen[key] {
+			sendRepackEntry(name, &WorkFile{}, entry, doneCh)
+		}
+	}
+	return nil
+}
+
+// sendRepackEntry restores what the manifest recorded of an entry read from
+// the archive name and sends it to be archived again.
+func sendRepackEntry(name string, task *WorkFile, entry *ManifestEntry, doneCh chan<- *WorkFile) {
+	task.Filename, task.LastModified, task.ETag = entry.Key, entry.LastModified, entry.ETag
+	task.Findings, task.Retention, task.Attrs = entry.Findings, entry.Retention, entry.Attributes
+	task.DeleteMarker = entry.DeleteMarker
+	task.Custody = CustodyDigests{}
+	task.Custody.Downloaded = custodyDigest(task)
+	repack.Lock()
+	repack.pending[name]++
+	repack.holders[entry.Key] = append(repack.holders[entry.Key], name)
+	repack.Unlock()
+	atomic.AddInt64(&DownloadedFiles, 1)
+	doneCh <- task
+}
+
+// repackUploaded notes keys uploaded in a repacked archive.
+func repackUploaded(keys []string) {
+	if workMode != modeRepack {
+		return
+	}
+	repack.Lock()
+	defer repack.Unlock()
+	for _, key := range keys {
+		if holders := repack.holders[key]; len(holders) > 0 {
+			repack.pending[holders[0]]--
+			repack.holders[key] = holders[1:]
+		}
+	}
+}
+
+// finishRepack deletes the small archives, with their sidecars, whose every
+// entry is now in an uploaded repacked archive, and drops them from
+// DEDUP_INDEX.  Archives with entries which failed are kept.
+func finishRepack(ctx context.Context) {
+	if workMode != modeRepack {
+		return
+	}
+	repack.Lock()
+	defer repack.Unlock()
+	replaced := make(map[string]bool)
+	var keys []string
+	for _, name := range slices.Sorted(func(yield func(string) bool) {
+		for name := range repack.pending {
+			if !yield(name) {
+				return
+			}
+		}
+	}) {
+		if repack.pending[name] != 0 || repack.failed[name] {
+			log.Printf("Repack: keeping %s, not all of its entries were archived again", name)
+			continue
+		}
+		replaced[name] = true
+		keys = append(keys, name)
+		for _, ext := range importSidecars {
+			if _, ok := repack.sizes[name+ext]; ok {
+				keys = append(keys, name+ext)
+			}
+		}
+	}
+
+	for len(keys) > 0 {
+		batch := keys[:min(len(keys), 1000)] // The most DeleteObjects accepts
+		keys = keys[len(batch):]
+		ids := make([]types.ObjectIdentifier, len(batch))
+		for i, key := range batch {
+			ids[i] = types.ObjectIdentifier{Key: aws.String(key)}
+		}
+		out, err := s3client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(dstBucket),
+			Delete: &types.Delete{Objects: ids, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			log.Printf("Repack: failed to delete %d replaced objects: %v", len(batch), err)
+			continue
+		}
+		for _, e := range out.Errors {
+			log.Printf("Repack: failed to delete %s: %s", aws.ToString(e.Key), aws.ToString(e.Message))
+		}
+	}
+	atomic.AddInt64(&RepackedArchives, int64(len(replaced)))
+	log.Printf("Repack: replaced %d archives", len(replaced))
+
+	if len(replaced) == 0 {
+		return
+	}
+	dropDedupTable(repack.dropped, replaced)
+	if dedupIndexFile == "" {
+		return
+	}
+	dat, err := os.ReadFile(dedupIndexFile)
+	if err != nil {
+		log.Printf("Repack: failed to read DEDUP_INDEX: %v", err)
+		return
+	}
+	var kept bytes.Buffer
+	for _, line := range bytes.SplitAfter(dat, []byte("\n")) {
+		var rec dedupRecord
+		if json.Unmarshal(line, &rec) == nil && replaced[rec.Archive] {
+			continue
+		}
+		kept.Write(line)
+	}
+	if err := os.WriteFile(dedupIndexFile+".tmp", kept.Bytes(), 0644); err != nil {
+		log.Printf("Repack: failed to write DEDUP_INDEX: %v", err)
+		return
+	}
+	if err := os.Rename(dedupIndexFile+".tmp", dedupIndexFile); err != nil {
+		log.Printf("Repack: failed to replace DEDUP_INDEX: %v", err)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const modeRestore = "restore"
+
+var restorePrefix = Env("RESTORE_PREFIX", "", "Prefix in SRC_BUCKET of the archives restored in restore mode")
+
+func initRestore() {
+	switch {
+	case importDir != "":
+		log.Fatal("IMPORT_DIR cannot be used in restore mode, the archives are read from SRC_BUCKET")
+	case importAs != "contents":
+		log.Fatal("IMPORT_AS cannot be used in restore mode, the objects themselves are restored")
+	}
+}
+
+// RunRestore puts the objects held by the archives under RESTORE_PREFIX in
+// SRC_BUCKET back into DST_BUCKET with their original keys and attributes.
+// Each archive is brought to a local directory with its sidecars and then
+// checked, scanned and uploaded as MODE=import does.  An archive whose
+// manifest sidecar is missing is restored from the manifest embedded with
+// EMBED_MANIFEST.  Restored archives are listed in restore.log so a restart
+// skips them.
+func RunRestore(ctx context.Context) {
+	s3Ready.Wait() // Wait for the S3 client to be ready
+
+	objects := make(map[string]int64)
+	var archives []string
+	paginator := s3.NewListObjectsV2Paginator(s3client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(srcBucket),
+		Prefix: aws.String(restorePrefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			log.Fatalf("failed to list %s: %v", srcBucket, err)
+		}
+		for _, obj := range page.Contents {
+			key := aws.ToString(obj.Key)
+			objects[key] = aws.ToInt64(obj.Size)
+			if archiveExt(key) != "" {
+				archives = append(archives, key)
+			}
+		}
+	}
+	log.Printf("Restoring %d archives from s3://%s/%s to s3://%s", len(archives), srcBucket, restorePrefix, dstBucket)
+
+	done := make(map[string]struct{})
+	if dat, err := os.ReadFile("restore.log"); err == nil {
+		for _, line := range strings.Split(string(dat), "\n") {
+			done[line] = struct{}{}
+		}
+	}
+	f, err := os.OpenFile("restore.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Fatalf("failed to open restore log: %v", err)
+	}
+	defer f.Close()
+
+	imported := make(map[string]string) // Archive and entry name to the key it was uploaded as
+	for _, name := range archives {
+		if _, ok := done[name]; ok {
+			continue
+		}
+		log.Println("Restoring", name)
+		if err := restoreArchive(ctx, name, objects, imported); err != nil {
+			fileErrCh <- &ErrorEvent{Filename: name, Err: fmt.Errorf("failed to restore %s: %w", name, err)}
+			continue
+		}
+		fmt.Fprintln(f, name)
+		atomic.AddInt64(&UploadedFiles, 1)
+	}
+	reportIncompleteChunks()
+}
+
+// restoreArchive downloads an archive and its sidecars into a directory of
+// their own, which is removed once the archive is restored.
+func restoreArchive(ctx context.Context, name string, objects map[string]int64, imported map[string]string) error {
+	dir, err := os.MkdirTemp("", "restore-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	size := objects[name]
+	tempDisk.Reserve(size)
+	defer tempDisk.Release(size)
+	if err := fetchRestoreFile(ctx, dir, name); err != nil {
+		return err
+	}
+	for _, ext := range importSidecars {
+		if _, ok := objects[name+ext]; !ok {
+			continue
+		}
+		if err := fetchRestoreFile(ctx, dir, name+ext); err != nil {
+			return err
+		}
+	}
+	if _, ok := objects[name+".manifest.jsonl"]; !ok {
+		if err := extractManifestEntry(dir, name); err != nil {
+			return err
+		}
+	}
+
+	importDir = dir
+	defer func() { importDir = "" }()
+	return importArchive(ctx, name, nil, imported)
+}
+
+// fetchRestoreFile downloads the object key of SRC_BUCKET under dir.
+func fetchRestoreFile(ctx context.Context, dir, key string) error {
+	out, err := s3client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(srcBucket), Key: aws.String(key)})
+	if err != nil {
+		return err
+	}
+	defer out.Body.Close()
+	path := filepath.Join(dir, key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	fh, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	n, err := io.Copy(fh, out.Body)
+	atomic.AddInt64(&DownloadedBytes, n)
+	if err != nil {
+		return err
+	}
+	return fh.Close()
+}
+
+// extractManifestEntry writes the manifest embedded in an archive out as its
+// sidecar.  The entry is checked against the checksum file along with the
+// others before anything is uploaded.
+func extractManifestEntry(dir, name string) error {
+	fh, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	r, closeReader, err := decompressArchive(name, fh)
+	if err != nil {
+		return err
+	}
+	defer closeReader()
+	tr := tar.NewReader(r)
+	var manifest []byte
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if hdr.Name == manifestEntryName {
+			// The last one, should an object have been stored under the name before
+			if manifest, err = io.ReadAll(tr); err != nil {
+				return err
+			}
+		}
+	}
+	if manifest == nil {
+		return fmt.Errorf("the manifest is missing and not embedded in the archive")
+	}
+	if debug {
+		log.Println("Restoring", name, "with its embedded manifest")
+	}
+	return os.WriteFile(filepath.Join(dir, name+".manifest.jsonl"), manifest, 0644)
+}
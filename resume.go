@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+)
+
+// reportResume logs, before any work starts, what a resumed run will do:
+// the objects already done and those left, the archives expected, and any
+// disagreement between upload.log, error.log, the checkpoint, the state
+// table and the metadata file.
+func reportResume() {
+	_, cpErr := os.Stat(checkpointFileName)
+	if uploadLogLines == 0 && stateTable == "" && stateResume == nil && cpErr != nil {
+		return // A fresh run
+	}
+	logged := len(skipFiles) // Keys read from upload.log
+	if stateResume != nil {
+		logged -= stateResume.Added
+	}
+	loadSkipFiles()
+	log.Printf("Resume: %d objects in %s", logged, uploadLogName)
+	if stateResume != nil && stateResume.Added > 0 {
+		log.Printf("Resume: %d more uploaded in %s", stateResume.Added, stateFileName)
+	}
+	if stateTable != "" {
+		log.Printf("Resume: %d more uploaded by run %s in state table %s", len(skipFiles)-logged, runID, stateTable)
+	}
+
+	failed := make(map[string]struct{})
+	if f, err := os.Open(errorLogName); err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			var ev struct{ Filename string }
+			if json.Unmarshal(scanner.Bytes(), &ev) == nil && ev.Filename != "" {
+				failed[ev.Filename] = struct{}{}
+			}
+		}
+		f.Close()
+	}
+	var retried int
+	for key := range failed {
+		if _, ok := skipFiles[key]; !ok {
+			retried++
+		}
+	}
+	if len(failed) > 0 {
+		log.Printf("Resume: %d objects failed before, %d of them not uploaded since and tried again", len(failed), retried)
+	}
+
+	var cp *Checkpoint
+	if dat, err := os.ReadFile(checkpointFileName); err == nil {
+		cp = new(Checkpoint)
+		if err := json.Unmarshal(dat, cp); err != nil {
+			log.Printf("Resume: inconsistent: %s cannot be read: %v", checkpointFileName, err)
+			cp = nil
+		} else if checkpointInterval <= 0 {
+			log.Printf("Resume: %s is ignored, CHECKPOINT_INTERVAL is not set", checkpointFileName)
+			cp = nil
+		}
+	}
+
+	metadataFile, err := os.Open(metadataFileName)
+	if err != nil {
+		log.Printf("Resume: %s is not listed yet, the objects left are only known once it is", metadataFileName)
+		return
+	}
+	defer metadataFile.Close()
+	if fi, err := metadataFile.Stat(); err == nil && cp != nil && cp.MetadataSize != fi.Size() {
+		log.Printf("Resume: inconsistent: %s was made for a different %s and is ignored", checkpointFileName, metadataFileName)
+		cp = nil
+	}
+
+	var (
+		listed               = make(map[string]struct{})
+		doneFiles, leftFiles int64
+		doneBytes, leftBytes int64
+		offset               int64
+		lines, lostBeforeCP  int
+	)
+	scanner := bufio.NewScanner(metadataFile)
+	for scanner.Scan() {
+		lines++
+		offset += int64(len(scanner.Bytes())) + 1
+		var entry MetaEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil || entry.Key == "" {
+			break
+		}
+		listed[entry.Key] = struct{}{}
+		_, done := skipFiles[entry.Key]
+		if done {
+			doneFiles++
+			doneBytes += entry.Size
+		} else {
+			leftFiles++
+			leftBytes += entry.Size
+		}
+		// Lines before the checkpoint were all uploaded or failed
+		if _, bad := failed[entry.Key]; cp != nil && offset <= cp.Offset && !done && !bad {
+			lostBeforeCP++
+		}
+	}
+	log.Printf("Resume: %d objects (%s) of %s done, %d objects (%s) left", doneFiles, humanizeBytes(doneBytes),
+		metadataFileName, leftFiles, humanizeBytes(leftBytes))
+	if subSetFiles != "" {
+		log.Printf("Resume: the counts are of the whole of %s, SUBSET %s takes a share of the objects left", metadataFileName, subSetFiles)
+	}
+	if sizeCapLimit > 0 {
+		log.Printf("Resume: about %d more archives expected at SIZECAP %s", (leftBytes+sizeCapLimit-1)/sizeCapLimit, humanizeBytes(sizeCapLimit))
+	}
+	if cp != nil {
+		log.Printf("Resume: reading %s from line %d, archive numbering carries on from %d", metadataFileName, cp.Line, cp.ArchiveCount)
+		if cp.Line > lines {
+			log.Printf("Resume: inconsistent: %s is at line %d, %s has %d lines", checkpointFileName, cp.Line, metadataFileName, lines)
+		}
+		if lostBeforeCP > 0 {
+			log.Printf("Resume: inconsistent: %d objects before the checkpoint are in neither %s nor %s and will not be archived", lostBeforeCP, uploadLogName, errorLogName)
+		}
+	}
+
+	var unlisted int
+	for key := range skipFiles {
+		if _, ok := listed[key]; !ok {
+			unlisted++
+		}
+	}
+	if unlisted > 0 {
+		log.Printf("Resume: inconsistent: %d objects done are not in %s, it may have been listed again or for another bucket", unlisted, metadataFileName)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	retentionClass   = Env("RETENTION_CLASS", "", "Retention class of objects with no RETENTION_TAG")
+	retentionTag     = Env("RETENTION_TAG", "", "Source object tag holding the retention class of the object")
+	retentionPeriod  = Env("RETENTION_PERIOD", "", "Retention period of classes not in RETENTION_PERIODS, as a number of d, w, m or y")
+	retentionPeriods = Env("RETENTION_PERIODS", "", "Retention period per class, as CLASS=PERIOD joined by ,")
+	retentionFrom    = Env("RETENTION_FROM", "archived", "Start of the retention period: archived or modified")
+
+	retentionEnabled bool
+	classPeriods     = map[string]period{}
+	defaultPeriod    *period
+)
+
+// Retention is the records retention policy of an object or archive.
+type Retention struct {
+	Class   string    `json:"class,omitempty"`
+	Expires time.Time `json:"expires,omitzero"`
+}
+
+// period is a calendar period, added with time.AddDate.
+type period struct {
+	years, months, days int
+}
+
+func initRetention() {
+	if retentionClass == "" && retentionTag == "" && retentionPeriod == "" && retentionPeriods == "" {
+		return
+	}
+	retentionEnabled = true
+	switch retentionFrom {
+	case "archived", "modified":
+	default:
+		log.Fatalf("RETENTION_FROM must be archived or modified: %q", retentionFrom)
+	}
+	if retentionPeriod != "" {
+		p, err := parsePeriod(retentionPeriod)
+		if err != nil {
+			log.Fatalf("failed to parse RETENTION_PERIOD: %v", err)
+		}
+		defaultPeriod = &p
+	}
+	for _, spec := range strings.Split(retentionPeriods, ",") {
+		if spec = strings.TrimSpace(spec); spec == "" {
+			continue
+		}
+		class, value, ok := strings.Cut(spec, "=")
+		if !ok {
+			log.Fatalf("RETENTION_PERIODS entries must be of the form CLASS=PERIOD: %q", spec)
+		}
+		p, err := parsePeriod(value)
+		if err != nil {
+			log.Fatalf("failed to parse retention period of %q: %v", class, err)
+		}
+		classPeriods[strings.TrimSpace(class)] = p
+	}
+}
+
+// parsePeriod parses a period such as 90d, 6m or 7y.
+func parsePeriod(s string) (period, error) {
+	s = strings.TrimSpace(s)
+	if len(s) < 2 {
+		return period{}, fmt.Errorf("invalid period %q", s)
+	}
+	n, err := strconv.Atoi(s[:len(s)-1])
+	if err != nil || n < 0 {
+		return period{}, fmt.Errorf("invalid period %q", s)
+	}
+	switch s[len(s)-1] {
+	case 'd':
+		return period{days: n}, nil
+	case 'w':
+		return period{days: 7 * n}, nil
+	case 'm':
+		return period{months: n}, nil
+	case 'y':
+		return period{years: n}, nil
+	}
+	return period{}, fmt.Errorf("invalid period unit in %q, expected d, w, m or y", s)
+}
+
+// retentionFor returns the retention policy of an object from its tags and
+// the configured defaults.  A class with no known period is an error, the
+// object would otherwise be archived without an expiry.
+func retentionFor(task *DownloadTask, tags map[string]string) (*Retention, error) {
+	if !retentionEnabled {
+		return nil, nil
+	}
+	r := &Retention{Class: retentionClass}
+	if value, ok := tags[retentionTag]; ok && retentionTag != "" {
+		r.Class = value
+	}
+	p, ok := classPeriods[r.Class]
+	if !ok {
+		if defaultPeriod == nil {
+			if r.Class == "" {
+				return r, nil // Classes only, no expiry
+			}
+			return nil, fmt.Errorf("object %s has retention class %q with no period", task.Filename, r.Class)
+		}
+		p = *defaultPeriod
+	}
+	from := time.Now()
+	if retentionFrom == "modified" && !task.LastModified.IsZero() {
+		from = task.LastModified
+	}
+	r.Expires = from.UTC().AddDate(p.years, p.months, p.days).Truncate(24 * time.Hour)
+	return r, nil
+}
+
+// longerRetention returns whichever of two policies expires later, an
+// archive is kept as long as its longest lived contents.
+func longerRetention(a, b *Retention) *Retention {
+	if a == nil || (b != nil && b.Expires.After(a.Expires)) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"maps"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	retryPasses       = EnvInt("RETRY_PASSES", 0, "Passes at the end of the run retrying the objects which failed (0 to disable)")
+	retryDelay        = EnvInt("RETRY_DELAY", 30, "Seconds waited before each retry pass, doubling from one pass to the next")
+	failedObjectsName = Env("FAILED_OBJECTS", "failed-objects.jsonl", "Objects which failed for good, one JSON MetaEntry per line, which a later run can take as its WORK_LIST")
+
+	retry struct {
+		sync.Mutex
+		pending  map[string]*DownloadTask // Sent on and neither archived nor failed yet
+		failed   map[string]*FailedObject // Failed and not archived since, by key
+		attempts map[string]int
+	}
+	RetriedFiles   int64 // Objects sent again by the retry passes
+	RecoveredFiles int64 // Objects archived on a retry
+)
+
+// FailedObject is a line of FAILED_OBJECTS: the listing of an object, so the
+// file can be given as a WORK_LIST, with why and how often it failed.
+type FailedObject struct {
+	MetaEntry
+	Error    string `json:"error"`
+	Attempts int    `json:"attempts"`
+	Run      string `json:"run"`
+
+	task  *DownloadTask // Set when the object can be sent again
+	final bool          // A verdict on the contents, which a retry would repeat
+}
+
+// noRetryError marks the failures of an object which trying again cannot
+// change, such as a virus found.
+type noRetryError struct {
+	error
+}
+
+func (e noRetryError) Unwrap() error { return e.error }
+
+func noRetry(err error) error { return noRetryError{err} }
+
+func init() {
+	retry.pending = make(map[string]*DownloadTask)
+	retry.failed = make(map[string]*FailedObject)
+	retry.attempts = make(map[string]int)
+}
+
+// retryGate passes the listed objects on, and once the listing is done
+// waits for each to reach the archiver or fail.  Those which failed, bar
+// those the retry cannot help, are then sent again, up to RETRY_PASSES
+// times, backing off between the passes.
+func retryGate(ctx context.Context, in <-chan *DownloadTask, out chan<- *DownloadTask) {
+	defer close(out)
+	send := func(task *DownloadTask) bool {
+		retry.Lock()
+		retry.pending[task.Filename] = task
+		retry.attempts[task.Filename]++
+		retry.Unlock()
+		select {
+		case out <- task:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	for task := range in {
+		if !send(task) {
+			return
+		}
+	}
+
+	delay := time.Duration(retryDelay) * time.Second
+	for pass := 1; pass <= retryPasses; pass++ {
+		if !pollUntil(ctx, func() bool {
+			retry.Lock()
+			defer retry.Unlock()
+			return len(retry.pending) == 0
+		}) {
+			return
+		}
+		retry.Lock()
+		var tasks []*DownloadTask
+		for _, key := range slices.Sorted(maps.Keys(retry.failed)) {
+			if f := retry.failed[key]; f.task != nil && !f.final {
+				tasks = append(tasks, f.task)
+			}
+		}
+		retry.Unlock()
+		if len(tasks) == 0 {
+			return
+		}
+
+		log.Printf("Retry: pass %d of %d sending %d failed objects again in %s", pass, retryPasses, len(tasks), delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+		delay *= 2
+		for _, task := range tasks {
+			atomic.AddInt64(&RetriedFiles, 1)
+			if !send(task) {
+				return
+			}
+		}
+	}
+}
+
+// retryFailed notes an object logged in error.log.
+func retryFailed(ev *ErrorEvent) {
+	retry.Lock()
+	defer retry.Unlock()
+	f := &FailedObject{MetaEntry: MetaEntry{Key: ev.Filename, Size: ev.Size}, Run: runUUID}
+	if ev.Err != nil {
+		f.Error = ev.Err.Error()
+		f.final = errors.As(ev.Err, new(noRetryError))
+	}
+	if task, ok := retry.pending[ev.Filename]; ok {
+		f.MetaEntry = MetaEntry{Key: task.Filename, Size: task.Size, LastModified: task.LastModified, ETag: task.ETag, DeleteMarker: task.DeleteMarker}
+		f.task = task
+		delete(retry.pending, ev.Filename)
+	}
+	f.Attempts = max(retry.attempts[ev.Filename], 1)
+	retry.failed[ev.Filename] = f
+}
+
+// retryArrived notes an object taken by the archiver.  Those archived as
+// exceptions are not retried but are still counted as failed.
+func retryArrived(task *WorkFile) {
+	retry.Lock()
+	defer retry.Unlock()
+	delete(retry.pending, task.Filename)
+	if f, ok := retry.failed[task.Filename]; ok {
+		if task.Exception != "" {
+			f.task = nil
+			return
+		}
+		delete(retry.failed, task.Filename)
+		atomic.AddInt64(&RecoveredFiles, 1)
+	}
+}
+
+// writeFailedObjects writes the objects still failed at the end of the run to
+// FAILED_OBJECTS, or removes the file of an earlier run when none did.
+func writeFailedObjects() {
+	retry.Lock()
+	defer retry.Unlock()
+	if len(retry.failed) == 0 {
+		os.Remove(failedObjectsName)
+		return
+	}
+	f, err := os.Create(failedObjectsName)
+	if err != nil {
+		log.Printf("failed to create %s: %v", failedObjectsName, err)
+		return
+	}
+	defer f.Close()
+	buf := bufio.NewWriter(f)
+	for _, key := range slices.Sorted(maps.Keys(retry.failed)) {
+		dat, _ := json.Marshal(retry.failed[key])
+		buf.Write(append(dat, '\n'))
+	}
+	if err := buf.Flush(); err != nil {
+		log.Printf("failed to write %s: %v", failedObjectsName, err)
+		return
+	}
+	log.Printf("%d objects failed, they are listed in %s for a later run to take as its WORK_LIST", len(retry.failed), failedObjectsName)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+var (
+	assumeRoleARN      = Env("ASSUME_ROLE_ARN", "", "Role assumed, with the instance credentials, for every AWS call")
+	assumeRoleSession  = Env("ASSUME_ROLE_SESSION_NAME", "archiver-{host}-{run}", "Session name of the assumed role, {run}, {host} and {version} are replaced")
+	assumeRoleIdentity = Env("ASSUME_ROLE_SOURCE_IDENTITY", "", "Source identity set on the assumed role session, with the same replacements")
+	assumeRoleTags     = Env("ASSUME_ROLE_TAGS", "", "Session tags of the assumed role as KEY=VALUE,..., with the same replacements in the values")
+	assumeRoleExternal = Env("ASSUME_ROLE_EXTERNAL_ID", "", "External ID required by the trust policy of a role in another account")
+	assumeRoleDuration = EnvInt("ASSUME_ROLE_DURATION", 3600, "Seconds the assumed role credentials are requested for")
+)
+
+var (
+	sessionNameInvalid = regexp.MustCompile(`[^\w+=,.@-]+`)
+	externalIDValid    = regexp.MustCompile(`^[\w+=,.@:/-]+$`)
+)
+
+// roleField expands the placeholders of an ASSUME_ROLE_* setting.  The run
+// is RUN_ID, or SRC_BUCKET without one, and the host is WORKER_ID.
+func roleField(s string) string {
+	run := runID
+	if run == "" {
+		run = srcBucket
+	}
+	return strings.NewReplacer("{run}", run, "{host}", workerID, "{version}", version).Replace(s)
+}
+
+// assumeRoleParams builds the AssumeRole request, with the session name and
+// source identity trimmed to the characters and lengths STS accepts.
+func assumeRoleParams() url.Values {
+	params := url.Values{}
+	params.Set("RoleArn", assumeRoleARN)
+	name := sessionNameInvalid.ReplaceAllString(roleField(assumeRoleSession), "-")
+	params.Set("RoleSessionName", name[:min(len(name), 64)])
+	params.Set("DurationSeconds", strconv.Itoa(assumeRoleDuration))
+	if assumeRoleExternal != "" {
+		params.Set("ExternalId", assumeRoleExternal)
+	}
+	if assumeRoleIdentity != "" {
+		identity := sessionNameInvalid.ReplaceAllString(roleField(assumeRoleIdentity), "-")
+		params.Set("SourceIdentity", identity[:min(len(identity), 64)])
+	}
+	if assumeRoleTags != "" {
+		for i, tag := range strings.Split(assumeRoleTags, ",") {
+			key, value, _ := strings.Cut(tag, "=")
+			n := strconv.Itoa(i + 1)
+			params.Set("Tags.member."+n+".Key", strings.TrimSpace(key))
+			params.Set("Tags.member."+n+".Value", roleField(strings.TrimSpace(value)))
+		}
+	}
+	return params
+}
+
+func initAssumeRole() {
+	if assumeRoleARN == "" {
+		return
+	}
+	if n := len(assumeRoleExternal); n > 0 && (n < 2 || n > 1224 || !externalIDValid.MatchString(assumeRoleExternal)) {
+		log.Fatal("invalid ASSUME_ROLE_EXTERNAL_ID, expected 2 to 1224 letters, digits or +=,.@:/-")
+	}
+	if assumeRoleDuration < 900 {
+		log.Fatal("ASSUME_ROLE_DURATION must be at least 900 seconds")
+	}
+	if assumeRoleTags != "" {
+		for _, tag := range strings.Split(assumeRoleTags, ",") {
+			if key, _, ok := strings.Cut(tag, "="); !ok || strings.TrimSpace(key) == "" {
+				log.Fatalf("invalid ASSUME_ROLE_TAGS entry %q, expected KEY=VALUE", tag)
+			}
+		}
+	}
+}
+
+// assumeRoleProvider exchanges the base credentials for those of
+// ASSUME_ROLE_ARN, so CloudTrail records the session name, source identity
+// and tags of this archiver against every call.
+type assumeRoleProvider struct {
+	base aws.CredentialsProvider
+}
+
+func (p assumeRoleProvider) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	var out struct {
+		Result struct {
+			Credentials struct {
+				AccessKeyId     string
+				SecretAccessKey string
+				SessionToken    string
+				Expiration      time.Time
+			}
+		} `xml:"AssumeRoleResult"`
+	}
+	params := assumeRoleParams()
+	if err := awsQueryCall(ctx, p.base, "sts", "2011-06-15", "AssumeRole", params, &out); err != nil {
+		return aws.Credentials{}, fmt.Errorf("failed to assume role %s: %w", assumeRoleARN, err)
+	}
+	if debug {
+		log.Printf("Assumed role %s as session %s", assumeRoleARN, params.Get("RoleSessionName"))
+	}
+	c := out.Result.Credentials
+	return aws.Credentials{
+		AccessKeyID:     c.AccessKeyId,
+		SecretAccessKey: c.SecretAccessKey,
+		SessionToken:    c.SessionToken,
+		Source:          "AssumeRole",
+		CanExpire:       true,
+		Expires:         c.Expiration,
+	}, nil
+}
+
+// withAssumedRole returns credentials for ASSUME_ROLE_ARN obtained with base,
+// or base itself when no role is to be assumed.
+func withAssumedRole(base aws.CredentialsProvider) aws.CredentialsProvider {
+	if assumeRoleARN == "" {
+		return base
+	}
+	return newCredentialsCache(assumeRoleProvider{base: base})
+}
@@ -1,28 +1,34 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/credentials/ec2rolecreds"
 	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/aws/smithy-go"
 )
 
 var (
-	region   string
-	s3client *s3.Client
+	uploadPartSize = EnvInt("UPLOAD_PART_MIB", 10, "Part size in MiB of the multipart uploads of archives and restored objects")
+
+	region         string
+	s3client       ObjectStore
+	awsCredentials aws.CredentialsProvider // Shared with the non-S3 service calls
 
 	s3Ready              sync.WaitGroup // channel to signal when the S3 client is ready
 	awscliLog            = log.New(os.Stderr, "awscli: ", log.LstdFlags)
@@ -31,9 +37,13 @@ var (
 
 func initS3() {
 	awscliLog.Println("Initializing S3 client...")
-	s3RefreshTime, err := time.ParseDuration(Env("REFRESH", "20m", "The refresh interval for grabbing new AMI credentials"))
+	var err error
+	credentialExpiryWindow, err = time.ParseDuration(Env("CREDENTIAL_EXPIRY_WINDOW", "10m", "How long before they expire credentials are refreshed, at most half their lifetime"))
 	if err != nil {
-		awscliLog.Fatal("Invalid REFRESH duration:", err)
+		awscliLog.Fatal("Invalid CREDENTIAL_EXPIRY_WINDOW duration:", err)
+	}
+	if os.Getenv("REFRESH") != "" {
+		awscliLog.Println("REFRESH is no longer used, credentials are refreshed CREDENTIAL_EXPIRY_WINDOW before they expire")
 	}
 
 	// Load environment variables for source and destination buckets and tarball key
@@ -44,6 +54,22 @@ func initS3() {
 	if srcBucket == "" || dstBucket == "" {
 		awscliLog.Fatal("SRC_BUCKET and DST_BUCKET environment variables must be set")
 	}
+	if uploadPartSize < 5 {
+		awscliLog.Fatal("UPLOAD_PART_MIB must be at least 5, the smallest part S3 accepts")
+	}
+
+	switch objectStoreKind {
+	case "":
+	case "memory":
+		initMemoryStore()
+		return
+	default:
+		awscliLog.Fatalf("Unknown OBJECT_STORE %q, expected \"memory\" or empty for S3", objectStoreKind)
+	}
+	if awsEndpointURL != "" {
+		initEndpointStore()
+		return
+	}
 
 	s3Ready.Add(1) // Add to wait group to signal when the S3 client is ready
 	go func() {
@@ -55,57 +81,54 @@ func initS3() {
 		}*/
 
 		imdsClient := imds.New(imds.Options{})
-		gro, err := imdsClient.GetRegion(context.TODO(), &imds.GetRegionInput{})
-		if err != nil {
-			awscliLog.Fatal("Could not get region property,", err)
+		chain := newCredentialChain(imdsClient)
+		if region = os.Getenv("AWS_REGION"); region == "" {
+			region = os.Getenv("AWS_DEFAULT_REGION")
 		}
-
-		iam, err := imdsClient.GetIAMInfo(context.TODO(), &imds.GetIAMInfoInput{})
-		if err != nil {
-			awscliLog.Fatal("Could not get IAM property,", err)
+		if region == "" {
+			gro, err := imdsClient.GetRegion(context.TODO(), &imds.GetRegionInput{})
+			if err != nil {
+				awscliLog.Fatal("Could not get region property, set AWS_REGION off EC2,", err)
+			}
+			region = gro.Region
 		}
-
-		region = gro.Region
-		awscliLog.Println("EC2 Environment:")
-		awscliLog.Println("  AWS_REGION:", gro.Region)
-		awscliLog.Println("  IMDS_ARN:", iam.IAMInfo.InstanceProfileArn)
-		awscliLog.Println("  IMDS_ID:", iam.IAMInfo.InstanceProfileID)
-
-		getConfig := func() error {
-			// Get a credential provider from the configured role attached to the currently running EC2 instance
-			provider := ec2rolecreds.New(func(o *ec2rolecreds.Options) {
-				o.Client = imdsClient
-			})
-
-			// Construct a client, wrap the provider in a cache, and supply the region for the desired service
-			s3client = s3.New(s3.Options{
-				Credentials: aws.NewCredentialsCache(provider),
-				Region:      region,
-			})
-			//fmt.Printf("config: %#v\n\n", sdkConfig)
-
-			return nil
+		awscliLog.Println("AWS Environment:")
+		awscliLog.Println("  AWS_REGION:", region)
+		webIdentity := chain.uses("web") && os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE") != ""
+		if webIdentity {
+			// In a pod the instance metadata is often out of reach
+			awscliLog.Println("  AWS_ROLE_ARN:", os.Getenv("AWS_ROLE_ARN"), "(web identity)")
+		} else if chain.uses("imds") {
+			if iam, err := imdsClient.GetIAMInfo(context.TODO(), &imds.GetIAMInfoInput{}); err != nil {
+				awscliLog.Println("  IMDS: no instance profile,", err)
+			} else {
+				awscliLog.Println("  IMDS_ARN:", iam.IAMInfo.InstanceProfileArn)
+				awscliLog.Println("  IMDS_ID:", iam.IAMInfo.InstanceProfileID)
+			}
 		}
 
+		// The clients last the whole run, their credentials are refreshed by
+		// the cache as they near expiry
+		awsCredentials = withAssumedRole(newCredentialsCache(chain))
+		s3client = meter(withSSE(newPooledStore(s3.Options{
+			Credentials:     awsCredentials,
+			Region:          region,
+			EndpointOptions: s3.EndpointResolverOptions{UseFIPSEndpoint: fipsEndpointState()},
+		})))
+
 		awscliLog.Println("Testing call to AWS...")
-		if err := getConfig(); err != nil {
-			awscliLog.Fatal("Error getting config:", err)
+		if _, err := awsCredentials.Retrieve(context.TODO()); err != nil {
+			// The instance may not have its role yet, each request tries again
+			awscliLog.Println("Error getting credentials:", err)
 		}
-
-		go func() {
-			// Refresh credentials every 20 minutes to ensure low latency on requests
-			// and recovery should the server not have a policy assigned to it yet.
-			for {
-				time.Sleep(s3RefreshTime)
-				//awscliLog.Printf("Pulling new creds for s3Client %#v\n", s3client)
-				getConfig()
-			}
-		}()
 		awscliLog.Println("S3 client initialized successfully")
 	}()
 }
 
-func downloadObjectInParts(ctx context.Context, srcBucket string, key string, size int64, partCount int) (string, error) {
+// downloadObjectInParts downloads an object to a temp file with partCount
+// ranged GETs at once.  A non-empty etag is required to still match, so the
+// parts cannot come from different versions of the object.
+func downloadObjectInParts(ctx context.Context, srcBucket string, key string, etag string, size int64, partCount int) (string, error) {
 	s3Ready.Wait()
 
 	ext := filepath.Ext(key)
@@ -113,7 +136,7 @@ func downloadObjectInParts(ctx context.Context, srcBucket string, key string, si
 		ext = ".tmp"
 	}
 
-	outFile, err := os.CreateTemp("", "s3obj-*"+ext)
+	outFile, err := createTempFile("s3obj-*" + ext)
 	if err != nil {
 		return "", fmt.Errorf("failed to create temp file: %w", err)
 	}
@@ -122,7 +145,7 @@ func downloadObjectInParts(ctx context.Context, srcBucket string, key string, si
 	defer func() {
 		outFile.Close()
 		if tempName != "" {
-			os.Remove(tempName)
+			deleteTempFile(tempName)
 		}
 	}()
 
@@ -148,10 +171,11 @@ func downloadObjectInParts(ctx context.Context, srcBucket string, key string, si
 		go func(partIdx int, start, end int64) {
 			defer wg.Done()
 			rangeHeader := fmt.Sprintf("bytes=%d-%d", start, end)
-			getObj, err := s3client.GetObject(ctx, &s3.GetObjectInput{
-				Bucket: aws.String(srcBucket),
-				Key:    aws.String(key),
-				Range:  aws.String(rangeHeader),
+			getObj, err := getSourceObject(ctx, &s3.GetObjectInput{
+				Bucket:  aws.String(srcBucket),
+				Key:     aws.String(key),
+				Range:   aws.String(rangeHeader),
+				IfMatch: ifMatch(etag),
 			})
 			if err != nil {
 				proceed = false
@@ -203,11 +227,12 @@ func downloadObjectInParts(ctx context.Context, srcBucket string, key string, si
 	return outFile.Name(), nil
 }
 
-func downloadObjectToBuffer(ctx context.Context, srcBucket string, key string, localBuf []byte) (int, error) {
+func downloadObjectToBuffer(ctx context.Context, srcBucket string, key string, etag string, localBuf []byte) (int, error) {
 	s3Ready.Wait() // Wait for the S3 client to be ready
-	getObj, err := s3client.GetObject(ctx, &s3.GetObjectInput{
-		Bucket: aws.String(srcBucket),
-		Key:    &key,
+	getObj, err := getSourceObject(ctx, &s3.GetObjectInput{
+		Bucket:  aws.String(srcBucket),
+		Key:     &key,
+		IfMatch: ifMatch(etag),
 	})
 	if err != nil {
 		return 0, fmt.Errorf("failed to download object %s: %w", key, err)
@@ -233,12 +258,29 @@ func downloadObjectToBuffer(ctx context.Context, srcBucket string, key string, l
 	return total, nil
 }
 
-func uploadFileInParts(ctx context.Context, dstBucket, key, filePath string, partCount int) error {
-	file, err := os.Open(filePath)
-	defer file.Close()
+// ifMatch returns the If-Match condition for an ETag, nil without one.
+func ifMatch(etag string) *string {
+	if etag == "" {
+		return nil
+	}
+	return aws.String(`"` + strings.Trim(etag, `"`) + `"`)
+}
+
+// uploadAttrs are the attributes set on an uploaded object.
+type uploadAttrs struct {
+	ContentType string
+	Metadata    map[string]string
+	Tags        map[string]string
+}
+
+// uploadFileInParts uploads a local file with the s3 manager, in parts of
+// UPLOAD_PART_MIB.
+func uploadFileInParts(ctx context.Context, dstBucket, key, filePath string, attrs uploadAttrs) error {
+	file, err := openTempFile(filePath)
 	if err != nil {
 		return fmt.Errorf("failed to open file %s: %w", filePath, err)
 	}
+	defer file.Close()
 
 	info, err := file.Stat()
 	if err != nil {
@@ -246,38 +288,153 @@ func uploadFileInParts(ctx context.Context, dstBucket, key, filePath string, par
 	}
 
 	size := info.Size()
-	if partCount <= 0 || size == 0 {
-		return fmt.Errorf("invalid partCount or file size")
+	if size == 0 {
+		return fmt.Errorf("file %s is empty", filePath)
 	}
 
 	s3Ready.Wait() // Wait for the S3 client to be ready
 
-	var partMiBs int64 = 10
 	uploader := manager.NewUploader(s3client, func(u *manager.Uploader) {
-		u.PartSize = partMiBs * 1024 * 1024
+		u.PartSize = int64(uploadPartSize) * 1024 * 1024
+		u.Concurrency = uploadParts()
 	})
-	_, err = uploader.Upload(ctx, &s3.PutObjectInput{
+	input := &s3.PutObjectInput{
 		Bucket:   aws.String(dstBucket),
 		Key:      aws.String(key),
 		Body:     &UploadReader{file},
-		Metadata: virusScanMap,
-	})
+		Metadata: attrs.Metadata,
+
+		ChecksumAlgorithm: uploadChecksum(),
+	}
+	if attrs.ContentType != "" {
+		input.ContentType = aws.String(attrs.ContentType)
+	}
+	if len(attrs.Tags) > 0 {
+		tags := url.Values{}
+		for k, v := range attrs.Tags {
+			tags.Set(k, v)
+		}
+		input.Tagging = aws.String(tags.Encode())
+	}
+	out, err := uploader.Upload(ctx, input)
 	if err != nil {
 		var apiErr smithy.APIError
+		var multi manager.MultiUploadFailure
 		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "EntityTooLarge" {
 			log.Printf("Error while uploading object to %s. The object is too large.\n"+
 				"The maximum size for a multipart upload is 5TB.", dstBucket)
+		} else if errors.As(err, &multi) {
+			// The manager aborts the upload, so its parts are not left behind
+			log.Printf("Couldn't upload large object to %v:%v, upload %s aborted. Here's why: %v\n",
+				dstBucket, key, multi.UploadID(), err)
 		} else {
 			log.Printf("Couldn't upload large object to %v:%v. Here's why: %v\n",
 				dstBucket, key, err)
 		}
-	} else {
-		err = s3.NewObjectExistsWaiter(s3client).Wait(
-			ctx, &s3.HeadObjectInput{Bucket: aws.String(dstBucket), Key: aws.String(key)}, time.Minute)
+		return err
+	}
+	return verifyUpload(ctx, dstBucket, key, size, out)
+}
+
+// verifyUpload checks, with a HEAD, that an uploaded object has the size of
+// the file sent and the ETag and checksum S3 reported for the upload, so an
+// upload cut short or replaced meanwhile is not logged as done.
+func verifyUpload(ctx context.Context, bucket, key string, size int64, out *manager.UploadOutput) error {
+	head, err := s3.NewObjectExistsWaiter(s3client).WaitForOutput(ctx, &s3.HeadObjectInput{
+		Bucket:       aws.String(bucket),
+		Key:          aws.String(key),
+		ChecksumMode: types.ChecksumModeEnabled,
+	}, time.Minute)
+	if err != nil {
+		return fmt.Errorf("failed to check upload of %s: %w", key, err)
+	}
+	if got := aws.ToInt64(head.ContentLength); got != size {
+		return fmt.Errorf("uploaded %s is %d bytes, not the %d sent", key, got, size)
+	}
+	if want := strings.Trim(aws.ToString(out.ETag), `"`); want != "" && strings.Trim(aws.ToString(head.ETag), `"`) != want {
+		return fmt.Errorf("uploaded %s has ETag %s, not %s of the upload", key, aws.ToString(head.ETag), want)
+	}
+	for _, sums := range [][2]*string{
+		{out.ChecksumCRC32C, head.ChecksumCRC32C},
+		{out.ChecksumSHA1, head.ChecksumSHA1},
+		{out.ChecksumSHA256, head.ChecksumSHA256},
+	} {
+		if sums[0] != nil && sums[1] != nil && *sums[0] != *sums[1] {
+			return fmt.Errorf("uploaded %s has checksum %s, not %s of the upload", key, *sums[1], *sums[0])
+		}
+	}
+	if debug {
+		log.Printf("Checked upload of %s, %d bytes", key, size)
+	}
+	return nil
+}
+
+// uploadWorkFile uploads the contents of task as the object task.Filename.
+func uploadWorkFile(ctx context.Context, dstBucket string, task *WorkFile) error {
+	s3Ready.Wait() // Wait for the S3 client to be ready
+
+	var body io.Reader = bytes.NewReader(task.Bytes)
+	if task.TempFile != "" {
+		file, err := openTempFile(task.TempFile)
 		if err != nil {
-			log.Printf("Failed attempt to wait for object %s to exist.\n", key)
+			return err
 		}
+		defer file.Close()
+		body = file
 	}
+	uploader := manager.NewUploader(s3client, func(u *manager.Uploader) {
+		u.PartSize = int64(uploadPartSize) * 1024 * 1024
+	})
+	input := &s3.PutObjectInput{
+		Bucket:   aws.String(dstBucket),
+		Key:      aws.String(task.Filename),
+		Body:     &UploadReader{body},
+		Metadata: restoredMetadata(task.Attrs),
 
-	return err
+		ChecksumAlgorithm: uploadChecksum(),
+	}
+	if attrs := task.Attrs; attrs != nil {
+		// Recreate the object as it was with RECORD_ATTRIBUTES
+		input.ContentType = header(attrs.ContentType)
+		input.ContentEncoding = header(attrs.ContentEncoding)
+		input.ContentDisposition = header(attrs.ContentDisposition)
+		input.ContentLanguage = header(attrs.ContentLanguage)
+		input.CacheControl = header(attrs.CacheControl)
+		input.Tagging = restoredTagging(attrs)
+		input.StorageClass = types.StorageClass(attrs.StorageClass)
+	}
+	_, err := uploader.Upload(ctx, input)
+	if err != nil {
+		return fmt.Errorf("failed to upload %s: %w", task.Filename, err)
+	}
+	return nil
+}
+
+// copyObject copies srcKey to dstKey within a bucket.  With attrs the copy
+// takes those attributes instead of the ones of srcKey.
+func copyObject(ctx context.Context, bucket, srcKey, dstKey string, attrs *ObjectAttrs) error {
+	s3Ready.Wait() // Wait for the S3 client to be ready
+
+	input := &s3.CopyObjectInput{
+		Bucket:     aws.String(bucket),
+		Key:        aws.String(dstKey),
+		CopySource: aws.String(bucket + "/" + url.PathEscape(srcKey)),
+	}
+	if attrs != nil {
+		input.MetadataDirective = types.MetadataDirectiveReplace
+		input.Metadata = restoredMetadata(attrs)
+		input.ContentType = header(attrs.ContentType)
+		input.ContentEncoding = header(attrs.ContentEncoding)
+		input.ContentDisposition = header(attrs.ContentDisposition)
+		input.ContentLanguage = header(attrs.ContentLanguage)
+		input.CacheControl = header(attrs.CacheControl)
+		input.TaggingDirective = types.TaggingDirectiveReplace
+		input.Tagging = restoredTagging(attrs)
+		input.StorageClass = types.StorageClass(attrs.StorageClass)
+	}
+	_, err := s3client.CopyObject(ctx, input)
+	if err != nil {
+		return fmt.Errorf("failed to copy %s to %s: %w", srcKey, dstKey, err)
+	}
+	return nil
 }
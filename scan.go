@@ -5,27 +5,70 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	clamav "github.com/hexahigh/go-clamav"
-	"github.com/remeh/sizedwaitgroup"
 )
 
 var (
 	clamavInstance *clamav.Clamav        // ClamAV instance for scanning files
+	clamavEngine   sync.RWMutex          // Held by scans while a reload swaps clamavInstance
+	clamavScanTime uint64                // MAX_SCANTIME of the engines compiled
 	virusScanMap   = map[string]string{} // Metadata map for virus scan
 	scanReady      sync.WaitGroup        // channel to signal scan readiness
+	scanCacheOnce  sync.Once             // Opens SCAN_CACHE once the engines are ready
 
 	clamLog         = log.New(os.Stderr, "clamav: ", log.LstdFlags)
 	concurrentScans = EnvInt("CONCURRENT_SCANNERS", 3, "How many concurrent scanners can run at once")
+	scanReadsFiles  bool // An engine reads files itself, rather than a stream
 )
 
 func initScan() {
-	clamLog.Println("Initializing ClamAV...")
-	definitionsPath := Env("DEFINITIONS", "./db", "The path with the ClamAV definitions")
 	maxScanTime := uint64(EnvInt("MAX_SCANTIME", 180000, "Max scan time in milliseconds"))
+	timeout := time.Duration(maxScanTime) * time.Millisecond
+	virusScanMap["result"] = "pass"
+	var engines []scanBackend
+	names := strings.Split(scannerBackend, ",")
+	for _, name := range names {
+		switch name {
+		case "libclamav":
+			initLibclamav(maxScanTime)
+			engines = append(engines, libclamavBackend{})
+			scanReadsFiles = true
+		case "clamd", "icap":
+			engines = append(engines, initRemoteScan(name, timeout))
+		case "yara":
+			engines = append(engines, initYaraScan(timeout))
+			scanReadsFiles = true
+		case "command":
+			engines = append(engines, initCommandScan(timeout))
+			scanReadsFiles = true
+		default:
+			log.Fatalf("SCANNER_BACKEND must be a list of libclamav, clamd, icap, yara or command: %q", scannerBackend)
+		}
+	}
+	scanEngine = engines[0]
+	if len(engines) > 1 {
+		scanEngine = newScanChain(names, engines)
+	}
+}
+
+// initLibclamav loads the ClamAV library with the signatures of DEFINITIONS,
+// which takes a while, so it is done in the background until scanReady.
+// With DEFINITIONS_MIRROR the signatures are fetched first.
+func initLibclamav(maxScanTime uint64) {
+	clamLog.Println("Initializing ClamAV...")
+	definitionsPath = launchPath(Env("DEFINITIONS", "./db", "The path with the ClamAV definitions"))
+	clamavScanTime = maxScanTime
+	if definitionsMirror != "" {
+		// Filled from the mirror, if it is not there yet
+		if err := os.MkdirAll(definitionsPath, 0755); err != nil {
+			clamLog.Fatalf("Definitions path error: %v", err)
+		}
+	}
 
 	// Test if path exists and can be read or fail
 	info, err := os.Stat(definitionsPath)
@@ -45,115 +88,129 @@ func initScan() {
 	go func() {
 		defer scanReady.Done() // Signal that the ClamAV instance is ready
 
-		// new clamav instance
-		clamavInstance = new(clamav.Clamav)
-		err := clamavInstance.Init(clamav.SCAN_OPTIONS{
-			General:   clamav.CL_SCAN_GENERAL_ALLMATCHES,
-			Parse:     ^uint(0), // clamav.CL_SCAN_PARSE_ARCHIVE | clamav.CL_SCAN_PARSE_ELF,
-			Heuristic: 0,        // clamav.CL_SCAN_HEURISTIC_EXCEEDS_MAX,
-			Mail:      0,
-			Dev:       0,
-		})
+		if definitionsMirror != "" {
+			if _, err := updateDefinitions(); err != nil {
+				clamLog.Fatalf("Could not fetch the definitions from %s: %v", definitionsMirror, err)
+			}
+		}
+		engine, dbVersion, dbTime, err := newClamavEngine()
 		if err != nil {
 			panic(err)
 		}
+		clamavInstance = engine
+		clamLog.Println("ClamAV initialized successfully")
+		clamavDBVersion = fmt.Sprintf("%d", dbVersion)
+		addScanEngine("ClamAV lib", clamavDBVersion, dbTime)
+		if definitionsRefresh > 0 {
+			go refreshDefinitions()
+		}
+	}()
+}
 
-		// free clamav memory
-		//defer clamavInstance.Free()
+// newClamavEngine compiles a ClamAV engine with the signatures of
+// DEFINITIONS, returning the version and date of the database.
+func newClamavEngine() (*clamav.Clamav, uint64, time.Time, error) {
+	// new clamav instance
+	engine := new(clamav.Clamav)
+	err := engine.Init(clamav.SCAN_OPTIONS{
+		General:   clamav.CL_SCAN_GENERAL_ALLMATCHES,
+		Parse:     ^uint(0), // clamav.CL_SCAN_PARSE_ARCHIVE | clamav.CL_SCAN_PARSE_ELF,
+		Heuristic: 0,        // clamav.CL_SCAN_HEURISTIC_EXCEEDS_MAX,
+		Mail:      0,
+		Dev:       0,
+	})
+	if err != nil {
+		return nil, 0, time.Time{}, err
+	}
+	fail := func(what string, err error) (*clamav.Clamav, uint64, time.Time, error) {
+		engine.Free()
+		return nil, 0, time.Time{}, fmt.Errorf("%s: %w", what, err)
+	}
 
-		// load db (/var/lib/clamav/)
-		signo, err := clamavInstance.LoadDB(definitionsPath, uint(clamav.CL_DB_DIRECTORY))
-		if err != nil {
-			panic(err)
-		}
-		clamLog.Println("db load succeed:", signo)
+	// load db (/var/lib/clamav/)
+	signo, err := engine.LoadDB(definitionsPath, uint(clamav.CL_DB_DIRECTORY))
+	if err != nil {
+		return fail("could not load the definitions", err)
+	}
+	clamLog.Println("db load succeed:", signo)
 
-		// compile engine
-		err = clamavInstance.CompileEngine()
-		if err != nil {
-			panic(err)
-		}
-		clamLog.Println("engine compiled successfully")
-		virusScanMap["vendor"] = "ClamAV lib"
-
-		// get db version
-		// This is the version of the ClamAV database.
-		// It is useful to know the version of the database to ensure it is up-to-date.
-		// The version is a number that represents the version of the database.
-		dbVersion, err := clamavInstance.EngineGetNum(clamav.CL_ENGINE_DB_VERSION)
-		if err != nil {
-			clamLog.Fatalln("Could not get ClamAV DB version", err)
-		}
-		clamLog.Println("ClamAV DB version:", dbVersion)
-		virusScanMap["version"] = fmt.Sprintf("%d", dbVersion)
+	// compile engine
+	if err := engine.CompileEngine(); err != nil {
+		return fail("could not compile the engine", err)
+	}
+	clamLog.Println("engine compiled successfully")
 
-		// get db time
-		// This is the time when the database was last updated.
-		// It is useful to know when the database was last updated to ensure it is up-to-date.
-		dbTime, err := clamavInstance.EngineGetNum(clamav.CL_ENGINE_DB_TIME)
-		if err != nil {
-			clamLog.Fatalln("Could not get ClamAV DB time", err)
-		}
-		clamLog.Println("ClamAV DB time:", time.Unix(int64(dbTime), 0))
-		virusScanMap["signature_date"] = time.Unix(int64(dbTime), 0).Format(time.RFC3339)
-
-		// set max scansize
-		// 40 GB
-		// This is the maximum size of a file that can be scanned.
-		// If a file exceeds this size, it will be skipped.
-		// This is useful to prevent scanning large files that may take a long time to scan.
-		// The value is in bytes, so 1024*1024*1024*40 = 40 GB.
-		// Note: This is a very high value, and you may want to adjust it based on your use case.
-		if err := clamavInstance.EngineSetNum(clamav.CL_ENGINE_MAX_SCANSIZE, 1024*1024*1024*40); err != nil {
-			clamLog.Fatalln("Could not set max scan size", err)
-		}
-		maxScanSize, err := clamavInstance.EngineGetNum(clamav.CL_ENGINE_MAX_SCANSIZE)
-		if err != nil {
-			clamLog.Fatalln("Could not get max scan size", err)
-		}
-		clamLog.Println("Max scan size:", maxScanSize)
-
-		// set max scan time
-		// 90000 milliseconds = 90 seconds
-		// This is the maximum time allowed for a scan before it is aborted.
-		// This is useful to prevent long-running scans from hanging indefinitely.
-		if err = clamavInstance.EngineSetNum(clamav.CL_ENGINE_MAX_SCANTIME, maxScanTime); err != nil {
-			clamLog.Fatalln("Could not set max scan time", err)
-		}
-		maxScanTime, err := clamavInstance.EngineGetNum(clamav.CL_ENGINE_MAX_SCANTIME)
-		if err != nil {
-			clamLog.Fatalln("Could not get max scan time", err)
-		}
-		clamLog.Println("Max scan time:", maxScanTime)
-
-		// set max file size
-		// 2 GB
-		// This is the maximum size of a file that can be scanned.
-		// If a file exceeds this size, it will be skipped.
-		// This is useful to prevent scanning large files that may take a long time to scan.
-		// The value is in bytes, so 2*1024*1024*1024 = 2 GB.
-		if err = clamavInstance.EngineSetNum(clamav.CL_ENGINE_MAX_FILESIZE, 2*1024*1024*1024-1); err != nil {
-			clamLog.Fatalln("Could not set max file size", err)
-		}
-		maxFileSize, err := clamavInstance.EngineGetNum(clamav.CL_ENGINE_MAX_FILESIZE)
-		if err != nil {
-			clamLog.Fatalln("Could not get max file size", err)
-		}
-		clamLog.Println("Max file size:", maxFileSize)
+	// get db version
+	// This is the version of the ClamAV database.
+	// It is useful to know the version of the database to ensure it is up-to-date.
+	// The version is a number that represents the version of the database.
+	dbVersion, err := engine.EngineGetNum(clamav.CL_ENGINE_DB_VERSION)
+	if err != nil {
+		return fail("could not get ClamAV DB version", err)
+	}
+	clamLog.Println("ClamAV DB version:", dbVersion)
 
-		clamLog.Println("ClamAV initialized successfully")
+	// get db time
+	// This is the time when the database was last updated.
+	// It is useful to know when the database was last updated to ensure it is up-to-date.
+	dbTime, err := engine.EngineGetNum(clamav.CL_ENGINE_DB_TIME)
+	if err != nil {
+		return fail("could not get ClamAV DB time", err)
+	}
+	clamLog.Println("ClamAV DB time:", time.Unix(int64(dbTime), 0))
 
-		virusScanMap["result"] = "pass"
-	}()
+	// set max scansize
+	// 40 GB
+	// This is the maximum size of a file that can be scanned.
+	// If a file exceeds this size, it will be skipped.
+	// This is useful to prevent scanning large files that may take a long time to scan.
+	// The value is in bytes, so 1024*1024*1024*40 = 40 GB.
+	// Note: This is a very high value, and you may want to adjust it based on your use case.
+	if err := engine.EngineSetNum(clamav.CL_ENGINE_MAX_SCANSIZE, 1024*1024*1024*40); err != nil {
+		return fail("could not set max scan size", err)
+	}
+	maxScanSize, err := engine.EngineGetNum(clamav.CL_ENGINE_MAX_SCANSIZE)
+	if err != nil {
+		return fail("could not get max scan size", err)
+	}
+	clamLog.Println("Max scan size:", maxScanSize)
+
+	// set max scan time
+	// 90000 milliseconds = 90 seconds
+	// This is the maximum time allowed for a scan before it is aborted.
+	// This is useful to prevent long-running scans from hanging indefinitely.
+	if err = engine.EngineSetNum(clamav.CL_ENGINE_MAX_SCANTIME, clamavScanTime); err != nil {
+		return fail("could not set max scan time", err)
+	}
+	maxScanTime, err := engine.EngineGetNum(clamav.CL_ENGINE_MAX_SCANTIME)
+	if err != nil {
+		return fail("could not get max scan time", err)
+	}
+	clamLog.Println("Max scan time:", maxScanTime)
+
+	// set max file size
+	// 2 GB
+	// This is the maximum size of a file that can be scanned.
+	// If a file exceeds this size, it will be skipped.
+	// This is useful to prevent scanning large files that may take a long time to scan.
+	// The value is in bytes, so 2*1024*1024*1024 = 2 GB.
+	if err = engine.EngineSetNum(clamav.CL_ENGINE_MAX_FILESIZE, 2*1024*1024*1024-1); err != nil {
+		return fail("could not set max file size", err)
+	}
+	maxFileSize, err := engine.EngineGetNum(clamav.CL_ENGINE_MAX_FILESIZE)
+	if err != nil {
+		return fail("could not get max file size", err)
+	}
+	clamLog.Println("Max file size:", maxFileSize)
+	return engine, dbVersion, time.Unix(int64(dbTime), 0), nil
 }
 
 // Scanner listens for WorkFile on tasksCh, scans them, and sends WorkFile to doneCh.
 func Scanner(ctx context.Context, tasksCh <-chan *WorkFile, doneCh chan<- *WorkFile) {
 	log.Println("Starting scanner...")
-	swg := sizedwaitgroup.New(concurrentScans)
 	defer close(doneCh) // Ensure doneCh is closed when the function exits
 
-	scanReady.Wait() // Wait for the ClamAV instance to be ready
+	waitScanner()
 
 	for {
 		select {
@@ -165,100 +222,169 @@ func Scanner(ctx context.Context, tasksCh <-chan *WorkFile, doneCh chan<- *WorkF
 			}
 
 			if !ok {
-				swg.Wait()
+				scanners.Wait()
 				Println("Closing scanner...")
 				return
 			}
 
-			swg.Add()
+			scanners.Add(1)
 			go func(task *WorkFile) {
-				defer swg.Done()
-				defer atomic.AddInt64(&ScannedFiles, 1)
-
-				if task.Size == 0 {
-					doneCh <- &WorkFile{
-						Size:     task.Size,
-						Filename: task.Filename,
-					}
-
-					return // Skip empty files
-				}
-
-				if task.TempFile == "" {
-					// If the file is small enough, we can scan it in memory
-					fmem := clamav.OpenMemory(task.Bytes)
-					if fmem == nil {
-						fileErrCh <- &ErrorEvent{
-							Size:     task.Size,
-							Filename: task.Filename,
-							Err:      fmt.Errorf("failed to open memory for scanning %s", task.Filename),
-						}
-						putMemory(task.Bytes)
-						return // Skip this file if memory scan fails
-					}
-					// Scan the file in memory
-					_, virusName, err := clamavInstance.ScanMapCB(fmem, task.Filename, context.Background())
-					//clamav.CloseMemory(fmem) // Clean up memory after scanning
-
-					if virusName != "" {
-						//log.Printf("Virus found in %q: %s\n", filePath, virusName)
-						// If a virus is found, return an error with the virus name
-						// and the file path for clarity.}
-						fileErrCh <- &ErrorEvent{
-							Size:     task.Size,
-							Filename: task.Filename,
-							Err:      fmt.Errorf("virus found in %s: %s", task.Filename, virusName),
-						}
-						putMemory(task.Bytes)
-						return // Skip this file if memory scan fails
-					} else if err != nil {
-						fileErrCh <- &ErrorEvent{
-							Size:     task.Size,
-							Filename: task.Filename,
-							Err:      fmt.Errorf("error scanning %s: %v", task.Filename, err),
-						}
-						putMemory(task.Bytes)
-						return // Skip this file if memory scan fails
-					}
-					doneCh <- &WorkFile{
-						Size:     task.Size,
-						Filename: task.Filename,
-						TempFile: task.TempFile,
-						Bytes:    task.Bytes,
-					}
-				} else {
-					// If the file is large, we scan it from a temporary file
-					// Scan the file
-					//fmt.Printf("Scanning file: %s\n", tempFilePath)
-					_, virusName, err := clamavInstance.ScanFile(task.TempFile)
-					if virusName != "" {
-						// If a virus is found, return an error with the virus name
-						// and the file path for clarity.}
-						fileErrCh <- &ErrorEvent{
-							Size:     task.Size,
-							Filename: task.Filename,
-							Err:      fmt.Errorf("virus found in %s: %s", task.Filename, virusName),
-						}
-						os.Remove(task.TempFile) // Clean up the temporary file after scanning
-						return                   // Skip this file if a virus is found
-					} else if err != nil {
-						// If a virus is found, return an error with the virus name
-						// and the file path for clarity.}
-						fileErrCh <- &ErrorEvent{
-							Size:     task.Size,
-							Filename: task.Filename,
-							Err:      fmt.Errorf("error scanning %s: %v", task.Filename, err),
-						}
-						os.Remove(task.TempFile) // Clean up the temporary file after scanning
-						return                   // Skip this file if a virus is found
-					}
-					doneCh <- &WorkFile{
-						Size:     task.Size,
-						Filename: task.Filename,
-						TempFile: task.TempFile,
-					}
-				}
+				defer scanners.Done()
+				scanTask(task, doneCh)
 			}(task)
 		}
 	}
 }
+
+// waitScanner waits for the scan engines to be ready and the scan cache to
+// be opened with their database version.
+func waitScanner() {
+	scanReady.Wait() // Wait for the ClamAV instance to be ready
+	scanCacheOnce.Do(openScanCache)
+}
+
+// scanInline scans an object in the goroutine which downloaded it, taking
+// a scanner slot as the Scanner does, and sends it on to doneCh.
+func scanInline(task *WorkFile, doneCh chan<- *WorkFile) {
+	waitScanner()
+	scanners.Add(1)
+	defer scanners.Done()
+	scanTask(task, doneCh)
+}
+
+// scanTask scans the contents of a downloaded object, or skips the scan as
+// SCAN_EXCLUDE or the scan cache allow, and sends it to doneCh with its
+// verdict.  An object in which a virus is found, or which cannot be scanned,
+// goes to the exceptions archive or is dropped.
+func scanTask(task *WorkFile, doneCh chan<- *WorkFile) {
+	scanStage.begin()
+	defer scanStage.end()
+	defer atomic.AddInt64(&ScannedFiles, 1)
+	start := time.Now()
+
+	if task.Size == 0 {
+		setScanResult(task, "empty", "", nil, false, start)
+		task.Custody.Scanned = custodyDigest(task)
+		recordStage(task.Filename, "scanned", "")
+		doneCh <- task
+
+		return // Skip empty files
+	}
+	if reason := scanSkipReason(task); reason != "" {
+		// Archived unscanned, saying why
+		setScanResult(task, "skipped", "", nil, false, start)
+		skipScan(task, reason)
+		task.Custody.Scanned = custodyDigest(task)
+		recordStage(task.Filename, "scanned", "")
+		doneCh <- task
+		return
+	}
+
+	if virusName, ok := cachedVerdict(task); ok {
+		// These contents were scanned with this database before
+		if virusName != "" {
+			setScanResult(task, "virus", virusName, nil, true, start)
+			sendException(task, noRetry(fmt.Errorf("virus found in %s: %s (cached verdict)", task.Filename, virusName)), doneCh)
+			return
+		}
+		setScanResult(task, "clean", "", nil, true, start)
+		task.Custody.Scanned = custodyDigest(task)
+		recordStage(task.Filename, "scanned", "")
+		doneCh <- task
+		return
+	}
+
+	var (
+		virusName string
+		err       error
+	)
+	// Small files are scanned in memory, large ones from their temp file.
+	// A scan cannot be interrupted, an object out of time is
+	// abandoned and its contents freed once the scan returns
+	if !runWithin(task, func() { virusName, err = scanWorkFile(task) }, func() {
+		if task.TempFile == "" {
+			putMemory(task.Bytes)
+		} else {
+			removeTempFile(task)
+		}
+	}) {
+		fileErrCh <- &ErrorEvent{Size: task.Size, Filename: task.Filename,
+			Err: fmt.Errorf("abandoned scanning %s after PER_OBJECT_TIMEOUT of %s", task.Filename, perObjectTimeout)}
+		return
+	}
+	if virusName != "" || err == nil {
+		cacheVerdict(task, virusName)
+	}
+	if virusName != "" {
+		// The object is left out of the archive, or kept apart
+		// in the exceptions archive with EXCEPTIONS_PREFIX
+		setScanResult(task, "virus", virusName, nil, false, start)
+		sendException(task, noRetry(fmt.Errorf("virus found in %s: %s", task.Filename, virusName)), doneCh)
+		return
+	} else if err != nil {
+		setScanResult(task, "error", "", err, false, start)
+		sendException(task, fmt.Errorf("error scanning %s: %v", task.Filename, err), doneCh)
+		return
+	}
+	setScanResult(task, "clean", "", nil, false, start)
+	task.Custody.Scanned = custodyDigest(task)
+	recordStage(task.Filename, "scanned", "")
+	doneCh <- task
+}
+
+// scanRecords returns the PAX records of the scan of task with TAR_PAX_SCAN,
+// so a tar entry extracted on its own still says how it was scanned.
+func scanRecords(task *WorkFile) map[string]string {
+	if !paxScan || task.ScanResult == "" {
+		return nil
+	}
+	records := map[string]string{"x-scan-result": task.ScanResult}
+	if db := virusScanMap["version"]; db != "" {
+		records["x-scan-db"] = db
+	}
+	return records
+}
+
+// scanWorkFile scans the contents of task with SCANNER_BACKEND, returning
+// the name of any virus found.
+func scanWorkFile(task *WorkFile) (string, error) {
+	return scanEngine.scan(task)
+}
+
+// libclamavBackend scans with the ClamAV library built into the binary.
+type libclamavBackend struct{}
+
+func (libclamavBackend) scan(task *WorkFile) (string, error) {
+	clamavEngine.RLock() // Held until the definitions are reloaded
+	defer clamavEngine.RUnlock()
+	if task.TempFile != "" {
+		return scanTempFile(task)
+	}
+	fmem := clamav.OpenMemory(task.Bytes)
+	if fmem == nil {
+		return "", fmt.Errorf("failed to open memory for scanning %s", task.Filename)
+	}
+	_, virusName, err := clamavInstance.ScanMapCB(fmem, task.Filename, context.Background())
+	return virusName, err
+}
+
+// scanTempFile scans the temp file of task.  ClamAV reads the file itself,
+// so an encrypted one is scanned from a short-lived plaintext copy in memory.
+func scanTempFile(task *WorkFile) (string, error) {
+	if !tempEncryption {
+		_, virusName, err := clamavInstance.ScanFile(task.TempFile)
+		return virusName, err
+	}
+	src, err := openTempFile(task.TempFile)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	f, free, err := plainMemFile(src, task.Size)
+	if err != nil {
+		return "", err
+	}
+	defer free()
+	_, virusName, err := clamavInstance.ScanDesc(int32(f.Fd()), task.Filename)
+	return virusName, err
+}
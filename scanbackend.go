@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	scannerBackend = Env("SCANNER_BACKEND", "libclamav", "Scanner used: libclamav built in, clamd to stream to a clamd daemon, or icap for an ICAP antivirus service")
+	clamdAddress   = Env("CLAMD_ADDRESS", "tcp://127.0.0.1:3310", "Address of clamd with SCANNER_BACKEND=clamd, tcp://host:port or unix:///path/to/clamd.sock")
+	icapURL        = Env("ICAP_URL", "", "Service scanning with SCANNER_BACKEND=icap, such as icap://127.0.0.1:1344/avscan")
+
+	scanEngine  scanBackend = libclamavBackend{}
+	scanEngines sync.Mutex  // Guards virusScanMap while the engines start
+)
+
+// scanBackend scans the contents of a file, returning the name of any virus
+// found.
+type scanBackend interface {
+	scan(task *WorkFile) (string, error)
+}
+
+// initRemoteScan connects to the clamd or ICAP service named and records the
+// version of its signatures.  Each scan may take up to timeout once the
+// contents are sent.
+func initRemoteScan(name string, timeout time.Duration) scanBackend {
+	if name == "clamd" {
+		c, err := newClamdBackend(clamdAddress, timeout)
+		if err != nil {
+			clamLog.Fatal(err)
+		}
+		if reply, err := c.command("PING", nil); err != nil || reply != "PONG" {
+			clamLog.Fatalf("Could not reach clamd at %s: %v %s", clamdAddress, err, reply)
+		}
+		engine, db, date, err := c.version()
+		if err != nil {
+			clamLog.Fatalf("Could not get the clamd version: %v", err)
+		}
+		clamLog.Printf("Scanning with %s at %s, DB version %s of %s", engine, clamdAddress, db, date)
+		addScanEngine("ClamAV clamd", db, date)
+		return c
+	}
+	if icapURL == "" {
+		clamLog.Fatal("ICAP_URL must be set with SCANNER_BACKEND=icap")
+	}
+	c, err := newICAPBackend(icapURL, timeout)
+	if err != nil {
+		clamLog.Fatal(err)
+	}
+	code, header, err := c.request("OPTIONS", "", nil)
+	if err != nil || code != 200 {
+		clamLog.Fatalf("Could not reach the ICAP service at %s: %v %d", icapURL, err, code)
+	}
+	// The ISTag changes with the service's signatures, so it keys the scan cache
+	vendor := cmp.Or(header.Get("Service"), "ICAP")
+	clamLog.Printf("Scanning with %s at %s, ISTag %s", vendor, icapURL, header.Get("Istag"))
+	addScanEngine(vendor, strings.Trim(header.Get("Istag"), `"`), time.Time{})
+	return c
+}
+
+// contentsOf opens the contents of task for a remote scanner to read, from
+// memory or from its temp file, decrypted as it is read.
+func contentsOf(task *WorkFile) (io.ReadCloser, error) {
+	if task.TempFile == "" {
+		return io.NopCloser(bytes.NewReader(task.Bytes)), nil
+	}
+	return openTempFile(task.TempFile)
+}
+
+// clamdBackend streams the contents to clamd with the INSTREAM command, one
+// connection per scan.
+type clamdBackend struct {
+	network, address string
+	timeout          time.Duration
+}
+
+func newClamdBackend(addr string, timeout time.Duration) (*clamdBackend, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "tcp":
+		return &clamdBackend{network: "tcp", address: u.Host, timeout: timeout}, nil
+	case "unix":
+		return &clamdBackend{network: "unix", address: u.Path, timeout: timeout}, nil
+	}
+	return nil, fmt.Errorf("CLAMD_ADDRESS must start with tcp:// or unix://: %q", addr)
+}
+
+// command sends a command to clamd and returns its reply.
+func (c *clamdBackend) command(cmd string, body io.Reader) (string, error) {
+	conn, err := net.DialTimeout(c.network, c.address, 10*time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(c.timeout))
+	w := bufio.NewWriter(conn)
+	w.WriteString("z" + cmd + "\x00")
+	if body != nil {
+		// Chunks each prefixed by their length, ended by an empty one
+		buf := make([]byte, 64<<10)
+		for {
+			n, err := io.ReadFull(body, buf)
+			if n > 0 {
+				conn.SetDeadline(time.Now().Add(c.timeout)) // Sending may take longer than the scan
+				binary.Write(w, binary.BigEndian, uint32(n))
+				if _, werr := w.Write(buf[:n]); werr != nil {
+					return "", werr
+				}
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			} else if err != nil {
+				return "", err
+			}
+		}
+		binary.Write(w, binary.BigEndian, uint32(0))
+	}
+	if err := w.Flush(); err != nil {
+		return "", err
+	}
+	conn.SetDeadline(time.Now().Add(c.timeout))
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		return "", err
+	}
+	return strings.TrimRight(reply, "\x00\n"), nil
+}
+
+func (c *clamdBackend) scan(task *WorkFile) (string, error) {
+	r, err := contentsOf(task)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	reply, err := c.command("INSTREAM", r)
+	if err != nil {
+		return "", fmt.Errorf("clamd: %v", err)
+	}
+	// "stream: OK", "stream: <virus> FOUND" or "<message> ERROR"
+	reply = strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case reply == "OK":
+		return "", nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return strings.TrimSuffix(reply, " FOUND"), nil
+	}
+	return "", fmt.Errorf("clamd: %s", reply)
+}
+
+// version returns the clamd version, and the version and date of its
+// signatures, from "ClamAV 1.0.5/27500/Mon Jan  1 09:00:00 2024".
+func (c *clamdBackend) version() (engine, db string, date time.Time, err error) {
+	reply, err := c.command("VERSION", nil)
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+	parts := strings.SplitN(reply, "/", 3)
+	if len(parts) == 3 {
+		date, _ = time.Parse(time.ANSIC, parts[2])
+		return parts[0], parts[1], date, nil
+	}
+	return reply, "", time.Time{}, nil
+}
+
+// icapBackend sends the contents to an ICAP service as the body of an HTTP
+// response with RESPMOD, as web proxies do.  The service answers 204 for
+// clean contents, and otherwise names the threat in a header.
+type icapBackend struct {
+	url     *url.URL
+	timeout time.Duration
+}
+
+func newICAPBackend(raw string, timeout time.Duration) (*icapBackend, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "icap" {
+		return nil, fmt.Errorf("ICAP_URL must start with icap://: %q", raw)
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), "1344")
+	}
+	return &icapBackend{url: u, timeout: timeout}, nil
+}
+
+// request makes an ICAP request, with an encapsulated body when given, and
+// returns the status and headers of the reply.
+func (c *icapBackend) request(method string, name string, body io.Reader) (int, textproto.MIMEHeader, error) {
+	conn, err := net.DialTimeout("tcp", c.url.Host, 10*time.Second)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(c.timeout))
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "%s %s ICAP/1.0\r\nHost: %s\r\nUser-Agent: bucket-archiver/%s\r\n", method, c.url, c.url.Host, version)
+	if body == nil {
+		w.WriteString("Encapsulated: null-body=0\r\n\r\n")
+	} else {
+		req := fmt.Sprintf("GET /%s HTTP/1.1\r\nHost: %s\r\n\r\n", url.PathEscape(name), srcBucket)
+		res := "HTTP/1.1 200 OK\r\nContent-Type: application/octet-stream\r\nTransfer-Encoding: chunked\r\n\r\n"
+		fmt.Fprintf(w, "Allow: 204\r\nEncapsulated: req-hdr=0, res-hdr=%d, res-body=%d\r\n\r\n%s%s", len(req), len(req)+len(res), req, res)
+		buf := make([]byte, 64<<10)
+		for {
+			n, err := io.ReadFull(body, buf)
+			if n > 0 {
+				fmt.Fprintf(w, "%x\r\n", n)
+				w.Write(buf[:n])
+				if _, werr := w.WriteString("\r\n"); werr != nil {
+					return 0, nil, werr
+				}
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			} else if err != nil {
+				return 0, nil, err
+			}
+		}
+		w.WriteString("0\r\n\r\n")
+	}
+	if err := w.Flush(); err != nil {
+		return 0, nil, err
+	}
+	conn.SetDeadline(time.Now().Add(c.timeout))
+	tp := textproto.NewReader(bufio.NewReader(conn))
+	line, err := tp.ReadLine()
+	if err != nil {
+		return 0, nil, err
+	}
+	proto, status, _ := strings.Cut(line, " ")
+	code, err := strconv.Atoi(strings.Fields(status + " ")[0])
+	if err != nil || !strings.HasPrefix(proto, "ICAP/") {
+		return 0, nil, fmt.Errorf("malformed ICAP status line %q", line)
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		return 0, nil, err
+	}
+	return code, header, nil
+}
+
+func (c *icapBackend) scan(task *WorkFile) (string, error) {
+	r, err := contentsOf(task)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	code, header, err := c.request("RESPMOD", task.Filename, r)
+	if err != nil {
+		return "", fmt.Errorf("icap: %v", err)
+	}
+	switch {
+	case code == 204:
+		return "", nil
+	case code != 200:
+		return "", fmt.Errorf("icap: status %d", code)
+	}
+	if threat := icapThreat(header); threat != "" {
+		return threat, nil
+	}
+	// The contents were modified, or replaced by a block page, without saying why
+	return "", fmt.Errorf("icap: the service modified the contents without naming a threat")
+}
+
+// icapThreat returns the name of the threat reported by an ICAP service, in
+// the X-Infection-Found header of the draft standard or in the headers used
+// by the common implementations.
+func icapThreat(header textproto.MIMEHeader) string {
+	if found := header.Get("X-Infection-Found"); found != "" {
+		// Type=0; Resolution=2; Threat=Eicar-Test-Signature;
+		for _, field := range strings.Split(found, ";") {
+			if threat, ok := strings.CutPrefix(strings.TrimSpace(field), "Threat="); ok {
+				return threat
+			}
+		}
+		return found
+	}
+	for _, name := range []string{"X-Virus-Id", "X-Virus-Name"} {
+		if threat := header.Get(name); threat != "" {
+			return threat
+		}
+	}
+	if found := header.Get("X-Violations-Found"); found != "" {
+		// A count, then the filename, the threat name, and two ids per violation
+		if lines := strings.Fields(found); len(lines) > 2 {
+			return lines[2]
+		}
+		return found
+	}
+	return ""
+}
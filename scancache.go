@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	scanCacheFile = Env("SCAN_CACHE", "", "File caching scan verdicts by ETag, size and ClamAV database version, so unchanged contents are not scanned again")
+
+	scanCache struct {
+		sync.Mutex
+		verdicts map[string]string // Cache key to the virus found, empty if clean
+		f        *os.File
+	}
+	ScanCacheHits int64 // Objects whose verdict came from the cache
+)
+
+// ScanVerdict is a line of the SCAN_CACHE file.
+type ScanVerdict struct {
+	ETag  string `json:"etag"`
+	Size  int64  `json:"size"`
+	DB    string `json:"db"`              // ClamAV database version
+	Virus string `json:"virus,omitempty"` // Name of the virus found
+}
+
+func scanCacheKey(etag string, size int64) string {
+	return etag + "/" + strconv.FormatInt(size, 10)
+}
+
+// openScanCache loads the verdicts made with the loaded ClamAV database and
+// rewrites the file without those of other versions, which can no longer be
+// used.  It must be called once the database is loaded.
+func openScanCache() {
+	if scanCacheFile == "" {
+		return
+	}
+	db := virusScanMap["version"]
+	scanCache.verdicts = make(map[string]string)
+	var kept []ScanVerdict
+	if f, err := os.Open(scanCacheFile); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var v ScanVerdict
+			if json.Unmarshal(scanner.Bytes(), &v) != nil || v.DB != db {
+				continue
+			}
+			if _, ok := scanCache.verdicts[scanCacheKey(v.ETag, v.Size)]; !ok {
+				scanCache.verdicts[scanCacheKey(v.ETag, v.Size)] = v.Virus
+				kept = append(kept, v)
+			}
+		}
+		f.Close()
+	} else if !os.IsNotExist(err) {
+		log.Fatalf("failed to read SCAN_CACHE: %v", err)
+	}
+
+	tmp := scanCacheFile + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		log.Fatalf("failed to create SCAN_CACHE: %v", err)
+	}
+	buf := bufio.NewWriter(f)
+	for _, v := range kept {
+		dat, _ := json.Marshal(v)
+		buf.Write(dat)
+		buf.WriteByte('\n')
+	}
+	if err := buf.Flush(); err != nil {
+		log.Fatalf("failed to write SCAN_CACHE: %v", err)
+	}
+	f.Close()
+	if err := os.Rename(tmp, scanCacheFile); err != nil {
+		log.Fatalf("failed to replace SCAN_CACHE: %v", err)
+	}
+	if scanCache.f, err = os.OpenFile(scanCacheFile, os.O_APPEND|os.O_WRONLY, 0644); err != nil {
+		log.Fatalf("failed to open SCAN_CACHE: %v", err)
+	}
+	log.Printf("Loaded %d cached scan verdicts for ClamAV database %s", len(kept), db)
+}
+
+// resetScanCache forgets the verdicts made with definitions since replaced.
+// Those in the file are dropped when it is next opened.
+func resetScanCache() {
+	scanCache.Lock()
+	defer scanCache.Unlock()
+	if scanCache.verdicts != nil {
+		scanCache.verdicts = make(map[string]string)
+	}
+}
+
+// cachedVerdict returns the virus found when contents with the ETag and size
+// of task were last scanned with this database, and whether there was such a
+// scan.  Only ETags of the downloaded contents, which the download checks
+// against the listing, are looked up.
+func cachedVerdict(task *WorkFile) (string, bool) {
+	if scanCache.verdicts == nil || task.ETag == "" {
+		return "", false
+	}
+	scanCache.Lock()
+	virus, ok := scanCache.verdicts[scanCacheKey(task.ETag, task.Size)]
+	scanCache.Unlock()
+	if ok {
+		atomic.AddInt64(&ScanCacheHits, 1)
+	}
+	return virus, ok
+}
+
+// cacheVerdict records the outcome of a completed scan of task.
+func cacheVerdict(task *WorkFile, virus string) {
+	if scanCache.verdicts == nil || task.ETag == "" {
+		return
+	}
+	key := scanCacheKey(task.ETag, task.Size)
+	scanCache.Lock()
+	defer scanCache.Unlock()
+	if _, ok := scanCache.verdicts[key]; ok {
+		return
+	}
+	scanCache.verdicts[key] = virus
+	dat, _ := json.Marshal(ScanVerdict{ETag: task.ETag, Size: task.Size, DB: virusScanMap["version"], Virus: virus})
+	if _, err := scanCache.f.Write(append(dat, '\n')); err != nil {
+		log.Printf("failed to write SCAN_CACHE: %v", err)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+var (
+	scanPolicy  = Env("SCAN_POLICY", "all", "With several SCANNER_BACKEND engines: all to archive a file only if every engine passes it, any if one does")
+	yaraRules   = Env("YARA_RULES", "", "Rules file the yara engine of SCANNER_BACKEND matches files against, a match rejecting the file")
+	scanCommand = Env("SCAN_COMMAND", "", "Command of the command engine of SCANNER_BACKEND, run with the path of each file in place of {} or after it; exit 1 rejects the file, naming it on stdout")
+)
+
+// addScanEngine records an engine in the scan metadata.  With several, the
+// vendors and signature versions are joined, so the scan cache is keyed on
+// all of them, and the signature date is that of the first.
+func addScanEngine(vendor, version string, signatureDate time.Time) {
+	scanEngines.Lock()
+	defer scanEngines.Unlock()
+	join := func(key, value string) {
+		if old := virusScanMap[key]; old != "" {
+			value = old + "+" + value
+		}
+		virusScanMap[key] = value
+	}
+	join("vendor", vendor)
+	join("version", version)
+	if _, ok := virusScanMap["signature_date"]; !ok && !signatureDate.IsZero() {
+		virusScanMap["signature_date"] = signatureDate.Format(time.RFC3339)
+	}
+}
+
+// scanChain passes a file through each engine of SCANNER_BACKEND in turn.
+// With SCAN_POLICY=all a finding or failure of any engine rejects the file,
+// with any it is archived once one engine passes it.
+type scanChain struct {
+	names   []string
+	engines []scanBackend
+	anyPass bool
+}
+
+func newScanChain(names []string, engines []scanBackend) *scanChain {
+	switch scanPolicy {
+	case "all", "any":
+	default:
+		log.Fatalf("SCAN_POLICY must be all or any: %q", scanPolicy)
+	}
+	return &scanChain{names: names, engines: engines, anyPass: scanPolicy == "any"}
+}
+
+func (c *scanChain) scan(task *WorkFile) (string, error) {
+	var (
+		viruses []string
+		errs    []error
+	)
+	for i, engine := range c.engines {
+		virus, err := engine.scan(task)
+		switch {
+		case virus != "":
+			virus = fmt.Sprintf("%s (%s)", virus, c.names[i])
+			if !c.anyPass {
+				return virus, nil
+			}
+			viruses = append(viruses, virus)
+		case err != nil:
+			err = fmt.Errorf("%s: %w", c.names[i], err)
+			if !c.anyPass {
+				return "", err
+			}
+			errs = append(errs, err)
+		case c.anyPass:
+			return "", nil
+		}
+	}
+	if len(viruses) > 0 {
+		return strings.Join(viruses, ", "), nil
+	}
+	return "", errors.Join(errs...)
+}
+
+// scanPath gives an engine which reads files itself the path of the
+// contents of task: its temp file, or a plaintext copy of it or of the
+// contents held in memory, freed by the returned func.
+func scanPath(task *WorkFile) (string, func(), error) {
+	if task.TempFile != "" && !tempEncryption {
+		return task.TempFile, func() {}, nil
+	}
+	r, err := contentsOf(task)
+	if err != nil {
+		return "", nil, err
+	}
+	defer r.Close()
+	f, free, err := plainMemFile(r, task.Size)
+	if err != nil {
+		return "", nil, err
+	}
+	return memFilePath(f), free, nil
+}
+
+// yaraBackend matches files against YARA_RULES with the yara command, the
+// first rule matched naming the finding.
+type yaraBackend struct {
+	timeout time.Duration
+}
+
+func initYaraScan(timeout time.Duration) scanBackend {
+	if yaraRules == "" {
+		clamLog.Fatal("YARA_RULES must be set with the yara engine of SCANNER_BACKEND")
+	}
+	yaraRules = launchPath(yaraRules) // Read by every scan, after WORKDIR is entered
+	dat, err := os.ReadFile(yaraRules)
+	if err != nil {
+		clamLog.Fatalf("Cannot read YARA_RULES: %v", err)
+	}
+	out, err := exec.Command("yara", "--version").Output()
+	if err != nil {
+		clamLog.Fatalf("Cannot run yara: %v", err)
+	}
+	// The rules change what is found, so their digest keys the scan cache
+	sum := sha256.Sum256(dat)
+	clamLog.Printf("Matching with yara %s against %s", strings.TrimSpace(string(out)), yaraRules)
+	addScanEngine("YARA "+strings.TrimSpace(string(out)), hex.EncodeToString(sum[:6]), time.Time{})
+	return &yaraBackend{timeout: timeout}
+}
+
+func (y *yaraBackend) scan(task *WorkFile) (string, error) {
+	path, done, err := scanPath(task)
+	if err != nil {
+		return "", err
+	}
+	defer done()
+	ctx, cancel := context.WithTimeout(context.Background(), y.timeout)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "yara", "--no-warnings", yaraRules, path)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("yara: %v %s", err, strings.TrimSpace(stderr.String()))
+	}
+	// A line of "<rule> <path>" for each rule matched
+	if rule, _, ok := strings.Cut(string(out), " "); ok {
+		return rule, nil
+	}
+	return "", nil
+}
+
+// commandBackend runs SCAN_COMMAND on each file, taking its exit status as
+// clamscan does: 0 passes the file, 1 rejects it, and anything else is an
+// error.
+type commandBackend struct {
+	args    []string
+	timeout time.Duration
+}
+
+func initCommandScan(timeout time.Duration) scanBackend {
+	args := strings.Fields(scanCommand)
+	if len(args) == 0 {
+		clamLog.Fatal("SCAN_COMMAND must be set with the command engine of SCANNER_BACKEND")
+	}
+	if _, err := exec.LookPath(args[0]); err != nil {
+		clamLog.Fatalf("Cannot run SCAN_COMMAND: %v", err)
+	}
+	clamLog.Printf("Scanning with %s", scanCommand)
+	addScanEngine(args[0], "", time.Time{})
+	return &commandBackend{args: args, timeout: timeout}
+}
+
+func (c *commandBackend) scan(task *WorkFile) (string, error) {
+	path, done, err := scanPath(task)
+	if err != nil {
+		return "", err
+	}
+	defer done()
+	args, placed := make([]string, len(c.args)), false
+	for i, arg := range c.args {
+		if strings.Contains(arg, "{}") {
+			arg, placed = strings.ReplaceAll(arg, "{}", path), true
+		}
+		args[i] = arg
+	}
+	if !placed {
+		args = append(args, path)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Dir = launchDir // A relative SCAN_COMMAND is found where the run started
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	var exit *exec.ExitError
+	switch {
+	case err == nil:
+		return "", nil
+	case errors.As(err, &exit) && exit.ExitCode() == 1:
+		// The last line is taken, as the name usually comes after any progress
+		lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+		return cmp.Or(strings.TrimSpace(lines[len(lines)-1]), "found by "+c.args[0]), nil
+	}
+	return "", fmt.Errorf("%s: %v %s", c.args[0], err, strings.TrimSpace(stderr.String()))
+}
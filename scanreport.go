@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+)
+
+var scanReportSidecar = Env("DISABLE_SCAN_REPORT", "", "Disable the .scan-report.jsonl file of per-object scan results uploaded with each archive") == ""
+
+// ScanReport is the scan of an object: the engines and signatures which
+// scanned it, their verdict and when.  It is recorded in the manifest entry
+// and in the .scan-report.jsonl of the archive, as the metadata set on the
+// archive only describes the engines of the run.
+type ScanReport struct {
+	Engine     string    `json:"engine"`               // Vendor of the SCANNER_BACKEND engines
+	DBVersion  string    `json:"db_version,omitempty"` // Version of their signatures
+	Verdict    string    `json:"verdict"`              // clean, empty, virus, error or skipped
+	Virus      string    `json:"virus,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	SkipReason string    `json:"skip_reason,omitempty"` // Why it was not scanned, with SCAN_EXCLUDE or SCAN_MAX_SIZE
+	Cached     bool      `json:"cached,omitempty"`      // The verdict of an earlier scan of the contents, with SCAN_CACHE
+	ScannedAt  time.Time `json:"scanned_at"`
+	Duration   float64   `json:"duration_seconds"`
+}
+
+// scanReportLine is a line of the .scan-report.jsonl of an archive.
+type scanReportLine struct {
+	Key  string `json:"key"`
+	Name string `json:"name"`
+	*ScanReport
+}
+
+// setScanResult records the verdict of the scan of task, begun at start,
+// with virus or err its outcome.
+func setScanResult(task *WorkFile, verdict, virus string, err error, cached bool, start time.Time) {
+	task.ScanResult = verdict
+	switch {
+	case virus != "":
+		task.ScanResult = "virus: " + virus
+	case err != nil:
+		task.ScanResult = "error: " + err.Error()
+	}
+	task.ScanReport = &ScanReport{
+		Engine:    virusScanMap["vendor"],
+		DBVersion: virusScanMap["version"],
+		Verdict:   verdict,
+		Virus:     virus,
+		Cached:    cached,
+		ScannedAt: start.UTC(),
+		Duration:  time.Since(start).Seconds(),
+	}
+	if err != nil {
+		task.ScanReport.Error = err.Error()
+	}
+}
+
+// WriteScanReport writes a <archive>.scan-report.jsonl file with the scan
+// of each object of the closed archive.
+func WriteScanReport(tgzFile string) []string {
+	if !scanReportSidecar || !scanningEnabled {
+		return nil
+	}
+	reportFile := tgzFile + ".scan-report.jsonl"
+	f, err := os.Create(reportFile)
+	if err != nil {
+		log.Fatalf("failed to create scan report: %v", err)
+	}
+	buf := bufio.NewWriter(f)
+	for _, entry := range archiveManifest {
+		if entry.ScanReport == nil {
+			continue // A tombstone, or an object archived unscanned
+		}
+		dat, _ := json.Marshal(scanReportLine{Key: entry.Key, Name: entry.Name, ScanReport: entry.ScanReport})
+		buf.Write(append(dat, '\n'))
+	}
+	if err := buf.Flush(); err != nil {
+		log.Fatalf("failed to write scan report: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatalf("failed to close scan report: %v", err)
+	}
+	return []string{reportFile}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"sync/atomic"
+)
+
+var (
+	scanExclude      = Env("SCAN_EXCLUDE", "", "Comma separated globs of objects archived without scanning, matched on the key, or on the base name for a glob without a slash")
+	scanExcludeTypes = Env("SCAN_EXCLUDE_TYPES", "", "Comma separated content types, or type/* for all of a kind, archived without scanning, with RECORD_ATTRIBUTES or ENRICH")
+	scanMaxSize      = Env("SCAN_MAX_SIZE", "", "Objects larger than this, such as 10G, are archived without scanning")
+
+	scanMaxBytes int64
+	SkippedScans int64 // Objects archived without scanning
+)
+
+func initScanSkip() {
+	for _, glob := range strings.Split(scanExclude, ",") {
+		if _, err := path.Match(glob, ""); err != nil {
+			log.Fatalf("invalid SCAN_EXCLUDE glob %q: %v", glob, err)
+		}
+	}
+	if scanExcludeTypes != "" && !recordAttributes && !enrichObjects {
+		log.Fatal("SCAN_EXCLUDE_TYPES needs the content types recorded with RECORD_ATTRIBUTES or ENRICH")
+	}
+	if scanMaxSize != "" {
+		var err error
+		if scanMaxBytes, err = parseByteSize(scanMaxSize); err != nil || scanMaxBytes <= 0 {
+			log.Fatalf("invalid SCAN_MAX_SIZE %q", scanMaxSize)
+		}
+	}
+}
+
+// scanSkipReason returns why task is archived without being scanned, or ""
+// if it is scanned.
+func scanSkipReason(task *WorkFile) string {
+	if scanMaxBytes > 0 && task.Size > scanMaxBytes {
+		return "larger than SCAN_MAX_SIZE " + scanMaxSize
+	}
+	if tempScanBytes > 0 && task.TempFile != "" && task.Size > tempScanBytes {
+		// Its plaintext copy would not fit in memory
+		return "larger than TEMP_SCAN_MEMORY " + tempScanMemory
+	}
+	if scanExclude != "" {
+		for _, glob := range strings.Split(scanExclude, ",") {
+			name := task.Filename
+			if !strings.Contains(glob, "/") {
+				name = path.Base(name)
+			}
+			if matched, _ := path.Match(glob, name); matched {
+				return "matches SCAN_EXCLUDE " + glob
+			}
+		}
+	}
+	if scanExcludeTypes != "" && task.Attrs != nil && task.Attrs.ContentType != "" {
+		contentType, _, _ := strings.Cut(strings.ToLower(task.Attrs.ContentType), ";")
+		contentType = strings.TrimSpace(contentType)
+		for _, excluded := range strings.Split(strings.ToLower(scanExcludeTypes), ",") {
+			if prefix, ok := strings.CutSuffix(excluded, "*"); (ok && strings.HasPrefix(contentType, prefix)) || contentType == excluded {
+				return fmt.Sprintf("content type %s in SCAN_EXCLUDE_TYPES", contentType)
+			}
+		}
+	}
+	return ""
+}
+
+// skipScan records that task is archived unscanned, and why.
+func skipScan(task *WorkFile, reason string) {
+	atomic.AddInt64(&SkippedScans, 1)
+	task.ScanResult = "skipped: " + reason
+	if task.ScanReport != nil {
+		task.ScanReport.SkipReason = reason
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const modeServe = "serve"
+
+var (
+	serveAddr    = Env("SERVE_ADDR", ":8080", "Address the catalog API listens on in serve mode")
+	serveRefresh = EnvInt("SERVE_REFRESH", 300, "Seconds between reloads of the catalog from DST_BUCKET in serve mode")
+	servePrefix  = Env("SERVE_PREFIX", "", "Prefix in DST_BUCKET of the archives and run summaries served in serve mode")
+
+	catalog struct {
+		sync.RWMutex
+		archives map[string]*catalogArchive
+		keys     map[string][]catalogHit // Object key to the archive entries holding it
+		runs     map[string]json.RawMessage
+		loaded   time.Time
+	}
+)
+
+// catalogArchive is an archive in DST_BUCKET with its info and manifest.
+type catalogArchive struct {
+	Name    string           `json:"name"`
+	Size    int64            `json:"size"`
+	Objects int              `json:"objects"`
+	Info    json.RawMessage  `json:"info,omitempty"`
+	Entries []*ManifestEntry `json:"entries,omitempty"`
+}
+
+// catalogHit is an archive entry holding an object.
+type catalogHit struct {
+	Archive string         `json:"archive"`
+	Entry   *ManifestEntry `json:"entry"`
+}
+
+// RunServe serves a read-only HTTP API over the archives, manifests and run
+// summaries in DST_BUCKET, reloaded every SERVE_REFRESH seconds.  Archives
+// and summaries are only fetched once, as they are never changed after
+// upload; those removed from the bucket, such as by repacking, are dropped.
+func RunServe(ctx context.Context) {
+	catalog.archives = make(map[string]*catalogArchive)
+	catalog.runs = make(map[string]json.RawMessage)
+	loadCatalog(ctx)
+	go func() {
+		for range time.Tick(time.Duration(max(serveRefresh, 10)) * time.Second) {
+			loadCatalog(ctx)
+		}
+	}()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /keys", serveKeys)
+	mux.HandleFunc("GET /keys/{key...}", serveKey)
+	mux.HandleFunc("GET /archives", serveArchives)
+	mux.HandleFunc("GET /archives/{name...}", serveArchive)
+	mux.HandleFunc("GET /runs", serveRuns)
+	mux.HandleFunc("GET /runs/{name}", serveRun)
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		catalog.RLock()
+		defer catalog.RUnlock()
+		writeJSON(w, map[string]any{"archives": len(catalog.archives), "keys": len(catalog.keys),
+			"runs": len(catalog.runs), "loaded": catalog.loaded})
+	})
+	log.Println("Serving the catalog of", dstBucket, "on", serveAddr)
+	log.Fatal(http.ListenAndServe(serveAddr, mux))
+}
+
+// loadCatalog lists DST_BUCKET and fetches the manifests, info files and run
+// summaries not yet loaded.
+func loadCatalog(ctx context.Context) {
+	s3Ready.Wait() // Wait for the S3 client to be ready
+	objects := make(map[string]int64)
+	var archives, runs []string
+	paginator := s3.NewListObjectsV2Paginator(s3client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(dstBucket),
+		Prefix: aws.String(servePrefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			log.Printf("Catalog: failed to list %s, keeping the last catalog: %v", dstBucket, err)
+			return
+		}
+		for _, obj := range page.Contents {
+			key := aws.ToString(obj.Key)
+			objects[key] = aws.ToInt64(obj.Size)
+			switch base := path.Base(key); {
+			case archiveExt(key) != "":
+				archives = append(archives, key)
+			case strings.Contains(base, "run_summary_") && strings.HasSuffix(base, ".json"):
+				runs = append(runs, key)
+			}
+		}
+	}
+
+	catalog.RLock()
+	var newArchives []string
+	for _, name := range archives {
+		if _, ok := catalog.archives[name]; !ok {
+			newArchives = append(newArchives, name)
+		}
+	}
+	var newRuns []string
+	for _, name := range runs {
+		if _, ok := catalog.runs[path.Base(name)]; !ok {
+			newRuns = append(newRuns, name)
+		}
+	}
+	catalog.RUnlock()
+
+	manifests := fetchManifests(ctx, newArchives, objects)
+	loaded := make(map[string]*catalogArchive, len(newArchives))
+	for _, name := range newArchives {
+		entries, ok := manifests[name]
+		if !ok {
+			continue // Tried again on the next refresh, as the manifest may not be uploaded yet
+		}
+		a := &catalogArchive{Name: name, Size: objects[name], Entries: entries, Objects: len(entries)}
+		if _, ok := objects[name+".info.json"]; ok {
+			if dat, err := getDestObject(ctx, name+".info.json"); err == nil && json.Valid(dat) {
+				a.Info = dat
+			}
+		}
+		loaded[name] = a
+	}
+	summaries := make(map[string]json.RawMessage, len(newRuns))
+	for _, name := range newRuns {
+		if dat, err := getDestObject(ctx, name); err == nil && json.Valid(dat) {
+			summaries[path.Base(name)] = dat
+		}
+	}
+
+	catalog.Lock()
+	defer catalog.Unlock()
+	for name := range catalog.archives {
+		if _, ok := objects[name]; !ok {
+			delete(catalog.archives, name)
+		}
+	}
+	for name, a := range loaded {
+		catalog.archives[name] = a
+	}
+	listedRuns := make(map[string]bool, len(runs))
+	for _, name := range runs {
+		listedRuns[path.Base(name)] = true
+	}
+	for name := range catalog.runs {
+		if !listedRuns[name] {
+			delete(catalog.runs, name)
+		}
+	}
+	for name, dat := range summaries {
+		catalog.runs[name] = dat
+	}
+	// The key index is rebuilt so entries of removed archives go with them
+	catalog.keys = make(map[string][]catalogHit)
+	for _, a := range catalog.archives {
+		for _, entry := range a.Entries {
+			catalog.keys[entry.Key] = append(catalog.keys[entry.Key], catalogHit{Archive: a.Name, Entry: entry})
+		}
+	}
+	for key, hits := range catalog.keys {
+		slices.SortFunc(hits, func(a, b catalogHit) int { return strings.Compare(a.Archive, b.Archive) })
+		catalog.keys[key] = hits
+	}
+	catalog.loaded = time.Now().UTC()
+	log.Printf("Catalog: %d archives, %d keys, %d run summaries", len(catalog.archives), len(catalog.keys), len(catalog.runs))
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// pageParams reads the prefix, after and limit query parameters used to
+// page through sorted names.
+func pageParams(r *http.Request) (prefix, after string, limit int) {
+	limit = 1000
+	if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && n > 0 {
+		limit = min(n, 10000)
+	}
+	return r.URL.Query().Get("prefix"), r.URL.Query().Get("after"), limit
+}
+
+// pageNames returns up to limit of the sorted names with the prefix, after
+// the given one.
+func pageNames(names []string, prefix, after string, limit int) []string {
+	slices.Sort(names)
+	var out []string
+	for _, name := range names {
+		if strings.HasPrefix(name, prefix) && name > after {
+			if out = append(out, name); len(out) == limit {
+				break
+			}
+		}
+	}
+	return out
+}
+
+// serveKeys lists the archived keys, by prefix.
+func serveKeys(w http.ResponseWriter, r *http.Request) {
+	prefix, after, limit := pageParams(r)
+	catalog.RLock()
+	names := make([]string, 0, len(catalog.keys))
+	for key := range catalog.keys {
+		names = append(names, key)
+	}
+	catalog.RUnlock()
+	writeJSON(w, map[string]any{"keys": pageNames(names, prefix, after, limit)})
+}
+
+// serveKey looks up the archives holding a key.
+func serveKey(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	catalog.RLock()
+	hits := catalog.keys[key]
+	catalog.RUnlock()
+	if len(hits) == 0 {
+		http.Error(w, "key not found in any archive", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, map[string]any{"key": key, "archives": hits})
+}
+
+// serveArchives lists the archives, with their info but not their entries.
+func serveArchives(w http.ResponseWriter, r *http.Request) {
+	prefix, after, limit := pageParams(r)
+	catalog.RLock()
+	defer catalog.RUnlock()
+	names := make([]string, 0, len(catalog.archives))
+	for name := range catalog.archives {
+		names = append(names, name)
+	}
+	list := []catalogArchive{}
+	for _, name := range pageNames(names, prefix, after, limit) {
+		a := *catalog.archives[name]
+		a.Entries = nil
+		list = append(list, a)
+	}
+	writeJSON(w, map[string]any{"archives": list})
+}
+
+// serveArchive returns an archive with its manifest entries.
+func serveArchive(w http.ResponseWriter, r *http.Request) {
+	catalog.RLock()
+	defer catalog.RUnlock()
+	a, ok := catalog.archives[r.PathValue("name")]
+	if !ok {
+		http.Error(w, "archive not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, a)
+}
+
+// serveRuns lists the run summaries.
+func serveRuns(w http.ResponseWriter, r *http.Request) {
+	prefix, after, limit := pageParams(r)
+	catalog.RLock()
+	defer catalog.RUnlock()
+	names := make([]string, 0, len(catalog.runs))
+	for name := range catalog.runs {
+		names = append(names, name)
+	}
+	list := []json.RawMessage{}
+	for _, name := range pageNames(names, prefix, after, limit) {
+		list = append(list, catalog.runs[name])
+	}
+	writeJSON(w, map[string]any{"runs": list})
+}
+
+// serveRun returns a run summary by its file name.
+func serveRun(w http.ResponseWriter, r *http.Request) {
+	catalog.RLock()
+	defer catalog.RUnlock()
+	dat, ok := catalog.runs[r.PathValue("name")]
+	if !ok {
+		http.Error(w, "run summary not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(dat)
+}
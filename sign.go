@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+var (
+	signingKey       = Env("SIGNING_KEY", "", "Sign manifests and the run summary with kms:<key-id> or a PEM private key file")
+	signingAlgorithm = Env("SIGNING_ALGORITHM", "ECDSA_SHA_256", "KMS signing algorithm for a kms: SIGNING_KEY")
+
+	localSigner crypto.Signer
+	kmsKeyID    string
+)
+
+func initSigning() {
+	if signingKey == "" {
+		return
+	}
+	if id, ok := strings.CutPrefix(signingKey, "kms:"); ok {
+		kmsKeyID = id
+		return
+	}
+	dat, err := os.ReadFile(signingKey)
+	if err != nil {
+		log.Fatalf("failed to read signing key: %v", err)
+	}
+	block, _ := pem.Decode(dat)
+	if block == nil {
+		log.Fatalf("signing key %s is not PEM encoded", signingKey)
+	}
+	var key any
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		log.Fatalf("failed to parse signing key: %v", err)
+	}
+	var ok bool
+	if localSigner, ok = key.(crypto.Signer); !ok {
+		log.Fatalf("unsupported signing key type %T", key)
+	}
+}
+
+// signFiles writes a detached <file>.sig signature for each file and returns
+// their names.  ECDSA and RSA (PKCS #1 v1.5) signatures are over the SHA-256
+// of the file, so they can be checked with "openssl dgst -sha256 -verify".
+func signFiles(files []string) []string {
+	if signingKey == "" {
+		return nil
+	}
+	var sigs []string
+	for _, file := range files {
+		dat, err := os.ReadFile(file)
+		if err != nil {
+			log.Fatalf("failed to read %s for signing: %v", file, err)
+		}
+		sig, err := signData(dat)
+		if err != nil {
+			log.Fatalf("failed to sign %s: %v", file, err)
+		}
+		sigFile := file + ".sig"
+		if err := os.WriteFile(sigFile, sig, 0644); err != nil {
+			log.Fatalf("failed to write signature file: %v", err)
+		}
+		sigs = append(sigs, sigFile)
+	}
+	return sigs
+}
+
+func signData(dat []byte) ([]byte, error) {
+	digest := sha256.Sum256(dat)
+	if kmsKeyID != "" {
+		var out struct {
+			Signature []byte
+		}
+		err := awsJSONCall(context.Background(), "kms", "1.1", "TrentService.Sign", map[string]any{
+			"KeyId":            kmsKeyID,
+			"Message":          digest[:],
+			"MessageType":      "DIGEST",
+			"SigningAlgorithm": signingAlgorithm,
+		}, &out)
+		return out.Signature, err
+	}
+	switch localSigner.(type) {
+	case ed25519.PrivateKey:
+		// Ed25519 signs the message itself
+		return localSigner.Sign(rand.Reader, dat, crypto.Hash(0))
+	default:
+		sig, err := localSigner.Sign(rand.Reader, digest[:], crypto.SHA256)
+		if err != nil {
+			return nil, fmt.Errorf("%T: %w", localSigner, err)
+		}
+		return sig, nil
+	}
+}
+
+// verifySignature checks a detached signature made by signFiles against
+// VERIFY_KEY.
+func verifySignature(file, sigFile string) error {
+	dat, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	sig, err := os.ReadFile(sigFile)
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256(dat)
+
+	if id, ok := strings.CutPrefix(verifyKey, "kms:"); ok {
+		var out struct {
+			SignatureValid bool
+		}
+		err := awsJSONCall(context.Background(), "kms", "1.1", "TrentService.Verify", map[string]any{
+			"KeyId":            id,
+			"Message":          digest[:],
+			"MessageType":      "DIGEST",
+			"Signature":        sig,
+			"SigningAlgorithm": signingAlgorithm,
+		}, &out)
+		if err != nil {
+			return err
+		}
+		if !out.SignatureValid {
+			return fmt.Errorf("signature is not valid")
+		}
+		return nil
+	}
+
+	keyDat, err := os.ReadFile(verifyKey)
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(keyDat)
+	if block == nil {
+		return fmt.Errorf("verify key %s is not PEM encoded", verifyKey)
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+	var valid bool
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		valid = ecdsa.VerifyASN1(pub, digest[:], sig)
+	case *rsa.PublicKey:
+		valid = rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) == nil
+	case ed25519.PublicKey:
+		valid = ed25519.Verify(pub, dat, sig)
+	default:
+		return fmt.Errorf("unsupported verify key type %T", pub)
+	}
+	if !valid {
+		return fmt.Errorf("signature is not valid")
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	simulateSpec = Env("SIMULATE", "", "Run the pipeline against generated objects instead of S3, as COUNT,SIZES where SIZES is fixed:SIZE, uniform:MIN-MAX, log:MIN-MAX or metadata:FILE")
+	simulateDir  = Env("SIMULATE_DIR", "simulated", "Directory a simulation runs in, holding its listing, logs and archives")
+
+	simulating     bool
+	simulateCount  int
+	simulateSizes  func(*rand.Rand) int64
+	SimulatedBytes int64 // Bytes of generated source objects
+)
+
+// initSimulate sets up a rehearsal of a run.  The source bucket is replaced
+// by an in-memory store filled with generated objects and the archives are
+// kept in SIMULATE_DIR instead of being uploaded, so nothing touches AWS.
+func initSimulate() {
+	if simulateSpec == "" {
+		return
+	}
+	count, sizes, ok := strings.Cut(simulateSpec, ",")
+	if !ok {
+		sizes = "log:1K-16M"
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(count))
+	if err != nil || n < 1 {
+		log.Fatalf("invalid SIMULATE object count %q", count)
+	}
+	simulateCount = n
+	simulateSizes, err = parseSizeDist(strings.TrimSpace(sizes))
+	if err != nil {
+		log.Fatalf("invalid SIMULATE sizes %q: %v", sizes, err)
+	}
+
+	switch {
+	case workMode != "":
+		log.Fatal("SIMULATE cannot be used with MODE")
+	case objectStoreKind != "" || awsEndpointURL != "" || objectStoreSeed != "":
+		log.Fatal("SIMULATE replaces the object store and cannot be used with OBJECT_STORE or AWS_ENDPOINT_URL")
+	case exportDir != "" || archiveStdout:
+		log.Fatal("SIMULATE keeps archives in SIMULATE_DIR and cannot be used with EXPORT_DIR or ARCHIVE_STDOUT")
+	case workList != "":
+		log.Fatal("SIMULATE generates its own objects and cannot be used with WORK_LIST")
+	}
+	simulating = true
+	objectStoreKind = "memory"
+}
+
+// enterSimulateDir moves into SIMULATE_DIR once the configuration files, such
+// as the ClamAV definitions, have been read, so that everything the run leaves
+// behind, the listing, logs and archives, is kept apart from real runs.
+func enterSimulateDir() {
+	if !simulating {
+		return
+	}
+	if err := os.MkdirAll(simulateDir, 0755); err != nil {
+		log.Fatalf("failed to create SIMULATE_DIR: %v", err)
+	}
+	if err := os.Chdir(simulateDir); err != nil {
+		log.Fatalf("failed to enter SIMULATE_DIR: %v", err)
+	}
+}
+
+// parseSizeDist parses a SIMULATE size distribution into a generator of
+// object sizes.
+func parseSizeDist(spec string) (func(*rand.Rand) int64, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	parseRange := func() (int64, int64, error) {
+		lo, hi, ok := strings.Cut(arg, "-")
+		if !ok {
+			return 0, 0, fmt.Errorf("expected MIN-MAX, got %q", arg)
+		}
+		from, err := parseByteSize(lo)
+		if err != nil {
+			return 0, 0, err
+		}
+		to, err := parseByteSize(hi)
+		if err != nil {
+			return 0, 0, err
+		}
+		if from > to {
+			return 0, 0, fmt.Errorf("minimum %s is above maximum %s", lo, hi)
+		}
+		return from, to, nil
+	}
+	switch kind {
+	case "fixed":
+		size, err := parseByteSize(arg)
+		if err != nil {
+			return nil, err
+		}
+		return func(*rand.Rand) int64 { return size }, nil
+	case "uniform":
+		lo, hi, err := parseRange()
+		if err != nil {
+			return nil, err
+		}
+		return func(rng *rand.Rand) int64 { return lo + rng.Int64N(hi-lo+1) }, nil
+	case "log":
+		lo, hi, err := parseRange()
+		if err != nil {
+			return nil, err
+		}
+		return logUniformSizes(max(lo, 1), hi), nil
+	case "metadata":
+		// Mimic a real bucket from a copy of its listing
+		sizes, count := histogramSizes(arg)
+		if count == 0 {
+			return nil, fmt.Errorf("no objects in %s", arg)
+		}
+		return sizes, nil
+	}
+	return nil, fmt.Errorf("unknown distribution %q, expected fixed, uniform, log or metadata", kind)
+}
+
+// simulateObjects fills the source bucket of store with the generated
+// objects.  They are windows onto one buffer of synthetic data, so memory use
+// is bounded by the largest object rather than the total.
+func simulateObjects(store *memStore) {
+	rng := rand.New(rand.NewPCG(1, 2)) // Identical objects on every run
+	sizes := make([]int64, simulateCount)
+	var largest int64
+	for i := range sizes {
+		sizes[i] = simulateSizes(rng)
+		largest = max(largest, sizes[i])
+	}
+	// Slack past the largest object keeps objects of one size from being
+	// identical windows
+	data := syntheticData(rng, largest+16<<20)
+
+	modified := time.Now().UTC().Truncate(time.Second)
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	for i, size := range sizes {
+		offset := rng.Int64N(int64(len(data)) - size + 1)
+		body := data[offset : offset+size : offset+size]
+		store.put(srcBucket, fmt.Sprintf("sim/%04d/%08d.dat", i/1000, i), &memObject{
+			data:         body,
+			contentType:  "application/octet-stream",
+			lastModified: modified.Add(-time.Duration(i) * time.Minute),
+			etag:         memETag(body),
+		})
+		SimulatedBytes += size
+	}
+	log.Printf("Simulation: generated %d objects, %s in total, the largest %s",
+		simulateCount, humanizeBytes(SimulatedBytes), humanizeBytes(largest))
+}
+
+// simulateReport prints the figures needed to size a real run.
+func simulateReport() {
+	var archiveBytes int64
+	for _, name := range uploadedArchives {
+		if info, err := os.Stat(name); err == nil {
+			archiveBytes += info.Size()
+		}
+	}
+	ratio := 0.0
+	if SimulatedBytes > 0 {
+		ratio = float64(archiveBytes) / float64(SimulatedBytes)
+	}
+	fmt.Printf("Simulation of %d objects (%s) finished in %s\n", simulateCount, humanizeBytes(SimulatedBytes), time.Since(runStarted).Round(time.Second))
+	fmt.Printf("  Archives:   %d, %s in %s (%.2f of the source size)\n", len(uploadedArchives), humanizeBytes(archiveBytes), simulateDir, ratio)
+	fmt.Printf("  Peak temp:  %s of local disk for temp files and pending archives\n", humanizeBytes(atomic.LoadInt64(&PeakTempBytes)))
+	fmt.Printf("  Failed:     %d objects, see %s\n", atomic.LoadInt64(&ErroredFiles), errorLogName)
+}
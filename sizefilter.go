@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	minObjectSize      = Env("MIN_OBJECT_SIZE", "", "Objects smaller than this, such as 1B for empty folder markers, are not archived")
+	maxObjectSize      = Env("MAX_OBJECT_SIZE", "", "Objects larger than this, such as 1T, are not archived")
+	skippedObjectsName = Env("SKIPPED_OBJECTS", "skipped.jsonl", "Objects left out by MIN_OBJECT_SIZE or MAX_OBJECT_SIZE, one JSON MetaEntry with the reason per line")
+
+	minObjectBytes, maxObjectBytes int64
+	sizeFilterActive               bool
+
+	SkippedObjects int64 // Objects left out by their size
+
+	skipped struct {
+		sync.Mutex
+		f   *os.File
+		buf *bufio.Writer
+	}
+)
+
+// SkippedObject is a line of the skipped objects file.
+type SkippedObject struct {
+	MetaEntry
+	Reason string `json:"reason"`
+}
+
+func initSizeFilter() {
+	var err error
+	if minObjectSize != "" {
+		if minObjectBytes, err = parseByteSize(minObjectSize); err != nil || minObjectBytes < 0 {
+			log.Fatalf("invalid MIN_OBJECT_SIZE %q", minObjectSize)
+		}
+	}
+	if maxObjectSize != "" {
+		if maxObjectBytes, err = parseByteSize(maxObjectSize); err != nil || maxObjectBytes <= 0 {
+			log.Fatalf("invalid MAX_OBJECT_SIZE %q", maxObjectSize)
+		}
+	}
+	if maxObjectBytes > 0 && minObjectBytes > maxObjectBytes {
+		log.Fatalf("MIN_OBJECT_SIZE %s is above MAX_OBJECT_SIZE %s", minObjectSize, maxObjectSize)
+	}
+	sizeFilterActive = minObjectBytes > 0 || maxObjectBytes > 0
+	if sizeFilterActive && (workList != "" || urlList != "") {
+		log.Fatal("MIN_OBJECT_SIZE and MAX_OBJECT_SIZE filter the listing, and cannot be used with WORK_LIST or URL_LIST")
+	}
+}
+
+// objectSizeReason returns why an object is left out for its size, or "".
+// Tombstones of delete markers have no size and are kept.
+func objectSizeReason(entry MetaEntry) string {
+	switch {
+	case !sizeFilterActive || entry.DeleteMarker:
+		return ""
+	case entry.Size < minObjectBytes:
+		return "smaller than MIN_OBJECT_SIZE " + minObjectSize
+	case maxObjectBytes > 0 && entry.Size > maxObjectBytes:
+		return "larger than MAX_OBJECT_SIZE " + maxObjectSize
+	}
+	return ""
+}
+
+// recordSkipped adds an object left out of the run to the skipped objects
+// file if its size is the reason.  The file is appended to, so a run
+// resumed from its checkpoint adds to the objects the first attempt found.
+func recordSkipped(entry MetaEntry) {
+	reason := objectSizeReason(entry)
+	if reason == "" {
+		return
+	}
+	atomic.AddInt64(&SkippedObjects, 1)
+	skipped.Lock()
+	defer skipped.Unlock()
+	if skipped.f == nil {
+		f, err := os.OpenFile(skippedObjectsName, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Fatalf("failed to open %s: %v", skippedObjectsName, err)
+		}
+		skipped.f, skipped.buf = f, bufio.NewWriter(f)
+	}
+	dat, _ := json.Marshal(SkippedObject{MetaEntry: entry, Reason: reason})
+	skipped.buf.Write(append(dat, '\n'))
+}
+
+// closeSkipped writes out the skipped objects file at the end of the run.
+func closeSkipped() {
+	skipped.Lock()
+	defer skipped.Unlock()
+	if skipped.f == nil {
+		return
+	}
+	if err := skipped.buf.Flush(); err != nil {
+		log.Printf("failed to write %s: %v", skippedObjectsName, err)
+	}
+	skipped.f.Close()
+	skipped.f = nil
+	log.Printf("%d objects were left out for their size, they are listed in %s", atomic.LoadInt64(&SkippedObjects), skippedObjectsName)
+}
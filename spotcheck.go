@@ -0,0 +1,286 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	spotChecks = EnvInt("SPOT_CHECKS", 0, "Objects sampled after the run, extracted from their uploaded archives and compared with the source (0 to disable)")
+
+	spotSample struct {
+		sync.Mutex
+		seen    int              // Entries offered to the sample
+		entries []spotCheckEntry // Reservoir of SPOT_CHECKS entries
+	}
+	spotDeletes []*ArchiveFile   // Archives whose sources are deleted once the checks pass
+	spotResult  *SpotCheckResult // Outcome of the checks, for the run summary
+)
+
+// spotCheckEntry is an archived object picked for a spot check.
+type spotCheckEntry struct {
+	Archive string // Archive holding the contents, which a deduplicated entry refers to
+	Name    string // Tar entry of the contents
+	Entry   *ManifestEntry
+}
+
+// SpotCheckResult is the outcome of the spot checks in the run summary.
+type SpotCheckResult struct {
+	Sampled    int      `json:"sampled"`
+	Matched    int      `json:"matched"`
+	Mismatched []string `json:"mismatched,omitempty"` // Keys whose archived contents differ from the source
+	Changed    []string `json:"changed,omitempty"`    // Keys modified or removed at the source since they were archived
+	Failed     []string `json:"failed,omitempty"`     // Keys which could not be checked, with the reason
+}
+
+func spotChecking() bool {
+	return spotChecks > 0 && !archiveStdout && exportDir == "" && !simulating && workMode != modeRepack
+}
+
+// sampleUploaded offers the entries of an uploaded archive to the sample,
+// keeping each entry of the run equally likely to be picked.
+func sampleUploaded(task *ArchiveFile) {
+	if !spotChecking() {
+		return
+	}
+	spotSample.Lock()
+	defer spotSample.Unlock()
+	for _, entry := range task.Manifest {
+		if transforms(entry.Key) {
+			continue // Rewritten on purpose, so not comparable with the source
+		}
+		if entry.Chunk != nil || entry.DeleteMarker {
+			continue // Only part of the source object, or none of it
+		}
+		pick := spotCheckEntry{Archive: task.Filename, Name: entry.Name, Entry: entry}
+		if entry.Ref != nil {
+			pick.Archive, pick.Name = entry.Ref.Archive, entry.Ref.Name
+		}
+		spotSample.seen++
+		if len(spotSample.entries) < spotChecks {
+			spotSample.entries = append(spotSample.entries, pick)
+		} else if i := rand.IntN(spotSample.seen); i < spotChecks {
+			spotSample.entries[i] = pick
+		}
+	}
+}
+
+// deleteAfterSpotChecks holds back the deletion of the sources of an
+// uploaded archive until the spot checks have passed.
+func deleteAfterSpotChecks(ctx context.Context, task *ArchiveFile) {
+	if !deleteSource {
+		return
+	}
+	if !spotChecking() {
+		deleteArchived(ctx, task)
+		return
+	}
+	spotDeletes = append(spotDeletes, task)
+}
+
+// runSpotChecks extracts the sampled objects from their archives in
+// DST_BUCKET and compares their SHA-256 with the source objects.  With
+// DELETE_SOURCE, the sources are only deleted once every check passed.
+func runSpotChecks(ctx context.Context) {
+	if !spotChecking() {
+		return
+	}
+	spotSample.Lock()
+	defer spotSample.Unlock()
+	result := &SpotCheckResult{Sampled: len(spotSample.entries)}
+	spotResult = result
+	if result.Sampled == 0 {
+		return
+	}
+	log.Printf("Spot checking %d of %d archived objects", result.Sampled, spotSample.seen)
+
+	byArchive := make(map[string][]spotCheckEntry)
+	for _, pick := range spotSample.entries {
+		byArchive[pick.Archive] = append(byArchive[pick.Archive], pick)
+	}
+	for _, archive := range slices.Sorted(func(yield func(string) bool) {
+		for name := range byArchive {
+			if !yield(name) {
+				return
+			}
+		}
+	}) {
+		picks := byArchive[archive]
+		digests, err := archivedDigests(ctx, archive, picks)
+		if err != nil {
+			for _, pick := range picks {
+				result.Failed = append(result.Failed, fmt.Sprintf("%s: %v", pick.Entry.Key, err))
+			}
+			continue
+		}
+		for _, pick := range picks {
+			key := pick.Entry.Key
+			archived, ok := digests[pick.Name]
+			if !ok {
+				result.Failed = append(result.Failed, fmt.Sprintf("%s: entry %s not found in %s", key, pick.Name, archive))
+				continue
+			}
+			source, changed, err := sourceDigest(ctx, pick.Entry)
+			switch {
+			case err != nil:
+				result.Failed = append(result.Failed, fmt.Sprintf("%s: %v", key, err))
+			case changed:
+				result.Changed = append(result.Changed, key)
+			case source != archived:
+				log.Printf("Spot check: %s in %s has SHA-256 %s, the source %s", key, archive, archived, source)
+				result.Mismatched = append(result.Mismatched, key)
+			default:
+				result.Matched++
+			}
+		}
+	}
+	log.Printf("Spot checks: %d matched, %d mismatched, %d changed at the source, %d could not be checked",
+		result.Matched, len(result.Mismatched), len(result.Changed), len(result.Failed))
+	for _, failure := range result.Failed {
+		log.Printf("Spot check failed: %s", failure)
+	}
+
+	if len(spotDeletes) > 0 {
+		if len(result.Mismatched) > 0 || len(result.Failed) > 0 {
+			log.Printf("Keeping the sources of %d archives, as not every spot check passed", len(spotDeletes))
+		} else {
+			for _, task := range spotDeletes {
+				deleteArchived(ctx, withoutKeys(task, result.Changed))
+			}
+			log.Printf("Spot checks passed, deleted %d source objects", atomic.LoadInt64(&DeletedFiles))
+		}
+	}
+}
+
+// withoutKeys returns the archive with the given keys left out of its
+// manifest, so the sources of objects changed since archiving are kept.
+func withoutKeys(task *ArchiveFile, keys []string) *ArchiveFile {
+	if len(keys) == 0 {
+		return task
+	}
+	kept := *task
+	kept.Manifest = nil
+	for _, entry := range task.Manifest {
+		if !slices.Contains(keys, entry.Key) {
+			kept.Manifest = append(kept.Manifest, entry)
+		}
+	}
+	return &kept
+}
+
+// archivedDigests downloads an archive and returns the SHA-256 of the
+// contents of the picked entries, by entry name.  Entries compressed with
+// the trained zstd dictionary are decompressed first.
+func archivedDigests(ctx context.Context, archive string, picks []spotCheckEntry) (map[string]string, error) {
+	head, err := s3client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(dstBucket), Key: aws.String(archive)})
+	if err != nil {
+		return nil, fmt.Errorf("archive %s: %w", archive, err)
+	}
+	size := aws.ToInt64(head.ContentLength)
+	tempDisk.Reserve(size)
+	defer tempDisk.Release(size)
+	file, err := downloadObjectInParts(ctx, dstBucket, archive, "", size, downloadPartsFor(size))
+	if err != nil {
+		return nil, err
+	}
+	defer deleteTempFile(file)
+	fh, err := openTempFile(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	r, closeReader, err := decompressArchive(archive, bufio.NewReader(fh))
+	if err != nil {
+		return nil, err
+	}
+	defer closeReader()
+
+	wanted := make(map[string]bool, len(picks))
+	for _, pick := range picks {
+		wanted[pick.Name] = true
+	}
+	digests := make(map[string]string, len(picks))
+	var dictDecoder *zstd.Decoder
+	tr := tar.NewReader(r)
+	for len(digests) < len(wanted) {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		switch {
+		case hdr.Name == zstdDictName:
+			dict, err := io.ReadAll(tr)
+			if err != nil {
+				return nil, err
+			}
+			if dictDecoder, err = zstd.NewReader(nil, zstd.WithDecoderDicts(dict)); err != nil {
+				return nil, fmt.Errorf("failed to load zstd dictionary: %w", err)
+			}
+			defer dictDecoder.Close()
+		case !wanted[hdr.Name]:
+		case dictDecoder != nil && strings.HasSuffix(hdr.Name, ".zst"):
+			dat, err := io.ReadAll(tr)
+			if err != nil {
+				return nil, err
+			}
+			if dat, err = dictDecoder.DecodeAll(dat, nil); err != nil {
+				return nil, fmt.Errorf("failed to decompress %s: %w", hdr.Name, err)
+			}
+			sum := sha256.Sum256(dat)
+			digests[hdr.Name] = hex.EncodeToString(sum[:])
+		default:
+			h := sha256.New()
+			if _, err := io.Copy(h, tr); err != nil {
+				return nil, err
+			}
+			digests[hdr.Name] = hex.EncodeToString(h.Sum(nil))
+		}
+	}
+	return digests, nil
+}
+
+// sourceDigest returns the SHA-256 of the source object, or changed if it was
+// modified or removed since it was archived.
+func sourceDigest(ctx context.Context, entry *ManifestEntry) (string, bool, error) {
+	out, err := getSourceObject(ctx, &s3.GetObjectInput{Bucket: aws.String(srcBucket), Key: aws.String(entry.Key)})
+	if err != nil {
+		var noKey *types.NoSuchKey
+		if errors.As(err, &noKey) {
+			return "", true, nil
+		}
+		return "", false, err
+	}
+	defer out.Body.Close()
+	// The same tests as checkUnchanged, so a key counted as changed here is
+	// one DELETE_SOURCE keeps
+	if lm := aws.ToTime(out.LastModified); !entry.LastModified.IsZero() && !lm.Equal(entry.LastModified) {
+		return "", true, nil
+	}
+	if want := strings.Trim(entry.ETag, `"`); want != "" && strings.Trim(aws.ToString(out.ETag), `"`) != want {
+		return "", true, nil
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, out.Body); err != nil {
+		return "", false, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), false, nil
+}
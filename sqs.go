@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+)
+
+// The SQS SDK is not vendored, so the few calls needed by the work queue are
+// made directly against the SQS JSON protocol.
+
+type sqsMessage struct {
+	MessageId     string
+	ReceiptHandle string
+	Body          string
+}
+
+func sqsSendMessage(ctx context.Context, queueURL, body string) error {
+	return awsJSONCall(ctx, "sqs", "1.0", "AmazonSQS.SendMessage", map[string]any{
+		"QueueUrl":    queueURL,
+		"MessageBody": body,
+	}, nil)
+}
+
+// sqsReceiveMessages long polls the queue for up to max messages which are
+// then hidden from other consumers for visibility seconds.
+func sqsReceiveMessages(ctx context.Context, queueURL string, max, wait, visibility int) ([]sqsMessage, error) {
+	var out struct {
+		Messages []sqsMessage
+	}
+	err := awsJSONCall(ctx, "sqs", "1.0", "AmazonSQS.ReceiveMessage", map[string]any{
+		"QueueUrl":            queueURL,
+		"MaxNumberOfMessages": max,
+		"WaitTimeSeconds":     wait,
+		"VisibilityTimeout":   visibility,
+	}, &out)
+	return out.Messages, err
+}
+
+func sqsDeleteMessage(ctx context.Context, queueURL, receipt string) error {
+	return awsJSONCall(ctx, "sqs", "1.0", "AmazonSQS.DeleteMessage", map[string]any{
+		"QueueUrl":      queueURL,
+		"ReceiptHandle": receipt,
+	}, nil)
+}
+
+func sqsChangeVisibility(ctx context.Context, queueURL, receipt string, visibility int) error {
+	return awsJSONCall(ctx, "sqs", "1.0", "AmazonSQS.ChangeMessageVisibility", map[string]any{
+		"QueueUrl":          queueURL,
+		"ReceiptHandle":     receipt,
+		"VisibilityTimeout": visibility,
+	}, nil)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+var (
+	srcSSECKey     = EnvSecret("SRC_SSE_C_KEY", "Base64 256-bit customer-provided key the objects of SRC_BUCKET are encrypted with (SSE-C), or a file holding it")
+	dstSSE         = Env("DST_SSE", "", "Server-side encryption of the objects uploaded to DST_BUCKET: AES256, aws:kms or aws:kms:dsse, empty for the bucket default")
+	dstSSEKMSKeyID = Env("DST_SSE_KMS_KEY_ID", "", "KMS key ID or ARN the objects uploaded to DST_BUCKET are encrypted with, implying DST_SSE=aws:kms")
+	dstBucketKey   = Env("DST_SSE_BUCKET_KEY", "", "Use an S3 Bucket Key for the aws:kms uploads to DST_BUCKET, cutting the KMS requests made") != ""
+
+	sseCKey, sseCKeyMD5 string // Base64 SSE-C key of SRC_BUCKET and its MD5
+)
+
+// initSSE checks the encryption settings of the source and destination
+// buckets.  They are applied to the requests by sseStore.
+func initSSE() {
+	if srcSSECKey != "" {
+		if downloadURL != "" || urlList != "" {
+			log.Fatal("SRC_SSE_C_KEY cannot be used with DOWNLOAD_URL or URL_LIST, whose objects are not read from S3")
+		}
+		encoded := srcSSECKey
+		if dat, err := os.ReadFile(srcSSECKey); err == nil {
+			encoded = strings.TrimSpace(string(dat))
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			log.Fatal("SRC_SSE_C_KEY must be a base64 256-bit key, or a file holding one")
+		}
+		sum := md5.Sum(key)
+		sseCKey, sseCKeyMD5 = encoded, base64.StdEncoding.EncodeToString(sum[:])
+		log.Println("Reading SRC_BUCKET with a customer-provided key, MD5", sseCKeyMD5)
+	}
+
+	if dstSSE == "" && dstSSEKMSKeyID != "" {
+		dstSSE = string(types.ServerSideEncryptionAwsKms)
+	}
+	switch types.ServerSideEncryption(dstSSE) {
+	case "":
+		return
+	case types.ServerSideEncryptionAes256:
+		if dstSSEKMSKeyID != "" || dstBucketKey {
+			log.Fatal("DST_SSE_KMS_KEY_ID and DST_SSE_BUCKET_KEY need DST_SSE=aws:kms or aws:kms:dsse")
+		}
+	case types.ServerSideEncryptionAwsKms, types.ServerSideEncryptionAwsKmsDsse:
+	default:
+		log.Fatalf("Unknown DST_SSE %q, expected AES256, aws:kms or aws:kms:dsse", dstSSE)
+	}
+	log.Printf("Uploading to DST_BUCKET with %s encryption, key %s", dstSSE, cmp.Or(dstSSEKMSKeyID, "default"))
+}
+
+// sseStore adds the SSE-C key to the reads of SRC_BUCKET and the server-side
+// encryption settings to the writes to DST_BUCKET, so every request made,
+// including those of the upload manager and the waiters, carries them.  The
+// parts of a multipart upload take the encryption of the upload and need no
+// headers of their own.
+type sseStore struct {
+	ObjectStore
+}
+
+func withSSE(store ObjectStore) ObjectStore {
+	return sseStore{store}
+}
+
+func (s sseStore) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	if sseCKey != "" && aws.ToString(params.Bucket) == srcBucket {
+		in := *params
+		in.SSECustomerAlgorithm, in.SSECustomerKey, in.SSECustomerKeyMD5 = aws.String("AES256"), aws.String(sseCKey), aws.String(sseCKeyMD5)
+		params = &in
+	}
+	return s.ObjectStore.GetObject(ctx, params, optFns...)
+}
+
+func (s sseStore) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	if sseCKey != "" && aws.ToString(params.Bucket) == srcBucket {
+		in := *params
+		in.SSECustomerAlgorithm, in.SSECustomerKey, in.SSECustomerKeyMD5 = aws.String("AES256"), aws.String(sseCKey), aws.String(sseCKeyMD5)
+		params = &in
+	}
+	return s.ObjectStore.HeadObject(ctx, params, optFns...)
+}
+
+func (s sseStore) GetObjectAttributes(ctx context.Context, params *s3.GetObjectAttributesInput, optFns ...func(*s3.Options)) (*s3.GetObjectAttributesOutput, error) {
+	if sseCKey != "" && aws.ToString(params.Bucket) == srcBucket {
+		in := *params
+		in.SSECustomerAlgorithm, in.SSECustomerKey, in.SSECustomerKeyMD5 = aws.String("AES256"), aws.String(sseCKey), aws.String(sseCKeyMD5)
+		params = &in
+	}
+	return s.ObjectStore.GetObjectAttributes(ctx, params, optFns...)
+}
+
+func (s sseStore) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	if dstSSE != "" && aws.ToString(params.Bucket) == dstBucket {
+		in := *params
+		in.ServerSideEncryption, in.SSEKMSKeyId, in.BucketKeyEnabled = dstEncryption()
+		params = &in
+	}
+	return s.ObjectStore.PutObject(ctx, params, optFns...)
+}
+
+func (s sseStore) CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	if dstSSE != "" && aws.ToString(params.Bucket) == dstBucket {
+		in := *params
+		in.ServerSideEncryption, in.SSEKMSKeyId, in.BucketKeyEnabled = dstEncryption()
+		params = &in
+	}
+	return s.ObjectStore.CreateMultipartUpload(ctx, params, optFns...)
+}
+
+func (s sseStore) CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	if dstSSE != "" && aws.ToString(params.Bucket) == dstBucket {
+		in := *params
+		in.ServerSideEncryption, in.SSEKMSKeyId, in.BucketKeyEnabled = dstEncryption()
+		params = &in
+	}
+	return s.ObjectStore.CopyObject(ctx, params, optFns...)
+}
+
+// dstEncryption returns the encryption settings of the writes to DST_BUCKET.
+func dstEncryption() (types.ServerSideEncryption, *string, *bool) {
+	var keyID *string
+	if dstSSEKMSKeyID != "" {
+		keyID = aws.String(dstSSEKMSKeyID)
+	}
+	var bucketKey *bool
+	if dstBucketKey {
+		bucketKey = aws.Bool(true)
+	}
+	return types.ServerSideEncryption(dstSSE), keyID, bucketKey
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+var (
+	stateTable = Env("STATE_TABLE", "", "DynamoDB table recording object and archive states, keyed by run_id and item")
+	runID      = Env("RUN_ID", "", "Run identifier used in STATE_TABLE (defaults to SRC_BUCKET)")
+
+	stateCh   chan stateItem
+	stateDone = make(chan struct{})
+)
+
+// stateItem is a DynamoDB item in attribute value form.
+type stateItem map[string]map[string]string
+
+// The table has a string partition key "run_id" and a string sort key "item",
+// which is "object#<key>" or "archive#<name>".
+const (
+	stateObject  = "object#"
+	stateArchive = "archive#"
+
+	maxStateBatch = 25 // BatchWriteItem limit
+)
+
+func initStateTable() {
+	if stateTable == "" {
+		close(stateDone)
+		return
+	}
+	if runID == "" {
+		runID = srcBucket
+	}
+	stateCh = make(chan stateItem, 1000)
+	go stateWriter()
+}
+
+// recordState queues a state transition of an object or archive for the
+// table, and writes it to STATE_FILE.  The size, archive and err fields are only stored when set.
+func recordState(kind, name, state string, size int64, archive string, err error) {
+	writeStateRecord(kind, name, state, size, archive, err)
+	if stateCh == nil {
+		return
+	}
+	item := stateItem{
+		"run_id":   {"S": runID},
+		"item":     {"S": kind + name},
+		"state":    {"S": state},
+		"worker":   {"S": workerID},
+		"run_uuid": {"S": runUUID},
+		"updated":  {"S": time.Now().UTC().Format(time.RFC3339)},
+	}
+	if size > 0 {
+		item["size"] = map[string]string{"N": fmt.Sprint(size)}
+	}
+	if archive != "" {
+		item["archive"] = map[string]string{"S": archive}
+	}
+	if err != nil {
+		item["error"] = map[string]string{"S": err.Error()}
+	}
+	stateCh <- item
+}
+
+// closeStateTable writes out any queued state transitions.
+func closeStateTable() {
+	if stateCh != nil {
+		close(stateCh)
+	}
+	<-stateDone
+}
+
+// stateWriter batches the queued items into the table.
+func stateWriter() {
+	defer close(stateDone)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var batch []stateItem
+	index := make(map[string]int) // A batch may not hold the same item twice
+	flush := func() {
+		if len(batch) > 0 {
+			writeStateBatch(batch)
+		}
+		batch = batch[:0]
+		clear(index)
+	}
+	for {
+		select {
+		case item, ok := <-stateCh:
+			if !ok {
+				flush()
+				return
+			}
+			key := item["item"]["S"]
+			if i, ok := index[key]; ok {
+				batch[i] = item // Keep the latest state
+				continue
+			}
+			index[key] = len(batch)
+			batch = append(batch, item)
+			if len(batch) == maxStateBatch {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func writeStateBatch(batch []stateItem) {
+	type putRequest struct {
+		PutRequest struct{ Item stateItem }
+	}
+	requests := make([]putRequest, len(batch))
+	for i, item := range batch {
+		requests[i].PutRequest.Item = item
+	}
+
+	for attempt := 0; len(requests) > 0; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * 200 * time.Millisecond)
+		}
+		var out struct {
+			UnprocessedItems map[string][]putRequest
+		}
+		err := awsJSONCall(context.Background(), "dynamodb", "1.0", "DynamoDB_20120810.BatchWriteItem", map[string]any{
+			"RequestItems": map[string]any{stateTable: requests},
+		}, &out)
+		if err != nil {
+			if attempt < 5 {
+				continue
+			}
+			log.Printf("failed to write %d items to state table: %v", len(requests), err)
+			return
+		}
+		requests = out.UnprocessedItems[stateTable]
+	}
+}
+
+// loadStateSkips adds the objects the table records as uploaded in this run
+// to skipFiles, so any worker can resume the run.
+func loadStateSkips() {
+	if stateTable == "" {
+		return
+	}
+	count := queryState(stateObject, "uploaded", func(key string) {
+		skipFiles[key] = struct{}{}
+	})
+	log.Printf("Loaded %d uploaded objects from state table %s", count, stateTable)
+}
+
+// queryState calls fn with the name of each item of this run of the given
+// kind, in the given state or any state if empty, and returns how many there
+// were.
+func queryState(kind, state string, fn func(name string)) int {
+	var (
+		startKey stateItem
+		count    int
+	)
+	for {
+		in := map[string]any{
+			"TableName":                stateTable,
+			"KeyConditionExpression":   "run_id = :r AND begins_with(#i, :p)",
+			"ProjectionExpression":     "#i",
+			"ExpressionAttributeNames": map[string]string{"#i": "item"},
+			"ExpressionAttributeValues": stateItem{
+				":r": {"S": runID},
+				":p": {"S": kind},
+			},
+		}
+		if state != "" {
+			in["FilterExpression"] = "#s = :u"
+			in["ExpressionAttributeNames"] = map[string]string{"#i": "item", "#s": "state"}
+			in["ExpressionAttributeValues"].(stateItem)[":u"] = map[string]string{"S": state}
+		}
+		if startKey != nil {
+			in["ExclusiveStartKey"] = startKey
+		}
+		var out struct {
+			Items            []stateItem
+			LastEvaluatedKey stateItem
+		}
+		if err := awsJSONCall(context.Background(), "dynamodb", "1.0", "DynamoDB_20120810.Query", in, &out); err != nil {
+			log.Fatalf("failed to query state table: %v", err)
+		}
+		for _, item := range out.Items {
+			fn(strings.TrimPrefix(item["item"]["S"], kind))
+			count++
+		}
+		if out.LastEvaluatedKey == nil {
+			break
+		}
+		startKey = out.LastEvaluatedKey
+	}
+	return count
+}
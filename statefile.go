@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	stateFileName = Env("STATE_FILE", "", "Local JSON lines file recording each object as it is downloaded, scanned, archived and uploaded, e.g. state.jsonl")
+	resumeRun     = Env("RESUME", "", "Carry on from the STATE_FILE of the previous run instead of starting it afresh") != ""
+
+	stateFile   *os.File
+	stateFileMu sync.Mutex
+	stateResume *StateResume // What the previous run got to, with RESUME
+)
+
+// stateRecord is a line of STATE_FILE: a state an object or archive reached.
+type stateRecord struct {
+	Item    string    `json:"item"` // object#<key> or archive#<name>
+	State   string    `json:"state"`
+	Size    int64     `json:"size,omitempty"`
+	Archive string    `json:"archive,omitempty"`
+	Error   string    `json:"error,omitempty"`
+	Run     string    `json:"run"`
+	Time    time.Time `json:"time"`
+}
+
+// StateResume counts the objects of the previous run by the last state they
+// reached, as read from STATE_FILE.
+type StateResume struct {
+	Uploaded int // Skipped
+	Added    int // Skipped which are not in upload.log
+	Pending  int // Downloaded, scanned or archived but not uploaded, done again
+	Failed   int // Tried again
+	Archives int // Archives the previous runs opened
+	Orphans  int // Closed archives never uploaded, removed from the disk
+}
+
+// initStateFile replays STATE_FILE with RESUME, adding the objects it
+// records as uploaded to those skipped and carrying the archive numbering on
+// past the archives it records, then opens it to record this run.  Without
+// RESUME the file is started afresh.
+func initStateFile() {
+	if stateFileName == "" {
+		if resumeRun {
+			log.Fatal("RESUME needs the STATE_FILE of the previous run")
+		}
+		return
+	}
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if resumeRun {
+		replayStateFile()
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+	var err error
+	if stateFile, err = os.OpenFile(stateFileName, flags, 0644); err != nil {
+		log.Fatalf("failed to open STATE_FILE: %v", err)
+	}
+}
+
+// replayStateFile reads the last state of every object and archive.
+func replayStateFile() {
+	f, err := os.Open(stateFileName)
+	if os.IsNotExist(err) {
+		log.Printf("Resume: %s does not exist yet, starting afresh", stateFileName)
+		return
+	} else if err != nil {
+		log.Fatalf("failed to open STATE_FILE: %v", err)
+	}
+	defer f.Close()
+
+	objects := make(map[string]string)
+	archives := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var rec stateRecord
+		if json.Unmarshal(scanner.Bytes(), &rec) != nil {
+			continue // A line cut short by a crash
+		}
+		if key, ok := strings.CutPrefix(rec.Item, stateObject); ok {
+			objects[key] = rec.State
+		} else if name, ok := strings.CutPrefix(rec.Item, stateArchive); ok {
+			archives[name] = rec.State
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatalf("failed to read STATE_FILE: %v", err)
+	}
+
+	r := &StateResume{Archives: len(archives)}
+	for key, state := range objects {
+		switch state {
+		case "uploaded":
+			if _, ok := skipFiles[key]; !ok {
+				skipFiles[key] = struct{}{}
+				r.Added++
+			}
+			r.Uploaded++
+		case "failed":
+			r.Failed++
+		default:
+			r.Pending++
+		}
+	}
+	var highest int
+	for name, state := range archives {
+		if n, ok := archiveNumber(name); ok && n > highest {
+			highest = n
+		}
+		if state == "closed" {
+			// Its objects are archived again, the copy left behind goes
+			if _, err := os.Stat(name); err == nil {
+				deleteTempFile(name)
+				r.Orphans++
+			}
+		}
+	}
+	if archiveNamingKind == "counter" && highest > archiveCount {
+		archiveCount = highest
+	}
+	stateResume = r
+	log.Printf("Resume: %s has %d objects uploaded and skipped, %d in progress and %d failed which are done again, and %d archives, numbering carries on after %d",
+		stateFileName, r.Uploaded, r.Pending, r.Failed, r.Archives, archiveCount)
+	if r.Orphans > 0 {
+		log.Printf("Resume: removed %d archives closed but never uploaded", r.Orphans)
+	}
+}
+
+// writeStateRecord appends a state to STATE_FILE.
+func writeStateRecord(kind, name, state string, size int64, archive string, err error) {
+	stateFileMu.Lock()
+	defer stateFileMu.Unlock()
+	if stateFile == nil {
+		return
+	}
+	rec := stateRecord{Item: kind + name, State: state, Size: size, Archive: archive, Run: runUUID, Time: time.Now().UTC()}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	dat, _ := json.Marshal(rec)
+	if _, err := stateFile.Write(append(dat, '\n')); err != nil {
+		log.Fatalf("failed to write STATE_FILE: %v", err)
+	}
+}
+
+// recordStage notes the progress of an object through the pipeline in
+// STATE_FILE.  Only the final states go to STATE_TABLE as well.
+func recordStage(key, state, archive string) {
+	writeStateRecord(stateObject, key, state, 0, archive, nil)
+}
+
+// closeStateFile syncs STATE_FILE at the end of the run.
+func closeStateFile() {
+	if stateFile == nil {
+		return
+	}
+	if err := stateFile.Sync(); err != nil {
+		log.Printf("failed to sync STATE_FILE: %v", err)
+	}
+	stateFileMu.Lock()
+	stateFile.Close()
+	stateFile = nil
+	stateFileMu.Unlock()
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+var (
+	objectStoreKind = Env("OBJECT_STORE", "", "Object store to use: empty for AWS S3, or \"memory\" for an in-process fake")
+	objectStoreSeed = Env("OBJECT_STORE_SEED", "", "Directory whose files are loaded into SRC_BUCKET of the memory object store")
+	awsEndpointURL  = Env("AWS_ENDPOINT_URL", "", "Endpoint of an S3 compatible service, such as LocalStack, used instead of AWS")
+)
+
+// ObjectStore is the part of the S3 API the archiver uses.  *s3.Client
+// implements it, as does memStore for tests and offline development.  It
+// also satisfies the SDK interfaces needed by the upload manager, the list
+// paginator and the object waiters.
+type ObjectStore interface {
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	GetObjectAttributes(ctx context.Context, params *s3.GetObjectAttributesInput, optFns ...func(*s3.Options)) (*s3.GetObjectAttributesOutput, error)
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error)
+	DeleteObjects(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error)
+	GetObjectTagging(ctx context.Context, params *s3.GetObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error)
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+
+	CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error)
+	UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error)
+	CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error)
+	AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error)
+	ListMultipartUploads(ctx context.Context, params *s3.ListMultipartUploadsInput, optFns ...func(*s3.Options)) (*s3.ListMultipartUploadsOutput, error)
+	ListObjectVersions(ctx context.Context, params *s3.ListObjectVersionsInput, optFns ...func(*s3.Options)) (*s3.ListObjectVersionsOutput, error)
+	RestoreObject(ctx context.Context, params *s3.RestoreObjectInput, optFns ...func(*s3.Options)) (*s3.RestoreObjectOutput, error)
+}
+
+var _ ObjectStore = (*s3.Client)(nil)
+
+// initMemoryStore backs the archiver with a memStore, optionally seeded from
+// a directory, so the pipeline can run without AWS.
+func initMemoryStore() {
+	region = Env("AWS_REGION", "us-east-1", "Region reported when not running on EC2")
+	awsCredentials = aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+		return aws.Credentials{AccessKeyID: "memory", SecretAccessKey: "memory", Source: "memory"}, nil
+	})
+	store := newMemStore()
+	if objectStoreSeed != "" {
+		if err := store.seed(srcBucket, objectStoreSeed); err != nil {
+			awscliLog.Fatalf("Could not seed memory store from %s: %v", objectStoreSeed, err)
+		}
+		awscliLog.Printf("Seeded memory store bucket %s with %d objects", srcBucket, len(store.buckets[srcBucket]))
+	}
+	if simulating {
+		simulateObjects(store)
+	}
+	s3client = meter(withSSE(store))
+	awscliLog.Println("Using in-memory object store")
+}
+
+// initEndpointStore points the S3 client at an S3 compatible endpoint, such
+// as LocalStack or MinIO, with static credentials from the environment in
+// place of the instance role.
+func initEndpointStore() {
+	region = Env("AWS_REGION", "us-east-1", "Region reported when not running on EC2")
+	accessKey := Env("AWS_ACCESS_KEY_ID", "", "Access key for AWS_ENDPOINT_URL")
+	secretKey := EnvSecret("AWS_SECRET_ACCESS_KEY", "Secret key for AWS_ENDPOINT_URL")
+	sessionToken := EnvSecret("AWS_SESSION_TOKEN", "Session token for AWS_ENDPOINT_URL")
+	if accessKey == "" || secretKey == "" {
+		// No made up keys are assumed, which a real endpoint could accept
+		awscliLog.Fatal("AWS_ENDPOINT_URL needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, such as test and test for LocalStack")
+	}
+	awsCredentials = withAssumedRole(aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+		return aws.Credentials{
+			AccessKeyID:     accessKey,
+			SecretAccessKey: secretKey,
+			SessionToken:    sessionToken,
+			Source:          "environment",
+		}, nil
+	}))
+	s3client = meter(withSSE(newPooledStore(s3.Options{
+		Credentials:  awsCredentials,
+		Region:       region,
+		BaseEndpoint: aws.String(awsEndpointURL),
+		UsePathStyle: true, // Bucket names are not resolvable as hosts locally
+	})))
+	awscliLog.Println("Using S3 endpoint", awsEndpointURL)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"archive/tar"
+	"hash"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	archiveStreams = Env("ARCHIVE_STREAMS", "", "Separate archive sequences per key prefix, as PREFIX=>DEST_PREFIX[@SIZECAP] joined by ;")
+
+	streams       []*archiveStream // Configured streams, longest prefix first
+	defaultStream = &archiveStream{}
+	curStream     *archiveStream // Stream whose state is in the archive globals
+	archiveBase   int            // Archive number each stream starts counting from
+)
+
+// archiveStream is an independent sequence of archives with its own names
+// and size cap.  The archiver works on one archive at a time through the
+// archive globals, so the state of the other streams is saved here while they
+// are switched out.
+type archiveStream struct {
+	prefix  string // Keys with this prefix belong to the stream
+	name    string // Archive name template
+	sizeCap int64
+	started bool
+
+	tgzFile  string // Open archive, empty if none
+	contents []string
+	opened   time.Time
+
+	count        int
+	tar          *tar.Writer
+	compressor   io.WriteCloser
+	file         *TempFile
+	bytesWritten int64
+	hash         hash.Hash
+	sums         []string
+	manifest     []*ManifestEntry
+	dirs         map[string]struct{}
+	names        map[string]struct{}
+	class        string
+	retention    *Retention
+
+	levels map[string]*archiveStream // Per classification level with CLASSIFICATION_SEPARATE
+}
+
+func initArchiveStreams() {
+	defaultStream.name = ArchiveName
+	defaultStream.sizeCap = sizeCapLimit
+	if archiveStreams == "" {
+		return
+	}
+	if archiveStdout {
+		log.Fatal("ARCHIVE_STREAMS cannot be used with ARCHIVE_STDOUT")
+	}
+	for _, spec := range strings.Split(archiveStreams, ";") {
+		if spec = strings.TrimSpace(spec); spec == "" {
+			continue
+		}
+		prefix, dest, ok := strings.Cut(spec, "=>")
+		if !ok || prefix == "" {
+			log.Fatalf("ARCHIVE_STREAMS entries must be of the form PREFIX=>DEST_PREFIX[@SIZECAP]: %q", spec)
+		}
+		s := &archiveStream{prefix: prefix, sizeCap: sizeCapLimit}
+		if d, sizeCap, ok := strings.Cut(dest, "@"); ok {
+			var err error
+			if s.sizeCap, err = parseByteSize(sizeCap); err != nil {
+				log.Fatalf("failed to parse size cap of stream %q: %v", prefix, err)
+			}
+			dest = d
+		}
+		s.name = underDstPrefix(dest)
+		if s.name == ArchiveName {
+			log.Fatalf("stream %q needs a DEST_PREFIX to keep its archives apart", prefix)
+		}
+		streams = append(streams, s)
+	}
+	sort.Slice(streams, func(i, j int) bool { return len(streams[i].prefix) > len(streams[j].prefix) })
+	for _, s := range streams {
+		log.Printf("Archive stream %q writes %s with a size cap of %s", s.prefix, s.name, humanizeBytes(s.sizeCap))
+	}
+}
+
+// streamFor returns the stream an object key belongs to.
+func streamFor(key string) *archiveStream {
+	for _, s := range streams {
+		if strings.HasPrefix(key, s.prefix) {
+			return s
+		}
+	}
+	return defaultStream
+}
+
+func allStreams() []*archiveStream {
+	var all []*archiveStream
+	for _, s := range append(streams[:len(streams):len(streams)], defaultStream) {
+		all = append(all, s)
+		for _, l := range s.levels {
+			all = append(all, l)
+		}
+	}
+	if exceptionStream != nil {
+		all = append(all, exceptionStream)
+	}
+	return all
+}
+
+// forLevel returns the stream holding the objects of s with a given
+// classification level, their archives are named under a LEVEL/ prefix,
+// after DST_PREFIX.
+func (s *archiveStream) forLevel(level string) *archiveStream {
+	if level == "" {
+		return s
+	}
+	l, ok := s.levels[level]
+	if !ok {
+		if s.levels == nil {
+			s.levels = make(map[string]*archiveStream)
+		}
+		l = &archiveStream{prefix: s.prefix, name: dstPrefix + level + "/" + strings.TrimPrefix(s.name, dstPrefix), sizeCap: s.sizeCap}
+		s.levels[level] = l
+	}
+	return l
+}
+
+// switchStream saves the archive globals into the current stream and loads
+// those of s in their place.
+func switchStream(s *archiveStream) {
+	if s == curStream {
+		return
+	}
+	if c := curStream; c != nil {
+		c.count, c.tar, c.compressor, c.file = archiveCount, archiveTar, archiveCompressor, archiveFile
+		c.bytesWritten, c.hash, c.sums = archiveBytesWritten, archiveHash, archiveSums
+		c.manifest, c.dirs, c.names, c.class, c.retention = archiveManifest, archiveDirs, archiveNames, archiveClass, archiveRetention
+	} else {
+		// Numbering may have been moved on by a checkpoint since startup
+		archiveBase = archiveCount
+	}
+	if !s.started {
+		s.started = true
+		s.count = archiveBase
+	}
+	archiveCount, archiveTar, archiveCompressor, archiveFile = s.count, s.tar, s.compressor, s.file
+	archiveBytesWritten, archiveHash, archiveSums = s.bytesWritten, s.hash, s.sums
+	archiveManifest, archiveDirs, archiveNames, archiveClass, archiveRetention = s.manifest, s.dirs, s.names, s.class, s.retention
+	curStream = s
+}
+
+func (s *archiveStream) open() {
+	s.tgzFile = OpenArchive(s.name)
+	s.opened = time.Now()
+}
+
+// roll closes the open archive of the stream and hands it to the uploader.
+func (s *archiveStream) roll(doneCh chan<- *ArchiveFile) {
+	switchStream(s)
+	doneCh <- finishArchive(s.tgzFile, s.contents)
+	s.tgzFile, s.contents = "", nil
+	archiveBytesWritten = 0
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+var (
+	streamUpload   = Env("STREAM_UPLOAD", "", "Stream each archive into a multipart upload to DST_BUCKET as it is written, so no archive is staged on local disk") != ""
+	streamPartSize = EnvInt("STREAM_PART_MIB", 16, "Part size in MiB of the streamed uploads, each part in flight is held in memory")
+
+	streamUploads = make(map[*TempFile]*streamedArchive) // The uploads of the open archives
+	streamedSize  int64                                  // Compressed size of the last archive closed
+)
+
+// streamedArchive is a multipart upload fed by the write end of a pipe which
+// stands in for the archive file.
+type streamedArchive struct {
+	key  string
+	size int64
+	done chan error
+}
+
+func initStreamUpload() {
+	if !streamUpload {
+		return
+	}
+	switch {
+	case archiveStdout || exportDir != "" || simulating:
+		log.Fatal("STREAM_UPLOAD cannot be used with ARCHIVE_STDOUT, EXPORT_DIR or SIMULATE, the archives do not go to DST_BUCKET")
+	case verifyArchives:
+		log.Fatal("VERIFY_ARCHIVES cannot be used with STREAM_UPLOAD, the archive is never on disk")
+	case archiveNamingKind == "content-hash":
+		log.Fatal("ARCHIVE_NAMING=content-hash cannot be used with STREAM_UPLOAD, the key is needed before the contents are known")
+	case streamPartSize < 5:
+		log.Fatal("STREAM_PART_MIB must be at least 5, the smallest part S3 accepts")
+	}
+	log.Printf("Archives are streamed to s3://%s in %d MiB parts", dstBucket, streamPartSize)
+}
+
+// createStreamFile starts the upload of the archive key, returning the file
+// the archive is written to in place of one on disk.
+func createStreamFile(key string) (*TempFile, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	u := &streamedArchive{key: key, done: make(chan error, 1)}
+	attrs := archiveAttrs(&ArchiveFile{Exceptions: exceptionStream != nil && curStream == exceptionStream})
+	go func() {
+		err := u.upload(context.Background(), r, attrs)
+		// Writes to an abandoned upload fail rather than block
+		r.Close()
+		u.done <- err
+	}()
+	f := &TempFile{File: w}
+	streamUploads[f] = u
+	return f, nil
+}
+
+// closeStreamFile ends the archive written to f and waits for its upload.
+func closeStreamFile(f *TempFile) {
+	u := streamUploads[f]
+	delete(streamUploads, f)
+	if err := f.Close(); err != nil {
+		log.Fatalf("failed to end the stream of %s: %v", u.key, err)
+	}
+	if err := <-u.done; err != nil {
+		log.Fatalf("failed to stream %s: %v", u.key, err)
+	}
+	streamedSize = atomic.LoadInt64(&u.size)
+	if debug {
+		log.Printf("Streamed %s, %d bytes", u.key, streamedSize)
+	}
+}
+
+// upload sends the archive read from r to DST_BUCKET.  Only the attributes
+// known when the archive is opened are set, the classification and retention
+// of its contents are in the manifest and info sidecars.
+func (u *streamedArchive) upload(ctx context.Context, r io.Reader, attrs uploadAttrs) error {
+	s3Ready.Wait() // Wait for the S3 client to be ready
+
+	uploader := manager.NewUploader(s3client, func(m *manager.Uploader) {
+		m.PartSize = int64(streamPartSize) * 1024 * 1024
+		m.Concurrency = uploadParts()
+	})
+	input := &s3.PutObjectInput{
+		Bucket:   aws.String(dstBucket),
+		Key:      aws.String(u.key),
+		Body:     io.TeeReader(r, u),
+		Metadata: attrs.Metadata,
+
+		ContentType:       aws.String(attrs.ContentType),
+		ChecksumAlgorithm: uploadChecksum(),
+	}
+	if len(attrs.Tags) > 0 {
+		tags := url.Values{}
+		for k, v := range attrs.Tags {
+			tags.Set(k, v)
+		}
+		input.Tagging = aws.String(tags.Encode())
+	}
+	out, err := uploader.Upload(ctx, input)
+	if err != nil {
+		var multi manager.MultiUploadFailure
+		if errors.As(err, &multi) {
+			return fmt.Errorf("upload %s aborted: %w", multi.UploadID(), err)
+		}
+		return err
+	}
+	return verifyUpload(ctx, dstBucket, u.key, atomic.LoadInt64(&u.size), out)
+}
+
+// Write counts the bytes read from the pipe.
+func (u *streamedArchive) Write(p []byte) (int, error) {
+	atomic.AddInt64(&u.size, int64(len(p)))
+	return len(p), nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	runStarted = time.Now().UTC()
+
+	uploadedArchives []string // Archives uploaded in this run, in order
+	ErroredFiles     int64
+)
+
+// RunSummary describes a finished run.
+type RunSummary struct {
+	RunID            string           `json:"run_id,omitempty"`
+	RunUUID          string           `json:"run_uuid"`
+	Worker           string           `json:"worker,omitempty"`
+	SourceBucket     string           `json:"source_bucket"`
+	ToolVersion      string           `json:"tool_version"`
+	FIPS             bool             `json:"fips"`
+	Started          time.Time        `json:"started"`
+	Finished         time.Time        `json:"finished"`
+	Objects          int64            `json:"objects"`
+	ArchivedObjects  int64            `json:"archived_objects"`
+	FailedObjects    int64            `json:"failed_objects"`
+	RetriedObjects   int64            `json:"retried_objects,omitempty"`   // Failed objects sent again with RETRY_PASSES
+	RecoveredObjects int64            `json:"recovered_objects,omitempty"` // Of those, the objects archived on a retry
+	DeletedObjects   int64            `json:"deleted_objects,omitempty"`   // Source objects deleted with DELETE_SOURCE
+	RetainedObjects  int64            `json:"retained_objects,omitempty"`  // Source objects kept as they failed the replica check
+	VerifiedObjects  int64            `json:"verified_objects,omitempty"`  // Downloads checked against their checksum or ETag
+	ScanCacheHits    int64            `json:"scan_cache_hits,omitempty"`   // Scans skipped for a cached verdict
+	SkippedScans     int64            `json:"skipped_scans,omitempty"`     // Objects archived unscanned with SCAN_EXCLUDE or SCAN_MAX_SIZE
+	SkippedObjects   int64            `json:"skipped_objects,omitempty"`   // Objects left out with MIN_OBJECT_SIZE or MAX_OBJECT_SIZE
+	RestoredObjects  int64            `json:"restored_objects,omitempty"`  // Archived objects restored with GLACIER_RESTORE_TIER
+	ReplacedArchives int64            `json:"replaced_archives,omitempty"` // Small archives deleted after repacking
+	UploadedBytes    int64            `json:"uploaded_bytes"`
+	Throttled        int64            `json:"throttled_requests,omitempty"` // Attempts answered with SlowDown or 429
+	SpotChecks       *SpotCheckResult `json:"spot_checks,omitempty"`
+	Reconciliation   *Reconciliation  `json:"reconciliation,omitempty"` // Listing against the bucket at the end, with RECONCILE
+	S3Usage          *S3Usage         `json:"s3_usage"`                 // Requests made and their estimated cost
+	Archives         []string         `json:"archives"`
+	Catalog          []string         `json:"catalog,omitempty"` // Parquet files written with CATALOG_PARQUET
+}
+
+// writeRunSummary writes run_summary_<time>.json next to the archives and,
+// with its signature, uploads it.
+func writeRunSummary(ctx context.Context) {
+	summary := &RunSummary{
+		RunID:            runID,
+		RunUUID:          runUUID,
+		SourceBucket:     srcBucket,
+		ToolVersion:      version,
+		FIPS:             fipsMode,
+		Started:          runStarted,
+		Finished:         time.Now().UTC(),
+		Objects:          atomic.LoadInt64(&TotalFiles),
+		ArchivedObjects:  atomic.LoadInt64(&UploadedArchivedFiles),
+		FailedObjects:    atomic.LoadInt64(&ErroredFiles) - atomic.LoadInt64(&RecoveredFiles),
+		RetriedObjects:   atomic.LoadInt64(&RetriedFiles),
+		RecoveredObjects: atomic.LoadInt64(&RecoveredFiles),
+		DeletedObjects:   atomic.LoadInt64(&DeletedFiles),
+		RetainedObjects:  atomic.LoadInt64(&RetainedFiles),
+		VerifiedObjects:  atomic.LoadInt64(&VerifiedFiles),
+		ScanCacheHits:    atomic.LoadInt64(&ScanCacheHits),
+		SkippedScans:     atomic.LoadInt64(&SkippedScans),
+		SkippedObjects:   atomic.LoadInt64(&SkippedObjects),
+		RestoredObjects:  atomic.LoadInt64(&RestoredFiles),
+		ReplacedArchives: atomic.LoadInt64(&RepackedArchives),
+		UploadedBytes:    atomic.LoadInt64(&UploadedBytes),
+		Throttled:        atomic.LoadInt64(&ThrottledRequests),
+		SpotChecks:       spotResult,
+		Reconciliation:   reconcileResult,
+		S3Usage:          s3Usage(),
+		Archives:         uploadedArchives,
+		Catalog:          catalogFiles,
+	}
+	name := "run_summary_" + runStarted.Format("20060102T150405Z") + ".json"
+	if workMode == modeWorker {
+		summary.Worker = workerID
+		name = workerID + "_" + name
+	}
+	summaryFile := filepath.Join(filepath.Dir(ArchiveName), name)
+
+	dat, _ := json.MarshalIndent(summary, "", "  ")
+	if err := os.WriteFile(summaryFile, append(dat, '\n'), 0644); err != nil {
+		log.Fatalf("failed to write run summary: %v", err)
+	}
+	files := append([]string{summaryFile}, signFiles([]string{summaryFile})...)
+	if archiveStdout || simulating {
+		log.Println("Wrote", summaryFile)
+		return
+	} else if exportDir != "" {
+		exportFiles(files)
+		os.Remove(summaryFile)
+		closeExport()
+		return
+	}
+	for _, file := range files {
+		if err := uploadFileInParts(ctx, dstBucket, file, file, withDstAttrs(uploadAttrs{Metadata: virusScanMap})); err != nil {
+			log.Fatal(err)
+		}
+		os.Remove(file)
+	}
+	log.Println("Uploaded run summary", summaryFile)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+var tarFormat = Env("TAR_FORMAT", "pax", "Tar header format: pax, gnu or ustar")
+
+func initTarFormat() {
+	switch tarFormat {
+	case "pax":
+		archiveTarFormat = tar.FormatPAX
+	case "gnu":
+		archiveTarFormat = tar.FormatGNU
+	case "ustar":
+		archiveTarFormat = tar.FormatUSTAR
+	default:
+		log.Fatalf("unknown TAR_FORMAT %q, must be pax, gnu or ustar", tarFormat)
+	}
+	if paxTimes && archiveTarFormat == tar.FormatUSTAR {
+		log.Fatal("TAR_PAX_TIMES cannot be used with TAR_FORMAT=ustar")
+	}
+	switch {
+	case paxScan && archiveTarFormat != tar.FormatPAX:
+		log.Fatal("TAR_PAX_SCAN needs TAR_FORMAT=pax")
+	case paxScan && !scanningEnabled:
+		log.Fatal("TAR_PAX_SCAN cannot be used with DISABLE_SCANNER")
+	}
+}
+
+// tarTime rounds t to the precision the tar format can hold.
+func tarTime(t time.Time) time.Time {
+	if archiveTarFormat == tar.FormatPAX {
+		return t
+	}
+	return t.Truncate(time.Second)
+}
+
+// checkTarEntry returns an error if an entry cannot be written in TAR_FORMAT,
+// such as a name too long or not ASCII for ustar, or a size of 8 GiB or more.
+// The name is checked with the longest suffix the archiver may give it.
+func checkTarEntry(name string, size int64, deleteMarker bool) error {
+	return tar.NewWriter(io.Discard).WriteHeader(&tar.Header{
+		Name:   name + entrySuffixRoom(name, size, deleteMarker),
+		Size:   size,
+		Mode:   0600,
+		Format: archiveTarFormat,
+	})
+}
+
+// entrySuffixRoom is the longest suffix an entry may be given in the
+// archive: a ~N keeping it unique, allowing for up to 99 entries of the same
+// name, and .deleted for a tombstone, .zst once dictionary compressed or the
+// .chunkNNNNN of a chunk.  Folder markers are stored as they are.
+func entrySuffixRoom(name string, size int64, deleteMarker bool) string {
+	switch {
+	case deleteMarker:
+		return "~99.deleted"
+	case strings.HasSuffix(name, "/"):
+		return ""
+	case chunkAbove > 0 && size > chunkAbove:
+		return ".chunk00000~99"
+	case zstdDictSamples > 0 && size > 0 && size <= maxMemBytes:
+		return "~99.zst"
+	}
+	return "~99"
+}
+
+// validateTarEntries checks every object in the metadata file against the
+// limits of TAR_FORMAT before any work is done, failing with a list of the
+// keys which cannot be archived.  Every entry fits in pax, so it is skipped,
+// as it is with EXCEPTIONS_PREFIX where those objects become exceptions.
+func validateTarEntries() {
+	if archiveTarFormat == tar.FormatPAX || exceptionStream != nil {
+		return
+	}
+	f, err := os.Open(metadataFileName)
+	if err != nil {
+		log.Fatalf("failed to open metadata file: %v", err)
+	}
+	defer f.Close()
+
+	var bad int
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry MetaEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil || entry.Key == "" {
+			continue
+		}
+		if err := checkTarEntry(entryName(entry.Key), entry.Size, entry.DeleteMarker); err != nil {
+			if bad++; bad <= 20 {
+				log.Printf("cannot archive %q (%d bytes) in %s format: %v", entry.Key, entry.Size, tarFormat, err)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatalf("error reading metadata file: %v", err)
+	}
+	if bad > 0 {
+		log.Fatalf("%d objects cannot be archived with TAR_FORMAT=%s, use pax or rewrite the keys", bad, tarFormat)
+	}
+}
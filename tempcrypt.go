@@ -0,0 +1,304 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+var (
+	tempEncryption = Env("TEMP_ENCRYPTION", "", "Encrypt temp files with AES-256-CTR under a key held only in memory, so objects never reach local disk in plaintext") != ""
+	tempScanMemory = Env("TEMP_SCAN_MEMORY", "2G", "Most memory held at once by plaintext copies of encrypted temp files for the scanners, larger objects are archived without scanning")
+
+	tempScanBytes int64 // Largest encrypted temp file scanned, 0 unless the scanners are given copies
+	scanCopies    = struct {
+		sync.Mutex
+		cond *sync.Cond
+		used int64
+	}{}
+
+	tempCipher cipher.Block
+	tempIVs    = struct {
+		sync.Mutex
+		m map[string][]byte // Temp file path to its random IV
+	}{m: make(map[string][]byte)}
+)
+
+// initTempEncryption creates the ephemeral key of the temp files.  It is
+// never written anywhere, so the temp files left behind by a crash cannot be
+// read back by anyone.
+func initTempEncryption() {
+	if !tempEncryption {
+		return
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		log.Fatalf("failed to generate temp file key: %v", err)
+	}
+	var err error
+	if tempCipher, err = aes.NewCipher(key); err != nil {
+		log.Fatalf("failed to create temp file cipher: %v", err)
+	}
+	log.Println("Encrypting temp files with an ephemeral key")
+	if !scanReadsFiles {
+		return
+	}
+	// Check the scanners can be given plaintext copies in memory
+	f, err := memFile("check")
+	if err != nil {
+		log.Fatalf("TEMP_ENCRYPTION cannot scan encrypted temp files: %v", err)
+	}
+	f.Close()
+	if tempScanBytes, err = parseByteSize(tempScanMemory); err != nil || tempScanBytes <= 0 {
+		log.Fatalf("invalid TEMP_SCAN_MEMORY %q", tempScanMemory)
+	}
+	scanCopies.cond = sync.NewCond(&scanCopies)
+}
+
+// plainMemFile returns a plaintext copy of the size bytes of r in a file held
+// only in memory, for scanners which read files themselves, and the func
+// freeing it.  It never touches local disk and is gone as soon as it is
+// freed, even by a crash.  With TEMP_ENCRYPTION the copies wait for room
+// under TEMP_SCAN_MEMORY.
+func plainMemFile(r io.Reader, size int64) (*os.File, func(), error) {
+	reserveScanCopy(size)
+	f, err := memFile("scan")
+	if err != nil {
+		releaseScanCopy(size)
+		return nil, nil, err
+	}
+	free := func() {
+		f.Close()
+		releaseScanCopy(size)
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		free()
+		return nil, nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		free()
+		return nil, nil, err
+	}
+	return f, free, nil
+}
+
+// reserveScanCopy blocks until n more bytes of plaintext copies fit under
+// TEMP_SCAN_MEMORY.  Encrypted temp files larger than it are not scanned,
+// any other larger copy is let through once none is held, so nothing wedges.
+func reserveScanCopy(n int64) {
+	if tempScanBytes == 0 {
+		return
+	}
+	scanCopies.Lock()
+	defer scanCopies.Unlock()
+	for scanCopies.used > 0 && scanCopies.used+n > tempScanBytes {
+		scanCopies.cond.Wait()
+	}
+	scanCopies.used += n
+}
+
+// releaseScanCopy returns n bytes and wakes any waiting copies.
+func releaseScanCopy(n int64) {
+	if tempScanBytes == 0 {
+		return
+	}
+	scanCopies.Lock()
+	scanCopies.used -= n
+	scanCopies.cond.Broadcast()
+	scanCopies.Unlock()
+}
+
+// memFilePath is a path by which other processes of this user can open f.
+func memFilePath(f *os.File) string {
+	return fmt.Sprintf("/proc/%d/fd/%d", os.Getpid(), f.Fd())
+}
+
+// TempFile is a temp file which is transparently encrypted with
+// TEMP_ENCRYPTION.  CTR mode keeps the file the size of the plaintext and
+// lets any offset be read or written, so parts can be written at once and
+// the file read back as a stream or at random.
+type TempFile struct {
+	*os.File
+	iv  []byte // Nil when not encrypted
+	off int64  // Offset of the next Read or Write when encrypted
+}
+
+// createTempFile creates a new temp file as os.CreateTemp does.
+func createTempFile(pattern string) (*TempFile, error) {
+	f, err := os.CreateTemp("", pattern)
+	if err != nil {
+		return nil, err
+	}
+	return newTempFile(f, tempEncryption)
+}
+
+// newTempFile wraps a newly created file, encrypting what is written to it
+// when encrypt is set.
+func newTempFile(f *os.File, encrypt bool) (*TempFile, error) {
+	t := &TempFile{File: f}
+	if encrypt {
+		t.iv = make([]byte, aes.BlockSize)
+		if _, err := rand.Read(t.iv); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return nil, err
+		}
+		tempIVs.Lock()
+		tempIVs.m[f.Name()] = t.iv
+		tempIVs.Unlock()
+	}
+	return t, nil
+}
+
+// openTempFile opens a temp file made by createTempFile for reading.
+func openTempFile(path string) (*TempFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	tempIVs.Lock()
+	iv := tempIVs.m[path]
+	tempIVs.Unlock()
+	return &TempFile{File: f, iv: iv}, nil
+}
+
+// deleteTempFile removes a temp file made by createTempFile and forgets its IV.
+func deleteTempFile(path string) {
+	os.Remove(path)
+	tempIVs.Lock()
+	delete(tempIVs.m, path)
+	tempIVs.Unlock()
+}
+
+// readTempFile returns the plaintext contents of a temp file.
+func readTempFile(path string) ([]byte, error) {
+	f, err := openTempFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// crypt XORs p, found at offset off of the file, with the key stream.
+func (t *TempFile) crypt(p []byte, off int64) {
+	if t.iv == nil || len(p) == 0 {
+		return
+	}
+	// The counter of the block holding off is the IV plus its block number
+	iv := make([]byte, aes.BlockSize)
+	hi, lo := binary.BigEndian.Uint64(t.iv[:8]), binary.BigEndian.Uint64(t.iv[8:])
+	next := lo + uint64(off/aes.BlockSize)
+	if next < lo {
+		hi++
+	}
+	binary.BigEndian.PutUint64(iv[:8], hi)
+	binary.BigEndian.PutUint64(iv[8:], next)
+	stream := cipher.NewCTR(tempCipher, iv)
+	if skip := off % aes.BlockSize; skip > 0 {
+		var discard [aes.BlockSize]byte
+		stream.XORKeyStream(discard[:skip], discard[:skip])
+	}
+	stream.XORKeyStream(p, p)
+}
+
+func (t *TempFile) Read(p []byte) (int, error) {
+	if t.iv == nil {
+		return t.File.Read(p)
+	}
+	n, err := t.ReadAt(p, t.off)
+	t.off += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (t *TempFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := t.File.ReadAt(p, off)
+	t.crypt(p[:n], off)
+	return n, err
+}
+
+func (t *TempFile) Seek(offset int64, whence int) (int64, error) {
+	if t.iv == nil {
+		return t.File.Seek(offset, whence)
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += t.off
+	case io.SeekEnd:
+		info, err := t.Stat()
+		if err != nil {
+			return 0, err
+		}
+		offset += info.Size()
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before the start of the file")
+	}
+	t.off = offset
+	return offset, nil
+}
+
+func (t *TempFile) Write(p []byte) (int, error) {
+	if t.iv == nil {
+		return t.File.Write(p)
+	}
+	n, err := t.WriteAt(p, t.off)
+	t.off += int64(n)
+	return n, err
+}
+
+// WriteAt encrypts a copy of p, leaving the caller's buffer as it was.
+func (t *TempFile) WriteAt(p []byte, off int64) (int, error) {
+	if t.iv == nil {
+		return t.File.WriteAt(p, off)
+	}
+	buf := make([]byte, len(p))
+	copy(buf, p)
+	t.crypt(buf, off)
+	return t.File.WriteAt(buf, off)
+}
+
+// ReadFrom and WriteTo hide those of os.File, which would bypass the cipher.
+// The struct wrappers keep io.Copy from calling them back.
+func (t *TempFile) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(struct{ io.Writer }{t}, r)
+}
+
+func (t *TempFile) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(w, struct{ io.Reader }{t})
+}
+
+// createArchiveFile creates a pending archive, encrypted like the temp files
+// until it is uploaded or exported.  The archives kept by SIMULATE are left
+// readable.
+func createArchiveFile(path string) (*TempFile, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return newTempFile(f, tempEncryption && !simulating)
+}
+
+// renameArchiveFile renames a closed archive, keeping its IV.
+func renameArchiveFile(oldPath, newPath string) error {
+	if err := os.Rename(oldPath, newPath); err != nil {
+		return err
+	}
+	tempIVs.Lock()
+	defer tempIVs.Unlock()
+	if iv, ok := tempIVs.m[oldPath]; ok {
+		tempIVs.m[newPath] = iv
+		delete(tempIVs.m, oldPath)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	maxTempBytes = Env("MAX_TEMP_BYTES", "", "Cap on local disk used by temp files and pending archives, e.g. 500G (empty for no cap)")
+
+	tempDisk      = &diskBudget{}
+	TempBytes     int64 // Bytes currently held on local disk by temp files and archives
+	PeakTempBytes int64 // Most bytes held at once
+)
+
+// diskBudget accounts for local disk usage against a global cap.  Large
+// downloads reserve their size up front and block until it fits, while
+// archives are counted as they are written, without waiting, so the pipeline
+// can always drain: writing an archive frees the temp files it is made of.
+// A waiting download has the archiver roll the open archives, which are only
+// released once uploaded.
+type diskBudget struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	limit    int64
+	pressure chan struct{} // Signalled while a reservation waits, for the archiver to roll
+}
+
+func initTempDisk() {
+	if maxTempBytes == "" {
+		return
+	}
+	limit, err := parseByteSize(maxTempBytes)
+	if err != nil {
+		log.Fatalf("failed to parse MAX_TEMP_BYTES: %v", err)
+	}
+	tempDisk.limit = limit
+	tempDisk.cond = sync.NewCond(&tempDisk.mu)
+	tempDisk.pressure = make(chan struct{}, 1)
+}
+
+// Reserve blocks until n more bytes fit under the cap.  A single reservation
+// larger than the cap is let through once nothing else is held, so one huge
+// object cannot wedge the run.
+func (d *diskBudget) Reserve(n int64) {
+	if d.limit == 0 {
+		d.Add(n)
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for {
+		used := atomic.LoadInt64(&TempBytes)
+		if used+n <= d.limit || used == 0 {
+			break
+		}
+		if debug {
+			log.Printf("waiting for %d bytes of temp space, %d of %d in use", n, used, d.limit)
+		}
+		select {
+		case d.pressure <- struct{}{}:
+		default:
+		}
+		d.cond.Wait()
+	}
+	d.Add(n)
+}
+
+// Add accounts for n bytes without waiting.
+func (d *diskBudget) Add(n int64) {
+	used := atomic.AddInt64(&TempBytes, n)
+	for peak := atomic.LoadInt64(&PeakTempBytes); used > peak; peak = atomic.LoadInt64(&PeakTempBytes) {
+		if atomic.CompareAndSwapInt64(&PeakTempBytes, peak, used) {
+			break
+		}
+	}
+}
+
+// Release returns n bytes to the budget and wakes any waiting reservations.
+func (d *diskBudget) Release(n int64) {
+	atomic.AddInt64(&TempBytes, -n)
+	if d.limit == 0 {
+		return
+	}
+	d.mu.Lock()
+	d.cond.Broadcast()
+	d.mu.Unlock()
+}
+
+// removeTempFile deletes the temp file backing task and releases its space,
+// along with any space reserved for its transformed copy.
+func removeTempFile(task *WorkFile) {
+	deleteTempFile(task.TempFile)
+	tempDisk.Release(task.Size + task.OutputReserve)
+}
+
+// diskWriter counts the bytes written to an archive against the budget as
+// they are written.  They are released when the archive is uploaded.
+type diskWriter struct{}
+
+func (diskWriter) Write(p []byte) (int, error) {
+	tempDisk.Add(int64(len(p)))
+	return len(p), nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/remeh/sizedwaitgroup"
+)
+
+var (
+	transformCmd        = Env("TRANSFORM_CMD", "", "Shell command to rewrite file contents (stdin to stdout) before archiving")
+	transformMatch      = Env("TRANSFORM_MATCH", "*", "Glob on the object base name selecting files to transform")
+	concurrentTransform = EnvInt("CONCURRENT_TRANSFORMS", 2, "How many concurrent transforms can run at once")
+
+	TransformedFiles int64
+)
+
+// Transformer listens for WorkFile on tasksCh, pipes matching files through
+// TRANSFORM_CMD, and sends the rewritten WorkFile to doneCh.
+//
+// The command is run with "sh -c" and is given the object key and size in the
+// OBJECT_KEY and OBJECT_SIZE environment variables.  A non-zero exit status
+// drops the file from the archive and records an error event.
+func Transformer(ctx context.Context, tasksCh <-chan *WorkFile, doneCh chan<- *WorkFile) {
+	log.Println("Starting transformer...")
+	if _, err := path.Match(transformMatch, ""); err != nil {
+		log.Fatalf("invalid TRANSFORM_MATCH %q: %v", transformMatch, err)
+	}
+	swg := sizedwaitgroup.New(concurrentTransform)
+	defer close(doneCh) // Ensure doneCh is closed when the function exits
+
+	for {
+		select {
+		case <-ctx.Done():
+			break
+		case task, ok := <-tasksCh:
+			if debug {
+				log.Printf("Transformer task: %#v %v\n", task, ok)
+			}
+
+			if !ok {
+				swg.Wait()
+				Println("Closing transformer...")
+				return
+			}
+
+			if !transforms(task.Filename) || task.Exception != "" || task.DeleteMarker {
+				doneCh <- task
+				continue
+			}
+
+			swg.Add()
+			go func(task *WorkFile) {
+				defer swg.Done()
+				transformStage.begin()
+				defer transformStage.end()
+
+				reserved := task.OutputReserve
+				task.OutputReserve = 0
+				start := time.Now()
+				ctx, cancel := objectContext(ctx, task.Spent) // TRANSFORM_CMD is killed at PER_OBJECT_TIMEOUT
+				defer cancel()
+				out, err := transformFile(ctx, task, reserved)
+				if err != nil || out.TempFile == "" {
+					tempDisk.Release(reserved) // No transformed copy on disk
+				}
+				// The original contents are no longer needed either way
+				if task.TempFile == "" {
+					if task.Bytes != nil {
+						putMemory(task.Bytes)
+					}
+				} else {
+					removeTempFile(task)
+				}
+				if err != nil {
+					fileErrCh <- &ErrorEvent{
+						Size:     task.Size,
+						Filename: task.Filename,
+						Err:      objectErr(ctx, fmt.Errorf("error transforming %s: %v", task.Filename, err)),
+					}
+					return
+				}
+				out.Spent += time.Since(start)
+				atomic.AddInt64(&TransformedFiles, 1)
+				doneCh <- out
+			}(task)
+		}
+	}
+}
+
+// transforms reports whether TRANSFORM_CMD rewrites the object key.
+func transforms(key string) bool {
+	if transformCmd == "" {
+		return false
+	}
+	matched, _ := path.Match(transformMatch, path.Base(key))
+	return matched
+}
+
+// transformFile runs TRANSFORM_CMD over the contents of task and returns a
+// new WorkFile holding the output, in memory if it is small enough.  Output
+// kept on disk takes over the reserved temp disk, trued up to its size.
+func transformFile(ctx context.Context, task *WorkFile, reserved int64) (*WorkFile, error) {
+	var in io.Reader
+	if task.TempFile == "" {
+		in = bytes.NewReader(task.Bytes)
+	} else {
+		fh, err := openTempFile(task.TempFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open temp file: %w", err)
+		}
+		defer fh.Close()
+		in = fh
+	}
+
+	ext := filepath.Ext(task.Filename)
+	if len(ext) == 0 {
+		ext = ".tmp"
+	}
+	outFile, err := createTempFile("s3xform-*" + ext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer outFile.Close()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", transformCmd)
+	cmd.Dir = launchDir // A relative TRANSFORM_CMD runs where the run started, not in WORKDIR
+	cmd.Env = append(os.Environ(),
+		"OBJECT_KEY="+task.Filename,
+		fmt.Sprintf("OBJECT_SIZE=%d", task.Size))
+	cmd.Stdin = in
+	cmd.Stdout = outFile
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		deleteTempFile(outFile.Name())
+		return nil, err
+	}
+
+	info, err := outFile.Stat()
+	if err != nil {
+		deleteTempFile(outFile.Name())
+		return nil, err
+	}
+	size := info.Size()
+	if size > maxMemBytes {
+		// Transformed size is used for the tar header.  Growth past the
+		// reservation is counted without waiting, as waiting here could
+		// wedge the pipeline behind this stage.
+		if size > reserved {
+			tempDisk.Add(size - reserved)
+		} else {
+			tempDisk.Release(reserved - size)
+		}
+		out := *task
+		out.Size, out.TempFile, out.Bytes, out.Transformed = size, outFile.Name(), nil, true
+		return &out, nil
+	}
+
+	// Small enough to hold in memory
+	defer deleteTempFile(outFile.Name())
+	out := *task
+	out.Size, out.TempFile, out.Bytes, out.Transformed = size, "", nil, true
+	if size == 0 {
+		return &out, nil
+	}
+	mem := getMemory(size)
+	if _, err := outFile.ReadAt(mem[:size], 0); err != nil && err != io.EOF {
+		putMemory(mem)
+		return nil, err
+	}
+	out.Bytes = mem[:size]
+	return &out, nil
+}
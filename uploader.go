@@ -2,24 +2,45 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"log"
+	"mime"
 	"os"
+	"path/filepath"
 	"sync/atomic"
+	"time"
 )
 
+var archivesPerHour = EnvInt("ARCHIVES_PER_HOUR", 0, "Limit on how many archives are uploaded per hour (0 for no limit)")
+
+// objectFinished is called once an object is uploaded or logged as an error.
+func objectFinished(key string) {
+	unitObjectFinished(key)
+	checkpointFinished(key)
+}
+
 // Uploader listens for ArchiveFile on tasksCh, uploads them, and when the channel is closed sends a done
 func Uploader(ctx context.Context, tasksCh <-chan *ArchiveFile, doneCh chan<- struct{}) {
 	log.Println("Starting uploader...")
 	defer close(doneCh) // Ensure doneCh is closed when the function exits
 
-	f, err := os.OpenFile("upload.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	f, err := os.OpenFile(uploadLogName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		log.Fatalf("failed to open log file: %v", err)
 	}
 	defer f.Close()
 
+	var idx *os.File
+	if dedupIndexFile != "" {
+		if idx, err = os.OpenFile(dedupIndexFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644); err != nil {
+			log.Fatalf("failed to open dedup index: %v", err)
+		}
+		defer idx.Close()
+	}
+
+	// Uploads are spaced out evenly, the archiver blocks behind a full channel
+	var nextUpload time.Time
 	for {
+		uploadStage.settle() // Done with the last archive, if any
 		select {
 		case <-ctx.Done():
 			break
@@ -32,15 +53,75 @@ func Uploader(ctx context.Context, tasksCh <-chan *ArchiveFile, doneCh chan<- st
 				Println("Closing uploader...")
 				return
 			}
+			uploadStage.begin()
 
-			if err := uploadFileInParts(ctx, dstBucket, task.Filename, task.Filename, 8); err != nil {
-				log.Fatal(err)
+			if archivesPerHour > 0 {
+				if wait := time.Until(nextUpload); wait > 0 {
+					if debug {
+						log.Println("Pacing upload of", task.Filename, "for", wait.Round(time.Second))
+					}
+					time.Sleep(wait)
+				}
+				nextUpload = time.Now().Add(time.Hour / time.Duration(archivesPerHour))
+			}
+
+			if archiveStdout {
+				// The stream has been written out, the sidecars are kept locally
+				for _, sidecar := range task.Sidecars {
+					log.Println("Wrote", sidecar)
+				}
+			} else if exportDir != "" {
+				exportFiles(append([]string{task.Filename}, task.Sidecars...))
+			} else if simulating {
+				// The archive and sidecars are kept in SIMULATE_DIR
+				if debug {
+					log.Println("Kept", task.Filename)
+				}
+			} else {
+				if !streamUpload { // Otherwise streamed to the bucket as it was written
+					if err := uploadFileInParts(ctx, dstBucket, task.Filename, task.Filename, archiveAttrs(task)); err != nil {
+						log.Fatal(err)
+					}
+				}
+				// Upload the sidecar files which describe the archive
+				for _, sidecar := range task.Sidecars {
+					if err := uploadFileInParts(ctx, dstBucket, sidecar, sidecar, withDstAttrs(uploadAttrs{
+						ContentType: mime.TypeByExtension(filepath.Ext(sidecar)),
+						Metadata:    scanMetadata(task.Exceptions),
+					})); err != nil {
+						log.Fatal(err)
+					}
+					os.Remove(sidecar)
+				}
 			}
 			// Write successful uploads to log file
+			logUploaded(f, task.Contents)
+			repackUploaded(task.Contents)
 			for _, fileName := range task.Contents {
-				fmt.Fprintln(f, fileName)
+				recordState(stateObject, fileName, "uploaded", 0, task.Filename, nil)
+				objectFinished(fileName)
+			}
+			recordState(stateArchive, task.Filename, "uploaded", 0, "", nil)
+			if !task.Exceptions {
+				// Only now that the archive is stored can its sources go
+				deleteAfterSpotChecks(ctx, task)
+				sampleUploaded(task)
+			}
+			uploadedArchives = append(uploadedArchives, task.Filename)
+			addCatalog(ctx, task)
+			addCanary(task)
+			if dedupIndex != nil && !task.Exceptions {
+				// Contents are only referenced by later runs once uploaded
+				recordDedup(idx, task)
+			}
+			if !archiveStdout && !streamUpload {
+				if info, err := os.Stat(task.Filename); err == nil {
+					tempDisk.Release(info.Size())
+				}
+				if !simulating {
+					deleteTempFile(task.Filename)
+				}
 			}
-			os.Remove(task.Filename)
 			atomic.AddInt64(&UploadedArchivedFiles, int64(len(task.Contents)))
 			atomic.AddInt64(&UploadedFiles, 1)
 		}
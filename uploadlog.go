@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	uploadLogKey = EnvSecret("UPLOAD_LOG_KEY", "Secret keying the upload.log hash chain, so the chain cannot be rebuilt without it")
+
+	runUUID = newUUID() // Identifies this run in the logs and manifests
+
+	uploadLogName     = Env("UPLOAD_LOG", "upload.log", "Log of the objects uploaded, which a restart skips")
+	uploadLogHeadName = uploadLogName + ".head"
+
+	uploadLogHead  []byte // Chain value after the last line of upload.log
+	uploadLogLines int    // Lines in upload.log
+)
+
+// UploadLogHead records the end of upload.log, so that lines removed from its
+// end, which leave a valid chain behind, are noticed.
+type UploadLogHead struct {
+	Lines   int       `json:"lines"`
+	Chain   string    `json:"chain"`
+	Run     string    `json:"run"`
+	Updated time.Time `json:"updated"`
+}
+
+// A chained line is the key, the run it was uploaded in and the chain value
+// after it, separated by tabs.  Lines of older versions hold just the key.
+var chainedLine = regexp.MustCompile(`^(.*)\t([0-9a-f-]{36})\t([0-9a-f]{64})$`)
+
+// newUUID returns a random version 4 UUID.
+func newUUID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		log.Fatalf("failed to generate run UUID: %v", err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func newChainHash() hash.Hash {
+	if uploadLogKey != "" {
+		return hmac.New(sha256.New, []byte(uploadLogKey))
+	}
+	return sha256.New()
+}
+
+// chainNext returns the chain value after a line: the hash of the previous
+// value and the line, without its own chain value.
+func chainNext(prev []byte, line string) []byte {
+	h := newChainHash()
+	h.Write(prev)
+	io.WriteString(h, line)
+	return h.Sum(nil)
+}
+
+// initUploadLog reads the keys uploaded by previous runs from upload.log,
+// checking every chained line and the head file before any of them is
+// trusted to skip an object.  Unchained lines of older versions are folded
+// into the chain as they are, but only ahead of the first chained line.  A
+// line left incomplete by a crash is dropped.
+func initUploadLog() {
+	log.Println("Run", runUUID)
+	if uploadLogKey == "" {
+		log.Printf("UPLOAD_LOG_KEY is not set: anyone able to edit %s can also rebuild its hash chain", uploadLogName)
+	}
+	dat, err := os.ReadFile(uploadLogName)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		log.Fatalf("failed to read %s: %v", uploadLogName, err)
+	}
+	if i := bytes.LastIndexByte(dat, '\n'); i+1 != len(dat) {
+		log.Printf("Dropping the incomplete last line of %s", uploadLogName)
+		dat = dat[:i+1]
+		if err := os.Truncate(uploadLogName, int64(len(dat))); err != nil {
+			log.Fatalf("failed to truncate %s: %v", uploadLogName, err)
+		}
+	}
+
+	var head UploadLogHead
+	haveHead := false
+	if b, err := os.ReadFile(uploadLogHeadName); err == nil {
+		if err := json.Unmarshal(b, &head); err != nil {
+			log.Fatalf("failed to parse %s: %v", uploadLogHeadName, err)
+		}
+		haveHead = true
+	}
+
+	var (
+		chain   []byte
+		chained int
+		atHead  []byte
+	)
+	scanner := bufio.NewScanner(bytes.NewReader(dat))
+	for scanner.Scan() {
+		line := scanner.Text()
+		uploadLogLines++
+		if m := chainedLine.FindStringSubmatch(line); m != nil {
+			chain = chainNext(chain, m[1]+"\t"+m[2])
+			if hex.EncodeToString(chain) != m[3] {
+				log.Fatalf("%s line %d does not match its hash chain: the log was edited, or UPLOAD_LOG_KEY changed", uploadLogName, uploadLogLines)
+			}
+			skipFiles[m[1]] = struct{}{}
+			chained++
+		} else if chained > 0 || haveHead && uploadLogLines > head.Lines {
+			// Older versions never wrote after a chained line
+			log.Fatalf("%s line %d is not chained: the log was edited", uploadLogName, uploadLogLines)
+		} else {
+			chain = chainNext(chain, line)
+			skipFiles[strings.TrimSpace(line)] = struct{}{}
+		}
+		if uploadLogLines == head.Lines {
+			atHead = chain
+		}
+	}
+	uploadLogHead = chain
+
+	switch {
+	case haveHead && uploadLogLines < head.Lines:
+		log.Fatalf("%s has %d lines, %s records %d: the log was truncated", uploadLogName, uploadLogLines, uploadLogHeadName, head.Lines)
+	case haveHead && hex.EncodeToString(atHead) != head.Chain:
+		log.Fatalf("%s does not match %s at line %d: the log was rewritten", uploadLogName, uploadLogHeadName, head.Lines)
+	case haveHead && uploadLogLines > head.Lines:
+		// The run stopped between appending to the log and updating the head
+		log.Printf("%s has %d lines past its head, from an interrupted run", uploadLogName, uploadLogLines-head.Lines)
+	case !haveHead && chained > 0:
+		log.Printf("%s is missing, the end of %s cannot be checked", uploadLogHeadName, uploadLogName)
+	}
+	log.Printf("Verified %d lines of %s", uploadLogLines, uploadLogName)
+}
+
+// logUploaded appends the keys of an uploaded archive to upload.log, each
+// extending the hash chain, then moves the head past them.
+func logUploaded(f *os.File, keys []string) {
+	var buf bytes.Buffer
+	for _, key := range keys {
+		line := key + "\t" + runUUID
+		uploadLogHead = chainNext(uploadLogHead, line)
+		fmt.Fprintf(&buf, "%s\t%x\n", line, uploadLogHead)
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		log.Fatalf("failed to write %s: %v", uploadLogName, err)
+	}
+	uploadLogLines += len(keys)
+
+	dat, _ := json.Marshal(UploadLogHead{
+		Lines:   uploadLogLines,
+		Chain:   hex.EncodeToString(uploadLogHead),
+		Run:     runUUID,
+		Updated: time.Now().UTC(),
+	})
+	tmp := uploadLogHeadName + ".tmp"
+	if err := os.WriteFile(tmp, append(dat, '\n'), 0644); err != nil {
+		log.Fatalf("failed to write %s: %v", tmp, err)
+	}
+	if err := os.Rename(tmp, uploadLogHeadName); err != nil {
+		log.Fatalf("failed to update %s: %v", uploadLogHeadName, err)
+	}
+}
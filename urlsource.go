@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+var (
+	urlList   = Env("URL_LIST", "", "Archive the HTTP(S) URLs listed in this file (\"-\" for stdin) instead of the objects of SRC_BUCKET")
+	urlHeader = EnvSecret("URL_HEADER", "Header, as \"Name: value\", added to every URL_LIST request")
+
+	urlSources = struct {
+		sync.Mutex
+		m map[string]*urlSource // Object key to where it is fetched from
+	}{m: make(map[string]*urlSource)}
+)
+
+// urlSource is a line of URL_LIST: a URL, and optionally the key to archive
+// it under and headers, such as Authorization, to fetch it with.
+type urlSource struct {
+	URL     string            `json:"url"`
+	Key     string            `json:"key,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+func initURLList() {
+	if urlList == "" {
+		return
+	}
+	switch {
+	case workMode != "":
+		log.Fatal("URL_LIST can only be used in a standalone run")
+	case workList != "":
+		log.Fatal("URL_LIST cannot be used with WORK_LIST")
+	case downloadURL != "":
+		log.Fatal("URL_LIST cannot be used with DOWNLOAD_URL")
+	case deleteSource:
+		log.Fatal("DELETE_SOURCE cannot be used with URL_LIST, the sources are not in S3")
+	case verifyDownloads || recordAttributes || classificationTag != "" || retentionTag != "":
+		log.Fatal("VERIFY_DOWNLOADS, RECORD_ATTRIBUTES, CLASSIFICATION_TAG and RETENTION_TAG need S3 sources and cannot be used with URL_LIST")
+	}
+	if urlHeader != "" && !strings.Contains(urlHeader, ":") {
+		log.Fatal("invalid URL_HEADER, expected \"Name: value\"")
+	}
+	log.Println("Archiving the URLs listed in", urlList)
+}
+
+// ReadURLList sends the URLs of URL_LIST to the doFiles pipeline.  Each line
+// is either a bare URL, archived under its host and path, or a JSON
+// urlSource.  Every URL is looked up with a HEAD request for its size,
+// Last-Modified and ETag.
+func ReadURLList(ctx context.Context, doFiles chan<- *DownloadTask) {
+	loadSkipFiles()
+	defer close(doFiles)
+
+	var in io.Reader = os.Stdin
+	if urlList != "-" {
+		f, err := os.Open(urlList)
+		if err != nil {
+			log.Fatalf("failed to open URL list: %v", err)
+		}
+		defer f.Close()
+		in = f
+	}
+
+	scanner := bufio.NewScanner(in)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		src := &urlSource{URL: line}
+		if strings.HasPrefix(line, "{") {
+			if err := json.Unmarshal([]byte(line), src); err != nil {
+				// The line may hold credentials, so only its number is logged
+				log.Printf("failed to unmarshal line %d of URL_LIST: %v", lineNo, err)
+				continue
+			}
+		}
+		u, err := url.Parse(src.URL)
+		if err != nil || u.Host == "" || u.Scheme != "https" && u.Scheme != "http" {
+			log.Printf("skipping line %d of URL_LIST, not an HTTP(S) URL", lineNo)
+			continue
+		}
+		if u.Scheme != "https" && fipsMode {
+			log.Fatalf("URL_LIST URLs must be HTTPS in FIPS mode: %s", redactURL(u))
+		}
+		if src.Key == "" {
+			src.Key = urlKey(u)
+		}
+		urlSources.Lock()
+		_, dup := urlSources.m[src.Key]
+		if !dup {
+			urlSources.m[src.Key] = src
+		}
+		urlSources.Unlock()
+		if dup {
+			fileErrCh <- &ErrorEvent{Filename: src.Key, Err: fmt.Errorf("line %d of URL_LIST has the key of an earlier URL, give it a key of its own", lineNo)}
+			continue
+		}
+
+		entry := MetaEntry{Key: src.Key}
+		if _, ok := skipFiles[entry.Key]; !ok {
+			if err := headURLEntry(ctx, src, &entry); err != nil {
+				fileErrCh <- &ErrorEvent{Filename: entry.Key, Err: fmt.Errorf("failed to look up %s: %v", redactURL(u), err)}
+				continue
+			}
+		}
+		sendListed(entry, doFiles)
+	}
+
+	if err := scanner.Err(); err != nil {
+		log.Fatalf("error reading URL list: %v", err)
+	}
+}
+
+// urlKey is the key a URL is archived under: its host and path.  The query
+// is left out, as that is where presigned URLs carry their signature and
+// tokens, which would otherwise be written into every log and manifest.
+func urlKey(u *url.URL) string {
+	return u.Host + u.Path
+}
+
+// redactURL is u without its password or query, for logs.
+func redactURL(u *url.URL) string {
+	r := *u
+	r.RawQuery, r.ForceQuery = "", false
+	return r.Redacted()
+}
+
+// redactErr removes the password and query of the URL in an error from the
+// HTTP client.
+func redactErr(err error, u *url.URL) error {
+	var ue *url.Error
+	if errors.As(err, &ue) {
+		ue.URL = redactURL(u)
+	}
+	return err
+}
+
+// newURLRequest makes a request for src with the URL_HEADER and its own
+// headers set.
+func newURLRequest(ctx context.Context, method string, src *urlSource) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, src.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if name, value, ok := strings.Cut(urlHeader, ":"); ok {
+		req.Header.Set(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	for name, value := range src.Headers {
+		req.Header.Set(name, value)
+	}
+	return req, nil
+}
+
+// headURLEntry fills in the size, modification time and ETag of a URL.  Weak
+// ETags are left out, as downloads could not be made conditional on them.
+func headURLEntry(ctx context.Context, src *urlSource, entry *MetaEntry) error {
+	req, err := newURLRequest(ctx, http.MethodHead, src)
+	if err != nil {
+		return err
+	}
+	resp, err := cdnClient.Do(req)
+	if err != nil {
+		return redactErr(err, req.URL)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HEAD: %s", resp.Status)
+	}
+	if resp.ContentLength < 0 {
+		return fmt.Errorf("HEAD: no Content-Length")
+	}
+	entry.Size = resp.ContentLength
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		entry.LastModified = t.UTC()
+	} else {
+		entry.LastModified = time.Now().UTC().Truncate(time.Second)
+	}
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		entry.ETag = strings.Trim(etag, `"`)
+	}
+	return nil
+}
+
+// getURLObject fetches a source object of URL_LIST as getSourceObject does
+// from S3, honouring the range and If-Match of the input.
+func getURLObject(ctx context.Context, in *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	urlSources.Lock()
+	src, ok := urlSources.m[aws.ToString(in.Key)]
+	urlSources.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%s is not in URL_LIST", aws.ToString(in.Key))
+	}
+	req, err := newURLRequest(ctx, http.MethodGet, src)
+	if err != nil {
+		return nil, err
+	}
+	if in.Range != nil {
+		req.Header.Set("Range", *in.Range)
+	}
+	if in.IfMatch != nil {
+		req.Header.Set("If-Match", *in.IfMatch)
+	}
+	resp, err := cdnClient.Do(req)
+	if err != nil {
+		return nil, redactErr(err, req.URL)
+	}
+	return httpObjectOutput(resp, in, redactURL(req.URL))
+}
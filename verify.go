@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"hash/crc64"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+var (
+	verifyDownloads = Env("VERIFY_DOWNLOADS", "", "Check every download against the S3 checksum of the object, or its ETag, including multipart objects part by part") != ""
+
+	VerifiedFiles     int64 // Downloads which matched their checksum or ETag
+	UnverifiableFiles int64 // Downloads with nothing they could be checked against
+)
+
+// s3Checksum is a checksum S3 may hold for an object, with its value as
+// returned by GetObjectAttributes.
+type s3Checksum struct {
+	name  string
+	new   func() hash.Hash
+	value *string
+}
+
+// crc64NVME is the table of the CRC-64/NVME checksum, in Go's reversed form.
+var crc64NVME = crc64.MakeTable(0x9a6c9329ac4bc9b5)
+
+func objectChecksums(c *types.Checksum) []s3Checksum {
+	if c == nil {
+		return nil
+	}
+	return []s3Checksum{
+		{"SHA256", sha256.New, c.ChecksumSHA256},
+		{"SHA1", sha1.New, c.ChecksumSHA1},
+		{"CRC64NVME", func() hash.Hash { return crc64.New(crc64NVME) }, c.ChecksumCRC64NVME},
+		{"CRC32C", func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) }, c.ChecksumCRC32C},
+		{"CRC32", func() hash.Hash { return crc32.NewIEEE() }, c.ChecksumCRC32},
+	}
+}
+
+func partChecksum(p types.ObjectPart, name string) string {
+	switch name {
+	case "SHA256":
+		return aws.ToString(p.ChecksumSHA256)
+	case "SHA1":
+		return aws.ToString(p.ChecksumSHA1)
+	case "CRC64NVME":
+		return aws.ToString(p.ChecksumCRC64NVME)
+	case "CRC32C":
+		return aws.ToString(p.ChecksumCRC32C)
+	case "CRC32":
+		return aws.ToString(p.ChecksumCRC32)
+	}
+	return ""
+}
+
+// errUnverifiable marks a download with no checksum or ETag it can be
+// checked against.
+var errUnverifiable = fmt.Errorf("no usable checksum")
+
+// verifyDownload checks a downloaded object against what S3 holds for it.
+// A checksum stored with the object is preferred: a full object checksum is
+// compared with the whole download, and a composite one part by part and
+// then over the part checksums.  Without a checksum the ETag is used, which
+// for a multipart upload is the MD5 of the MD5s of its parts, so the part
+// boundaries are taken from the object parts or, when S3 does not list them,
+// from HeadObject of each part number.
+func verifyDownload(ctx context.Context, wf *WorkFile) error {
+	if !verifyDownloads || wf.Size == 0 {
+		return nil
+	}
+	var r io.ReaderAt = bytes.NewReader(wf.Bytes)
+	if wf.TempFile != "" {
+		fh, err := openTempFile(wf.TempFile)
+		if err != nil {
+			return err
+		}
+		defer fh.Close()
+		r = fh
+	}
+
+	attrs, parts, err := objectAttributes(ctx, wf.Filename)
+	if err != nil {
+		return fmt.Errorf("failed to get attributes of %s: %w", wf.Filename, err)
+	}
+	if size := aws.ToInt64(attrs.ObjectSize); size != wf.Size {
+		return fmt.Errorf("object %s is %d bytes in S3, %d were downloaded", wf.Filename, size, wf.Size)
+	}
+
+	err = verifyChecksum(r, wf.Size, attrs.Checksum, parts)
+	if err == errUnverifiable {
+		err = verifyETag(ctx, r, wf, aws.ToString(attrs.ETag), parts)
+	}
+	switch {
+	case err == errUnverifiable:
+		if debug {
+			log.Printf("Download of %s could not be verified", wf.Filename)
+		}
+		atomic.AddInt64(&UnverifiableFiles, 1)
+		return nil
+	case err != nil:
+		return fmt.Errorf("download of %s failed verification: %w", wf.Filename, err)
+	}
+	atomic.AddInt64(&VerifiedFiles, 1)
+	return nil
+}
+
+// objectAttributes returns the ETag, checksum, size and parts of a source
+// object, paging through the parts of objects with more than 1000.
+func objectAttributes(ctx context.Context, key string) (*s3.GetObjectAttributesOutput, []types.ObjectPart, error) {
+	s3Ready.Wait() // Wait for the S3 client to be ready
+	var (
+		first  *s3.GetObjectAttributesOutput
+		parts  []types.ObjectPart
+		marker *string
+	)
+	for {
+		out, err := s3client.GetObjectAttributes(ctx, &s3.GetObjectAttributesInput{
+			Bucket:           aws.String(srcBucket),
+			Key:              aws.String(key),
+			PartNumberMarker: marker,
+			ObjectAttributes: []types.ObjectAttributes{
+				types.ObjectAttributesEtag,
+				types.ObjectAttributesChecksum,
+				types.ObjectAttributesObjectParts,
+				types.ObjectAttributesObjectSize,
+			},
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		if first == nil {
+			first = out
+		}
+		if out.ObjectParts == nil {
+			break
+		}
+		parts = append(parts, out.ObjectParts.Parts...)
+		if !aws.ToBool(out.ObjectParts.IsTruncated) || out.ObjectParts.NextPartNumberMarker == nil {
+			break
+		}
+		marker = out.ObjectParts.NextPartNumberMarker
+	}
+	return first, parts, nil
+}
+
+// verifyChecksum compares the download with the strongest checksum S3 holds
+// for the object.
+func verifyChecksum(r io.ReaderAt, size int64, c *types.Checksum, parts []types.ObjectPart) error {
+	for _, sum := range objectChecksums(c) {
+		if sum.value == nil {
+			continue
+		}
+		want, count, composite := strings.Cut(*sum.value, "-")
+		if !composite {
+			got, err := sectionSum(r, 0, size, sum.new())
+			if err != nil {
+				return err
+			}
+			if got := base64.StdEncoding.EncodeToString(got); got != want {
+				return fmt.Errorf("%s checksum is %s, expected %s", sum.name, got, want)
+			}
+			return nil
+		}
+
+		// A composite checksum is the checksum of the part checksums, which
+		// S3 lists with the parts
+		n, _ := strconv.Atoi(count)
+		if len(parts) != n || partChecksum(parts[0], sum.name) == "" {
+			continue
+		}
+		outer := sum.new()
+		var offset int64
+		for _, p := range parts {
+			got, err := sectionSum(r, offset, aws.ToInt64(p.Size), sum.new())
+			if err != nil {
+				return err
+			}
+			if want := partChecksum(p, sum.name); base64.StdEncoding.EncodeToString(got) != want {
+				return fmt.Errorf("part %d %s checksum is %s, expected %s",
+					aws.ToInt32(p.PartNumber), sum.name, base64.StdEncoding.EncodeToString(got), want)
+			}
+			outer.Write(got)
+			offset += aws.ToInt64(p.Size)
+		}
+		if offset != size {
+			return fmt.Errorf("parts hold %d bytes, the object %d", offset, size)
+		}
+		if got := base64.StdEncoding.EncodeToString(outer.Sum(nil)); got != want {
+			return fmt.Errorf("%s composite checksum is %s-%d, expected %s", sum.name, got, n, *sum.value)
+		}
+		return nil
+	}
+	return errUnverifiable
+}
+
+// verifyETag compares the download with an ETag computed the way S3 does for
+// a plain or multipart upload.  ETags of objects encrypted with SSE-KMS or
+// SSE-C are not MD5s, so a mismatch on those only leaves them unverified.
+func verifyETag(ctx context.Context, r io.ReaderAt, wf *WorkFile, etag string, parts []types.ObjectPart) error {
+	etag = strings.Trim(etag, `"`)
+	if etag == "" {
+		return errUnverifiable
+	}
+	want, count, multipart := strings.Cut(etag, "-")
+	var got string
+	if !multipart {
+		sum, err := sectionSum(r, 0, wf.Size, md5.New())
+		if err != nil {
+			return err
+		}
+		got = hex.EncodeToString(sum)
+	} else {
+		n, err := strconv.Atoi(count)
+		if err != nil || n < 1 {
+			return errUnverifiable
+		}
+		sizes, err := partSizes(ctx, wf.Filename, n, parts)
+		if err != nil {
+			return err
+		}
+		outer := md5.New()
+		var offset int64
+		for _, size := range sizes {
+			sum, err := sectionSum(r, offset, size, md5.New())
+			if err != nil {
+				return err
+			}
+			outer.Write(sum)
+			offset += size
+		}
+		if offset != wf.Size {
+			return fmt.Errorf("parts hold %d bytes, the object %d", offset, wf.Size)
+		}
+		got = hex.EncodeToString(outer.Sum(nil))
+	}
+	if got == want {
+		return nil
+	}
+
+	head, err := s3client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(srcBucket), Key: aws.String(wf.Filename)})
+	if err == nil && (head.ServerSideEncryption == types.ServerSideEncryptionAwsKms ||
+		head.ServerSideEncryption == types.ServerSideEncryptionAwsKmsDsse || head.SSECustomerAlgorithm != nil) {
+		return errUnverifiable
+	}
+	return fmt.Errorf("ETag is %s, expected %s", got, want)
+}
+
+// partSizes returns the sizes of the n parts of a multipart object.
+func partSizes(ctx context.Context, key string, n int, parts []types.ObjectPart) ([]int64, error) {
+	sizes := make([]int64, n)
+	if len(parts) == n {
+		for i, p := range parts {
+			sizes[i] = aws.ToInt64(p.Size)
+		}
+		return sizes, nil
+	}
+	for i := range sizes {
+		head, err := s3client.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket:     aws.String(srcBucket),
+			Key:        aws.String(key),
+			PartNumber: aws.Int32(int32(i + 1)),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to head part %d: %w", i+1, err)
+		}
+		sizes[i] = aws.ToInt64(head.ContentLength)
+	}
+	return sizes, nil
+}
+
+// sectionSum returns the raw digest of size bytes of r at offset.
+func sectionSum(r io.ReaderAt, offset, size int64, h hash.Hash) ([]byte, error) {
+	if _, err := io.Copy(h, io.NewSectionReader(r, offset, size)); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
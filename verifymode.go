@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const modeVerify = "verify"
+
+var (
+	verifyPrefix = Env("VERIFY_PREFIX", "", "Prefix in DST_BUCKET of the archives checked against SRC_BUCKET in verify mode")
+	verifyReport = Env("VERIFY_REPORT", "", "Report of the objects missing, extra or mismatched in verify mode (default verify_report_<time>.jsonl)")
+)
+
+// VerifyFinding is a line of the verify report: an object of SRC_BUCKET
+// which no archive holds as it is, an object archived which is no longer in
+// SRC_BUCKET, or an archive which could not be read back.
+type VerifyFinding struct {
+	Key        string `json:"key,omitempty"`
+	Problem    string `json:"problem"` // missing, extra, mismatched or unreadable
+	Archive    string `json:"archive,omitempty"`
+	Size       int64  `json:"size,omitempty"`        // Size archived
+	SourceSize int64  `json:"source_size,omitempty"` // Size in SRC_BUCKET
+	ETag       string `json:"etag,omitempty"`        // ETag archived
+	SourceETag string `json:"source_etag,omitempty"` // ETag in SRC_BUCKET
+	Error      string `json:"error,omitempty"`
+}
+
+// VerifyResult counts the findings of verify mode.
+type VerifyResult struct {
+	Archives   int
+	Objects    int // In SRC_BUCKET
+	Matched    int
+	Missing    int
+	Extra      int
+	Mismatched int
+	Unreadable int
+}
+
+// archivedObject is the latest version of a key held by the archives.
+type archivedObject struct {
+	archive      string
+	size         int64
+	etag         string
+	lastModified time.Time
+	chunks       map[int]struct{} // Chunks seen of an object split by CHUNK_THRESHOLD
+	count        int              // Chunks it was split into
+	deleted      bool
+}
+
+func initVerifyMode() {
+	if importDir != "" {
+		log.Fatal("IMPORT_DIR cannot be used in verify mode")
+	}
+	if verifyReport == "" {
+		verifyReport = "verify_report_" + runStarted.Format("20060102T150405Z") + ".jsonl"
+	}
+}
+
+// RunVerify downloads every archive under VERIFY_PREFIX in DST_BUCKET and
+// reads it back against its checksum file and manifest, then compares the
+// objects the manifests record with a fresh listing of SRC_BUCKET by size
+// and ETag.  Each object missing from the archives, archived but gone from
+// the source, or archived with another size or ETag is written to
+// VERIFY_REPORT, as is each archive which fails to read back.
+func RunVerify(ctx context.Context) *VerifyResult {
+	s3Ready.Wait() // Wait for the S3 client to be ready
+
+	f, err := os.Create(verifyReport)
+	if err != nil {
+		log.Fatalf("failed to create verify report: %v", err)
+	}
+	defer f.Close()
+	report := bufio.NewWriter(f)
+	r := &VerifyResult{}
+	found := func(finding *VerifyFinding) {
+		dat, _ := json.Marshal(finding)
+		report.Write(dat)
+		report.WriteByte('\n')
+	}
+
+	sizes := make(map[string]int64)
+	var archives []string
+	paginator := s3.NewListObjectsV2Paginator(s3client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(dstBucket),
+		Prefix: aws.String(verifyPrefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			log.Fatalf("failed to list %s: %v", dstBucket, err)
+		}
+		for _, obj := range page.Contents {
+			key := aws.ToString(obj.Key)
+			sizes[key] = aws.ToInt64(obj.Size)
+			if archiveExt(key) != "" {
+				archives = append(archives, key)
+			}
+		}
+	}
+	log.Printf("Verify: reading back %d archives of s3://%s/%s", len(archives), dstBucket, verifyPrefix)
+
+	archived := make(map[string]*archivedObject)
+	for _, name := range archives {
+		r.Archives++
+		entries, err := verifyModeArchive(ctx, name, sizes)
+		if err != nil {
+			r.Unreadable++
+			found(&VerifyFinding{Problem: "unreadable", Archive: name, Error: err.Error()})
+			log.Printf("Verify: %s failed: %v", name, err)
+			continue
+		}
+		for _, entry := range entries {
+			addArchived(archived, name, entry)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, input := range listingInputs(srcBucket) {
+		paginator = s3.NewListObjectsV2Paginator(s3client, input)
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				log.Fatalf("failed to list %s: %v", srcBucket, err)
+			}
+			for _, obj := range page.Contents {
+				key := aws.ToString(obj.Key)
+				if !keySelected(key) {
+					continue
+				}
+				size, etag := aws.ToInt64(obj.Size), strings.Trim(aws.ToString(obj.ETag), `"`)
+				r.Objects++
+				seen[key] = true
+				a, ok := archived[key]
+				switch {
+				case !ok || a.deleted:
+					r.Missing++
+					found(&VerifyFinding{Key: key, Problem: "missing", SourceSize: size, SourceETag: etag})
+				case a.size != size || a.etag != etag || len(a.chunks) != a.count:
+					r.Mismatched++
+					finding := &VerifyFinding{Key: key, Problem: "mismatched", Archive: a.archive,
+						Size: a.size, SourceSize: size, ETag: a.etag, SourceETag: etag}
+					if len(a.chunks) != a.count {
+						finding.Error = fmt.Sprintf("%d of %d chunks archived", len(a.chunks), a.count)
+					}
+					found(finding)
+				default:
+					r.Matched++
+				}
+			}
+		}
+	}
+	for _, key := range slices.Sorted(maps.Keys(archived)) {
+		if a := archived[key]; !seen[key] && !a.deleted {
+			r.Extra++
+			found(&VerifyFinding{Key: key, Problem: "extra", Archive: a.archive, Size: a.size, ETag: a.etag})
+		}
+	}
+
+	if err := report.Flush(); err != nil {
+		log.Fatalf("failed to write verify report: %v", err)
+	}
+	return r
+}
+
+// addArchived records an entry of an archive against its key.  Chunks of
+// the same version of an object add up, and a later version replaces an
+// earlier one.
+func addArchived(archived map[string]*archivedObject, name string, entry *ManifestEntry) {
+	size, count, index := entry.Size, 1, 0
+	if entry.Chunk != nil {
+		size, count, index = entry.Chunk.ObjectSize, entry.Chunk.Count, entry.Chunk.Index
+	}
+	a, ok := archived[entry.Key]
+	switch {
+	case ok && a.etag == entry.ETag && a.size == size && a.deleted == entry.DeleteMarker:
+		a.chunks[index] = struct{}{} // Another chunk, or another copy
+		return
+	case ok && entry.LastModified.Before(a.lastModified):
+		return // An older version of the object
+	}
+	archived[entry.Key] = &archivedObject{archive: name, size: size, etag: entry.ETag, lastModified: entry.LastModified,
+		chunks: map[int]struct{}{index: {}}, count: count, deleted: entry.DeleteMarker}
+}
+
+// verifyModeArchive downloads an archive and reads it through against its
+// checksum file and manifest, returning the manifest entries.
+func verifyModeArchive(ctx context.Context, name string, sizes map[string]int64) ([]*ManifestEntry, error) {
+	if _, ok := sizes[name+".manifest.jsonl"]; !ok {
+		return nil, fmt.Errorf("the manifest is missing")
+	}
+	dat, err := getDestObject(ctx, name+".manifest.jsonl")
+	if err != nil {
+		return nil, err
+	}
+	entries, err := parseManifest(bytes.NewReader(dat))
+	if err != nil {
+		return nil, err
+	}
+	sumAlgorithm, entrySums, archiveSum := "", map[string]string{}, ""
+	for algorithm := range checksumAlgorithms {
+		if _, ok := sizes[name+"."+algorithm]; ok {
+			sumAlgorithm = algorithm
+			dat, err := getDestObject(ctx, name+"."+algorithm)
+			if err != nil {
+				return nil, err
+			}
+			if archiveSum, entrySums, err = parseChecksums(dat); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if sumAlgorithm == "" {
+		return nil, fmt.Errorf("the checksum file is missing")
+	}
+
+	size := sizes[name]
+	tempDisk.Reserve(size)
+	defer tempDisk.Release(size)
+	path, err := downloadObjectInParts(ctx, dstBucket, name, "", size, downloadPartsFor(size))
+	if err != nil {
+		return nil, err
+	}
+	defer deleteTempFile(path)
+	if err := verifyArchiveContents(name, path, checksumAlgorithms[sumAlgorithm].new, entries, entrySums, archiveSum); err != nil {
+		return nil, err
+	}
+	return slices.Collect(maps.Values(entries)), nil
+}
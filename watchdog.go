@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"runtime/pprof"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	stallTimeout = EnvInt("STALL_TIMEOUT", 900, "Seconds without progress in any stage, while work is in flight, before the pipeline is reported as wedged (0 to disable)")
+	stallAction  = Env("STALL_ACTION", "log", "On a wedged pipeline: \"log\" diagnostics, \"restart\" the stalled downloads, or \"exit\" for a supervisor to rerun")
+
+	// The stages of the pipeline, in order
+	downloadStage  = &pipelineStage{name: "download"}
+	scanStage      = &pipelineStage{name: "scan"}
+	transformStage = &pipelineStage{name: "transform"}
+	detectStage    = &pipelineStage{name: "detect"}
+	archiveStage   = &pipelineStage{name: "archive"}
+	verifyStage    = &pipelineStage{name: "verify"}
+	uploadStage    = &pipelineStage{name: "upload"}
+	pipelineStages = []*pipelineStage{downloadStage, scanStage, transformStage, detectStage, archiveStage, verifyStage, uploadStage}
+)
+
+// pipelineStage counts the goroutines of a stage working on an object, or
+// archive, and those finished.
+type pipelineStage struct {
+	name   string
+	active int64
+	done   int64
+	last   int64 // Unix nanoseconds of the last finished
+
+	mu     sync.Mutex
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (s *pipelineStage) begin() {
+	atomic.AddInt64(&s.active, 1)
+}
+
+func (s *pipelineStage) end() {
+	atomic.AddInt64(&s.active, -1)
+	atomic.AddInt64(&s.done, 1)
+	atomic.StoreInt64(&s.last, time.Now().UnixNano())
+}
+
+// settle ends the work of a single goroutine stage, if it was working, when
+// it goes back to waiting for its next task.
+func (s *pipelineStage) settle() {
+	if atomic.LoadInt64(&s.active) > 0 {
+		s.end()
+	}
+}
+
+// context returns the context for new work of the stage, which restart
+// cancels.
+func (s *pipelineStage) context(parent context.Context) context.Context {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ctx == nil {
+		s.ctx, s.cancel = context.WithCancel(parent)
+	}
+	return s.ctx
+}
+
+// restart cancels the work in progress, new work gets a fresh context.
+func (s *pipelineStage) restart() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cancel != nil {
+		s.cancel()
+		s.ctx, s.cancel = nil, nil
+	}
+}
+
+func (s *pipelineStage) String() string {
+	last := "none finished yet"
+	if t := atomic.LoadInt64(&s.last); t > 0 {
+		last = "last finished " + time.Since(time.Unix(0, t)).Round(time.Second).String() + " ago"
+	}
+	return fmt.Sprintf("%s: %d active, %d done, %s", s.name, atomic.LoadInt64(&s.active), atomic.LoadInt64(&s.done), last)
+}
+
+// stageQueue is a channel between two stages.
+type stageQueue struct {
+	name string
+	len  func() int
+	cap  int
+}
+
+func queueOf[T any](name string, ch chan T) stageQueue {
+	return stageQueue{name: name, len: func() int { return len(ch) }, cap: cap(ch)}
+}
+
+// activeStages is the short form of the active goroutines per stage for the
+// status line.
+func activeStages() string {
+	var parts []string
+	for _, s := range pipelineStages {
+		if n := atomic.LoadInt64(&s.active); n > 0 {
+			parts = append(parts, fmt.Sprintf("%s %d", s.name, n))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// StartWatchdog checks the pipeline for a wedge: objects held by a stage or
+// waiting in a queue, yet no stage has finished anything, and no bytes were
+// downloaded or uploaded, for STALL_TIMEOUT seconds.  Diagnostics of every
+// stage and queue, and the stacks of all goroutines, are then logged and
+// STALL_ACTION is taken.  A slow listing is not a wedge, as nothing is in
+// flight meanwhile.
+func StartWatchdog(ctx context.Context, queues []stageQueue) {
+	if stallTimeout <= 0 {
+		return
+	}
+	switch stallAction {
+	case "log", "restart", "exit":
+	default:
+		log.Fatalf("invalid STALL_ACTION %q, must be log, restart or exit", stallAction)
+	}
+	timeout := time.Duration(stallTimeout) * time.Second
+	progress := func() (n int64) {
+		for _, s := range pipelineStages {
+			n += atomic.LoadInt64(&s.done)
+		}
+		return n + atomic.LoadInt64(&DownloadedBytes) + atomic.LoadInt64(&UploadedBytes) + atomic.LoadInt64(&ErroredFiles)
+	}
+
+	go func() {
+		last, since := progress(), time.Now()
+		ticker := time.NewTicker(min(timeout/10, 10*time.Second))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if p := progress(); p != last || budgetPaused() {
+				last, since = p, time.Now() // Waiting on the budget is not a wedge
+				continue
+			}
+			inFlight := false
+			for _, s := range pipelineStages {
+				inFlight = inFlight || atomic.LoadInt64(&s.active) > 0
+			}
+			for _, q := range queues {
+				inFlight = inFlight || q.len() > 0
+			}
+			if !inFlight || time.Since(since) < timeout {
+				continue
+			}
+			stalled := reportStall(queues, time.Since(since))
+			since = time.Now() // Report again after another STALL_TIMEOUT
+
+			switch {
+			case stallAction == "exit":
+				log.Println("Watchdog: exiting, as STALL_ACTION=exit; objects not in upload.log are retried by the next run")
+				os.Exit(3)
+			case stallAction == "restart" && stalled == downloadStage:
+				log.Println("Watchdog: cancelling the stalled downloads, their objects are logged as errors")
+				downloadStage.restart()
+			case stallAction == "restart":
+				log.Printf("Watchdog: the %s stage cannot be restarted, only downloads can", stalled.name)
+			}
+		}
+	}()
+}
+
+// reportStall logs the state of the stages and queues, writes the goroutine
+// stacks to a file, and returns the stage most likely to be stalled: the
+// last one along the pipeline holding work, as the stages before it are
+// only waiting for room in the queues after them.
+func reportStall(queues []stageQueue, idle time.Duration) *pipelineStage {
+	var stalled *pipelineStage
+	for _, s := range pipelineStages {
+		if atomic.LoadInt64(&s.active) > 0 {
+			stalled = s
+		}
+	}
+	if stalled == nil {
+		stalled = pipelineStages[0]
+	}
+
+	log.Printf("Watchdog: no progress for %s with work in flight, the %s stage looks stalled", idle.Round(time.Second), stalled.name)
+	for _, s := range pipelineStages {
+		if atomic.LoadInt64(&s.done) > 0 || atomic.LoadInt64(&s.active) > 0 {
+			log.Printf("Watchdog:   %s", s)
+		}
+	}
+	for _, q := range queues {
+		log.Printf("Watchdog:   queue %s: %d/%d", q.name, q.len(), q.cap)
+	}
+	log.Printf("Watchdog:   limits: download parts %d, small downloads %d, scanners %d",
+		downloadParts.Limit(), smallDownloads.Limit(), scanners.Limit())
+	if tempDisk.limit > 0 {
+		log.Printf("Watchdog:   temp disk: %s of %s", humanizeBytes(atomic.LoadInt64(&TempBytes)), humanizeBytes(tempDisk.limit))
+	}
+
+	name := "stall_" + time.Now().UTC().Format("20060102T150405Z") + ".txt"
+	if f, err := os.Create(name); err != nil {
+		log.Printf("Watchdog: failed to write goroutine stacks: %v", err)
+	} else {
+		pprof.Lookup("goroutine").WriteTo(f, 2)
+		f.Close()
+		log.Printf("Watchdog: goroutine stacks written to %s", name)
+	}
+	return stalled
+}
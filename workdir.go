@@ -0,0 +1,39 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+)
+
+var (
+	workDir = Env("WORKDIR", "", "Directory the run keeps its listing, logs, checkpoints and archives in, so runs on one host can be kept apart (default the current directory)")
+
+	launchDir, _ = os.Getwd() // Where the run was started, before WORKDIR or SIMULATE_DIR
+)
+
+// launchPath makes a path given in the settings absolute against the
+// directory the run was started in, for files still used once WORKDIR or
+// SIMULATE_DIR has been entered, such as by a goroutine started before.
+func launchPath(path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(launchDir, path)
+}
+
+// enterWorkDir moves into WORKDIR once the configuration files have been read,
+// as enterSimulateDir does, so that METADATA_FILE, UPLOAD_LOG, ERROR_LOG and
+// the archives are all found under it.
+func enterWorkDir() {
+	if workDir == "" {
+		return
+	}
+	if err := os.MkdirAll(workDir, 0755); err != nil {
+		log.Fatalf("failed to create WORKDIR: %v", err)
+	}
+	if err := os.Chdir(workDir); err != nil {
+		log.Fatalf("failed to enter WORKDIR: %v", err)
+	}
+	log.Println("Working in", workDir)
+}
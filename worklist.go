@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+var workList = Env("WORK_LIST", "", "Read the objects to archive from this file (\"-\" for stdin) instead of listing the bucket")
+
+// ReadWorkList sends the objects named in WORK_LIST to the doFiles pipeline.
+// Each line is either a bare key or a JSON MetaEntry record as written to
+// metadata.jsonl.  Bare keys are looked up in the source bucket for their
+// size.
+func ReadWorkList(ctx context.Context, doFiles chan<- *DownloadTask) {
+	loadSkipFiles()
+	defer close(doFiles)
+
+	var in io.Reader = os.Stdin
+	if workList != "-" {
+		f, err := os.Open(workList)
+		if err != nil {
+			log.Fatalf("failed to open work list: %v", err)
+		}
+		defer f.Close()
+		in = f
+	}
+	log.Println("Reading work list from", workList)
+
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+
+		var entry MetaEntry
+		if strings.HasPrefix(line, "{") {
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				log.Printf("failed to unmarshal line %q: %v", line, err)
+				continue
+			}
+			if entry.Key == "" {
+				continue // Summary line from a metadata.jsonl
+			}
+		} else {
+			entry.Key = line
+			if _, ok := skipFiles[entry.Key]; !ok {
+				if err := headMetaEntry(ctx, &entry); err != nil {
+					fileErrCh <- &ErrorEvent{
+						Filename: entry.Key,
+						Err:      fmt.Errorf("failed to look up object %s: %v", entry.Key, err),
+					}
+					continue
+				}
+			}
+		}
+
+		sendListed(entry, doFiles)
+	}
+
+	if err := scanner.Err(); err != nil {
+		log.Fatalf("error reading work list: %v", err)
+	}
+}
+
+// headMetaEntry fills in the size and modification time of a key.
+func headMetaEntry(ctx context.Context, entry *MetaEntry) error {
+	s3Ready.Wait() // Wait for the S3 client to be ready
+	out, err := s3client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(srcBucket),
+		Key:    aws.String(entry.Key),
+	})
+	if err != nil {
+		return err
+	}
+	entry.Size = aws.ToInt64(out.ContentLength)
+	entry.LastModified = aws.ToTime(out.LastModified)
+	entry.ETag = strings.Trim(aws.ToString(out.ETag), `"`)
+	return nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	modeCoordinator = "coordinator"
+	modeWorker      = "worker"
+
+	maxUnitBody = 200 * 1024 // Stay well under the 256KiB SQS message limit
+)
+
+var (
+	workMode       = Env("MODE", "", "Run as a \"coordinator\" which queues work units, a \"worker\" which processes them, \"import\", \"restore\", \"verify\", \"bench\", \"estimate\", \"repack\", \"events\" or \"serve\" (empty for standalone)")
+	queueURL       = Env("QUEUE_URL", "", "SQS queue URL carrying work units between the coordinator and workers, or S3 event notifications in events mode")
+	workerID       = Env("WORKER_ID", defaultWorkerID(), "Worker name, prefixed to archive names so workers do not collide")
+	workVisibility = EnvInt("WORK_VISIBILITY", 300, "Seconds a received work unit stays hidden from other workers between heartbeats")
+	workerIdleExit = EnvInt("WORKER_IDLE_EXIT", 120, "Seconds without new work units before a worker finishes up and exits")
+
+	pendingMutex sync.Mutex
+	pendingKeys  = make(map[string]*pendingUnit) // Object key to the work unit it came from
+)
+
+// WorkUnit is the body of a queue message, a batch of objects which fits in
+// about one archive.
+type WorkUnit struct {
+	ID      string      `json:"id"`
+	Objects []MetaEntry `json:"objects"`
+}
+
+// pendingUnit tracks a received work unit until every object in it is either
+// uploaded or logged as an error, at which point the message is deleted.
+type pendingUnit struct {
+	id        string
+	receipt   string
+	remaining int
+	stop      chan struct{}
+	etags     map[string]string // Object key to the ETag notified, with QUEUE_MODE=events
+}
+
+func defaultWorkerID() string {
+	if name, err := os.Hostname(); err == nil {
+		return name
+	}
+	return "worker"
+}
+
+func initWorkQueue() {
+	switch workMode {
+	case "":
+		return
+	case modeImport:
+		initImport()
+		return
+	case modeRestore:
+		initRestore()
+		return
+	case modeVerify:
+		initVerifyMode()
+		return
+	case modeBench, modeEstimate, modeRepack, modeServe:
+		return
+	case modeCoordinator, modeWorker, modeEvents:
+	default:
+		log.Fatalf("invalid MODE %q, must be %q, %q, %q, %q, %q, %q, %q, %q, %q or %q", workMode, modeCoordinator, modeWorker, modeImport, modeRestore, modeVerify, modeBench, modeEstimate, modeRepack, modeEvents, modeServe)
+	}
+	if queueURL == "" {
+		log.Fatalf("QUEUE_URL must be set in %s mode", workMode)
+	}
+	if workMode == modeWorker {
+		dir, file := filepath.Split(ArchiveName)
+		ArchiveName = filepath.Join(dir, workerID+"_"+file)
+	}
+}
+
+// EnqueueWork packs the objects from doFiles into work units of about SIZECAP
+// bytes and sends them to the queue.
+func EnqueueWork(ctx context.Context, doFiles <-chan *DownloadTask) {
+	log.Println("Enqueuing work units to", queueURL)
+	var (
+		unit     = &WorkUnit{}
+		unitSize int64
+		bodySize int
+		units    int
+		objects  int
+	)
+	send := func() {
+		if len(unit.Objects) == 0 {
+			return
+		}
+		units++
+		objects += len(unit.Objects)
+		unit.ID = fmt.Sprintf("unit-%07d", units)
+		dat, _ := json.Marshal(unit)
+		if err := sqsSendMessage(ctx, queueURL, string(dat)); err != nil {
+			log.Fatalf("failed to send work unit %s: %v", unit.ID, err)
+		}
+		if debug {
+			log.Printf("sent work unit %s with %d objects", unit.ID, len(unit.Objects))
+		}
+		unit, unitSize, bodySize = &WorkUnit{}, 0, 0
+	}
+
+	for task := range doFiles {
+		entry := MetaEntry{Key: task.Filename, Size: task.Size, LastModified: task.LastModified, ETag: task.ETag}
+		dat, _ := json.Marshal(entry)
+		if len(unit.Objects) > 0 && (unitSize+task.Size > sizeCapLimit || bodySize+len(dat)+1 > maxUnitBody) {
+			send()
+		}
+		unit.Objects = append(unit.Objects, entry)
+		unitSize += task.Size
+		bodySize += len(dat) + 1
+	}
+	send()
+	log.Printf("Enqueued %d work units holding %d objects", units, objects)
+}
+
+// ReceiveWork pulls work units off the queue and sends their objects to the
+// doFiles pipeline until no new units have arrived for WORKER_IDLE_EXIT.
+func ReceiveWork(ctx context.Context, doFiles chan<- *DownloadTask) {
+	loadSkipFiles()
+	log.Println("Receiving work units from", queueURL)
+	defer close(doFiles)
+
+	lastWork := time.Now()
+	for time.Since(lastWork) < time.Duration(workerIdleExit)*time.Second {
+		msgs, err := sqsReceiveMessages(ctx, queueURL, 1, 20, workVisibility)
+		if err != nil {
+			log.Printf("failed to receive work units: %v", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		for _, msg := range msgs {
+			lastWork = time.Now()
+			var unit WorkUnit
+			if err := json.Unmarshal([]byte(msg.Body), &unit); err != nil {
+				log.Printf("failed to unmarshal work unit %s: %v", msg.MessageId, err)
+				continue // Left on the queue for the redrive policy to deal with
+			}
+			log.Printf("Received work unit %s with %d objects", unit.ID, len(unit.Objects))
+
+			p := &pendingUnit{id: unit.ID, receipt: msg.ReceiptHandle, stop: make(chan struct{})}
+			var todo []MetaEntry
+			pendingMutex.Lock()
+			for _, entry := range unit.Objects {
+				if _, ok := pendingKeys[entry.Key]; ok {
+					continue // Redelivered while still in flight here
+				}
+				if _, ok := skipFiles[entry.Key]; ok {
+					continue
+				}
+				pendingKeys[entry.Key] = p
+				p.remaining++
+				todo = append(todo, entry)
+			}
+			pendingMutex.Unlock()
+
+			if p.remaining == 0 {
+				finishUnit(p)
+				continue
+			}
+			go heartbeatUnit(ctx, p)
+
+			for _, entry := range todo {
+				atomic.AddInt64(&TotalBytes, entry.Size)
+				atomic.AddInt64(&TotalFiles, 1)
+				if err := checkTarEntry(entryName(entry.Key), entry.Size, entry.DeleteMarker); err != nil {
+					rejectTarEntry(entry, err, doFiles)
+					continue
+				}
+				doFiles <- &DownloadTask{Filename: entry.Key, Size: entry.Size, LastModified: entry.LastModified, ETag: entry.ETag,
+					DeleteMarker: entry.DeleteMarker, StorageClass: entry.StorageClass}
+			}
+		}
+	}
+	log.Printf("No work units for %d seconds, finishing up", workerIdleExit)
+}
+
+// heartbeatUnit keeps a work unit hidden from other workers until it is done.
+func heartbeatUnit(ctx context.Context, p *pendingUnit) {
+	ticker := time.NewTicker(time.Duration(workVisibility) * time.Second / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			if err := sqsChangeVisibility(ctx, queueURL, p.receipt, workVisibility); err != nil {
+				log.Printf("failed to extend work unit %s: %v", p.id, err)
+			}
+		}
+	}
+}
+
+// unitObjectFinished marks an object as uploaded or failed.  Once every object
+// in a work unit is finished, the unit is removed from the queue.
+func unitObjectFinished(key string) {
+	if workMode != modeWorker && workMode != modeEvents {
+		return
+	}
+	pendingMutex.Lock()
+	p, ok := pendingKeys[key]
+	if !ok {
+		pendingMutex.Unlock()
+		return
+	}
+	delete(pendingKeys, key)
+	p.remaining--
+	done := p.remaining == 0
+	pendingMutex.Unlock()
+
+	if done {
+		close(p.stop)
+		finishUnit(p)
+	}
+}
+
+func finishUnit(p *pendingUnit) {
+	if err := sqsDeleteMessage(context.Background(), queueURL, p.receipt); err != nil {
+		log.Printf("failed to delete work unit %s: %v", p.id, err)
+		return
+	}
+	log.Printf("Finished work unit %s", p.id)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const zstdDictName = ".zstd/dictionary" // Tar entry holding the trained dictionary
+
+var (
+	zstdDictSamples = EnvInt("ZSTD_DICT_SAMPLES", 0, "Train a zstd dictionary on this many in-memory objects and compress entries with it")
+	zstdDictSize    = EnvInt("ZSTD_DICT_SIZE", 110*1024, "Maximum size in bytes of the trained zstd dictionary")
+
+	zstdDict        []byte        // Trained dictionary, nil until training completes
+	zstdDictEncoder *zstd.Encoder // Encoder primed with zstdDict
+	zstdDictSampled [][]byte      // Samples collected while training
+)
+
+// dictCompress returns task with its contents compressed with the trained
+// dictionary, reporting whether it was compressed and should be stored as a
+// ".zst" entry.  Until enough samples have been collected the objects are used
+// for training and returned unchanged.
+func dictCompress(task *WorkFile) (*WorkFile, bool) {
+	if zstdDictEncoder == nil {
+		sample := make([]byte, len(task.Bytes))
+		copy(sample, task.Bytes)
+		zstdDictSampled = append(zstdDictSampled, sample)
+		if len(zstdDictSampled) >= zstdDictSamples {
+			trainDict()
+		}
+		return task, false
+	}
+
+	compressed := zstdDictEncoder.EncodeAll(task.Bytes, make([]byte, 0, len(task.Bytes)))
+	putMemory(task.Bytes)
+	out := *task
+	out.Size, out.Bytes = int64(len(compressed)), compressed
+	return &out, true
+}
+
+// trainDict builds a dictionary from the collected samples and writes it into
+// every open archive, those opened later carry it from the start.
+func trainDict() {
+	defer func() { zstdDictSampled = nil }()
+
+	// The first half of the samples seed the dictionary history, the second
+	// half are used to tune the entropy tables against that history.
+	half := len(zstdDictSampled) / 2
+	var history []byte
+	for _, sample := range zstdDictSampled[:half] {
+		history = append(history, sample...)
+	}
+	if len(history) > zstdDictSize {
+		history = history[len(history)-zstdDictSize:]
+	}
+
+	// Pick an ID in the range reserved for user dictionaries
+	sum := sha256.Sum256(history)
+	id := 32768 + binary.LittleEndian.Uint32(sum[:])%(1<<31-32768)
+
+	dict, err := buildDict(zstd.BuildDictOptions{
+		ID:       id,
+		Contents: zstdDictSampled[half:],
+		History:  history,
+		Offsets:  [3]int{1, 4, 8},
+		Level:    zstd.SpeedDefault,
+	})
+	if err != nil {
+		log.Printf("failed to train zstd dictionary, storing entries as is: %v", err)
+		zstdDictSamples = 0
+		return
+	}
+	zstdDictEncoder, err = zstd.NewWriter(nil, zstd.WithEncoderDict(dict), zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		log.Printf("failed to load zstd dictionary, storing entries as is: %v", err)
+		zstdDictSamples = 0
+		return
+	}
+	zstdDict = dict
+	Println(fmt.Sprintf("Trained zstd dictionary %d of %d bytes on %d samples", id, len(dict), len(zstdDictSampled)))
+	writeDictEntries()
+}
+
+// writeDictEntries writes the dictionary into the open archive of every
+// stream, as any of them may receive compressed entries from now on.
+func writeDictEntries() {
+	cur := curStream
+	for _, s := range allStreams() {
+		if s != cur && s.file == nil {
+			continue
+		}
+		switchStream(s)
+		writeDictEntry()
+	}
+	switchStream(cur)
+}
+
+// buildDict wraps zstd.BuildDict, which panics when the samples are entirely
+// covered by the history and leave no literals to tune against.
+func buildDict(o zstd.BuildDictOptions) (dict []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("samples too uniform: %v", r)
+		}
+	}()
+	return zstd.BuildDict(o)
+}
+
+// writeDictEntry stores the dictionary in the open archive so that entries can
+// be restored with "zstd -D .zstd/dictionary -d".
+func writeDictEntry() {
+	if emitDirs {
+		writeDirEntries(zstdDictName, time.Time{}) // Undated, like the dictionary
+	}
+	archiveNames[zstdDictName] = struct{}{}
+	header := &tar.Header{
+		Name:   zstdDictName,
+		Size:   int64(len(zstdDict)),
+		Mode:   0600,
+		Format: headerFormat(),
+	}
+	if err := archiveTar.WriteHeader(header); err != nil {
+		log.Fatalf("failed to write tar header for %s: %v", zstdDictName, err)
+	}
+	if _, err := archiveTar.Write(zstdDict); err != nil {
+		log.Fatalf("failed to write %s to tar: %v", zstdDictName, err)
+	}
+	h := newChecksum()
+	h.Write(zstdDict)
+	archiveSums = append(archiveSums, fmt.Sprintf("%x  %s", h.Sum(nil), zstdDictName))
+}